@@ -0,0 +1,193 @@
+package libgomongo
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+)
+
+// DatabaseAPI is the part of a database used by applications. It is
+// satisfied by *DB and by the database returned by NewMemoryDB, so that
+// the data layer can be replaced in unit tests.
+type DatabaseAPI interface {
+    // Collection returns the named collection of the database.
+    Collection(name string) CollectionAPI
+
+    // Run runs a command, see DB.Run.
+    Run(cmd interface{}, result interface{}) error
+}
+
+// CollectionAPI is the part of a collection used by applications, see
+// DatabaseAPI. It is satisfied by *Collection.
+type CollectionAPI interface {
+    // Query prepares a query on the collection, as Find does.
+    Query(filter interface{}) QueryAPI
+
+    Count(query interface{}) (int64, error)
+    Insert(data interface{}, writeConcern *MongoWriteConcern) (int, error)
+    Update(selector, update interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error)
+    EnsureIndex(key interface{}, options int) error
+    Remove(selector interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error)
+    RemoveId(id interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error)
+    RemoveAll(selector interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error)
+}
+
+// QueryAPI builds and runs a query prepared by CollectionAPI.Query. It is
+// satisfied by *Query, whose With methods change the query as its setters
+// do and return it.
+type QueryAPI interface {
+    WithSort(sort interface{}) QueryAPI
+    WithLimit(limit int) QueryAPI
+    WithSkip(skip int) QueryAPI
+    WithFields(fields interface{}) QueryAPI
+
+    One(result interface{}) error
+    All(result interface{}) error
+    Iter() IterAPI
+    Count() (int, error)
+    Distinct(key string, result interface{}) error
+}
+
+// IterAPI iterates over the results of a query. It is satisfied by the
+// iterator of Query.Iter and by the tailable *Iter.
+type IterAPI interface {
+    Next(result interface{}) bool
+    Err() error
+    Close() error
+}
+
+var (
+    _ DatabaseAPI   = (*DB)(nil)
+    _ CollectionAPI = (*Collection)(nil)
+    _ QueryAPI      = (*Query)(nil)
+    _ IterAPI       = (*Iter)(nil)
+)
+
+// Collection returns the named collection of the database, as C does.
+func (db *DB) Collection(name string) CollectionAPI {
+    return db.C(name)
+}
+
+// Query prepares a query on the collection, as Find does, as a QueryAPI.
+func (c *Collection) Query(filter interface{}) QueryAPI {
+    return c.Find(filter)
+}
+
+// Select prepares a query on the collection with the given spec and
+// options, as Find followed by the Query setters does.
+func (c *Collection) Select(spec QuerySpec, options FindOptions) QueryAPI {
+    q := c.Find(spec.Query)
+    q.Spec = spec
+    if options.ReadPreference == nil {
+        options.ReadPreference = q.Options.ReadPreference
+    }
+    q.Options = options
+    return q
+}
+
+// WithSort sets the sort order of the query, as Sort does.
+func (q *Query) WithSort(sort interface{}) QueryAPI {
+    return q.Sort(sort)
+}
+
+// WithLimit sets the number of results of the query, as Limit does.
+func (q *Query) WithLimit(limit int) QueryAPI {
+    return q.Limit(limit)
+}
+
+// WithSkip sets the number of documents skipped by the query, as Skip does.
+func (q *Query) WithSkip(skip int) QueryAPI {
+    return q.Skip(skip)
+}
+
+// WithFields limits the fields of the results, as Fields does.
+func (q *Query) WithFields(fields interface{}) QueryAPI {
+    return q.Fields(fields)
+}
+
+// One unmarshals the first result of the query into result, and returns
+// ErrNotFound when the query matches no document.
+func (q *Query) One(result interface{}) error {
+    one := *q
+    one.Options.Limit = -1
+    cur, err := one.Cursor()
+    if err != nil {
+        return err
+    }
+    defer cur.Destroy()
+    if cur.Next() != MONGO_OK {
+        if cur.ErrNo() == MONGO_CURSOR_EXHAUSTED {
+            return ErrNotFound
+        }
+        return cur.Error()
+    }
+    return cur.Current().Unmarshal(result)
+}
+
+// All unmarshals every result of the query into result, which must be a
+// pointer to a slice.
+func (q *Query) All(result interface{}) error {
+    return allResults(q.Iter(), result)
+}
+
+// Iter runs the query and returns an iterator over its results. Close
+// must be called to release the cursor.
+func (q *Query) Iter() IterAPI {
+    cur, err := q.Cursor()
+    return &cursorIter{cursor: cur, err: err}
+}
+
+// cursorIter is the iterator of Query.Iter.
+type cursorIter struct {
+    cursor *Cursor
+    err    error
+}
+
+func (iter *cursorIter) Next(result interface{}) bool {
+    if iter.err != nil || iter.cursor == nil {
+        return false
+    }
+    if iter.cursor.Next() != MONGO_OK {
+        if iter.cursor.ErrNo() != MONGO_CURSOR_EXHAUSTED {
+            iter.err = iter.cursor.Error()
+        }
+        return false
+    }
+    if err := iter.cursor.Current().Unmarshal(result); err != nil {
+        iter.err = err
+        return false
+    }
+    return true
+}
+
+func (iter *cursorIter) Err() error {
+    return iter.err
+}
+
+func (iter *cursorIter) Close() error {
+    if iter.cursor != nil {
+        iter.cursor.Destroy()
+        iter.cursor = nil
+    }
+    return iter.err
+}
+
+// allResults appends the results of iter to the slice result points to,
+// then closes iter.
+func allResults(iter IterAPI, result interface{}) error {
+    rv := reflect.ValueOf(result)
+    if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+        iter.Close()
+        return errors.New(fmt.Sprintf("MongoDB: result argument must be a slice address, but got %T", result))
+    }
+    slice := rv.Elem()
+    slice.Set(slice.Slice(0, 0))
+    for {
+        elem := reflect.New(slice.Type().Elem())
+        if !iter.Next(elem.Interface()) {
+            break
+        }
+        slice.Set(reflect.Append(slice, elem.Elem()))
+    }
+    return iter.Close()
+}
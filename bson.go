@@ -8,9 +8,11 @@ import "C"
 import (
     "errors"
     "fmt"
-    // "time"
+    "github.com/QLeelulu/libgomongo/bson"
+    "math"
     "reflect"
     "strconv"
+    "time"
     "unsafe"
 )
 
@@ -19,7 +21,7 @@ const (
     BSON_ERROR = -1
 )
 
-type BsonType int8
+type BsonType = bson.Type
 
 const (
     BSON_EOO BsonType = iota
@@ -52,6 +54,47 @@ type BsonIterator struct {
     // bson     *C.bson
 }
 
+// ObjectId is a unique ID identifying a BSON value, see bson.ObjectId.
+type ObjectId = bson.ObjectId
+
+// NewObjectId returns a new unique ObjectId, generated by bson_oid_gen.
+func NewObjectId() ObjectId {
+    var oid C.bson_oid_t
+    C.bson_oid_gen(&oid)
+    return ObjectId(C.GoBytes(unsafe.Pointer(&oid), 12))
+}
+
+// ObjectIdHex returns an ObjectId from the provided hex representation.
+// Calling this function with an invalid hex representation will cause a
+// runtime panic. See the IsObjectIdHex function.
+func ObjectIdHex(s string) ObjectId {
+    return bson.ObjectIdHex(s)
+}
+
+// IsObjectIdHex returns whether s is a valid hex representation of an
+// ObjectId.
+func IsObjectIdHex(s string) bool {
+    return bson.IsObjectIdHex(s)
+}
+
+// The other BSON value types, see the bson package.
+type (
+    Binary         = bson.Binary
+    RegEx          = bson.RegEx
+    JavaScript     = bson.JavaScript
+    Symbol         = bson.Symbol
+    MongoTimestamp = bson.MongoTimestamp
+    DBPointer      = bson.DBPointer
+)
+
+// Getter and Setter let a type choose how it is stored and decoded, and are
+// consulted by the Append and Unmarshal functions before reflection. See
+// bson.RegisterType for the types of other packages.
+type (
+    Getter = bson.Getter
+    Setter = bson.Setter
+)
+
 func BsonError(errNo int) error {
     if errNo == BSON_OK {
         return nil
@@ -65,23 +108,59 @@ func NewBson() *Bson {
     return b
 }
 
+// NewBsonFromM returns a finished bson built from m, or nil if a value of m
+// can not be encoded.
 func NewBsonFromM(m M) *Bson {
     b := &Bson{}
     b._bson = &C.bson{}
     b.Init()
-    b.FromMap(m)
+    if b.FromMap(m) != BSON_OK {
+        b.Destroy()
+        return nil
+    }
     b.Finish()
     return b
 }
 
+// NewBsonFromDoc returns a finished bson built from doc, which may be nil,
+// a M, a map[string]interface{}, a D, a Raw or a struct. It returns nil if
+// doc can not be encoded.
+//
+// The document is encoded in Go by bson.Marshal and handed to the C driver
+// at once, which is much cheaper than a cgo call per element as done by
+// NewBsonFromM.
+func NewBsonFromDoc(doc interface{}) *Bson {
+    b, _ := newBsonFromDoc(doc)
+    return b
+}
+
+// newBsonFromDoc is NewBsonFromDoc, returning the error of bson.Marshal.
+func newBsonFromDoc(doc interface{}) (*Bson, error) {
+    data, err := bson.Marshal(doc)
+    if err != nil {
+        return nil, err
+    }
+    return NewBsonFromRaw(Raw(data)), nil
+}
+
 func NewBsonIterator() *BsonIterator {
     b := &BsonIterator{}
     b.iterator = &C.bson_iterator{}
     return b
 }
 
+// Print logs the document as extended JSON with the logger of the
+// package.
 func (b *Bson) Print() {
-    C.bson_print(b._bson)
+    if b._bson == nil || b._bson.data == nil {
+        return
+    }
+    doc, err := bson.MarshalExtJSON(b.Raw(), false)
+    if err != nil {
+        Logger().Warn("MongoDB: invalid document", "error", err)
+        return
+    }
+    Logger().Info("MongoDB: document", "doc", string(doc))
 }
 
 // func (b *Bson) PrintRaw(deep int) {
@@ -92,8 +171,14 @@ func (b *Bson) Init() int {
     return int(C.bson_init(b._bson))
 }
 
+// Finish finishes the bson, and returns BSON_ERROR if it holds a value
+// which could not be encoded, or a key or string which is not UTF-8.
 func (b *Bson) Finish() int {
-    return int(C.bson_finish(b._bson))
+    r := int(C.bson_finish(b._bson))
+    if b._bson.err&BSON_NOT_ENCODED != 0 {
+        return BSON_ERROR
+    }
+    return r
 }
 
 func (b *Bson) Destroy() {
@@ -137,6 +222,14 @@ func (b *Bson) AppendStringN(key, val string, _len uint) int {
  * @return BSON_OK or BSON_ERROR.
  */
 // MONGO_EXPORT int bson_append_oid( bson *b, const char *name, const bson_oid_t *oid );
+func (b *Bson) AppendOid(name string, oid ObjectId) int {
+    if !oid.Valid() {
+        return BSON_ERROR
+    }
+    var _oid C.bson_oid_t
+    copy((*[12]byte)(unsafe.Pointer(&_oid))[:], oid)
+    return int(C.bson_append_oid(b._bson, C.CString(name), &_oid))
+}
 
 /**
  * Append a bson_oid_t to a bson.
@@ -307,6 +400,32 @@ func (b *Bson) AppendNull(name string) int {
     return int(C.bson_append_null(b._bson, C.CString(name)))
 }
 
+/**
+ * Append a minkey value to a bson.
+ *
+ * @param b the bson to append to.
+ * @param name the key for the minkey value.
+ *
+ * @return BSON_OK or BSON_ERROR.
+ */
+// MONGO_EXPORT int bson_append_minkey( bson *b, const char *name );
+func (b *Bson) AppendMinKey(name string) int {
+    return int(C.bson_append_minkey(b._bson, C.CString(name)))
+}
+
+/**
+ * Append a maxkey value to a bson.
+ *
+ * @param b the bson to append to.
+ * @param name the key for the maxkey value.
+ *
+ * @return BSON_OK or BSON_ERROR.
+ */
+// MONGO_EXPORT int bson_append_maxkey( bson *b, const char *name );
+func (b *Bson) AppendMaxKey(name string) int {
+    return int(C.bson_append_maxkey(b._bson, C.CString(name)))
+}
+
 /**
  * Append an undefined value to a bson.
  *
@@ -372,6 +491,9 @@ func (b *Bson) AppendElement(name_or_null string, bson_iterator *BsonIterator) i
  */
 // MONGO_EXPORT int bson_append_timestamp( bson *b, const char *name, bson_timestamp_t *ts );
 // MONGO_EXPORT int bson_append_timestamp2( bson *b, const char *name, int time, int increment );
+func (b *Bson) AppendTimestamp(name string, time, increment int) int {
+    return int(C.bson_append_timestamp2(b._bson, C.CString(name), C.int(time), C.int(increment)))
+}
 
 /* these both append a bson_date */
 /**
@@ -384,6 +506,10 @@ func (b *Bson) AppendElement(name_or_null string, bson_iterator *BsonIterator) i
  * @return BSON_OK or BSON_ERROR.
  */
 // MONGO_EXPORT int bson_append_date( bson *b, const char *name, bson_date_t millis );
+func (b *Bson) AppendDate(name string, t time.Time) int {
+    millis := t.Unix()*1e3 + int64(t.Nanosecond()/1e6)
+    return int(C.bson_append_date(b._bson, C.CString(name), C.bson_date_t(millis)))
+}
 
 /**
  * Append a time_t value to a bson.
@@ -443,54 +569,232 @@ func (b *Bson) AppendFinishArray() int {
     return int(C.bson_append_finish_array(b._bson))
 }
 
+// FromMap appends the elements of m. It stops at the first value which can
+// not be appended, returns BSON_ERROR and marks the bson BSON_NOT_ENCODED.
 func (b *Bson) FromMap(m map[string]interface{}) int {
     if m == nil {
         return BSON_OK
     }
-    r := BSON_OK
     for k, v := range m {
-        r = b.appendValue(k, v)
-        if r != BSON_OK {
-            return r
+        if b.appendValue(k, v) != BSON_OK {
+            return b.fail()
         }
     }
-    return r
+    return BSON_OK
+}
+
+// FromD appends the elements of d in order, and fails as FromMap.
+func (b *Bson) FromD(d D) int {
+    for _, e := range d {
+        if b.appendValue(e.Name, e.Value) != BSON_OK {
+            return b.fail()
+        }
+    }
+    return BSON_OK
+}
+
+// fail marks the bson BSON_NOT_ENCODED, so that it is not sent to the
+// server, and returns BSON_ERROR.
+func (b *Bson) fail() int {
+    b._bson.err |= BSON_NOT_ENCODED
+    return BSON_ERROR
+}
+
+// FromDoc appends the elements of doc, which may be nil, a M, a
+// map[string]interface{}, a D or a Raw.
+func (b *Bson) FromDoc(doc interface{}) int {
+    switch d := doc.(type) {
+    case nil:
+        return BSON_OK
+    case M:
+        return b.FromMap(d)
+    case map[string]interface{}:
+        return b.FromMap(d)
+    case D:
+        return b.FromD(d)
+    case Raw:
+        return b.fromRaw(d)
+    }
+    return BSON_ERROR
 }
 
 // @k: key
 // @v: value
 func (b *Bson) appendValue(k string, v interface{}) int {
+    if got, ok, err := bson.GetBSON(v); ok {
+        if err != nil {
+            return BSON_ERROR
+        }
+        return b.appendValue(k, got)
+    }
+    switch v {
+    case bson.MinKey:
+        return b.AppendMinKey(k)
+    case bson.MaxKey:
+        return b.AppendMaxKey(k)
+    case bson.Undefined:
+        return b.AppendUndefined(k)
+    }
     switch v.(type) {
     case nil:
         return b.AppendNull(k)
     case string:
         return b.AppendString(k, v.(string))
-    case int, int8, int32:
-        return b.AppendInt(k, v.(int))
+    case int:
+        return b.appendInt64(k, int64(v.(int)))
+    case int8:
+        return b.AppendInt(k, int(v.(int8)))
+    case int16:
+        return b.AppendInt(k, int(v.(int16)))
+    case int32:
+        return b.AppendInt(k, int(v.(int32)))
     case int64:
         return b.AppendLong(k, v.(int64))
-    case float64, float32:
+    case uint8:
+        return b.AppendInt(k, int(v.(uint8)))
+    case uint16:
+        return b.AppendInt(k, int(v.(uint16)))
+    case uint32:
+        return b.appendInt64(k, int64(v.(uint32)))
+    case uint:
+        return b.appendUint64(k, uint64(v.(uint)))
+    case uint64:
+        return b.appendUint64(k, v.(uint64))
+    case float32:
+        return b.AppendDouble(k, float64(v.(float32)))
+    case float64:
         return b.AppendDouble(k, v.(float64))
     case bool:
         return b.AppendBool(k, v.(bool))
+    case ObjectId:
+        return b.AppendOid(k, v.(ObjectId))
+    case time.Time:
+        return b.AppendDate(k, v.(time.Time))
+    case []byte:
+        data := v.([]byte)
+        return b.AppendBinary(k, 0, data, uint(len(data)))
+    case Binary:
+        bin := v.(Binary)
+        return b.AppendBinary(k, bin.Kind, bin.Data, uint(len(bin.Data)))
+    case RegEx:
+        re := v.(RegEx)
+        return b.AppendRegex(k, re.Pattern, re.Options)
+    case JavaScript:
+        return b.appendJavaScript(k, v.(JavaScript))
     case M:
         return b.AppendMap(k, v.(M))
     case map[string]interface{}:
         return b.AppendMap(k, v.(map[string]interface{}))
+    case D:
+        return b.AppendD(k, v.(D))
+    case Raw:
+        return b.AppendRaw(k, v.(Raw))
+    case Symbol:
+        return b.AppendSymbol(k, string(v.(Symbol)))
+    case MongoTimestamp:
+        ts := v.(MongoTimestamp)
+        return b.AppendTimestamp(k, int(ts>>32), int(uint32(ts)))
+    case DBPointer:
+        return b.appendDBPointer(k, v.(DBPointer))
     default:
-        t := reflect.TypeOf(v)
+        // named types, as `type Status int`, are encoded as their kind
+        rv := reflect.ValueOf(v)
+        t := rv.Type()
         switch t.Kind() {
+        case reflect.Int8, reflect.Int16, reflect.Int32:
+            return b.AppendInt(k, int(rv.Int()))
+        case reflect.Int:
+            return b.appendInt64(k, rv.Int())
+        case reflect.Int64:
+            return b.AppendLong(k, rv.Int())
+        case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+            return b.appendInt64(k, int64(rv.Uint()))
+        case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+            return b.appendUint64(k, rv.Uint())
+        case reflect.Float32, reflect.Float64:
+            return b.AppendDouble(k, rv.Float())
+        case reflect.String:
+            return b.AppendString(k, rv.String())
+        case reflect.Bool:
+            return b.AppendBool(k, rv.Bool())
+        case reflect.Map:
+            if t.Key().Kind() != reflect.String {
+                logUnsupported(k, t)
+                return b.fail()
+            }
+            if rv.IsNil() {
+                return b.AppendNull(k)
+            }
+            m := make(map[string]interface{}, rv.Len())
+            for _, mk := range rv.MapKeys() {
+                m[mk.String()] = rv.MapIndex(mk).Interface()
+            }
+            return b.AppendMap(k, m)
         case reflect.Array, reflect.Slice:
-            b._appendArray(k, v)
-        case reflect.Struct:
-            fmt.Println("[To Bson] type does not support ==> Struct")
+            return b._appendArray(k, v)
         case reflect.Ptr:
-            fmt.Println("[To Bson] type does not support ==> Ptr")
+            if rv.IsNil() {
+                return b.AppendNull(k)
+            }
+            return b.appendValue(k, rv.Elem().Interface())
+        case reflect.Struct:
+            // encoded in Go, by the struct tags
+            data, err := bson.Marshal(v)
+            if err != nil {
+                return b.fail()
+            }
+            return b.AppendRaw(k, Raw(data))
         default:
-            panic(fmt.Sprintf("Unkonw type: %T, %d", v, t.Kind()))
+            logUnsupported(k, t)
+            return b.fail()
         }
     }
-    return BSON_OK
+}
+
+// appendInt64 appends v as a BSON int when it fits in 32 bits, and as a BSON
+// long otherwise.
+func (b *Bson) appendInt64(k string, v int64) int {
+    if v >= math.MinInt32 && v <= math.MaxInt32 {
+        return b.AppendInt(k, int(v))
+    }
+    return b.AppendLong(k, v)
+}
+
+// appendUint64 appends v as a BSON int or long. Values that overflow an
+// int64 can not be stored without loss, and BSON_ERROR is returned.
+func (b *Bson) appendUint64(k string, v uint64) int {
+    if v > math.MaxInt64 {
+        return b.fail()
+    }
+    return b.appendInt64(k, int64(v))
+}
+
+// appendDBPointer appends ptr, which the C driver has no function for, as
+// the element encoded by bson.Marshal.
+func (b *Bson) appendDBPointer(k string, ptr DBPointer) int {
+    elem, err := newBsonFromDoc(D{{Name: k, Value: ptr}})
+    if err != nil {
+        return BSON_ERROR
+    }
+    defer elem.Destroy()
+    it := NewBsonIterator()
+    it.Init(elem)
+    if it.Next() != BSON_DBREF {
+        return BSON_ERROR
+    }
+    return b.AppendElement(k, it)
+}
+
+func (b *Bson) appendJavaScript(k string, js JavaScript) int {
+    if js.Scope == nil {
+        return b.AppendCode(k, js.Code)
+    }
+    scope := NewBsonFromDoc(js.Scope)
+    if scope == nil {
+        return BSON_ERROR
+    }
+    defer scope.Destroy()
+    return b.AppendCodeWScope(k, js.Code, scope)
 }
 
 func (b *Bson) AppendArray(key string, arr interface{}) (int, error) {
@@ -507,32 +811,36 @@ func (b *Bson) AppendArray(key string, arr interface{}) (int, error) {
 }
 
 func (b *Bson) _appendArray(key string, arr interface{}) int {
-    r := BSON_OK
     b.AppendStartArray(key)
     v := reflect.ValueOf(arr)
     n := v.Len()
     for i := 0; i < n; i++ {
-        r = b.appendValue(strconv.Itoa(i), v.Index(i).Interface())
-        if r != BSON_OK {
-            return r
+        if b.appendValue(strconv.Itoa(i), v.Index(i).Interface()) != BSON_OK {
+            // the array is closed, so that the bson stays well formed
+            b.AppendFinishArray()
+            return b.fail()
         }
     }
-    b.AppendFinishArray()
-    return r
+    return b.AppendFinishArray()
 }
 
 func (b *Bson) AppendMap(key string, m map[string]interface{}) int {
     if m == nil {
         return b.AppendNull(key)
     }
-    r := BSON_OK
     b.AppendStartObject(key)
-    for k, v := range m {
-        r = b.appendValue(k, v)
-        if r != BSON_OK {
-            return r
-        }
+    r := b.FromMap(m)
+    b.AppendFinishObject()
+    return r
+}
+
+// AppendD appends d as a sub object, keeping the order of its elements.
+func (b *Bson) AppendD(key string, d D) int {
+    if d == nil {
+        return b.AppendNull(key)
     }
+    b.AppendStartObject(key)
+    r := b.FromD(d)
     b.AppendFinishObject()
     return r
 }
@@ -771,6 +1079,9 @@ func (it *BsonIterator) DoubleRaw() float64 {
 //  * @return the value of the current BSON object.
 //  */
 // MONGO_EXPORT bson_oid_t *bson_iterator_oid( const bson_iterator *i );
+func (it *BsonIterator) Oid() ObjectId {
+    return ObjectId(C.GoBytes(unsafe.Pointer(C.bson_iterator_oid(it.iterator)), 12))
+}
 
 // /**
 //  * Get the string value of the BSON object currently pointed to by the
@@ -811,6 +1122,9 @@ func (it *BsonIterator) StringLen() int {
 // /* works with bson_code, bson_codewscope, and BSON_STRING */
 // /* returns NULL for everything else */
 // MONGO_EXPORT const char *bson_iterator_code( const bson_iterator *i );
+func (it *BsonIterator) Code() string {
+    return C.GoString(C.bson_iterator_code(it.iterator))
+}
 
 // /**
 //  * Get the code scope value of the BSON object currently pointed to
@@ -828,6 +1142,13 @@ func (it *BsonIterator) StringLen() int {
 //  *   valid when the iterator's data buffer is deallocated.
 //  */
 // MONGO_EXPORT void bson_iterator_code_scope_init( const bson_iterator *i, bson *scope, bson_bool_t copyData );
+// CodeWithScope returns the code and a copy of its scope, which the caller
+// must Destroy. The scope is empty for anything but BSON_CODEWSCOPE.
+func (it *BsonIterator) CodeWithScope() (string, *Bson) {
+    scope := NewBson()
+    C.bson_iterator_code_scope_init(it.iterator, scope._bson, C.bson_bool_t(1))
+    return it.Code(), scope
+}
 
 // /**
 //  * Get the date value of the BSON object currently pointed to by the
@@ -839,6 +1160,10 @@ func (it *BsonIterator) StringLen() int {
 //  */
 // /* both of these only work with bson_date */
 // MONGO_EXPORT bson_date_t bson_iterator_date( const bson_iterator *i );
+func (it *BsonIterator) Date() time.Time {
+    millis := int64(C.bson_iterator_date(it.iterator))
+    return time.Unix(millis/1e3, millis%1e3*1e6)
+}
 
 // /**
 //  * Get the time value of the BSON object currently pointed to by the
@@ -849,6 +1174,9 @@ func (it *BsonIterator) StringLen() int {
 //  * @return the time value of the current BSON object.
 //  */
 // MONGO_EXPORT time_t bson_iterator_time_t( const bson_iterator *i );
+func (it *BsonIterator) Time() time.Time {
+    return time.Unix(int64(C.bson_iterator_time_t(it.iterator)), 0)
+}
 
 // /**
 //  * Get the length of the BSON binary object currently pointed to by the
@@ -859,6 +1187,9 @@ func (it *BsonIterator) StringLen() int {
 //  * @return the length of the current BSON binary object.
 //  */
 // MONGO_EXPORT int bson_iterator_bin_len( const bson_iterator *i );
+func (it *BsonIterator) BinLen() int {
+    return int(C.bson_iterator_bin_len(it.iterator))
+}
 
 // /**
 //  * Get the type of the BSON binary object currently pointed to by the
@@ -869,6 +1200,9 @@ func (it *BsonIterator) StringLen() int {
 //  * @return the type of the current BSON binary object.
 //  */
 // MONGO_EXPORT char bson_iterator_bin_type( const bson_iterator *i );
+func (it *BsonIterator) BinType() byte {
+    return byte(C.bson_iterator_bin_type(it.iterator))
+}
 
 // /**
 //  * Get the value of the BSON binary object currently pointed to by the
@@ -879,6 +1213,14 @@ func (it *BsonIterator) StringLen() int {
 //  * @return the value of the current BSON binary object.
 //  */
 // MONGO_EXPORT const char *bson_iterator_bin_data( const bson_iterator *i );
+func (it *BsonIterator) BinData() []byte {
+    return C.GoBytes(unsafe.Pointer(C.bson_iterator_bin_data(it.iterator)), C.int(it.BinLen()))
+}
+
+// Binary returns the subtype and a copy of the data of the binary value.
+func (it *BsonIterator) Binary() (subtype byte, data []byte) {
+    return it.BinType(), it.BinData()
+}
 
 // /**
 //  * Get the value of the BSON regex object currently pointed to by the
@@ -899,6 +1241,11 @@ func (it *BsonIterator) StringLen() int {
 //  * @return the options of the current BSON regex object.
 //  */
 // MONGO_EXPORT const char *bson_iterator_regex_opts( const bson_iterator *i );
+func (it *BsonIterator) Regex() (pattern, opts string) {
+    pattern = C.GoString(C.bson_iterator_regex(it.iterator))
+    opts = C.GoString(C.bson_iterator_regex_opts(it.iterator))
+    return
+}
 
 // /* these work with BSON_OBJECT and BSON_ARRAY */
 // /**
@@ -0,0 +1,233 @@
+// Package bson is a pure Go implementation of the BSON format, producing the
+// same bytes as the bson_append_* functions of the mongo-c-driver.
+//
+// It holds the document types used by libgomongo, and can be used without
+// cgo, as in tests or in processes that only need to encode and decode
+// documents.
+//
+// More information: http://bsonspec.org/
+package bson
+
+import (
+    "crypto/md5"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+// Type is the type of a BSON element.
+type Type int8
+
+const (
+    TypeEOO        Type = 0x00
+    TypeDouble     Type = 0x01
+    TypeString     Type = 0x02
+    TypeObject     Type = 0x03
+    TypeArray      Type = 0x04
+    TypeBinary     Type = 0x05
+    TypeUndefined  Type = 0x06 /**< Deprecated. */
+    TypeOID        Type = 0x07
+    TypeBool       Type = 0x08
+    TypeDate       Type = 0x09
+    TypeNull       Type = 0x0A
+    TypeRegex      Type = 0x0B
+    TypeDBPointer  Type = 0x0C /**< Deprecated. */
+    TypeCode       Type = 0x0D
+    TypeSymbol     Type = 0x0E /**< Deprecated. */
+    TypeCodeWScope Type = 0x0F
+    TypeInt        Type = 0x10
+    TypeTimestamp  Type = 0x11
+    TypeLong       Type = 0x12
+    TypeMinKey     Type = -1
+    TypeMaxKey     Type = 0x7F
+)
+
+// Binary subtypes.
+const (
+    BinaryGeneric  = 0x00
+    BinaryFunction = 0x01
+    BinaryOld      = 0x02 /**< Deprecated, the data is prefixed with its length. */
+    BinaryUUIDOld  = 0x03
+    BinaryUUID     = 0x04
+    BinaryMD5      = 0x05
+    BinaryUser     = 0x80
+)
+
+// M is a shortcut for writing map[string]interface{} in BSON literal
+// expressions. The type M is encoded the same as the type
+// map[string]interface{}.
+type M map[string]interface{}
+
+// D represents a BSON document that preserves the order of its elements,
+// as needed by commands, compound index keys and sorts on several fields.
+//
+//     D{{"count", "people"}, {"query", M{"age": 33}}}
+//
+// D is accepted wherever a M is, and a document is decoded into a D when
+// one is given as the result.
+type D []DocElem
+
+// DocElem is an element of a D document.
+type DocElem struct {
+    Name  string
+    Value interface{}
+}
+
+// Map returns a M with the elements of d. Sub documents are not converted.
+func (d D) Map() M {
+    m := make(M, len(d))
+    for _, e := range d {
+        m[e.Name] = e.Value
+    }
+    return m
+}
+
+// ObjectId is a unique ID identifying a BSON value, holding the 12 raw bytes
+// of a bson_oid_t.
+//
+// More information: http://www.mongodb.org/display/DOCS/Object+IDs
+type ObjectId string
+
+var (
+    objectIdCounter uint32
+    machineId       = readMachineId()
+)
+
+// readMachineId returns the first 3 bytes of the md5 of the hostname, or
+// random bytes if the hostname is not available.
+func readMachineId() []byte {
+    id := make([]byte, 3)
+    if hostname, err := os.Hostname(); err == nil {
+        sum := md5.Sum([]byte(hostname))
+        copy(id, sum[:])
+        return id
+    }
+    if _, err := io.ReadFull(rand.Reader, id); err != nil {
+        panic(fmt.Sprintf("cannot get hostname nor generate a random machine id: %v", err))
+    }
+    return id
+}
+
+// NewObjectId returns a new unique ObjectId, made of the current time, a
+// machine id, the process id and a counter.
+func NewObjectId() ObjectId {
+    var b [12]byte
+    binary.BigEndian.PutUint32(b[:], uint32(time.Now().Unix()))
+    copy(b[4:], machineId)
+    pid := os.Getpid()
+    b[7] = byte(pid >> 8)
+    b[8] = byte(pid)
+    i := atomic.AddUint32(&objectIdCounter, 1)
+    b[9] = byte(i >> 16)
+    b[10] = byte(i >> 8)
+    b[11] = byte(i)
+    return ObjectId(b[:])
+}
+
+// ObjectIdHex returns an ObjectId from the provided hex representation.
+// Calling this function with an invalid hex representation will cause a
+// runtime panic. See the IsObjectIdHex function.
+func ObjectIdHex(s string) ObjectId {
+    d, err := hex.DecodeString(s)
+    if err != nil || len(d) != 12 {
+        panic(fmt.Sprintf("Invalid input to ObjectIdHex: %q", s))
+    }
+    return ObjectId(d)
+}
+
+// IsObjectIdHex returns whether s is a valid hex representation of an
+// ObjectId.
+func IsObjectIdHex(s string) bool {
+    if len(s) != 24 {
+        return false
+    }
+    _, err := hex.DecodeString(s)
+    return err == nil
+}
+
+// Hex returns the 24 characters hex representation of the ObjectId.
+func (id ObjectId) Hex() string {
+    return hex.EncodeToString([]byte(id))
+}
+
+// String returns a hex string representation of the id, as
+// ObjectIdHex("4d88e15b60f486e428412dc9").
+func (id ObjectId) String() string {
+    return fmt.Sprintf("ObjectIdHex(%q)", id.Hex())
+}
+
+// Valid returns true if id is a valid ObjectId.
+func (id ObjectId) Valid() bool {
+    return len(id) == 12
+}
+
+// Time returns the creation time of the id, with a precision of a second.
+func (id ObjectId) Time() time.Time {
+    if !id.Valid() {
+        return time.Time{}
+    }
+    return time.Unix(int64(binary.BigEndian.Uint32([]byte(id[:4]))), 0)
+}
+
+// Binary is a BSON binary value. Values of the generic subtype 0x00 are
+// decoded as []byte, other subtypes as Binary.
+type Binary struct {
+    Kind byte
+    Data []byte
+}
+
+// RegEx is a BSON regular expression. The options are sorted letters, as
+// "i", "m", "s" or "x".
+type RegEx struct {
+    Pattern string
+    Options string
+}
+
+// JavaScript is a BSON code value. When Scope is not nil, it is encoded as
+// code with scope; Scope must then be a document, as a M or a D.
+type JavaScript struct {
+    Code  string
+    Scope interface{}
+}
+
+// Symbol is a BSON symbol, a deprecated string type.
+type Symbol string
+
+// MongoTimestamp is a BSON timestamp, used internally by MongoDB for
+// replication. The seconds are in the high 32 bits and the increment in the
+// low 32 bits.
+type MongoTimestamp int64
+
+// NewMongoTimestamp returns the timestamp of the given seconds and
+// increment.
+func NewMongoTimestamp(seconds, increment uint32) MongoTimestamp {
+    return MongoTimestamp(int64(seconds)<<32 | int64(increment))
+}
+
+// DBPointer is a deprecated BSON reference to a document of another
+// collection.
+type DBPointer struct {
+    Namespace string
+    Id        ObjectId
+}
+
+type orderKey int64
+
+// MinKey and MaxKey compare lower and higher than any other BSON value.
+var (
+    MinKey = orderKey(-1 << 63)
+    MaxKey = orderKey(1<<63 - 1)
+)
+
+type undefined struct{}
+
+// Undefined is the deprecated BSON undefined value.
+var Undefined undefined
+
+var errNotFound = errors.New("bson: element not found")
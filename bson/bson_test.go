@@ -0,0 +1,399 @@
+package bson
+
+import (
+    "encoding/hex"
+    "errors"
+    "github.com/couchbaselabs/go.assert"
+    "net"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestMarshal(t *testing.T) {
+    data, err := Marshal(D{{Name: "hello", Value: "world"}})
+    assert.Equals(t, err, nil)
+    assert.Equals(t, hex.EncodeToString(data), "160000000268656c6c6f0006000000776f726c640000")
+
+    data, err = Marshal(nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, hex.EncodeToString(data), "0500000000")
+
+    data, err = Marshal(D{{Name: "a", Value: []interface{}{"x", 1}}})
+    assert.Equals(t, err, nil)
+    assert.Equals(t, hex.EncodeToString(data), "1d00000004610015000000023000020000007800103100010000000000")
+
+    // as the C driver, nil documents are null and strings end at a NUL
+    data, err = Marshal(D{{Name: "m", Value: M(nil)}, {Name: "d", Value: D(nil)}, {Name: "k\x00ey", Value: "wor\x00ld"}})
+    assert.Equals(t, err, nil)
+    same, _ := Marshal(D{{Name: "m", Value: nil}, {Name: "d", Value: nil}, {Name: "k", Value: "wor"}})
+    assert.DeepEquals(t, data, same)
+
+    _, err = Marshal(42)
+    assert.NotEquals(t, err, nil)
+    _, err = Marshal(M{"big": uint64(1 << 63)})
+    assert.NotEquals(t, err, nil)
+    _, err = Marshal(M{"id": ObjectId("short")})
+    assert.NotEquals(t, err, nil)
+}
+
+type testStatus int
+
+type testDoc struct {
+    Id      ObjectId `bson:"_id"`
+    Name    string
+    Age     int      `bson:"age,omitempty"`
+    Status  testStatus
+    Tags    []string
+    Created time.Time
+    Extra   M `bson:",omitempty"`
+    secret  string
+}
+
+func TestRoundTrip(t *testing.T) {
+    now := time.Unix(1372000000, 123e6)
+    id := NewObjectId()
+    in := D{
+        {Name: "double", Value: 1.5},
+        {Name: "string", Value: "libgomongo"},
+        {Name: "doc", Value: D{{Name: "b", Value: true}, {Name: "a", Value: 2}}},
+        {Name: "array", Value: []interface{}{"x", 1, int64(1 << 40)}},
+        {Name: "bin", Value: []byte{0, 1, 2}},
+        {Name: "uuid", Value: Binary{Kind: BinaryUUID, Data: []byte("0123456789abcdef")}},
+        {Name: "old", Value: Binary{Kind: BinaryOld, Data: []byte("old")}},
+        {Name: "undefined", Value: Undefined},
+        {Name: "oid", Value: id},
+        {Name: "bool", Value: false},
+        {Name: "date", Value: now},
+        {Name: "null", Value: nil},
+        {Name: "re", Value: RegEx{Pattern: "^joe", Options: "i"}},
+        {Name: "dbptr", Value: DBPointer{Namespace: "db.people", Id: id}},
+        {Name: "code", Value: JavaScript{Code: "function() {}"}},
+        {Name: "symbol", Value: Symbol("sym")},
+        {Name: "scoped", Value: JavaScript{Code: "x", Scope: M{"x": 1}}},
+        {Name: "int", Value: 42},
+        {Name: "ts", Value: NewMongoTimestamp(1372000000, 7)},
+        {Name: "long", Value: int64(1 << 40)},
+        {Name: "min", Value: MinKey},
+        {Name: "max", Value: MaxKey},
+    }
+    data, err := Marshal(in)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, Raw(data).Validate(), nil)
+
+    var out D
+    assert.Equals(t, Unmarshal(data, &out), nil)
+    assert.Equals(t, len(out), len(in))
+    for i := range in {
+        assert.Equals(t, out[i].Name, in[i].Name)
+        if in[i].Name == "date" {
+            assert.Equals(t, out[i].Value.(time.Time).Equal(now), true)
+            continue
+        }
+        assert.DeepEquals(t, out[i].Value, in[i].Value)
+    }
+
+    again, err := Marshal(out)
+    assert.Equals(t, err, nil)
+    assert.DeepEquals(t, again, data)
+}
+
+func TestStruct(t *testing.T) {
+    doc := testDoc{
+        Id:      NewObjectId(),
+        Name:    "Joe",
+        Status:  testStatus(3),
+        Tags:    []string{"a", "b"},
+        Created: time.Unix(1372000000, 0),
+        secret:  "hidden",
+    }
+    data, err := Marshal(&doc)
+    assert.Equals(t, err, nil)
+
+    m := M{}
+    assert.Equals(t, Unmarshal(data, &m), nil)
+    _, ok := m["age"]
+    assert.Equals(t, ok, false)
+    _, ok = m["extra"]
+    assert.Equals(t, ok, false)
+    _, ok = m["secret"]
+    assert.Equals(t, ok, false)
+    assert.Equals(t, m["status"], 3)
+    assert.DeepEquals(t, m["tags"], []interface{}{"a", "b"})
+
+    var out testDoc
+    assert.Equals(t, Unmarshal(data, &out), nil)
+    assert.Equals(t, out.Id, doc.Id)
+    assert.Equals(t, out.Name, "Joe")
+    assert.Equals(t, out.Status, testStatus(3))
+    assert.DeepEquals(t, out.Tags, doc.Tags)
+    assert.Equals(t, out.Created.Equal(doc.Created), true)
+}
+
+func TestOverflow(t *testing.T) {
+    data, err := Marshal(D{{Name: "long", Value: int64(1 << 40)}, {Name: "neg", Value: -1}, {Name: "half", Value: 2.5}, {Name: "two", Value: 2.0}})
+    assert.Equals(t, err, nil)
+
+    var small struct{ Long int8 }
+    assert.NotEquals(t, Unmarshal(data, &small), nil)
+    var unsigned struct{ Neg uint }
+    assert.NotEquals(t, Unmarshal(data, &unsigned), nil)
+    var half struct{ Half int }
+    assert.NotEquals(t, Unmarshal(data, &half), nil)
+
+    // whole doubles, as the counts of the commands, still fit
+    var fits struct {
+        Long int64
+        Neg  int8
+        Two  uint8
+        Half float32
+    }
+    assert.Equals(t, Unmarshal(data, &fits), nil)
+    assert.Equals(t, fits.Long, int64(1<<40))
+    assert.Equals(t, fits.Neg, int8(-1))
+    assert.Equals(t, fits.Two, uint8(2))
+    assert.Equals(t, fits.Half, float32(2.5))
+}
+
+func TestRaw(t *testing.T) {
+    data, err := Marshal(D{{Name: "name", Value: "libgomongo"}, {Name: "m", Value: M{"n": 7}}})
+    assert.Equals(t, err, nil)
+    raw := Raw(data)
+
+    elems, err := raw.Elements()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, len(elems), 2)
+    assert.Equals(t, elems[1].Value.Type, TypeObject)
+
+    var n int
+    assert.Equals(t, raw.Lookup("m", "n").Unmarshal(&n), nil)
+    assert.Equals(t, n, 7)
+    assert.Equals(t, raw.Lookup("m", "x").Type, TypeEOO)
+    assert.NotEquals(t, raw.Lookup("x").Unmarshal(&n), nil)
+
+    // embedded without being encoded again
+    outer, err := Marshal(M{"doc": raw})
+    assert.Equals(t, err, nil)
+    assert.DeepEquals(t, []byte(Raw(outer).Lookup("doc").Document()), data)
+
+    bad := append([]byte(nil), data...)
+    bad[len(bad)-1] = 1
+    assert.NotEquals(t, Raw(bad).Validate(), nil)
+    assert.NotEquals(t, Unmarshal(bad, &M{}), nil)
+    assert.NotEquals(t, Unmarshal(data[:4], &M{}), nil)
+}
+
+func TestObjectId(t *testing.T) {
+    a, b := NewObjectId(), NewObjectId()
+    assert.Equals(t, a.Valid(), true)
+    assert.NotEquals(t, a, b)
+    assert.Equals(t, ObjectIdHex(a.Hex()), a)
+    assert.Equals(t, time.Since(a.Time()) < time.Minute, true)
+}
+
+func TestExtJSON(t *testing.T) {
+    id := ObjectIdHex("4d88e15b60f486e428412dc9")
+    in := D{
+        {Name: "_id", Value: id},
+        {Name: "name", Value: "a \"quoted\" name\n"},
+        {Name: "int", Value: 42},
+        {Name: "long", Value: int64(1 << 40)},
+        {Name: "double", Value: 1.0},
+        {Name: "date", Value: time.Unix(1356351330, 501e6)},
+        {Name: "bin", Value: Binary{Kind: BinaryUUID, Data: []byte{1, 2, 3}}},
+        {Name: "re", Value: RegEx{Pattern: "^joe", Options: "i"}},
+        {Name: "ts", Value: NewMongoTimestamp(1372000000, 7)},
+        {Name: "scoped", Value: JavaScript{Code: "x", Scope: D{{Name: "x", Value: 1}}}},
+        {Name: "tags", Value: []interface{}{"a", MinKey}},
+    }
+
+    canonical, err := MarshalExtJSON(in, true)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, string(canonical), `{"_id":{"$oid":"4d88e15b60f486e428412dc9"},"name":"a \"quoted\" name\n",`+
+        `"int":{"$numberInt":"42"},"long":{"$numberLong":"1099511627776"},"double":{"$numberDouble":"1.0"},`+
+        `"date":{"$date":{"$numberLong":"1356351330501"}},"bin":{"$binary":{"base64":"AQID","subType":"04"}},`+
+        `"re":{"$regularExpression":{"pattern":"^joe","options":"i"}},"ts":{"$timestamp":{"t":1372000000,"i":7}},`+
+        `"scoped":{"$code":"x","$scope":{"x":{"$numberInt":"1"}}},"tags":["a",{"$minKey":1}]}`)
+
+    relaxed, err := MarshalExtJSON(in, false)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, string(relaxed), `{"_id":{"$oid":"4d88e15b60f486e428412dc9"},"name":"a \"quoted\" name\n",`+
+        `"int":42,"long":1099511627776,"double":1.0,"date":{"$date":"2012-12-24T12:15:30.501Z"},`+
+        `"bin":{"$binary":{"base64":"AQID","subType":"04"}},"re":{"$regularExpression":{"pattern":"^joe","options":"i"}},`+
+        `"ts":{"$timestamp":{"t":1372000000,"i":7}},"scoped":{"$code":"x","$scope":{"x":1}},"tags":["a",{"$minKey":1}]}`)
+
+    // both formats decode to the same bytes
+    want, err := Marshal(in)
+    assert.Equals(t, err, nil)
+    for _, data := range [][]byte{canonical, relaxed} {
+        var r Raw
+        assert.Equals(t, UnmarshalExtJSON(data, &r), nil)
+        assert.DeepEquals(t, []byte(r), want)
+    }
+
+    // query operators are plain documents
+    var m M
+    assert.Equals(t, UnmarshalExtJSON([]byte(`{"age": {"$gt": 30}, "n": 1.5}`), &m), nil)
+    assert.DeepEquals(t, m, M{"age": M{"$gt": 30}, "n": 1.5})
+
+    assert.NotEquals(t, UnmarshalExtJSON([]byte(`{"_id": {"$oid": "bad"}}`), &m), nil)
+    assert.NotEquals(t, UnmarshalExtJSON([]byte(`[1, 2]`), &m), nil)
+    assert.NotEquals(t, UnmarshalExtJSON([]byte(`{"a": `), &m), nil)
+}
+
+type testMoney struct {
+    Cents int64
+}
+
+func (m testMoney) GetBSON() (interface{}, error) {
+    return m.Cents, nil
+}
+
+func (m *testMoney) SetBSON(raw Raw) error {
+    return raw.Lookup("").Unmarshal(&m.Cents)
+}
+
+type testInvoice struct {
+    Total testMoney
+    Paid  *testMoney
+    Ip    net.IP
+}
+
+func init() {
+    RegisterType(net.IP{},
+        func(v interface{}) (interface{}, error) {
+            return v.(net.IP).String(), nil
+        },
+        func(raw Raw, result interface{}) error {
+            var s string
+            if err := raw.Lookup("").Unmarshal(&s); err != nil {
+                return err
+            }
+            *result.(*net.IP) = net.ParseIP(s)
+            return nil
+        })
+    RegisterType(int16(0),
+        func(v interface{}) (interface{}, error) {
+            return strconv.Itoa(int(v.(int16))), nil
+        },
+        func(raw Raw, result interface{}) error {
+            var s string
+            if err := raw.Lookup("").Unmarshal(&s); err != nil {
+                return err
+            }
+            n, err := strconv.Atoi(s)
+            *result.(*int16) = int16(n)
+            return err
+        })
+}
+
+func TestHooks(t *testing.T) {
+    in := testInvoice{Total: testMoney{1250}, Paid: &testMoney{1000}, Ip: net.ParseIP("10.0.0.1")}
+    data, err := Marshal(in)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, Raw(data).Lookup("total").Type, TypeLong)
+    assert.Equals(t, Raw(data).Lookup("ip").Type, TypeString)
+
+    var m M
+    assert.Equals(t, Unmarshal(data, &m), nil)
+    assert.DeepEquals(t, m, M{"total": int64(1250), "paid": int64(1000), "ip": "10.0.0.1"})
+
+    var out testInvoice
+    assert.Equals(t, Unmarshal(data, &out), nil)
+    assert.Equals(t, out.Total, testMoney{1250})
+    assert.Equals(t, *out.Paid, testMoney{1000})
+    assert.Equals(t, out.Ip.Equal(in.Ip), true)
+
+    // a Setter result receives the whole document, under an empty key
+    var doc testWhole
+    assert.Equals(t, Unmarshal(data, &doc), nil)
+    assert.Equals(t, doc.n, 3)
+
+    _, err = Marshal(M{"bad": testFailing{}})
+    assert.NotEquals(t, err, nil)
+    _, err = Marshal(M{"self": testSelf{}})
+    assert.NotEquals(t, err, nil)
+    _, err = Marshal(M{"ping": testPing{}})
+    assert.NotEquals(t, err, nil)
+
+    // a Setter receives the original bytes of its value
+    data, err = Marshal(D{{Name: "kept", Value: D{{Name: "z", Value: 1}, {Name: "code", Value: JavaScript{Code: "x", Scope: D{{Name: "b", Value: 1}, {Name: "a", Value: 2}}}}}}})
+    assert.Equals(t, err, nil)
+    var keep struct{ Kept testKeep }
+    assert.Equals(t, Unmarshal(data, &keep), nil)
+    assert.DeepEquals(t, keep.Kept.raw.Lookup("").Document(), Raw(data).Lookup("kept").Document())
+
+    // the hooks of a built-in type come before its encoding
+    data, err = Marshal(M{"n": int16(7)})
+    assert.Equals(t, err, nil)
+    assert.Equals(t, Raw(data).Lookup("n").Type, TypeString)
+    var n struct{ N int16 }
+    assert.Equals(t, Unmarshal(data, &n), nil)
+    assert.Equals(t, n.N, int16(7))
+}
+
+type testWhole struct {
+    n int
+}
+
+func (w *testWhole) SetBSON(raw Raw) error {
+    elems, err := raw.Lookup("").Document().Elements()
+    w.n = len(elems)
+    return err
+}
+
+type testKeep struct {
+    raw Raw
+}
+
+func (k *testKeep) SetBSON(raw Raw) error {
+    k.raw = raw
+    return nil
+}
+
+type testSelf struct{}
+
+func (s testSelf) GetBSON() (interface{}, error) {
+    return s, nil
+}
+
+type testPing struct{}
+type testPong struct{}
+
+func (testPing) GetBSON() (interface{}, error) {
+    return testPong{}, nil
+}
+
+func (testPong) GetBSON() (interface{}, error) {
+    return testPing{}, nil
+}
+
+type testFailing struct{}
+
+func (testFailing) GetBSON() (interface{}, error) {
+    return nil, errors.New("cannot store")
+}
+
+var benchDoc = D{
+    {Name: "_id", Value: ObjectIdHex("4d88e15b60f486e428412dc9")},
+    {Name: "name", Value: "libgomongo"},
+    {Name: "age", Value: 33},
+    {Name: "score", Value: 1.5},
+    {Name: "tags", Value: []interface{}{"go", "c", "mongo"}},
+    {Name: "address", Value: M{"city": "Guangzhou", "zip": 510000}},
+}
+
+func BenchmarkMarshal(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        Marshal(benchDoc)
+    }
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+    data, _ := Marshal(benchDoc)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        var m M
+        Unmarshal(data, &m)
+    }
+}
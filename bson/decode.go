@@ -0,0 +1,343 @@
+package bson
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math"
+    "reflect"
+    "strings"
+    "time"
+)
+
+var (
+    typeOfD   = reflect.TypeOf(D{})
+    typeOfRaw = reflect.TypeOf(Raw{})
+)
+
+// Unmarshal decodes the BSON document in data into result. The result
+// argument must be a pointer to a map, a D, a Raw, a struct or an
+// interface{}.
+//
+// Documents are decoded as M, unless a D is asked for, and arrays as
+// []interface{}. Struct fields are matched by the lowercased field name, or
+// by the name given in a `bson:"name"` tag. Values implementing Setter, and
+// values of the types registered with RegisterType, decode themselves.
+func Unmarshal(data []byte, result interface{}) error {
+    if err := Raw(data).Validate(); err != nil {
+        return err
+    }
+    switch r := result.(type) {
+    case *Raw:
+        *r = append(Raw(nil), data...)
+        return nil
+    case Setter:
+        return r.SetBSON(RawValue{Type: TypeObject, Data: data}.element())
+    }
+    return setResult(result, RawValue{Type: TypeObject, Data: data})
+}
+
+// decodeDocument decodes a whole document into a D.
+func decodeDocument(data []byte) (D, error) {
+    elems, err := Raw(data).elements(false)
+    if err != nil {
+        return nil, err
+    }
+    d := make(D, len(elems))
+    for i, el := range elems {
+        v, err := el.Value.decode()
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("bson: element %q: %s", el.Key, err))
+        }
+        d[i] = DocElem{el.Key, v}
+    }
+    return d, nil
+}
+
+// decode returns the Go value of v, with documents decoded as D.
+func (v RawValue) decode() (interface{}, error) {
+    data := v.Data
+    switch v.Type {
+    case TypeDouble:
+        return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+    case TypeString:
+        return string(data[4 : len(data)-1]), nil
+    case TypeSymbol:
+        return Symbol(data[4 : len(data)-1]), nil
+    case TypeObject:
+        return decodeDocument(data)
+    case TypeArray:
+        d, err := decodeDocument(data)
+        if err != nil {
+            return nil, err
+        }
+        arr := make([]interface{}, len(d))
+        for i, el := range d {
+            arr[i] = el.Value
+        }
+        return arr, nil
+    case TypeBinary:
+        kind := data[4]
+        bin := data[5:]
+        if kind == BinaryOld && len(bin) >= 4 {
+            bin = bin[4:]
+        }
+        bin = append([]byte(nil), bin...)
+        if kind == BinaryGeneric {
+            return bin, nil
+        }
+        return Binary{Kind: kind, Data: bin}, nil
+    case TypeUndefined:
+        return Undefined, nil
+    case TypeOID:
+        return ObjectId(data), nil
+    case TypeBool:
+        return data[0] != 0, nil
+    case TypeDate:
+        millis := int64(binary.LittleEndian.Uint64(data))
+        return time.Unix(millis/1e3, millis%1e3*1e6), nil
+    case TypeNull:
+        return nil, nil
+    case TypeRegex:
+        i := strings.IndexByte(string(data), 0)
+        return RegEx{Pattern: string(data[:i]), Options: string(data[i+1 : len(data)-1])}, nil
+    case TypeDBPointer:
+        n := len(data) - 12
+        return DBPointer{Namespace: string(data[4 : n-1]), Id: ObjectId(data[n:])}, nil
+    case TypeCode:
+        return JavaScript{Code: string(data[4 : len(data)-1])}, nil
+    case TypeCodeWScope:
+        if err := v.validate(); err != nil {
+            return nil, err
+        }
+        n := int(int32(binary.LittleEndian.Uint32(data[4:])))
+        scope, err := decodeDocument(data[8+n:])
+        if err != nil {
+            return nil, err
+        }
+        return JavaScript{Code: string(data[8 : 7+n]), Scope: unordered(scope)}, nil
+    case TypeInt:
+        return int(int32(binary.LittleEndian.Uint32(data))), nil
+    case TypeTimestamp:
+        return MongoTimestamp(binary.LittleEndian.Uint64(data)), nil
+    case TypeLong:
+        return int64(binary.LittleEndian.Uint64(data)), nil
+    case TypeMinKey:
+        return MinKey, nil
+    case TypeMaxKey:
+        return MaxKey, nil
+    }
+    return nil, errors.New(fmt.Sprintf("unknown type 0x%02x", byte(v.Type)))
+}
+
+// unordered returns v with every D, including the ones nested in documents
+// and arrays, converted to M.
+func unordered(v interface{}) interface{} {
+    switch v := v.(type) {
+    case D:
+        m := make(M, len(v))
+        for _, e := range v {
+            m[e.Name] = unordered(e.Value)
+        }
+        return m
+    case []interface{}:
+        arr := make([]interface{}, len(v))
+        for i, e := range v {
+            arr[i] = unordered(e)
+        }
+        return arr
+    }
+    return v
+}
+
+func setResult(result interface{}, v RawValue) error {
+    rv := reflect.ValueOf(result)
+    if rv.Kind() != reflect.Ptr || rv.IsNil() {
+        return errors.New(fmt.Sprintf("bson: result argument must be a non-nil pointer, but got %T", result))
+    }
+    return setValue(rv.Elem(), v)
+}
+
+// setValue decodes v into out, converting between compatible kinds when
+// needed. Documents and arrays are decoded element by element, so that the
+// hooks of the values they hold receive their original bytes.
+func setValue(out reflect.Value, v RawValue) error {
+    if v.Type == TypeNull {
+        out.Set(reflect.Zero(out.Type()))
+        return nil
+    }
+    if ok, err := setHooks(out, v); ok {
+        return err
+    }
+    switch out.Kind() {
+    case reflect.Ptr:
+        elem := reflect.New(out.Type().Elem())
+        if err := setValue(elem.Elem(), v); err != nil {
+            return err
+        }
+        out.Set(elem)
+        return nil
+    case reflect.Map, reflect.Struct, reflect.Slice:
+        if v.Type == TypeObject || v.Type == TypeArray {
+            if ok, err := setDocument(out, v); ok {
+                return err
+            }
+        }
+    }
+
+    val, err := v.decode()
+    if err != nil {
+        return err
+    }
+    // documents are decoded as D, and only stay ordered when a D is asked for
+    if out.Kind() == reflect.Interface {
+        val = unordered(val)
+    }
+    in := reflect.ValueOf(val)
+    if in.Type().AssignableTo(out.Type()) {
+        out.Set(in)
+        return nil
+    }
+    switch out.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+        reflect.Float32, reflect.Float64:
+        switch in.Kind() {
+        case reflect.Int, reflect.Int64, reflect.Float64:
+            return setNumber(out, in)
+        }
+    case reflect.String:
+        if in.Kind() == reflect.String {
+            out.SetString(in.String())
+            return nil
+        }
+    case reflect.Bool:
+        if in.Kind() == reflect.Bool {
+            out.SetBool(in.Bool())
+            return nil
+        }
+    }
+    return errors.New(fmt.Sprintf("bson: cannot decode %T into %s", val, out.Type()))
+}
+
+// setDocument decodes the document or array v into out, a map, a struct or
+// a slice, and reports whether out can hold it.
+func setDocument(out reflect.Value, v RawValue) (bool, error) {
+    t := out.Type()
+    if t == typeOfRaw || t == typeOfD {
+        if v.Type != TypeObject {
+            return false, nil
+        }
+        if t == typeOfRaw {
+            out.Set(reflect.ValueOf(append(Raw(nil), v.Data...)))
+            return true, nil
+        }
+        d, err := decodeDocument(v.Data)
+        if err == nil {
+            out.Set(reflect.ValueOf(d))
+        }
+        return true, err
+    }
+    switch {
+    case t.Kind() == reflect.Map && v.Type == TypeObject && t.Key().Kind() == reflect.String:
+    case t.Kind() == reflect.Struct && v.Type == TypeObject:
+    case t.Kind() == reflect.Slice && v.Type == TypeArray:
+    default:
+        return false, nil
+    }
+    elems, err := Raw(v.Data).Elements()
+    if err != nil {
+        return true, err
+    }
+    switch t.Kind() {
+    case reflect.Map:
+        mv := reflect.MakeMapWithSize(t, len(elems))
+        for _, el := range elems {
+            elem := reflect.New(t.Elem()).Elem()
+            if err := setValue(elem, el.Value); err != nil {
+                return true, err
+            }
+            mv.SetMapIndex(reflect.ValueOf(el.Key).Convert(t.Key()), elem)
+        }
+        out.Set(mv)
+    case reflect.Struct:
+        values := make(map[string]RawValue, len(elems))
+        for _, el := range elems {
+            values[el.Key] = el.Value
+        }
+        for i := 0; i < t.NumField(); i++ {
+            key, _ := fieldKey(t.Field(i))
+            if key == "" {
+                continue
+            }
+            if val, ok := values[key]; ok {
+                if err := setValue(out.Field(i), val); err != nil {
+                    return true, err
+                }
+            }
+        }
+    case reflect.Slice:
+        sv := reflect.MakeSlice(t, len(elems), len(elems))
+        for i, el := range elems {
+            if err := setValue(sv.Index(i), el.Value); err != nil {
+                return true, err
+            }
+        }
+        out.Set(sv)
+    }
+    return true, nil
+}
+
+// setNumber stores the number in into out, and fails rather than truncate
+// it, as a long into an int8 or a double with a fraction into an int.
+func setNumber(out, in reflect.Value) error {
+    fits := true
+    switch out.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        if in.Kind() == reflect.Float64 {
+            f := in.Float()
+            fits = f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && !out.OverflowInt(int64(f))
+        } else {
+            fits = !out.OverflowInt(in.Int())
+        }
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        if in.Kind() == reflect.Float64 {
+            f := in.Float()
+            fits = f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 && !out.OverflowUint(uint64(f))
+        } else {
+            fits = in.Int() >= 0 && !out.OverflowUint(uint64(in.Int()))
+        }
+    case reflect.Float32:
+        if in.Kind() == reflect.Float64 {
+            fits = !out.OverflowFloat(in.Float())
+        }
+    }
+    if !fits {
+        return errors.New(fmt.Sprintf("bson: %v overflows %s", in.Interface(), out.Type()))
+    }
+    out.Set(in.Convert(out.Type()))
+    return nil
+}
+
+// fieldKey returns the document key for the struct field f, and whether the
+// field is marked omitempty. An empty key means the field is skipped.
+func fieldKey(f reflect.StructField) (string, bool) {
+    if f.PkgPath != "" {
+        return "", false
+    }
+    tag := f.Tag.Get("bson")
+    if tag == "-" {
+        return "", false
+    }
+    omitempty := false
+    parts := strings.Split(tag, ",")
+    for _, opt := range parts[1:] {
+        if opt == "omitempty" {
+            omitempty = true
+        }
+    }
+    if parts[0] != "" {
+        return parts[0], omitempty
+    }
+    return strings.ToLower(f.Name), omitempty
+}
@@ -0,0 +1,397 @@
+package bson
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Marshal encodes doc into a BSON document. The doc argument may be nil, a
+// M, a map with string keys, a D, a Raw, a struct or a pointer to a struct.
+//
+// Values are encoded as by the bson_append_* functions: Go integers become
+// a BSON int when they fit in 32 bits and a long otherwise, floats a
+// double, time.Time a date and []byte a generic binary. Unsigned integers
+// that overflow an int64 can not be stored and make Marshal fail. Nil
+// documents and pointers are stored as null, and keys and strings end at
+// their first NUL byte.
+//
+// Struct fields are stored under the lowercased field name, or the name
+// given in a `bson:"name"` tag. Fields tagged `bson:",omitempty"` are left
+// out when they hold the zero value of their type.
+//
+// Values implementing Getter, and values of the types registered with
+// RegisterType, are stored as the value they return, whatever their type.
+func Marshal(doc interface{}) ([]byte, error) {
+    e := &encoder{out: make([]byte, 0, 64)}
+    if err := e.addDoc(doc); err != nil {
+        return nil, err
+    }
+    return e.out, nil
+}
+
+type encoder struct {
+    out []byte
+}
+
+func (e *encoder) addDoc(doc interface{}) error {
+    if r, ok := doc.(Raw); ok {
+        if len(r) < 5 || int(int32(binary.LittleEndian.Uint32(r))) != len(r) {
+            return errors.New("bson: invalid Raw document")
+        }
+        e.out = append(e.out, r...)
+        return nil
+    }
+    start := len(e.out)
+    e.out = append(e.out, 0, 0, 0, 0)
+    if err := e.addElems(doc); err != nil {
+        return err
+    }
+    e.out = append(e.out, 0)
+    binary.LittleEndian.PutUint32(e.out[start:], uint32(len(e.out)-start))
+    return nil
+}
+
+func (e *encoder) addElems(doc interface{}) error {
+    switch d := doc.(type) {
+    case nil:
+        return nil
+    case M:
+        for k, v := range d {
+            if err := e.addElem(k, v); err != nil {
+                return err
+            }
+        }
+        return nil
+    case map[string]interface{}:
+        for k, v := range d {
+            if err := e.addElem(k, v); err != nil {
+                return err
+            }
+        }
+        return nil
+    case D:
+        for _, el := range d {
+            if err := e.addElem(el.Name, el.Value); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if got, ok, err := GetBSON(doc); ok {
+        if err != nil {
+            return err
+        }
+        return e.addElems(got)
+    }
+
+    v := reflect.ValueOf(doc)
+    switch v.Kind() {
+    case reflect.Ptr, reflect.Interface:
+        if v.IsNil() {
+            return errors.New(fmt.Sprintf("bson: cannot encode a nil %T as a document", doc))
+        }
+        return e.addElems(v.Elem().Interface())
+    case reflect.Map:
+        if v.Type().Key().Kind() != reflect.String {
+            break
+        }
+        for _, k := range v.MapKeys() {
+            if err := e.addElem(k.String(), v.MapIndex(k).Interface()); err != nil {
+                return err
+            }
+        }
+        return nil
+    case reflect.Struct:
+        t := v.Type()
+        for i := 0; i < t.NumField(); i++ {
+            key, omitempty := fieldKey(t.Field(i))
+            if key == "" {
+                continue
+            }
+            fv := v.Field(i)
+            if omitempty && isZero(fv) {
+                continue
+            }
+            if err := e.addElem(key, fv.Interface()); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    return errors.New(fmt.Sprintf("bson: cannot encode %T as a document", doc))
+}
+
+func (e *encoder) addElem(name string, v interface{}) error {
+    // the hooks come first, so that they may change how the built-in types
+    // are stored
+    if got, ok, err := GetBSON(v); ok {
+        if err != nil {
+            return err
+        }
+        return e.addElem(name, got)
+    }
+    switch v := v.(type) {
+    case nil:
+        e.addHeader(TypeNull, name)
+    case string:
+        e.addHeader(TypeString, name)
+        e.addString(v)
+    case int:
+        e.addInt64(name, int64(v))
+    case int8:
+        e.addInt32(name, int32(v))
+    case int16:
+        e.addInt32(name, int32(v))
+    case int32:
+        e.addInt32(name, v)
+    case int64:
+        e.addHeader(TypeLong, name)
+        e.addUint64(uint64(v))
+    case uint8:
+        e.addInt32(name, int32(v))
+    case uint16:
+        e.addInt32(name, int32(v))
+    case uint32:
+        e.addInt64(name, int64(v))
+    case uint:
+        return e.addUint(name, uint64(v))
+    case uint64:
+        return e.addUint(name, v)
+    case float32:
+        e.addDouble(name, float64(v))
+    case float64:
+        e.addDouble(name, v)
+    case bool:
+        e.addHeader(TypeBool, name)
+        if v {
+            e.out = append(e.out, 1)
+        } else {
+            e.out = append(e.out, 0)
+        }
+    case ObjectId:
+        if !v.Valid() {
+            return errors.New(fmt.Sprintf("bson: invalid ObjectId %q for %q", string(v), name))
+        }
+        e.addHeader(TypeOID, name)
+        e.out = append(e.out, v...)
+    case time.Time:
+        e.addHeader(TypeDate, name)
+        e.addUint64(uint64(v.Unix()*1e3 + int64(v.Nanosecond()/1e6)))
+    case []byte:
+        e.addBinary(name, BinaryGeneric, v)
+    case Binary:
+        e.addBinary(name, v.Kind, v.Data)
+    case RegEx:
+        e.addHeader(TypeRegex, name)
+        e.addCString(v.Pattern)
+        e.addCString(v.Options)
+    case JavaScript:
+        if v.Scope == nil {
+            e.addHeader(TypeCode, name)
+            e.addString(v.Code)
+            break
+        }
+        e.addHeader(TypeCodeWScope, name)
+        start := len(e.out)
+        e.out = append(e.out, 0, 0, 0, 0)
+        e.addString(v.Code)
+        if err := e.addDoc(v.Scope); err != nil {
+            return err
+        }
+        binary.LittleEndian.PutUint32(e.out[start:], uint32(len(e.out)-start))
+    case Symbol:
+        e.addHeader(TypeSymbol, name)
+        e.addString(string(v))
+    case MongoTimestamp:
+        e.addHeader(TypeTimestamp, name)
+        e.addUint64(uint64(v))
+    case DBPointer:
+        if !v.Id.Valid() {
+            return errors.New(fmt.Sprintf("bson: invalid ObjectId %q for %q", string(v.Id), name))
+        }
+        e.addHeader(TypeDBPointer, name)
+        e.addString(v.Namespace)
+        e.out = append(e.out, v.Id...)
+    case orderKey:
+        if v == MinKey {
+            e.addHeader(TypeMinKey, name)
+        } else if v == MaxKey {
+            e.addHeader(TypeMaxKey, name)
+        } else {
+            return errors.New(fmt.Sprintf("bson: invalid order key for %q", name))
+        }
+    case undefined:
+        e.addHeader(TypeUndefined, name)
+    case M:
+        return e.addSubDoc(name, v, v == nil)
+    case map[string]interface{}:
+        return e.addSubDoc(name, v, v == nil)
+    case D:
+        return e.addSubDoc(name, v, v == nil)
+    case Raw:
+        e.addHeader(TypeObject, name)
+        return e.addDoc(v)
+    default:
+        return e.addReflect(name, reflect.ValueOf(v))
+    }
+    return nil
+}
+
+// addReflect encodes the values that are not of a known type, as named
+// types like `type Status int`, by their kind.
+func (e *encoder) addReflect(name string, v reflect.Value) error {
+    switch v.Kind() {
+    case reflect.Int8, reflect.Int16, reflect.Int32:
+        e.addInt32(name, int32(v.Int()))
+    case reflect.Int:
+        e.addInt64(name, v.Int())
+    case reflect.Int64:
+        e.addHeader(TypeLong, name)
+        e.addUint64(uint64(v.Int()))
+    case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+        e.addInt64(name, int64(v.Uint()))
+    case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+        return e.addUint(name, v.Uint())
+    case reflect.Float32, reflect.Float64:
+        e.addDouble(name, v.Float())
+    case reflect.String:
+        e.addHeader(TypeString, name)
+        e.addString(v.String())
+    case reflect.Bool:
+        return e.addElem(name, v.Bool())
+    case reflect.Ptr, reflect.Interface:
+        if v.IsNil() {
+            e.addHeader(TypeNull, name)
+            return nil
+        }
+        return e.addElem(name, v.Elem().Interface())
+    case reflect.Map:
+        return e.addSubDoc(name, v.Interface(), v.IsNil())
+    case reflect.Struct:
+        e.addHeader(TypeObject, name)
+        return e.addDoc(v.Interface())
+    case reflect.Array, reflect.Slice:
+        e.addHeader(TypeArray, name)
+        start := len(e.out)
+        e.out = append(e.out, 0, 0, 0, 0)
+        for i := 0; i < v.Len(); i++ {
+            if err := e.addElem(strconv.Itoa(i), v.Index(i).Interface()); err != nil {
+                return err
+            }
+        }
+        e.out = append(e.out, 0)
+        binary.LittleEndian.PutUint32(e.out[start:], uint32(len(e.out)-start))
+    default:
+        return errors.New(fmt.Sprintf("bson: cannot encode %s for %q", v.Type(), name))
+    }
+    return nil
+}
+
+// addSubDoc encodes doc as a sub document, or as null when it is nil.
+func (e *encoder) addSubDoc(name string, doc interface{}, isNil bool) error {
+    if isNil {
+        e.addHeader(TypeNull, name)
+        return nil
+    }
+    e.addHeader(TypeObject, name)
+    return e.addDoc(doc)
+}
+
+func (e *encoder) addHeader(t Type, name string) {
+    e.out = append(e.out, byte(t))
+    e.addCString(name)
+}
+
+// addCString appends s up to its first NUL byte, as the C driver which
+// takes the strlen of its strings.
+func (e *encoder) addCString(s string) {
+    e.out = append(e.out, cstring(s)...)
+    e.out = append(e.out, 0)
+}
+
+func (e *encoder) addString(s string) {
+    s = cstring(s)
+    e.addUint32(uint32(len(s) + 1))
+    e.addCString(s)
+}
+
+// cstring returns s up to its first NUL byte.
+func cstring(s string) string {
+    if i := strings.IndexByte(s, 0); i >= 0 {
+        return s[:i]
+    }
+    return s
+}
+
+func (e *encoder) addUint32(v uint32) {
+    e.out = append(e.out, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) addUint64(v uint64) {
+    e.addUint32(uint32(v))
+    e.addUint32(uint32(v >> 32))
+}
+
+func (e *encoder) addInt32(name string, v int32) {
+    e.addHeader(TypeInt, name)
+    e.addUint32(uint32(v))
+}
+
+// addInt64 encodes v as a BSON int when it fits in 32 bits, and as a BSON
+// long otherwise.
+func (e *encoder) addInt64(name string, v int64) {
+    if v >= math.MinInt32 && v <= math.MaxInt32 {
+        e.addInt32(name, int32(v))
+        return
+    }
+    e.addHeader(TypeLong, name)
+    e.addUint64(uint64(v))
+}
+
+func (e *encoder) addUint(name string, v uint64) error {
+    if v > math.MaxInt64 {
+        return errors.New(fmt.Sprintf("bson: %d for %q overflows an int64", v, name))
+    }
+    e.addInt64(name, int64(v))
+    return nil
+}
+
+func (e *encoder) addDouble(name string, v float64) {
+    e.addHeader(TypeDouble, name)
+    e.addUint64(math.Float64bits(v))
+}
+
+func (e *encoder) addBinary(name string, kind byte, data []byte) {
+    e.addHeader(TypeBinary, name)
+    if kind == BinaryOld {
+        e.addUint32(uint32(len(data) + 4))
+        e.out = append(e.out, kind)
+        e.addUint32(uint32(len(data)))
+    } else {
+        e.addUint32(uint32(len(data)))
+        e.out = append(e.out, kind)
+    }
+    e.out = append(e.out, data...)
+}
+
+// isZero reports whether v holds the zero value of its type, for the
+// omitempty option.
+func isZero(v reflect.Value) bool {
+    switch v.Kind() {
+    case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+        return v.Len() == 0
+    case reflect.Ptr, reflect.Interface:
+        return v.IsNil()
+    case reflect.Struct:
+        if t, ok := v.Interface().(time.Time); ok {
+            return t.IsZero()
+        }
+    }
+    return v.IsZero()
+}
@@ -0,0 +1,173 @@
+package bson
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "reflect"
+    "sync"
+)
+
+// Getter is implemented by types that choose the value they are stored as.
+// GetBSON is called by the encoder before it looks at the type of the
+// value, and the returned value is encoded in place of the original one. It
+// must not return a value of its own type.
+//
+//     type Money struct{ Cents int64 }
+//
+//     func (m Money) GetBSON() (interface{}, error) {
+//         return m.Cents, nil
+//     }
+type Getter interface {
+    GetBSON() (interface{}, error)
+}
+
+// Setter is implemented by types that decode themselves, and must be
+// implemented on a pointer receiver. SetBSON is called with the original
+// bytes of the element, as the only element of a document, under an empty
+// key. It is not called for null values, which leave the zero value.
+//
+//     func (m *Money) SetBSON(raw bson.Raw) error {
+//         return raw.Lookup("").Unmarshal(&m.Cents)
+//     }
+//
+// A Setter given as the result of Unmarshal receives the whole document in
+// the same way, under an empty key.
+type Setter interface {
+    SetBSON(raw Raw) error
+}
+
+var (
+    typeOfGetter = reflect.TypeOf((*Getter)(nil)).Elem()
+    typeOfSetter = reflect.TypeOf((*Setter)(nil)).Elem()
+)
+
+type typeHooks struct {
+    get func(v interface{}) (interface{}, error)
+    set func(raw Raw, result interface{}) error
+}
+
+var (
+    typeRegistryLock sync.RWMutex
+    typeRegistry     = make(map[reflect.Type]typeHooks)
+)
+
+// RegisterType sets how the values of a type that can not implement Getter
+// and Setter, as the types of other packages, are encoded and decoded. The
+// sample argument is a value of that type, get returns the value a value of
+// the type is stored as, and set decodes raw into result, a pointer to the
+// type, raw being given as to Setter. Either of get and set may be nil.
+//
+//     bson.RegisterType(net.IP{},
+//         func(v interface{}) (interface{}, error) {
+//             return v.(net.IP).String(), nil
+//         },
+//         func(raw bson.Raw, result interface{}) error {
+//             var s string
+//             if err := raw.Lookup("").Unmarshal(&s); err != nil {
+//                 return err
+//             }
+//             *result.(*net.IP) = net.ParseIP(s)
+//             return nil
+//         })
+//
+// Types implementing Getter or Setter take precedence over the registry.
+func RegisterType(sample interface{}, get func(v interface{}) (interface{}, error), set func(raw Raw, result interface{}) error) {
+    typeRegistryLock.Lock()
+    typeRegistry[reflect.TypeOf(sample)] = typeHooks{get, set}
+    typeRegistryLock.Unlock()
+}
+
+func lookupType(t reflect.Type) (typeHooks, bool) {
+    typeRegistryLock.RLock()
+    h, ok := typeRegistry[t]
+    typeRegistryLock.RUnlock()
+    return h, ok
+}
+
+// Maximum number of Getters followed by GetBSON, as A returning a B whose
+// GetBSON returns an A would be followed forever.
+const maxGetterDepth = 32
+
+// GetBSON returns the value v is stored as when it implements Getter, on a
+// value or a pointer receiver, or when its type is registered with a get
+// function. The ok result is false for all the other values, and for nil
+// pointers, which are stored as null.
+//
+// The returned value is followed in turn when it has hooks of its own, so
+// that out has none.
+func GetBSON(v interface{}) (out interface{}, ok bool, err error) {
+    out = v
+    for depth := 0; ; depth++ {
+        next, hooked, err := getHook(out)
+        if err != nil {
+            return nil, true, err
+        }
+        if !hooked {
+            if depth == 0 {
+                return nil, false, nil
+            }
+            return out, true, nil
+        }
+        if depth == maxGetterDepth {
+            return nil, true, errors.New(fmt.Sprintf("bson: GetBSON of %T is nested more than %d times", v, maxGetterDepth))
+        }
+        out = next
+    }
+}
+
+// getHook returns the value v is stored as by its own hooks, see GetBSON.
+func getHook(v interface{}) (out interface{}, ok bool, err error) {
+    if v == nil {
+        return nil, false, nil
+    }
+    rv := reflect.ValueOf(v)
+    if rv.Kind() == reflect.Ptr && rv.IsNil() {
+        return nil, false, nil
+    }
+    t := rv.Type()
+    if g, isGetter := v.(Getter); isGetter {
+        out, err = g.GetBSON()
+        ok = true
+    } else if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(typeOfGetter) {
+        p := reflect.New(t)
+        p.Elem().Set(rv)
+        out, err = p.Interface().(Getter).GetBSON()
+        ok = true
+    } else if h, found := lookupType(t); found && h.get != nil {
+        out, err = h.get(v)
+        ok = true
+    }
+    // a value of the same type would be given to GetBSON again, forever
+    if ok && err == nil && out != nil && reflect.TypeOf(out) == t {
+        return nil, true, errors.New(fmt.Sprintf("bson: GetBSON of %s returns a %s", t, t))
+    }
+    return out, ok, err
+}
+
+// setHooks decodes v into out with its Setter or registered set function,
+// and reports whether out has one.
+func setHooks(out reflect.Value, v RawValue) (bool, error) {
+    if out.Kind() == reflect.Interface || !out.CanAddr() {
+        return false, nil
+    }
+    p := out.Addr()
+    if p.Type().Implements(typeOfSetter) {
+        return true, p.Interface().(Setter).SetBSON(v.element())
+    }
+    if h, found := lookupType(out.Type()); found && h.set != nil {
+        return true, h.set(v.element(), p.Interface())
+    }
+    return false, nil
+}
+
+// element returns a copy of v as the only element of a document, under an
+// empty key.
+func (v RawValue) element() Raw {
+    size := 4 + 2 + len(v.Data) + 1
+    r := make(Raw, 4, size)
+    binary.LittleEndian.PutUint32(r, uint32(size))
+    r = append(r, byte(v.Type), 0)
+    r = append(r, v.Data...)
+    return append(r, 0)
+}
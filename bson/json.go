@@ -0,0 +1,423 @@
+package bson
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// MarshalExtJSON encodes doc, as accepted by Marshal, into MongoDB Extended
+// JSON v2. The canonical format keeps every BSON type, while the relaxed
+// format writes numbers and dates in their natural JSON form when this can
+// be done without loss.
+//
+// More information: https://github.com/mongodb/specifications/blob/master/source/extended-json.rst
+func MarshalExtJSON(doc interface{}, canonical bool) ([]byte, error) {
+    data, err := Marshal(doc)
+    if err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    if err := writeJSONDocument(&buf, Raw(data), false, canonical); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// UnmarshalExtJSON decodes the Extended JSON document in data into result,
+// as Unmarshal does. Both the canonical and the relaxed formats are
+// accepted.
+func UnmarshalExtJSON(data []byte, result interface{}) error {
+    d, err := parseExtJSON(data)
+    if err != nil {
+        return err
+    }
+    raw, err := Marshal(d)
+    if err != nil {
+        return err
+    }
+    return Unmarshal(raw, result)
+}
+
+// MarshalJSON encodes the document in relaxed Extended JSON.
+func (r Raw) MarshalJSON() ([]byte, error) {
+    var buf bytes.Buffer
+    if err := writeJSONDocument(&buf, r, false, false); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// UnmarshalJSON sets r to the document encoded in Extended JSON by data.
+func (r *Raw) UnmarshalJSON(data []byte) error {
+    return UnmarshalExtJSON(data, r)
+}
+
+func writeJSONDocument(buf *bytes.Buffer, r Raw, array, canonical bool) error {
+    elems, err := r.elements(false)
+    if err != nil {
+        return err
+    }
+    if array {
+        buf.WriteByte('[')
+    } else {
+        buf.WriteByte('{')
+    }
+    for i, el := range elems {
+        if i > 0 {
+            buf.WriteByte(',')
+        }
+        if !array {
+            writeJSONString(buf, el.Key)
+            buf.WriteByte(':')
+        }
+        if err := writeJSONValue(buf, el.Value, canonical); err != nil {
+            return errors.New(fmt.Sprintf("bson: element %q: %s", el.Key, err))
+        }
+    }
+    if array {
+        buf.WriteByte(']')
+    } else {
+        buf.WriteByte('}')
+    }
+    return nil
+}
+
+func writeJSONValue(buf *bytes.Buffer, v RawValue, canonical bool) error {
+    if v.Type == TypeObject || v.Type == TypeArray {
+        return writeJSONDocument(buf, Raw(v.Data), v.Type == TypeArray, canonical)
+    }
+    val, err := v.decode()
+    if err != nil {
+        return err
+    }
+    switch val := val.(type) {
+    case nil:
+        buf.WriteString("null")
+    case string:
+        writeJSONString(buf, val)
+    case bool:
+        buf.WriteString(strconv.FormatBool(val))
+    case float64:
+        s := formatDouble(val)
+        if canonical || math.IsInf(val, 0) || math.IsNaN(val) {
+            fmt.Fprintf(buf, `{"$numberDouble":"%s"}`, s)
+        } else {
+            buf.WriteString(s)
+        }
+    case int:
+        if canonical {
+            fmt.Fprintf(buf, `{"$numberInt":"%d"}`, val)
+        } else {
+            buf.WriteString(strconv.Itoa(val))
+        }
+    case int64:
+        if canonical {
+            fmt.Fprintf(buf, `{"$numberLong":"%d"}`, val)
+        } else {
+            buf.WriteString(strconv.FormatInt(val, 10))
+        }
+    case ObjectId:
+        fmt.Fprintf(buf, `{"$oid":"%s"}`, val.Hex())
+    case time.Time:
+        millis := int64(binary.LittleEndian.Uint64(v.Data))
+        if !canonical && val.Year() >= 1970 && val.Year() <= 9999 {
+            fmt.Fprintf(buf, `{"$date":"%s"}`, val.UTC().Format("2006-01-02T15:04:05.999Z07:00"))
+        } else {
+            fmt.Fprintf(buf, `{"$date":{"$numberLong":"%d"}}`, millis)
+        }
+    case []byte:
+        writeJSONBinary(buf, BinaryGeneric, val)
+    case Binary:
+        writeJSONBinary(buf, val.Kind, val.Data)
+    case RegEx:
+        buf.WriteString(`{"$regularExpression":{"pattern":`)
+        writeJSONString(buf, val.Pattern)
+        buf.WriteString(`,"options":`)
+        writeJSONString(buf, val.Options)
+        buf.WriteString(`}}`)
+    case DBPointer:
+        buf.WriteString(`{"$dbPointer":{"$ref":`)
+        writeJSONString(buf, val.Namespace)
+        fmt.Fprintf(buf, `,"$id":{"$oid":"%s"}}}`, val.Id.Hex())
+    case JavaScript:
+        buf.WriteString(`{"$code":`)
+        writeJSONString(buf, val.Code)
+        if v.Type == TypeCodeWScope {
+            n := int(int32(binary.LittleEndian.Uint32(v.Data[4:])))
+            buf.WriteString(`,"$scope":`)
+            if err := writeJSONDocument(buf, Raw(v.Data[8+n:]), false, canonical); err != nil {
+                return err
+            }
+        }
+        buf.WriteByte('}')
+    case Symbol:
+        buf.WriteString(`{"$symbol":`)
+        writeJSONString(buf, string(val))
+        buf.WriteByte('}')
+    case MongoTimestamp:
+        fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, uint32(val>>32), uint32(val))
+    case orderKey:
+        if val == MinKey {
+            buf.WriteString(`{"$minKey":1}`)
+        } else {
+            buf.WriteString(`{"$maxKey":1}`)
+        }
+    case undefined:
+        buf.WriteString(`{"$undefined":true}`)
+    default:
+        return errors.New(fmt.Sprintf("cannot write %T as JSON", val))
+    }
+    return nil
+}
+
+func writeJSONBinary(buf *bytes.Buffer, kind byte, data []byte) {
+    fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"%02x"}}`, base64.StdEncoding.EncodeToString(data), kind)
+}
+
+// formatDouble formats f as required by $numberDouble, keeping a decimal
+// point on integral values.
+func formatDouble(f float64) string {
+    switch {
+    case math.IsInf(f, 1):
+        return "Infinity"
+    case math.IsInf(f, -1):
+        return "-Infinity"
+    case math.IsNaN(f):
+        return "NaN"
+    }
+    s := strconv.FormatFloat(f, 'G', -1, 64)
+    if !strings.ContainsAny(s, ".E") {
+        s += ".0"
+    }
+    return s
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+    const hexDigits = "0123456789abcdef"
+    buf.WriteByte('"')
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        switch {
+        case c == '"' || c == '\\':
+            buf.WriteByte('\\')
+            buf.WriteByte(c)
+        case c == '\n':
+            buf.WriteString(`\n`)
+        case c == '\r':
+            buf.WriteString(`\r`)
+        case c == '\t':
+            buf.WriteString(`\t`)
+        case c < 0x20:
+            buf.WriteString(`\u00`)
+            buf.WriteByte(hexDigits[c>>4])
+            buf.WriteByte(hexDigits[c&0xF])
+        default:
+            buf.WriteByte(c)
+        }
+    }
+    buf.WriteByte('"')
+}
+
+// parseExtJSON parses an Extended JSON document into a D.
+func parseExtJSON(data []byte) (D, error) {
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.UseNumber()
+    v, err := parseJSONValue(dec)
+    if err != nil {
+        return nil, errors.New("bson: invalid extended JSON: " + err.Error())
+    }
+    d, ok := v.(D)
+    if !ok {
+        return nil, errors.New(fmt.Sprintf("bson: extended JSON is not a document but a %T", v))
+    }
+    return d, nil
+}
+
+func parseJSONValue(dec *json.Decoder) (interface{}, error) {
+    tok, err := dec.Token()
+    if err != nil {
+        return nil, err
+    }
+    switch t := tok.(type) {
+    case json.Delim:
+        if t == '[' {
+            arr := []interface{}{}
+            for dec.More() {
+                v, err := parseJSONValue(dec)
+                if err != nil {
+                    return nil, err
+                }
+                arr = append(arr, v)
+            }
+            _, err := dec.Token()
+            return arr, err
+        }
+        d := D{}
+        for dec.More() {
+            key, err := dec.Token()
+            if err != nil {
+                return nil, err
+            }
+            v, err := parseJSONValue(dec)
+            if err != nil {
+                return nil, err
+            }
+            d = append(d, DocElem{key.(string), v})
+        }
+        if _, err := dec.Token(); err != nil {
+            return nil, err
+        }
+        return fromExtJSON(d)
+    case json.Number:
+        return parseJSONNumber(t)
+    }
+    return tok, nil
+}
+
+// parseJSONNumber returns a plain JSON number as an int when it fits in 32
+// bits, an int64 when it fits in 64 bits, and a float64 otherwise.
+func parseJSONNumber(n json.Number) (interface{}, error) {
+    s := string(n)
+    if !strings.ContainsAny(s, ".eE") {
+        if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+            if i >= math.MinInt32 && i <= math.MaxInt32 {
+                return int(i), nil
+            }
+            return i, nil
+        }
+    }
+    return strconv.ParseFloat(s, 64)
+}
+
+// fromExtJSON returns the BSON value represented by the type wrapper d, as
+// {"$oid": "..."}, or d itself when it is a plain document.
+func fromExtJSON(d D) (interface{}, error) {
+    if len(d) == 0 || !strings.HasPrefix(d[0].Name, "$") {
+        return d, nil
+    }
+    key, val := d[0].Name, d[0].Value
+    if key == "$code" && len(d) == 2 && d[1].Name == "$scope" {
+        code, ok := val.(string)
+        scope, ok2 := d[1].Value.(D)
+        if !ok || !ok2 {
+            return nil, errors.New("invalid $code with $scope")
+        }
+        return JavaScript{Code: code, Scope: scope}, nil
+    }
+    if len(d) != 1 {
+        return d, nil
+    }
+    str, isString := val.(string)
+    sub, isDoc := val.(D)
+    switch key {
+    case "$oid":
+        if isString && IsObjectIdHex(str) {
+            return ObjectIdHex(str), nil
+        }
+    case "$symbol":
+        if isString {
+            return Symbol(str), nil
+        }
+    case "$numberInt":
+        if isString {
+            i, err := strconv.ParseInt(str, 10, 32)
+            return int(i), err
+        }
+    case "$numberLong":
+        if isString {
+            return strconv.ParseInt(str, 10, 64)
+        }
+    case "$numberDouble":
+        if isString {
+            switch str {
+            case "Infinity":
+                return math.Inf(1), nil
+            case "-Infinity":
+                return math.Inf(-1), nil
+            case "NaN":
+                return math.NaN(), nil
+            }
+            return strconv.ParseFloat(str, 64)
+        }
+    case "$binary":
+        m := sub.Map()
+        b64, ok := m["base64"].(string)
+        st, ok2 := m["subType"].(string)
+        if isDoc && ok && ok2 && len(sub) == 2 {
+            data, err := base64.StdEncoding.DecodeString(b64)
+            if err != nil {
+                return nil, err
+            }
+            kind, err := hex.DecodeString(fmt.Sprintf("%02s", st))
+            if err != nil || len(kind) != 1 {
+                return nil, errors.New("invalid $binary subType " + st)
+            }
+            if kind[0] == BinaryGeneric {
+                return data, nil
+            }
+            return Binary{Kind: kind[0], Data: data}, nil
+        }
+    case "$code":
+        if isString {
+            return JavaScript{Code: str}, nil
+        }
+    case "$timestamp":
+        m := sub.Map()
+        t, ok := toInt64(m["t"])
+        i, ok2 := toInt64(m["i"])
+        if isDoc && ok && ok2 && len(sub) == 2 {
+            return NewMongoTimestamp(uint32(t), uint32(i)), nil
+        }
+    case "$regularExpression":
+        m := sub.Map()
+        pattern, ok := m["pattern"].(string)
+        options, ok2 := m["options"].(string)
+        if isDoc && ok && ok2 && len(sub) == 2 {
+            return RegEx{Pattern: pattern, Options: options}, nil
+        }
+    case "$dbPointer":
+        m := sub.Map()
+        ns, ok := m["$ref"].(string)
+        id, ok2 := m["$id"].(ObjectId)
+        if isDoc && ok && ok2 && len(sub) == 2 {
+            return DBPointer{Namespace: ns, Id: id}, nil
+        }
+    case "$date":
+        if isString {
+            t, err := time.Parse(time.RFC3339Nano, str)
+            return t, err
+        }
+        if millis, ok := toInt64(val); ok {
+            return time.Unix(millis/1e3, millis%1e3*1e6), nil
+        }
+    case "$minKey":
+        return MinKey, nil
+    case "$maxKey":
+        return MaxKey, nil
+    case "$undefined":
+        return Undefined, nil
+    default:
+        // a document with a $ key, as a query operator
+        return d, nil
+    }
+    return nil, errors.New(fmt.Sprintf("invalid %s value", key))
+}
+
+func toInt64(v interface{}) (int64, bool) {
+    switch v := v.(type) {
+    case int:
+        return int64(v), true
+    case int64:
+        return v, true
+    }
+    return 0, false
+}
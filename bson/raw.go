@@ -0,0 +1,210 @@
+package bson
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+)
+
+// Raw is a BSON document held in Go memory. Its elements are only decoded
+// when asked for.
+//
+// A Raw is accepted wherever a M is, and is encoded as is, without being
+// decoded and encoded again.
+type Raw []byte
+
+// RawElement is an element of a Raw document.
+type RawElement struct {
+    Key   string
+    Value RawValue
+}
+
+// RawValue is the undecoded value of an element, Data holding the bytes that
+// follow the key in the document.
+type RawValue struct {
+    Type Type
+    Data []byte
+}
+
+// Validate checks that r is a well formed document, including its sub
+// documents and arrays.
+func (r Raw) Validate() error {
+    _, err := r.elements(true)
+    return err
+}
+
+// Elements returns the elements of the document, in order. Their values are
+// not decoded.
+func (r Raw) Elements() ([]RawElement, error) {
+    return r.elements(false)
+}
+
+// Lookup returns the value found by following path through the sub
+// documents and arrays of r, as in r.Lookup("address", "city"). The Type
+// of the value is TypeEOO when there is no such element.
+func (r Raw) Lookup(path ...string) RawValue {
+    doc := r
+    for i, key := range path {
+        elems, err := doc.elements(false)
+        if err != nil {
+            return RawValue{}
+        }
+        var found *RawValue
+        for j := range elems {
+            if elems[j].Key == key {
+                found = &elems[j].Value
+                break
+            }
+        }
+        if found == nil {
+            return RawValue{}
+        }
+        if i == len(path)-1 {
+            return *found
+        }
+        if found.Type != TypeObject && found.Type != TypeArray {
+            return RawValue{}
+        }
+        doc = Raw(found.Data)
+    }
+    return RawValue{}
+}
+
+// Unmarshal decodes the document into result, see the Unmarshal function.
+func (r Raw) Unmarshal(result interface{}) error {
+    return Unmarshal(r, result)
+}
+
+// Document returns the value as a Raw document, or nil if it is neither a
+// sub document nor an array.
+func (v RawValue) Document() Raw {
+    if v.Type != TypeObject && v.Type != TypeArray {
+        return nil
+    }
+    return Raw(v.Data)
+}
+
+// Unmarshal decodes the value into result, which must be a pointer.
+func (v RawValue) Unmarshal(result interface{}) error {
+    if v.Type == TypeEOO {
+        return errNotFound
+    }
+    return setResult(result, v)
+}
+
+func (r Raw) elements(deep bool) ([]RawElement, error) {
+    if len(r) < 5 {
+        return nil, errors.New("bson: document too short")
+    }
+    if int(int32(binary.LittleEndian.Uint32(r))) != len(r) {
+        return nil, errors.New("bson: document length does not match its data")
+    }
+    if r[len(r)-1] != 0 {
+        return nil, errors.New("bson: document is not terminated")
+    }
+    elems := []RawElement{}
+    data := r[4 : len(r)-1]
+    for len(data) > 0 {
+        t := Type(data[0])
+        end := bytes.IndexByte(data[1:], 0)
+        if end < 0 {
+            return nil, errors.New("bson: unterminated key")
+        }
+        key := string(data[1 : 1+end])
+        data = data[2+end:]
+        n, err := valueSize(t, data)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("bson: element %q: %s", key, err))
+        }
+        val := RawValue{Type: t, Data: data[:n]}
+        if deep {
+            if err := val.validate(); err != nil {
+                return nil, errors.New(fmt.Sprintf("bson: element %q: %s", key, err))
+            }
+        }
+        elems = append(elems, RawElement{Key: key, Value: val})
+        data = data[n:]
+    }
+    return elems, nil
+}
+
+// validate checks the content of the value, its size being already known.
+func (v RawValue) validate() error {
+    switch v.Type {
+    case TypeObject, TypeArray:
+        return Raw(v.Data).Validate()
+    case TypeString, TypeCode, TypeSymbol:
+        if v.Data[len(v.Data)-1] != 0 {
+            return errors.New("unterminated string")
+        }
+    case TypeBool:
+        if v.Data[0] > 1 {
+            return errors.New("invalid boolean")
+        }
+    case TypeCodeWScope:
+        if len(v.Data) < 14 {
+            return errors.New("invalid code")
+        }
+        n := int(int32(binary.LittleEndian.Uint32(v.Data[4:])))
+        if n < 1 || 8+n > len(v.Data) || v.Data[7+n] != 0 {
+            return errors.New("invalid code")
+        }
+        return Raw(v.Data[8+n:]).Validate()
+    }
+    return nil
+}
+
+// valueSize returns the size of the value of type t at the start of data.
+func valueSize(t Type, data []byte) (int, error) {
+    n := 0
+    switch t {
+    case TypeUndefined, TypeNull, TypeMinKey, TypeMaxKey:
+        n = 0
+    case TypeBool:
+        n = 1
+    case TypeInt:
+        n = 4
+    case TypeDouble, TypeDate, TypeTimestamp, TypeLong:
+        n = 8
+    case TypeOID:
+        n = 12
+    case TypeString, TypeCode, TypeSymbol, TypeBinary, TypeDBPointer:
+        if len(data) < 4 {
+            return 0, errors.New("truncated value")
+        }
+        l := int(int32(binary.LittleEndian.Uint32(data)))
+        if l < 0 || (t != TypeBinary && l < 1) {
+            return 0, errors.New("invalid length")
+        }
+        n = 4 + l
+        if t == TypeBinary {
+            n++
+        }
+        if t == TypeDBPointer {
+            n += 12
+        }
+    case TypeObject, TypeArray, TypeCodeWScope:
+        if len(data) < 4 {
+            return 0, errors.New("truncated value")
+        }
+        n = int(int32(binary.LittleEndian.Uint32(data)))
+        if n < 5 {
+            return 0, errors.New("invalid length")
+        }
+    case TypeRegex:
+        for i := 0; i < 2; i++ {
+            end := bytes.IndexByte(data[n:], 0)
+            if end < 0 {
+                return 0, errors.New("unterminated regex")
+            }
+            n += end + 1
+        }
+    default:
+        return 0, errors.New(fmt.Sprintf("unknown type 0x%02x", byte(t)))
+    }
+    if n > len(data) {
+        return 0, errors.New("truncated value")
+    }
+    return n, nil
+}
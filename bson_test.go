@@ -2,8 +2,12 @@ package libgomongo
 
 import (
     // "fmt"
+    "encoding/json"
+    "github.com/QLeelulu/libgomongo/bson"
     "github.com/couchbaselabs/go.assert"
+    "strings"
     "testing"
+    "time"
 )
 
 type NewStruct struct {
@@ -174,3 +178,507 @@ func TestBsonAppendArray(t *testing.T) {
     b.Print()
     b.Destroy()
 }
+
+func TestObjectId(t *testing.T) {
+    id := NewObjectId()
+    assert.Equals(t, id.Valid(), true)
+    assert.Equals(t, len(id.Hex()), 24)
+    assert.Equals(t, IsObjectIdHex(id.Hex()), true)
+    assert.Equals(t, ObjectIdHex(id.Hex()), id)
+    assert.Equals(t, IsObjectIdHex("4d88e15b60f486e428412dc"), false)
+
+    b := NewBson()
+    b.Init()
+    assert.Equals(t, b.AppendOid("_id", id), BSON_OK)
+    assert.Equals(t, b.AppendOid("bad", ObjectId("short")), BSON_ERROR)
+    b.Finish()
+    b.Destroy()
+}
+
+func TestBsonIteratorTypes(t *testing.T) {
+    now := time.Unix(1372000000, 123e6)
+    hash := []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+
+    scope := NewBsonFromM(M{"x": 1})
+    b := NewBson()
+    b.Init()
+    assert.Equals(t, b.AppendBinary("hash", 0, hash, uint(len(hash))), BSON_OK)
+    assert.Equals(t, b.AppendBinary("uuid", 4, hash[:4], 4), BSON_OK)
+    assert.Equals(t, b.AppendRegex("re", "^joe", "i"), BSON_OK)
+    assert.Equals(t, b.AppendCode("code", "function() { return 1; }"), BSON_OK)
+    assert.Equals(t, b.AppendCodeWScope("scoped", "function() { return x; }", scope), BSON_OK)
+    assert.Equals(t, b.AppendDate("date", now), BSON_OK)
+    assert.Equals(t, b.AppendTimestamp("ts", 1372000000, 7), BSON_OK)
+    b.Finish()
+    defer b.Destroy()
+    scope.Destroy()
+
+    it := NewBsonIterator()
+    assert.Equals(t, it.Find(b, "hash"), BSON_BINDATA)
+    subtype, data := it.Binary()
+    assert.Equals(t, subtype, byte(0))
+    assert.DeepEquals(t, data, hash)
+
+    assert.Equals(t, it.Find(b, "uuid"), BSON_BINDATA)
+    subtype, data = it.Binary()
+    assert.Equals(t, subtype, byte(4))
+    assert.DeepEquals(t, data, hash[:4])
+
+    assert.Equals(t, it.Find(b, "re"), BSON_REGEX)
+    pattern, opts := it.Regex()
+    assert.Equals(t, pattern, "^joe")
+    assert.Equals(t, opts, "i")
+
+    assert.Equals(t, it.Find(b, "code"), BSON_CODE)
+    assert.Equals(t, it.Code(), "function() { return 1; }")
+
+    assert.Equals(t, it.Find(b, "scoped"), BSON_CODEWSCOPE)
+    code, sc := it.CodeWithScope()
+    assert.Equals(t, code, "function() { return x; }")
+    assert.DeepEquals(t, sc.Map(), M{"x": 1})
+    sc.Destroy()
+
+    assert.Equals(t, it.Find(b, "date"), BSON_DATE)
+    assert.Equals(t, it.Date().Equal(now), true)
+
+    assert.Equals(t, it.Find(b, "ts"), BSON_TIMESTAMP)
+    assert.Equals(t, it.TimestampTime(), 1372000000)
+    assert.Equals(t, it.TimestampTimeIncrement(), 7)
+
+    m := b.Map()
+    assert.DeepEquals(t, m["hash"], hash)
+    assert.DeepEquals(t, m["uuid"], Binary{Kind: 4, Data: hash[:4]})
+    assert.Equals(t, m["re"], RegEx{Pattern: "^joe", Options: "i"})
+    assert.Equals(t, m["code"], JavaScript{Code: "function() { return 1; }"})
+    assert.DeepEquals(t, m["scoped"], JavaScript{Code: "function() { return x; }", Scope: M{"x": 1}})
+}
+
+func TestBsonFromMapTypes(t *testing.T) {
+    now := time.Unix(1372000000, 123e6)
+    in := M{
+        "hash": []byte("md5"),
+        "uuid": Binary{Kind: 4, Data: []byte("0123456789abcdef")},
+        "re":   RegEx{Pattern: "^joe", Options: "i"},
+        "code": JavaScript{Code: "function() { return x; }", Scope: M{"x": 1}},
+        "date": now,
+    }
+    b := NewBsonFromM(in)
+    defer b.Destroy()
+
+    out := b.Map()
+    assert.DeepEquals(t, out["hash"], in["hash"])
+    assert.DeepEquals(t, out["uuid"], in["uuid"])
+    assert.Equals(t, out["re"], in["re"])
+    assert.DeepEquals(t, out["code"], in["code"])
+    assert.Equals(t, out["date"].(time.Time).Equal(now), true)
+}
+
+type testStatus int
+type testRatio float32
+type testName string
+
+func TestBsonFromMapNumbers(t *testing.T) {
+    b := NewBson()
+    b.Init()
+    st := b.FromMap(M{
+        "int":     42,
+        "bigint":  1 << 40,
+        "int8":    int8(-8),
+        "int16":   int16(-16),
+        "int32":   int32(-32),
+        "uint8":   uint8(8),
+        "uint16":  uint16(16),
+        "uint32":  uint32(1 << 31),
+        "uint":    uint(64),
+        "uint64":  uint64(1 << 62),
+        "float32": float32(0.5),
+        "status":  testStatus(3),
+        "ratio":   testRatio(0.25),
+        "name":    testName("libgomongo"),
+    })
+    assert.Equals(t, st, BSON_OK)
+    b.Finish()
+    defer b.Destroy()
+
+    types := map[string]BsonType{
+        "int": BSON_INT, "bigint": BSON_LONG, "int8": BSON_INT, "int16": BSON_INT,
+        "int32": BSON_INT, "uint8": BSON_INT, "uint16": BSON_INT, "uint32": BSON_LONG,
+        "uint": BSON_INT, "uint64": BSON_LONG, "float32": BSON_DOUBLE,
+        "status": BSON_INT, "ratio": BSON_DOUBLE, "name": BSON_STRING,
+    }
+    it := NewBsonIterator()
+    for key, typ := range types {
+        assert.Equals(t, it.Find(b, key), typ)
+    }
+
+    m := b.Map()
+    assert.Equals(t, m["bigint"], int64(1<<40))
+    assert.Equals(t, m["int8"], -8)
+    assert.Equals(t, m["uint32"], int64(1<<31))
+    assert.Equals(t, m["uint64"], int64(1<<62))
+    assert.Equals(t, m["float32"], 0.5)
+    assert.Equals(t, m["status"], 3)
+    assert.Equals(t, m["name"], "libgomongo")
+
+    var out struct {
+        Status testStatus
+        Ratio  testRatio
+        Uint64 uint64
+    }
+    assert.Equals(t, b.Unmarshal(&out), nil)
+    assert.Equals(t, out.Status, testStatus(3))
+    assert.Equals(t, out.Ratio, testRatio(0.25))
+    assert.Equals(t, out.Uint64, uint64(1<<62))
+}
+
+func TestBsonFromMapOverflow(t *testing.T) {
+    b := NewBson()
+    b.Init()
+    assert.Equals(t, b.FromMap(M{"big": uint64(1 << 63)}), BSON_ERROR)
+    b.Destroy()
+
+    // the sub documents are closed, and the bson is not valid
+    b = NewBson()
+    b.Init()
+    assert.Equals(t, b.FromD(D{{Name: "a", Value: D{{Name: "l", Value: []interface{}{1, uint64(1 << 63)}}}}}), BSON_ERROR)
+    assert.Equals(t, b.Finish(), BSON_ERROR)
+    assert.NotEquals(t, b.Err()&BSON_NOT_ENCODED, 0)
+    assert.NotEquals(t, b.Validate(), nil)
+    b.Destroy()
+
+    assert.Equals(t, NewBsonFromM(M{"m": M{"big": uint64(1 << 63)}}), (*Bson)(nil))
+    assert.Equals(t, NewBsonFromM(M{"keys": map[int]string{1: "a"}}), (*Bson)(nil))
+}
+
+func TestBsonD(t *testing.T) {
+    d := D{{Name: "z", Value: 1}, {Name: "a", Value: "x"}, {Name: "m", Value: D{{Name: "b", Value: true}, {Name: "a", Value: 2}}}}
+    b := NewBsonFromDoc(d)
+    defer b.Destroy()
+
+    it := NewBsonIterator()
+    it.Init(b)
+    keys := []string{}
+    for it.Next() != BSON_EOO {
+        keys = append(keys, it.Key())
+    }
+    assert.DeepEquals(t, keys, []string{"z", "a", "m"})
+
+    assert.DeepEquals(t, b.D(), d)
+    var out D
+    assert.Equals(t, b.Unmarshal(&out), nil)
+    assert.DeepEquals(t, out, d)
+    assert.DeepEquals(t, b.Map(), M{"z": 1, "a": "x", "m": M{"b": true, "a": 2}})
+
+    var doc interface{}
+    assert.Equals(t, b.Unmarshal(&doc), nil)
+    assert.DeepEquals(t, doc, b.Map())
+
+    assert.Equals(t, NewBsonFromDoc(42), (*Bson)(nil))
+}
+
+func TestRaw(t *testing.T) {
+    b := NewBsonFromDoc(D{{Name: "name", Value: "libgomongo"}, {Name: "tags", Value: []string{"go", "c"}}, {Name: "m", Value: D{{Name: "b", Value: true}, {Name: "n", Value: 7}}}})
+    raw := b.Raw()
+    b.Destroy()
+
+    assert.Equals(t, raw.Validate(), nil)
+    elems, err := raw.Elements()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, len(elems), 3)
+    assert.Equals(t, elems[0].Key, "name")
+    assert.Equals(t, elems[2].Value.Type, BSON_OBJECT)
+
+    var n int
+    assert.Equals(t, raw.Lookup("m", "n").Unmarshal(&n), nil)
+    assert.Equals(t, n, 7)
+    var tag string
+    assert.Equals(t, raw.Lookup("tags", "1").Unmarshal(&tag), nil)
+    assert.Equals(t, tag, "c")
+    assert.Equals(t, raw.Lookup("m", "missing").Type, BSON_EOO)
+    assert.Equals(t, raw.Lookup("name", "x").Type, BSON_EOO)
+
+    var doc struct {
+        Name string
+        M    Raw
+    }
+    assert.Equals(t, raw.Unmarshal(&doc), nil)
+    assert.Equals(t, doc.Name, "libgomongo")
+    assert.DeepEquals(t, doc.M, raw.Lookup("m").Document())
+
+    // appended as is, as a sub document and as a whole document
+    outer := NewBsonFromM(M{"doc": raw})
+    it := NewBsonIterator()
+    assert.Equals(t, it.Find(outer, "doc"), BSON_OBJECT)
+    sub := NewBson()
+    it.SubObjectInit(sub, true)
+    assert.DeepEquals(t, sub.Raw(), raw)
+    sub.Destroy()
+    outer.Destroy()
+
+    whole := NewBsonFromDoc(raw)
+    assert.DeepEquals(t, whole.Raw(), raw)
+    whole.Destroy()
+
+    bad := append(Raw(nil), raw...)
+    bad[len(bad)-1] = 1
+    assert.NotEquals(t, bad.Validate(), nil)
+    assert.Equals(t, NewBsonFromRaw(bad[:4]), (*Bson)(nil))
+}
+
+func TestBsonGoEncoder(t *testing.T) {
+    scope := D{{Name: "x", Value: 1}}
+    point := 7
+    sub, err := bson.Marshal(D{{Name: "r", Value: "raw"}})
+    assert.Equals(t, err, nil)
+    doc := D{
+        {Name: "double", Value: 1.5},
+        {Name: "string", Value: "libgomongo"},
+        {Name: "doc", Value: D{{Name: "b", Value: true}, {Name: "a", Value: uint16(2)}}},
+        {Name: "array", Value: []interface{}{"x", int8(1), int64(1 << 40)}},
+        {Name: "bin", Value: []byte{0, 1, 2}},
+        {Name: "old", Value: Binary{Kind: 2, Data: []byte("old")}},
+        {Name: "oid", Value: NewObjectId()},
+        {Name: "date", Value: time.Unix(1372000000, 123e6)},
+        {Name: "null", Value: nil},
+        {Name: "re", Value: RegEx{Pattern: "^joe", Options: "i"}},
+        {Name: "code", Value: JavaScript{Code: "function() {}"}},
+        {Name: "scoped", Value: JavaScript{Code: "x", Scope: scope.Map()}},
+        {Name: "symbol", Value: Symbol("sym")},
+        {Name: "int", Value: 1 << 20},
+        {Name: "ts", Value: bson.NewMongoTimestamp(1372000000, 7)},
+        {Name: "long", Value: uint64(1 << 40)},
+        {Name: "status", Value: testStatus(3)},
+        {Name: "min", Value: bson.MinKey},
+        {Name: "max", Value: bson.MaxKey},
+        {Name: "undefined", Value: bson.Undefined},
+        {Name: "nilM", Value: M(nil)},
+        {Name: "nilD", Value: D(nil)},
+        {Name: "nilMap", Value: map[string]interface{}(nil)},
+        {Name: "nilNamedMap", Value: map[string]int(nil)},
+        {Name: "point", Value: struct{ X, Y int }{1, 2}},
+        {Name: "ptr", Value: &point},
+        {Name: "nilPtr", Value: (*int)(nil)},
+        {Name: "nul", Value: "lib\x00gomongo"},
+        {Name: "k\x00ey", Value: 1},
+        {Name: "dbptr", Value: DBPointer{Namespace: "db.people", Id: ObjectIdHex("4d88e15b60f486e428412dc9")}},
+        {Name: "raw", Value: Raw(sub)},
+        {Name: "cents", Value: testCents(12)},
+        {Name: "ratio", Value: testRatio(0.5)},
+        {Name: "name", Value: testName("joe")},
+    }
+    b := NewBson()
+    b.Init()
+    assert.Equals(t, b.FromD(doc), BSON_OK)
+    b.Finish()
+    defer b.Destroy()
+
+    data, err := bson.Marshal(doc)
+    assert.Equals(t, err, nil)
+    assert.DeepEquals(t, Raw(data), b.Raw())
+
+    g := NewBsonFromDoc(doc)
+    defer g.Destroy()
+    assert.DeepEquals(t, g.Raw(), b.Raw())
+
+    var m M
+    assert.Equals(t, g.Raw().Unmarshal(&m), nil)
+    assert.Equals(t, m["nilM"], nil)
+    assert.Equals(t, m["ptr"], 7)
+    assert.Equals(t, m["point"].(M)["y"], 2)
+    assert.Equals(t, m["nul"], "lib")
+    assert.Equals(t, m["k"], 1)
+    assert.Equals(t, m["dbptr"].(DBPointer).Namespace, "db.people")
+    assert.Equals(t, m["raw"].(M)["r"], "raw")
+    assert.Equals(t, m["cents"], int64(1200))
+}
+
+func TestBsonExtJSON(t *testing.T) {
+    b := NewBsonFromDoc(D{{Name: "_id", Value: ObjectIdHex("4d88e15b60f486e428412dc9")}, {Name: "n", Value: int64(5)}})
+    defer b.Destroy()
+
+    data, err := b.MarshalExtJSON(true)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, string(data), `{"_id":{"$oid":"4d88e15b60f486e428412dc9"},"n":{"$numberLong":"5"}}`)
+    data, err = json.Marshal(M{"doc": b})
+    assert.Equals(t, err, nil)
+    assert.Equals(t, string(data), `{"doc":{"_id":{"$oid":"4d88e15b60f486e428412dc9"},"n":5}}`)
+
+    c := NewBson()
+    assert.Equals(t, c.UnmarshalExtJSON([]byte(`{"_id":{"$oid":"4d88e15b60f486e428412dc9"},"n":{"$numberLong":"5"}}`)), nil)
+    defer c.Destroy()
+    assert.DeepEquals(t, c.Raw(), b.Raw())
+    // the document held by c is replaced
+    assert.Equals(t, c.UnmarshalExtJSON([]byte(`{"n":1}`)), nil)
+    var n int
+    assert.Equals(t, c.Raw().Lookup("n").Unmarshal(&n), nil)
+    assert.Equals(t, n, 1)
+    assert.NotEquals(t, NewBson().UnmarshalExtJSON([]byte(`{"n":{"$numberLong":"x"}}`)), nil)
+}
+
+type testCents int
+
+func (c testCents) GetBSON() (interface{}, error) {
+    return int64(c) * 100, nil
+}
+
+func (c *testCents) SetBSON(raw Raw) error {
+    var n int64
+    err := raw.Lookup("").Unmarshal(&n)
+    *c = testCents(n / 100)
+    return err
+}
+
+func TestBsonHooks(t *testing.T) {
+    b := NewBsonFromM(M{"price": testCents(12)})
+    defer b.Destroy()
+    it := NewBsonIterator()
+    assert.Equals(t, it.Find(b, "price"), BSON_LONG)
+    assert.Equals(t, it.Long(), int64(1200))
+
+    var doc struct {
+        Price testCents
+    }
+    assert.Equals(t, b.Unmarshal(&doc), nil)
+    assert.Equals(t, doc.Price, testCents(12))
+}
+
+func TestBsonValidate(t *testing.T) {
+    b := NewBsonFromDoc(D{{Name: "name", Value: "Joe"}, {Name: "address", Value: M{"city": "Guangzhou"}}})
+    assert.Equals(t, b.Validate(), nil)
+    b.Destroy()
+
+    b = NewBsonFromDoc(M{"address": M{"zip.code": 510000}})
+    err := b.Validate()
+    assert.NotEquals(t, err, nil)
+    assert.Equals(t, strings.Contains(err.Error(), `"address.zip.code"`), true)
+    b.Destroy()
+
+    b = NewBsonFromDoc(M{"tags": []interface{}{M{"$bad": 1}}})
+    err = b.Validate()
+    assert.NotEquals(t, err, nil)
+    assert.Equals(t, strings.Contains(err.Error(), `"tags.0.$bad"`), true)
+    b.Destroy()
+
+    b = NewBsonFromDoc(M{"name": "\xff"})
+    assert.NotEquals(t, b.Validate(), nil)
+    b.Destroy()
+
+    b = NewBsonFromDoc(M{"blob": make([]byte, MONGO_DEFAULT_MAX_BSON_SIZE)})
+    assert.NotEquals(t, b.Validate(), nil)
+    b.Destroy()
+
+    b = NewBson()
+    b.Init()
+    b.AppendString("name", "Joe")
+    assert.Equals(t, b.IsFinished(), false)
+    assert.NotEquals(t, b.Validate(), nil)
+    b.Finish()
+    assert.Equals(t, b.Validate(), nil)
+    b.Destroy()
+}
+
+func TestBsonDocument(t *testing.T) {
+    b := NewBsonFromDoc(D{
+        {Name: "name", Value: "Joe"},
+        {Name: "address", Value: D{{Name: "city", Value: "Guangzhou"}, {Name: "zip", Value: 510000}}},
+        {Name: "items", Value: []interface{}{M{"price": 1.5}, M{"price": 2.5}}},
+    })
+    defer b.Destroy()
+
+    assert.DeepEquals(t, b.Keys(), []string{"name", "address", "items"})
+    assert.Equals(t, b.Size(), len(b.Raw()))
+    v, ok := b.Get("address.city")
+    assert.Equals(t, ok, true)
+    assert.Equals(t, v, "Guangzhou")
+    v, ok = b.Get("items.1.price")
+    assert.Equals(t, ok, true)
+    assert.Equals(t, v, 2.5)
+    v, ok = b.Get("address")
+    assert.DeepEquals(t, v, M{"city": "Guangzhou", "zip": 510000})
+    _, ok = b.Get("items.2.price")
+    assert.Equals(t, ok, false)
+    _, ok = b.Get("name.first")
+    assert.Equals(t, ok, false)
+
+    c := b.Copy()
+    assert.NotEquals(t, c, (*Bson)(nil))
+    defer c.Destroy()
+    assert.DeepEquals(t, c.Raw(), b.Raw())
+
+    // the order of the keys does not matter, the types of the values do
+    same := NewBsonFromDoc(D{
+        {Name: "items", Value: []interface{}{M{"price": 1.5}, M{"price": 2.5}}},
+        {Name: "address", Value: D{{Name: "zip", Value: 510000}, {Name: "city", Value: "Guangzhou"}}},
+        {Name: "name", Value: "Joe"},
+    })
+    defer same.Destroy()
+    assert.Equals(t, b.Equal(same), true)
+    other := NewBsonFromDoc(D{
+        {Name: "name", Value: "Joe"},
+        {Name: "address", Value: D{{Name: "city", Value: "Guangzhou"}, {Name: "zip", Value: int64(510000)}}},
+        {Name: "items", Value: []interface{}{M{"price": 2.5}, M{"price": 1.5}}},
+    })
+    defer other.Destroy()
+    assert.Equals(t, b.Equal(other), false)
+
+    patch := NewBsonFromDoc(D{{Name: "address", Value: "redacted"}, {Name: "age", Value: 33}})
+    defer patch.Destroy()
+    merged := b.Merge(patch)
+    defer merged.Destroy()
+    assert.DeepEquals(t, merged.Keys(), []string{"name", "address", "items", "age"})
+    v, _ = merged.Get("address")
+    assert.Equals(t, v, "redacted")
+    assert.Equals(t, merged.Validate(), nil)
+}
+
+var benchDoc = D{
+    {Name: "_id", Value: ObjectIdHex("4d88e15b60f486e428412dc9")},
+    {Name: "name", Value: "libgomongo"},
+    {Name: "age", Value: 33},
+    {Name: "score", Value: 1.5},
+    {Name: "tags", Value: []interface{}{"go", "c", "mongo"}},
+    {Name: "address", Value: M{"city": "Guangzhou", "zip": 510000}},
+}
+
+// BenchmarkEncodeCgo builds the document with a cgo call per element.
+func BenchmarkEncodeCgo(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        doc := NewBson()
+        doc.Init()
+        doc.FromD(benchDoc)
+        doc.Finish()
+        doc.Destroy()
+    }
+}
+
+// BenchmarkEncodeGo encodes the document in Go and hands it to C at once.
+func BenchmarkEncodeGo(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        NewBsonFromDoc(benchDoc).Destroy()
+    }
+}
+
+// BenchmarkDecodeCgo walks the document with the C iterator.
+func BenchmarkDecodeCgo(b *testing.B) {
+    doc := NewBsonFromDoc(benchDoc)
+    defer doc.Destroy()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        it := NewBsonIterator()
+        it.Init(doc)
+        for it.Next() != BSON_EOO {
+            it.Key()
+            it.Type()
+        }
+    }
+}
+
+// BenchmarkDecodeGo copies the document once and decodes it in Go.
+func BenchmarkDecodeGo(b *testing.B) {
+    doc := NewBsonFromDoc(benchDoc)
+    defer doc.Destroy()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        doc.Map()
+    }
+}
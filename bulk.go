@@ -0,0 +1,332 @@
+package libgomongo
+
+import (
+    "errors"
+    "strconv"
+    "strings"
+)
+
+// Maximum number of documents of a batch of inserts, as the maxWriteBatchSize
+// of the servers.
+const maxBulkBatch = 1000
+
+// Size of the OP_INSERT message around its documents, without the namespace:
+// the message header and the flags.
+const insertHeaderSize = 16 + 4
+
+// Bulk queues write operations on a collection, which are sent by Run with
+// as few round trips as the wire protocol allows: the consecutive inserts
+// are sent in batches below the maximum document size of the server, and
+// the updates and removes one by one, each followed by a getlasterror.
+//
+// A Bulk is ordered by default, and Run stops at the first error. The
+// operations of an unordered Bulk are all run, whatever their errors.
+type Bulk struct {
+    c       *Collection
+    ops     []bulkOp
+    ordered bool
+    err     error // of the arguments given to the builder methods
+}
+
+type bulkOpKind int
+
+const (
+    bulkInsert bulkOpKind = iota
+    bulkUpdate
+    bulkRemove
+)
+
+type bulkOp struct {
+    kind   bulkOpKind
+    doc    interface{} // document to insert, or selector
+    update interface{}
+    flags  int // of the update or remove
+}
+
+// BulkResult holds the outcome of the operations of a Bulk.
+type BulkResult struct {
+    // Inserted is the number of documents inserted. It is a lower bound
+    // when a batch of inserts failed: the documents of the batch are not
+    // counted, as the server does not tell how many of them were inserted.
+    Inserted int
+    Matched  int // documents matched by the updates and the upserts
+    Upserted int // documents inserted by the upserts
+    Removed  int
+}
+
+// BulkErrorCase is the error of an operation of a Bulk.
+type BulkErrorCase struct {
+    // Index is the position of the operation in the Bulk, counting each
+    // document given to Insert, each pair given to Update, UpdateAll and
+    // Upsert, and each selector given to Remove and RemoveAll.
+    Index int
+    // Count is the number of operations from Index on which the error
+    // covers. It is 1 but for a batch of inserts, whose failed document is
+    // not reported by the server, and of which some documents may have been
+    // inserted.
+    Count int
+    Err   error
+}
+
+// BulkError is the error returned by Bulk.Run when operations failed.
+type BulkError struct {
+    ecases []BulkErrorCase
+}
+
+func (e *BulkError) Error() string {
+    if len(e.ecases) == 1 {
+        return e.ecases[0].Err.Error()
+    }
+    msgs := make([]string, len(e.ecases))
+    for i, ecase := range e.ecases {
+        msgs[i] = ecase.Err.Error()
+    }
+    return "MongoDB: " + strconv.Itoa(len(e.ecases)) + " bulk operations failed: " + strings.Join(msgs, "; ")
+}
+
+// Cases returns the errors of the failed operations, in the order they were
+// run.
+func (e *BulkError) Cases() []BulkErrorCase {
+    return e.ecases
+}
+
+// Bulk returns an empty ordered Bulk on the collection.
+func (c *Collection) Bulk() *Bulk {
+    return &Bulk{c: c, ordered: true}
+}
+
+// Unordered makes Run send every operation, rather than stop at the first
+// error.
+func (b *Bulk) Unordered() {
+    b.ordered = false
+}
+
+// Insert queues the insert of docs.
+func (b *Bulk) Insert(docs ...interface{}) {
+    for _, doc := range docs {
+        b.ops = append(b.ops, bulkOp{kind: bulkInsert, doc: doc})
+    }
+}
+
+// Update queues the update of the first document matched by each of the
+// selector and update pairs.
+func (b *Bulk) Update(pairs ...interface{}) {
+    b.updates("Update", pairs, 0)
+}
+
+// UpdateAll queues the update of every document matched by each of the
+// selector and update pairs.
+func (b *Bulk) UpdateAll(pairs ...interface{}) {
+    b.updates("UpdateAll", pairs, MONGO_UPDATE_MULTI)
+}
+
+// Upsert queues the update of the first document matched by each of the
+// selector and update pairs, inserting the document when none matches.
+func (b *Bulk) Upsert(pairs ...interface{}) {
+    b.updates("Upsert", pairs, MONGO_UPDATE_UPSERT)
+}
+
+func (b *Bulk) updates(method string, pairs []interface{}, flags int) {
+    if len(pairs)%2 != 0 {
+        if b.err == nil {
+            b.err = errors.New("MongoDB: Bulk." + method + " needs selector and update pairs")
+        }
+        return
+    }
+    for i := 0; i < len(pairs); i += 2 {
+        b.ops = append(b.ops, bulkOp{kind: bulkUpdate, doc: pairs[i], update: pairs[i+1], flags: flags})
+    }
+}
+
+// Remove queues the removal of the first document matched by each of the
+// selectors.
+func (b *Bulk) Remove(selectors ...interface{}) {
+    for _, selector := range selectors {
+        b.ops = append(b.ops, bulkOp{kind: bulkRemove, doc: selector, flags: MONGO_DELETE_SINGLE})
+    }
+}
+
+// RemoveAll queues the removal of every document matched by each of the
+// selectors.
+func (b *Bulk) RemoveAll(selectors ...interface{}) {
+    for _, selector := range selectors {
+        b.ops = append(b.ops, bulkOp{kind: bulkRemove, doc: selector})
+    }
+}
+
+// Run sends the queued operations with the default write concern of the
+// connection, and returns a *BulkError holding the errors of the failed
+// operations. When the write concern does not acknowledge the writes, no
+// error of the server is reported and the returned BulkResult is nil.
+func (b *Bulk) Run() (*BulkResult, error) {
+    if b.err != nil {
+        return nil, b.err
+    }
+    run := &bulkRun{Bulk: b, conn: b.c.Db.Conn, result: &BulkResult{}}
+    run.writeConcern = run.conn.WriteConcern()
+    run.acknowledged = run.writeConcern != nil && run.writeConcern.GetW() >= 1
+    if run.acknowledged {
+        // the updates and removes are acknowledged by a getlasterror of
+        // their own, for their number of documents
+        run.unacknowledged = NewMongoWriteConcern()
+        run.unacknowledged.Init()
+        run.unacknowledged.SetW(0)
+        run.unacknowledged.Finish()
+        defer run.unacknowledged.Destroy()
+    }
+
+    for i := 0; i < len(b.ops) && (!b.ordered || len(run.ecases) == 0); {
+        if b.ops[i].kind == bulkInsert {
+            i = run.inserts(i)
+        } else {
+            if err := run.write(b.ops[i]); err != nil {
+                run.ecases = append(run.ecases, BulkErrorCase{Index: i, Count: 1, Err: err})
+            }
+            i++
+        }
+    }
+
+    result := run.result
+    if !run.acknowledged {
+        result = nil
+    }
+    if len(run.ecases) > 0 {
+        return result, &BulkError{ecases: run.ecases}
+    }
+    return result, nil
+}
+
+// bulkRun is the state of a Bulk.Run.
+type bulkRun struct {
+    *Bulk
+    conn           *Mongo
+    writeConcern   *MongoWriteConcern
+    acknowledged   bool
+    unacknowledged *MongoWriteConcern // given to the updates, when acknowledged
+    result         *BulkResult
+    ecases         []BulkErrorCase
+}
+
+// inserts sends the inserts from b.ops[start] on, up to the next operation
+// of another kind or to the first error of an ordered Bulk, and returns the
+// index of the next operation.
+func (run *bulkRun) inserts(start int) int {
+    // room left for the documents by the header and the namespace
+    maxSize := run.conn.MaxBsonSize() - insertHeaderSize - len(run.c.Namespace) - 1
+    var batch []*Bson
+    first, size := start, 0
+    // flush sends the batch, and reports whether it was inserted
+    flush := func() bool {
+        if len(batch) == 0 {
+            return true
+        }
+        err := run.insertBatch(batch)
+        for _, doc := range batch {
+            doc.Destroy()
+        }
+        if err != nil {
+            run.ecases = append(run.ecases, BulkErrorCase{Index: first, Count: len(batch), Err: err})
+        } else {
+            run.result.Inserted += len(batch)
+        }
+        batch, size = nil, 0
+        return err == nil
+    }
+
+    i := start
+    for ; i < len(run.ops) && run.ops[i].kind == bulkInsert; i++ {
+        doc, err := docBson(run.ops[i].doc)
+        if err == nil {
+            if err = run.conn.ValidateBson(doc, true); err != nil {
+                doc.Destroy()
+            }
+        }
+        if err != nil {
+            if !flush() && run.ordered {
+                return i
+            }
+            run.ecases = append(run.ecases, BulkErrorCase{Index: i, Count: 1, Err: err})
+            if run.ordered {
+                return i
+            }
+            continue
+        }
+        if len(batch) == maxBulkBatch || len(batch) > 0 && size+doc.Size() > maxSize {
+            if !flush() && run.ordered {
+                doc.Destroy()
+                return i
+            }
+        }
+        if len(batch) == 0 {
+            first = i
+        }
+        batch = append(batch, doc)
+        size += doc.Size()
+    }
+    flush()
+    return i
+}
+
+// insertBatch inserts docs with a single message.
+func (run *bulkRun) insertBatch(docs []*Bson) error {
+    flags := 0
+    if !run.ordered {
+        flags = MONGO_CONTINUE_ON_ERROR
+    }
+    return run.conn.retry(true, func() error {
+        if run.conn.InsertBatch(run.c.Namespace, docs, run.writeConcern, flags) != MONGO_OK {
+            return run.conn.Error()
+        }
+        return nil
+    })
+}
+
+// write sends an update or a remove, and reads its outcome with a
+// getlasterror when acknowledged.
+func (run *bulkRun) write(op bulkOp) error {
+    selector, err := docBson(op.doc)
+    if err != nil {
+        return err
+    }
+    defer selector.Destroy()
+    var update *Bson
+    if op.kind == bulkUpdate {
+        if update, err = docBson(op.update); err != nil {
+            return err
+        }
+        defer update.Destroy()
+    }
+
+    conn := run.conn
+    return conn.retry(true, func() error {
+        var r int
+        if op.kind == bulkUpdate {
+            writeConcern := run.unacknowledged
+            if writeConcern == nil {
+                writeConcern = run.writeConcern
+            }
+            r = conn.Update(run.c.Namespace, selector, update, op.flags, writeConcern)
+        } else {
+            r = conn.RemoveFlags(run.c.Namespace, selector, op.flags)
+        }
+        if r != MONGO_OK {
+            return conn.Error()
+        }
+        if !run.acknowledged {
+            return nil
+        }
+        res, err := run.c.Db.getLastError(run.writeConcern)
+        if err != nil {
+            return err
+        }
+        switch {
+        case op.kind == bulkRemove:
+            run.result.Removed += res.N
+        case res.Upserted != nil:
+            run.result.Upserted++
+        default:
+            run.result.Matched += res.N
+        }
+        return nil
+    })
+}
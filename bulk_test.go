@@ -0,0 +1,148 @@
+package libgomongo
+
+import (
+    "github.com/couchbaselabs/go.assert"
+    "testing"
+)
+
+func TestBulk(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+    col := conn.Db("libgomongo-test").C("bulk")
+    col.RemoveAll(nil, nil)
+
+    bulk := col.Bulk()
+    bulk.Insert(M{"_id": 1, "n": 1}, M{"_id": 2, "n": 2}, M{"_id": 3, "n": 3})
+    bulk.Update(M{"_id": 1}, M{"$set": M{"n": 10}})
+    bulk.UpdateAll(M{"_id": M{"$gte": 2}}, M{"$inc": M{"n": 1}})
+    bulk.Upsert(M{"_id": 4}, M{"$set": M{"n": 4}}, M{"_id": 1}, M{"$set": M{"up": true}})
+    bulk.Remove(M{"_id": 2})
+    bulk.RemoveAll(M{"_id": M{"$gte": 3}})
+    result, err := bulk.Run()
+    assert.Equals(t, err, nil)
+    assert.DeepEquals(t, result, &BulkResult{Inserted: 3, Matched: 4, Upserted: 1, Removed: 3})
+
+    var docs []M
+    assert.Equals(t, col.Find(nil).All(&docs), nil)
+    assert.Equals(t, len(docs), 1)
+    assert.Equals(t, docs[0]["n"], 10)
+    assert.Equals(t, docs[0]["up"], true)
+
+    // odd pairs
+    bulk = col.Bulk()
+    bulk.Update(M{"_id": 1})
+    _, err = bulk.Run()
+    assert.NotEquals(t, err, nil)
+}
+
+func TestBulkErrors(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+    col := conn.Db("libgomongo-test").C("bulk")
+
+    // an ordered bulk stops at the duplicate key
+    col.RemoveAll(nil, nil)
+    bulk := col.Bulk()
+    bulk.Insert(M{"_id": 1}, M{"_id": 1}, M{"_id": 2})
+    bulk.Remove(M{"_id": 1})
+    result, err := bulk.Run()
+    assert.NotEquals(t, err, nil)
+    cases := err.(*BulkError).Cases()
+    assert.Equals(t, len(cases), 1)
+    assert.Equals(t, cases[0].Index, 0)
+    assert.Equals(t, cases[0].Count, 3)
+    n, _ := col.Count(nil)
+    assert.Equals(t, n, int64(1))
+    // the failed batch is not counted, though its first document was
+    // inserted
+    assert.Equals(t, result.Inserted <= int(n), true)
+    assert.Equals(t, result.Removed, 0)
+
+    // an unordered one goes on
+    col.RemoveAll(nil, nil)
+    bulk = col.Bulk()
+    bulk.Unordered()
+    bulk.Insert(M{"_id": 1}, M{"_id": 1}, M{"_id": 2})
+    bulk.Update(M{"_id": 1}, M{"$bogus": 1})
+    bulk.Insert(M{"$bad": 1})
+    bulk.Remove(M{"_id": 1})
+    result, err = bulk.Run()
+    assert.NotEquals(t, err, nil)
+    cases = err.(*BulkError).Cases()
+    assert.Equals(t, len(cases), 3)
+    assert.DeepEquals(t, []int{cases[0].Index, cases[0].Count}, []int{0, 3})
+    assert.DeepEquals(t, []int{cases[1].Index, cases[1].Count}, []int{3, 1})
+    assert.DeepEquals(t, []int{cases[2].Index, cases[2].Count}, []int{4, 1})
+    assert.Equals(t, result.Removed, 1)
+    n, _ = col.Count(nil)
+    assert.Equals(t, n, int64(1))
+
+    // the failed update of an ordered bulk
+    bulk = col.Bulk()
+    bulk.Update(M{"_id": 2}, M{"$set": M{"n": 1}}, M{"_id": 2}, M{"$bogus": 1})
+    bulk.Remove(M{"_id": 2})
+    result, err = bulk.Run()
+    cases = err.(*BulkError).Cases()
+    assert.Equals(t, len(cases), 1)
+    assert.Equals(t, cases[0].Index, 1)
+    assert.Equals(t, cases[0].Count, 1)
+    assert.Equals(t, result.Matched, 1)
+    assert.Equals(t, result.Removed, 0)
+}
+
+func TestBulkBatches(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+    col := conn.Db("libgomongo-test").C("bulk")
+    col.RemoveAll(nil, nil)
+
+    monitor := &recordingMonitor{}
+    conn.SetMonitor(monitor)
+    bulk := col.Bulk()
+    for i := 0; i < 2500; i++ {
+        bulk.Insert(M{"n": i})
+    }
+    result, err := bulk.Run()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, result.Inserted, 2500)
+    var batches []int
+    for _, op := range monitor.take() {
+        if op.Event.Operation == "insert" {
+            batches = append(batches, op.Event.Documents)
+        }
+    }
+    assert.DeepEquals(t, batches, []int{1000, 1000, 500})
+
+    // documents of 1MB, batched below the maximum document size, less the
+    // header and the namespace of the message
+    col.RemoveAll(nil, nil)
+    big := make([]byte, 1024*1024)
+    doc := NewBsonFromDoc(M{"n": 10, "data": big})
+    per := (conn.MaxBsonSize() - insertHeaderSize - len(col.Namespace) - 1) / doc.Size()
+    doc.Destroy()
+    var expected []int
+    for n := 20; n > 0; n -= per {
+        if n < per {
+            expected = append(expected, n)
+        } else {
+            expected = append(expected, per)
+        }
+    }
+    bulk = col.Bulk()
+    for i := 0; i < 20; i++ {
+        bulk.Insert(M{"n": i, "data": big})
+    }
+    result, err = bulk.Run()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, result.Inserted, 20)
+    batches = nil
+    for _, op := range monitor.take() {
+        if op.Event.Operation == "insert" {
+            batches = append(batches, op.Event.Documents)
+        }
+    }
+    assert.DeepEquals(t, batches, expected)
+}
@@ -2,12 +2,15 @@ package libgomongo
 
 import (
     "errors"
+    "fmt"
 )
 
 // db
 type DB struct {
     Name string // db name
     Conn *Mongo // connection
+
+    readPref *ReadPreference
 }
 
 type Collection struct {
@@ -16,6 +19,8 @@ type Collection struct {
     Name      string
     Namespace string
     Db        *DB
+
+    readPref *ReadPreference
 }
 
 // get collection instance
@@ -28,9 +33,11 @@ func (db *DB) C(name string) *Collection {
     return c
 }
 
-func (c *Collection) Find(query M) *Query {
+// Find prepares a query on the collection. The query may be nil, a M or a D.
+func (c *Collection) Find(query interface{}) *Query {
     q := NewQuery(c.Db.Conn, c.Namespace)
     q.Spec.Query = query
+    q.Options.ReadPreference = c.readPreference()
     return &q
 }
 
@@ -42,22 +49,25 @@ func (c *Collection) Find(query M) *Query {
  * @return the number of matching documents. If the command fails,
  *     MONGO_ERROR is returned.
  */
-func (c *Collection) Count(query M) (int64, error) {
-    b := NewBson()
-    b.Init()
-    b.FromMap(query)
-    b.Finish()
+func (c *Collection) Count(query interface{}) (int64, error) {
+    var n int64
+    err := c.Db.Conn.retry(false, func() error {
+        var err error
+        n, err = c.count(query)
+        return err
+    })
+    return n, err
+}
+
+func (c *Collection) count(query interface{}) (int64, error) {
+    b, err := docBson(query)
+    if err != nil {
+        return MONGO_ERROR, err
+    }
     defer b.Destroy()
     r := c.Db.Conn.Count(c.Db.Name, c.Name, b)
     if r == MONGO_ERROR {
-        var errs string
-        err := c.Db.Conn.Error()
-        if err != nil {
-            errs = err.Error()
-        } else {
-            errs = "Unknow Error."
-        }
-        return r, errors.New("MongoDb Count error: " + errs)
+        return r, prefixError("MongoDb Count error: ", c.Db.Conn.Error())
     }
     return r, nil
 }
@@ -79,33 +89,332 @@ func (c *Collection) Count(query M) (int64, error) {
  *     field is MONGO_BSON_INVALID, check the err field
  *     on the bson struct for the reason.
  */
-func (c *Collection) Insert(data M, writeConcern *MongoWriteConcern) (int, error) {
-    b := NewBsonFromM(data)
-    r := c.Db.Conn.Insert(c.Namespace, b, writeConcern)
-    if r == MONGO_OK {
-        return r, nil
+func (c *Collection) Insert(data interface{}, writeConcern *MongoWriteConcern) (int, error) {
+    b, err := docBson(data)
+    if err != nil {
+        return MONGO_ERROR, err
+    }
+    defer b.Destroy()
+    if err := c.Db.Conn.ValidateBson(b, true); err != nil {
+        return MONGO_ERROR, err
     }
-    return r, c.Db.Conn.Error()
+    r := MONGO_OK
+    err = c.Db.Conn.retry(true, func() error {
+        if r = c.Db.Conn.Insert(c.Namespace, b, writeConcern); r != MONGO_OK {
+            return c.Db.Conn.Error()
+        }
+        return nil
+    })
+    return r, err
 }
 
 /**
- * Remove a document from a MongoDB server.
+ * Create an index on the collection, if it does not exist yet.
  *
- * The default write concern set on the conn object will be used.
+ * @param key the index key specified by (key, direction) pairs, as a M or,
+ *     for compound indexes where the order of the keys matters, as a D.
+ * @param options a bitfield of MONGO_INDEX_UNIQUE, MONGO_INDEX_DROP_DUPS,
+ *     MONGO_INDEX_BACKGROUND and MONGO_INDEX_SPARSE.
+ */
+func (c *Collection) EnsureIndex(key interface{}, options int) error {
+    b, err := docBson(key)
+    if err != nil {
+        return err
+    }
+    defer b.Destroy()
+    conn := c.Db.Conn
+    return conn.retry(false, func() error {
+        if conn.CreateIndex(c.Namespace, b, "", options, nil) != MONGO_OK {
+            err := conn.Error()
+            if errmsg := conn.LastErrStr(); errmsg != "" {
+                err = &OpError{Code: MONGO_WRITE_ERROR, ServerCode: conn.LastErrCode(), Err: errors.New(errmsg)}
+            }
+            return prefixError("MongoDB EnsureIndex error: ", err)
+        }
+        return nil
+    })
+}
+
+// docBson returns a finished bson built from doc, see NewBsonFromDoc, or
+// the error which kept doc from being encoded.
+func docBson(doc interface{}) (*Bson, error) {
+    return newBsonFromDoc(doc)
+}
+
+// ErrNotFound is returned when a single document operation matched no
+// document.
+var ErrNotFound = errors.New("MongoDB: not found")
+
+// ChangeInfo holds details about the outcome of a write operation.
+type ChangeInfo struct {
+    Updated    int         // Number of existing documents updated
+    Removed    int         // Number of documents removed
+    UpsertedId interface{} // Upserted _id field, when not explicitly provided
+}
+
+/**
+ * Remove the first document matching the selector from the collection.
  *
- * @param conn a mongo object.
- * @param ns the namespace.
- * @param cond the bson query.
- * @param custom_write_concern a write concern object that will
- *     override any write concern set on the conn object.
+ * The default write concern set on the conn object will be used, unless
+ * overridden by writeConcern. When the resulting write concern has w >= 1
+ * the outcome is read with getlasterror: ErrNotFound is returned if no
+ * document matched. Otherwise the write is not acknowledged and the
+ * returned ChangeInfo is nil.
+ *
+ * @param selector the bson query as a M or a D.
+ * @param writeConcern a write concern object, or nil.
+ */
+func (c *Collection) Remove(selector interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    info, err := c.remove(selector, MONGO_DELETE_SINGLE, writeConcern)
+    if err == nil && info != nil && info.Removed == 0 {
+        return info, ErrNotFound
+    }
+    return info, err
+}
+
+/**
+ * Remove the document with the given _id from the collection.
+ *
+ * See Remove for the meaning of writeConcern and the returned values.
+ */
+func (c *Collection) RemoveId(id interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    return c.Remove(M{"_id": id}, writeConcern)
+}
+
+/**
+ * Remove all the documents matching the selector from the collection.
+ *
+ * The default write concern set on the conn object will be used, unless
+ * overridden by writeConcern. When the resulting write concern has w >= 1
+ * the number of removed documents is read with getlasterror. Otherwise the
+ * write is not acknowledged and the returned ChangeInfo is nil.
  *
- * @return MONGO_OK or MONGO_ERROR with error stored in conn object.
+ * @param selector the bson query as a M or a D, nil removes every document.
+ * @param writeConcern a write concern object, or nil.
  */
-func (c *Collection) Remove(cond M, writeConcern *MongoWriteConcern) (int, error) {
-    b_cond := NewBsonFromM(cond)
-    r := c.Db.Conn.Remove(c.Namespace, b_cond, writeConcern)
-    if r == MONGO_OK {
-        return r, nil
+func (c *Collection) RemoveAll(selector interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    return c.remove(selector, 0, writeConcern)
+}
+
+func (c *Collection) remove(selector interface{}, flags int, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    cond, err := docBson(selector)
+    if err != nil {
+        return nil, err
+    }
+    defer cond.Destroy()
+    conn := c.Db.Conn
+    if writeConcern == nil {
+        writeConcern = conn.WriteConcern()
+    }
+    var info *ChangeInfo
+    err = conn.retry(true, func() error {
+        if conn.RemoveFlags(c.Namespace, cond, flags) != MONGO_OK {
+            return conn.Error()
+        }
+        if writeConcern == nil || writeConcern.GetW() < 1 {
+            return nil
+        }
+        n, err := c.Db.lastError(writeConcern)
+        if err != nil {
+            return err
+        }
+        info = &ChangeInfo{Removed: n}
+        return nil
+    })
+    return info, err
+}
+
+/**
+ * Update the first document matching the selector.
+ *
+ * The default write concern set on the conn object will be used, unless
+ * overridden by writeConcern. When the resulting write concern has w >= 1
+ * the outcome is read with getlasterror: ErrNotFound is returned if no
+ * document matched. Otherwise the write is not acknowledged and the
+ * returned ChangeInfo is nil.
+ *
+ * @param selector the bson query as a M or a D.
+ * @param update a document of update operators, as {"$set": ...}, or the
+ *     document replacing the matched one.
+ * @param writeConcern a write concern object, or nil.
+ */
+func (c *Collection) Update(selector, update interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    cond, err := docBson(selector)
+    if err != nil {
+        return nil, err
+    }
+    defer cond.Destroy()
+    op, err := docBson(update)
+    if err != nil {
+        return nil, err
+    }
+    defer op.Destroy()
+    conn := c.Db.Conn
+    if err := conn.ValidateBson(op, false); err != nil {
+        return nil, err
+    }
+    if writeConcern == nil {
+        writeConcern = conn.WriteConcern()
+    }
+    acknowledged := writeConcern != nil && writeConcern.GetW() >= 1
+    // the outcome is read by a getlasterror of our own, for its n
+    unacknowledged := NewMongoWriteConcern()
+    unacknowledged.Init()
+    unacknowledged.SetW(0)
+    unacknowledged.Finish()
+    defer unacknowledged.Destroy()
+
+    var info *ChangeInfo
+    err = conn.retry(true, func() error {
+        if conn.Update(c.Namespace, cond, op, 0, unacknowledged) != MONGO_OK {
+            return conn.Error()
+        }
+        if !acknowledged {
+            return nil
+        }
+        res, err := c.Db.getLastError(writeConcern)
+        if err != nil {
+            return err
+        }
+        info = &ChangeInfo{Updated: res.N}
+        return nil
+    })
+    if err == nil && info != nil && info.Updated == 0 {
+        return info, ErrNotFound
+    }
+    return info, err
+}
+
+// lastError runs getlasterror with the options of writeConcern, and returns
+// the number of documents affected by the last write on the connection.
+func (db *DB) lastError(writeConcern *MongoWriteConcern) (int, error) {
+    res, err := db.getLastError(writeConcern)
+    return res.N, err
+}
+
+// lastErrorResult is the reply of getlasterror.
+type lastErrorResult struct {
+    N               int
+    Err             string
+    Code            int
+    UpdatedExisting bool        `bson:"updatedExisting"`
+    Upserted        interface{} // _id of the document inserted by an upsert
+}
+
+// getLastError runs getlasterror with the options of writeConcern, and
+// returns its reply, with an error when the last write on the connection
+// failed.
+func (db *DB) getLastError(writeConcern *MongoWriteConcern) (lastErrorResult, error) {
+    cmd := NewBson()
+    cmd.Init()
+    cmd.AppendInt("getlasterror", 1)
+    if mode := writeConcern.GetMode(); mode != "" {
+        cmd.AppendString("w", mode)
+    } else if w := writeConcern.GetW(); w > 1 {
+        cmd.AppendInt("w", w)
+    }
+    if wtimeout := writeConcern.GetWTimeout(); wtimeout > 0 {
+        cmd.AppendInt("wtimeout", wtimeout)
+    }
+    if writeConcern.GetJ() != 0 {
+        cmd.AppendBool("j", true)
+    }
+    if writeConcern.GetFsync() != 0 {
+        cmd.AppendBool("fsync", true)
+    }
+    cmd.Finish()
+    defer cmd.Destroy()
+
+    var res lastErrorResult
+    if err := db.run(cmd, &res); err != nil {
+        return res, err
+    }
+    if res.Err != "" {
+        return res, &OpError{Code: MONGO_WRITE_ERROR, ServerCode: res.Code, Err: errors.New("MongoDB write error: " + res.Err)}
+    }
+    return res, nil
+}
+
+// Run issues the provided command on the db database and unmarshals its
+// result into result, which may be nil. The cmd argument may be a *Bson, a D,
+// a M, or a string with the command name, which is sent as {<cmd>: 1}.
+//
+// The command name must be the first key of the command document, so
+// commands with more than one key should be given as a D or a *Bson.
+//
+// As the command may write, it is only run again on errors when the retry
+// policy of the connection has RetryWrites.
+func (db *DB) Run(cmd interface{}, result interface{}) error {
+    return db.Conn.retry(true, func() error {
+        return db.run(cmd, result)
+    })
+}
+
+func (db *DB) run(cmd interface{}, result interface{}) error {
+    return db.runOptions(cmd, result, 0)
+}
+
+// runOptions runs cmd as run does, with the cursor options of a query, of
+// which MONGO_SLAVE_OK lets a secondary run the commands that read.
+func (db *DB) runOptions(cmd interface{}, result interface{}, options int) error {
+    var b *Bson
+    var err error
+    switch c := cmd.(type) {
+    case *Bson:
+        b = c
+    case string:
+        if b, err = docBson(D{{Name: c, Value: 1}}); err != nil {
+            return err
+        }
+        defer b.Destroy()
+    case D, M, map[string]interface{}:
+        if b, err = docBson(c); err != nil {
+            return err
+        }
+        defer b.Destroy()
+    default:
+        return errors.New(fmt.Sprintf("MongoDB command error: unsupported command type %T", cmd))
+    }
+
+    out := NewBson()
+    defer out.Destroy()
+    var r int
+    if options&MONGO_SLAVE_OK != 0 {
+        r = db.Conn.findOneSlaveOk(db.Name+".$cmd", b, &Bson{}, out)
+    } else {
+        r = db.Conn.FindOne(db.Name+".$cmd", b, &Bson{}, out)
+    }
+    if r != MONGO_OK {
+        return prefixError("MongoDB command error: ", db.Conn.queryError())
+    }
+
+    raw := out.Raw()
+    res := M{}
+    if err := raw.Unmarshal(&res); err != nil {
+        return err
+    }
+    if !commandOk(res) {
+        errmsg, _ := res["errmsg"].(string)
+        if errmsg == "" {
+            errmsg = "Unknow Error."
+        }
+        return &OpError{Code: MONGO_COMMAND_FAILED, ServerCode: serverCode(res), Err: errors.New("MongoDB command error: " + errmsg)}
+    }
+    if result == nil {
+        return nil
+    }
+    return raw.Unmarshal(result)
+}
+
+// commandOk reports whether the "ok" field of a command reply is set.
+func commandOk(res M) bool {
+    switch ok := res["ok"].(type) {
+    case float64:
+        return ok == 1
+    case int:
+        return ok == 1
+    case bool:
+        return ok
     }
-    return r, c.Db.Conn.Error()
+    return false
 }
@@ -19,50 +19,124 @@ func (c *Mongo) ErrNo() MongoError {
     return MongoError(c.conn.err)
 }
 
+// LastErrStr returns the message of the last error reported by the server,
+// as stored in conn->lasterrstr.
+func (c *Mongo) LastErrStr() string {
+    return C.GoString(&c.conn.lasterrstr[0])
+}
+
+// LastErrCode returns the code of the last error reported by the server,
+// as stored in conn->lasterrcode.
+func (c *Mongo) LastErrCode() int {
+    return int(c.conn.lasterrcode)
+}
+
+// Messages of the errors of the mongo_error_t type, see Mongo.Error.
+var connErrors = map[MongoError]string{
+    MONGO_CONN_NO_SOCKET:    "MongoDB: Could not create a socket.",
+    MONGO_CONN_FAIL:         "MongoDB: An error occured while calling connect(). ",
+    MONGO_CONN_ADDR_FAIL:    "MongoDB: An error occured while calling getaddrinfo().",
+    MONGO_CONN_NOT_MASTER:   "MongoDB [Warning]: connected to a non-master node (read-only).",
+    MONGO_CONN_BAD_SET_NAME: "MongoDB: Given rs name doesn't match this replica set.",
+    MONGO_CONN_NO_PRIMARY:   "MongoDB: Can't find primary in replica set. Connection closed.",
+
+    MONGO_IO_ERROR:              "MongoDB: An error occurred while reading or writing on the socket.",
+    MONGO_SOCKET_ERROR:          "MongoDB: Other socket error.",
+    MONGO_READ_SIZE_ERROR:       "MongoDB: The response is not the expected length.",
+    MONGO_COMMAND_FAILED:        "MongoDB: The command returned with 'ok' value of 0.",
+    MONGO_WRITE_ERROR:           "MongoDB: Write with given write_concern returned an error.",
+    MONGO_NS_INVALID:            "MongoDB: The name for the ns (database or collection) is invalid.",
+    MONGO_BSON_INVALID:          "MongoDB: BSON not valid for the specified op.",
+    MONGO_BSON_NOT_FINISHED:     "MongoDB: BSON object has not been finished.",
+    MONGO_BSON_TOO_LARGE:        "MongoDB: BSON object exceeds max BSON size.",
+    MONGO_WRITE_CONCERN_INVALID: "MongoDB: Supplied write concern object is invalid.",
+}
+
+// Names of the errors of the connection, as in the C driver.
+var connErrorNames = [...]string{
+    MONGO_CONN_SUCCESS:          "MONGO_CONN_SUCCESS",
+    MONGO_CONN_NO_SOCKET:        "MONGO_CONN_NO_SOCKET",
+    MONGO_CONN_FAIL:             "MONGO_CONN_FAIL",
+    MONGO_CONN_ADDR_FAIL:        "MONGO_CONN_ADDR_FAIL",
+    MONGO_CONN_NOT_MASTER:       "MONGO_CONN_NOT_MASTER",
+    MONGO_CONN_BAD_SET_NAME:     "MONGO_CONN_BAD_SET_NAME",
+    MONGO_CONN_NO_PRIMARY:       "MONGO_CONN_NO_PRIMARY",
+    MONGO_IO_ERROR:              "MONGO_IO_ERROR",
+    MONGO_SOCKET_ERROR:          "MONGO_SOCKET_ERROR",
+    MONGO_READ_SIZE_ERROR:       "MONGO_READ_SIZE_ERROR",
+    MONGO_COMMAND_FAILED:        "MONGO_COMMAND_FAILED",
+    MONGO_WRITE_ERROR:           "MONGO_WRITE_ERROR",
+    MONGO_NS_INVALID:            "MONGO_NS_INVALID",
+    MONGO_BSON_INVALID:          "MONGO_BSON_INVALID",
+    MONGO_BSON_NOT_FINISHED:     "MONGO_BSON_NOT_FINISHED",
+    MONGO_BSON_TOO_LARGE:        "MONGO_BSON_TOO_LARGE",
+    MONGO_WRITE_CONCERN_INVALID: "MONGO_WRITE_CONCERN_INVALID",
+}
+
+// String returns the name of the error, as "MONGO_IO_ERROR".
+func (status MongoError) String() string {
+    if status >= 0 && int(status) < len(connErrorNames) {
+        return connErrorNames[status]
+    }
+    return fmt.Sprintf("MongoError(%d)", int(status))
+}
+
+// Error returns the error of the connection as an *OpError, with the code
+// of the error reported by the server for the failed commands and writes,
+// or nil.
 func (c *Mongo) Error() error {
-    var err error
     status := c.ErrNo()
-    switch status {
-    case MONGO_CONN_SUCCESS:
-    case MONGO_CONN_NO_SOCKET:
-        err = errors.New("MongoDB: Could not create a socket.")
-    case MONGO_CONN_FAIL:
-        err = errors.New("MongoDB: An error occured while calling connect(). ")
-    case MONGO_CONN_ADDR_FAIL:
-        err = errors.New("MongoDB: An error occured while calling getaddrinfo().")
-    case MONGO_CONN_NOT_MASTER:
-        err = errors.New("MongoDB [Warning]: connected to a non-master node (read-only).")
-    case MONGO_CONN_BAD_SET_NAME:
-        err = errors.New("MongoDB: Given rs name doesn't match this replica set.")
-    case MONGO_CONN_NO_PRIMARY:
-        err = errors.New("MongoDB: Can't find primary in replica set. Connection closed.")
-
-    case MONGO_IO_ERROR:
-        err = errors.New("MongoDB: An error occurred while reading or writing on the socket.")
-    case MONGO_SOCKET_ERROR:
-        err = errors.New("MongoDB: Other socket error.")
-    case MONGO_READ_SIZE_ERROR:
-        err = errors.New("MongoDB: The response is not the expected length.")
-    case MONGO_COMMAND_FAILED:
-        err = errors.New("MongoDB: The command returned with 'ok' value of 0.")
-    case MONGO_WRITE_ERROR:
-        err = errors.New("MongoDB: Write with given write_concern returned an error.")
-    case MONGO_NS_INVALID:
-        err = errors.New("MongoDB: The name for the ns (database or collection) is invalid.")
-    case MONGO_BSON_INVALID:
-        err = errors.New("MongoDB: BSON not valid for the specified op.")
-    case MONGO_BSON_NOT_FINISHED:
-        err = errors.New("MongoDB: BSON object has not been finished.")
-    case MONGO_BSON_TOO_LARGE:
-        err = errors.New("MongoDB: BSON object exceeds max BSON size.")
-    case MONGO_WRITE_CONCERN_INVALID:
-        err = errors.New("MongoDB: Supplied write concern object is invalid.")
-    default:
-        err = errors.New(fmt.Sprintf("MongoDB: Unkonw error[%d]", status))
+    if status == MONGO_CONN_SUCCESS {
+        return nil
+    }
+    msg, ok := connErrors[status]
+    if !ok {
+        msg = fmt.Sprintf("MongoDB: Unkonw error[%d]", status)
+    }
+    err := &OpError{Code: status, Err: errors.New(msg)}
+    if status == MONGO_COMMAND_FAILED || status == MONGO_WRITE_ERROR {
+        err.ServerCode = c.LastErrCode()
     }
     return err
 }
 
+// queryError returns the error of a failed query: the error of the
+// connection, or the $err reply of the server, or nil.
+func (c *Mongo) queryError() error {
+    if err := c.Error(); err != nil {
+        return err
+    }
+    if msg := c.LastErrStr(); msg != "" {
+        return &OpError{Code: MONGO_COMMAND_FAILED, ServerCode: c.LastErrCode(), Err: errors.New("MongoDB: The query failed: " + msg)}
+    }
+    return nil
+}
+
+// prefixError returns err with prefix before its message, keeping the codes
+// of an *OpError for IsRetryable.
+func prefixError(prefix string, err error) error {
+    var op *OpError
+    if errors.As(err, &op) {
+        return &OpError{Code: op.Code, ServerCode: op.ServerCode, Err: errors.New(prefix + op.Err.Error())}
+    }
+    return errors.New(prefix + errString(err))
+}
+
+// serverCode returns the "code" field of a reply of the server, or 0.
+func serverCode(res M) int {
+    switch code := res["code"].(type) {
+    case int:
+        return code
+    case int32:
+        return int(code)
+    case int64:
+        return int(code)
+    case float64:
+        return int(code)
+    }
+    return 0
+}
+
 // /** Initialize sockets for Windows.
 //  */
 // MONGO_EXPORT void mongo_init_sockets( void );
@@ -144,6 +218,9 @@ func (c *Mongo) ReplicaSetInit(name string) {
 //  * @param port the port to connect to.
 //  */
 // MONGO_EXPORT void mongo_replica_set_add_seed( mongo *conn, const char *host, int port );
+func (c *Mongo) ReplicaSetAddSeed(host string, port int) {
+    C.mongo_replica_set_add_seed(c.conn, C.CString(host), C.int(port))
+}
 
 // /**
 //  * DEPRECATED - use mongo_replica_set_add_seed.
@@ -189,6 +266,9 @@ func (c *Mongo) ReplicaSetInit(name string) {
 //  *   mongo_conn_return_t will be set on the conn->err field.
 
 // MONGO_EXPORT int mongo_replica_set_client( mongo *conn );
+func (c *Mongo) ReplicaSetClient() int {
+    return int(C.mongo_replica_set_client(c.conn))
+}
 
 // /**
 //  * DEPRECATED - use mongo_replica_set_client.
@@ -204,6 +284,38 @@ func (c *Mongo) ReplicaSetInit(name string) {
 //  */
 // MONGO_EXPORT int mongo_replset_connect( mongo *conn );
 
+// /**
+//  * Get the number of hosts of the replica set, and the host at index i
+//  * as "host:port".
+//  */
+// MONGO_EXPORT int mongo_get_host_count(mongo* conn);
+// MONGO_EXPORT const char* mongo_get_host(mongo* conn, int i);
+//
+// Hosts returns the hosts of the replica set the connection is connected
+// to, as "host:port", or nil for a connection to a single server.
+func (c *Mongo) Hosts() []string {
+    if c.conn.replica_set == nil {
+        return nil
+    }
+    n := int(C.mongo_get_host_count(c.conn))
+    hosts := make([]string, 0, n)
+    for i := 0; i < n; i++ {
+        hosts = append(hosts, C.GoString(C.mongo_get_host(c.conn, C.int(i))))
+    }
+    return hosts
+}
+
+// MONGO_EXPORT const char* mongo_get_primary(mongo* conn);
+//
+// Primary returns the server, or the primary of the replica set, the
+// connection is connected to, as "host:port", or "" before connecting.
+func (c *Mongo) Primary() string {
+    if c.conn.primary == nil {
+        return ""
+    }
+    return C.GoString(C.mongo_get_primary(c.conn))
+}
+
 // /** Set a timeout for operations on this connection. This
 //  *  is a platform-specific feature, and only work on *nix
 //  *  system. You must also compile for linux to support this.
@@ -270,6 +382,8 @@ func (c *Mongo) Disconnect() {
 //  */
 // MONGO_EXPORT void mongo_destroy( mongo *conn );
 func (c *Mongo) Destroy() {
+    c.StopTopologyMonitor()
+    c.closeMembers()
     C.mongo_destroy(c.conn)
 }
 
@@ -309,6 +423,25 @@ func (c *Mongo) SetWriteConcern(mongo_write_concern *MongoWriteConcern) {
 // MONGO_EXPORT int mongo_write_concern_get_fsync( mongo_write_concern *write_concern );
 // MONGO_EXPORT const char* mongo_write_concern_get_mode( mongo_write_concern *write_concern );
 // MONGO_EXPORT bson* mongo_write_concern_get_cmd( mongo_write_concern *write_concern );
+func (wc *MongoWriteConcern) GetW() int {
+    return int(C.mongo_write_concern_get_w(wc.writeConcern))
+}
+func (wc *MongoWriteConcern) GetWTimeout() int {
+    return int(C.mongo_write_concern_get_wtimeout(wc.writeConcern))
+}
+func (wc *MongoWriteConcern) GetJ() int {
+    return int(C.mongo_write_concern_get_j(wc.writeConcern))
+}
+func (wc *MongoWriteConcern) GetFsync() int {
+    return int(C.mongo_write_concern_get_fsync(wc.writeConcern))
+}
+func (wc *MongoWriteConcern) GetMode() string {
+    mode := C.mongo_write_concern_get_mode(wc.writeConcern)
+    if mode == nil {
+        return ""
+    }
+    return C.GoString(mode)
+}
 
 // /**
 //  * The following functions set the attributes of the write_concern object.
@@ -319,3 +452,27 @@ func (c *Mongo) SetWriteConcern(mongo_write_concern *MongoWriteConcern) {
 // MONGO_EXPORT void mongo_write_concern_set_j( mongo_write_concern *write_concern, int j );
 // MONGO_EXPORT void mongo_write_concern_set_fsync( mongo_write_concern *write_concern, int fsync );
 // MONGO_EXPORT void mongo_write_concern_set_mode( mongo_write_concern *write_concern, const char* mode );
+func (wc *MongoWriteConcern) SetW(w int) {
+    C.mongo_write_concern_set_w(wc.writeConcern, C.int(w))
+}
+func (wc *MongoWriteConcern) SetWTimeout(wtimeout int) {
+    C.mongo_write_concern_set_wtimeout(wc.writeConcern, C.int(wtimeout))
+}
+func (wc *MongoWriteConcern) SetJ(j int) {
+    C.mongo_write_concern_set_j(wc.writeConcern, C.int(j))
+}
+func (wc *MongoWriteConcern) SetFsync(fsync int) {
+    C.mongo_write_concern_set_fsync(wc.writeConcern, C.int(fsync))
+}
+func (wc *MongoWriteConcern) SetMode(mode string) {
+    C.mongo_write_concern_set_mode(wc.writeConcern, C.CString(mode))
+}
+
+// The write concern used by default for writes on this connection, or nil
+// if the connection has none.
+func (c *Mongo) WriteConcern() *MongoWriteConcern {
+    if c.conn.write_concern == nil {
+        return nil
+    }
+    return &MongoWriteConcern{writeConcern: c.conn.write_concern}
+}
@@ -1,17 +1,61 @@
 package libgomongo
 
 import (
+    "errors"
     "fmt"
+    "github.com/QLeelulu/libgomongo/mongotest"
     "github.com/couchbaselabs/go.assert"
+    "net"
+    "os"
+    "strconv"
     "testing"
-    // "time"
+    "time"
 )
 
 var (
     host = "127.0.0.1"
     port = 27017
+
+    // fakeServer is the in-process server the tests run against, unless
+    // MONGO_TEST_HOST names a live mongod, as "127.0.0.1:27017".
+    fakeServer *mongotest.Server
 )
 
+func TestMain(m *testing.M) {
+    if addr := os.Getenv("MONGO_TEST_HOST"); addr != "" {
+        h, p, err := net.SplitHostPort(addr)
+        if err == nil {
+            port, err = strconv.Atoi(p)
+        }
+        if err != nil {
+            fmt.Println("invalid MONGO_TEST_HOST:", addr)
+            os.Exit(2)
+        }
+        host = h
+    } else {
+        server, err := mongotest.NewServer()
+        if err != nil {
+            fmt.Println("cannot start the test server:", err)
+            os.Exit(2)
+        }
+        fakeServer = server
+        host, port = server.Host(), server.Port()
+    }
+    code := m.Run()
+    if fakeServer != nil {
+        fakeServer.Close()
+    }
+    os.Exit(code)
+}
+
+// requireMongod skips the tests that need features of a live mongod, as
+// JavaScript.
+func requireMongod(t *testing.T) {
+    if fakeServer != nil {
+        t.Skip("needs a live mongod, set MONGO_TEST_HOST")
+    }
+}
+
 func newClient() (*Mongo, int) {
     conn := NewMongo()
     status := conn.Client(host, port)
@@ -28,3 +72,298 @@ func TestConn(t *testing.T) {
 
     assert.Equals(t, status, MONGO_OK)
 }
+
+func TestConnFaults(t *testing.T) {
+    if fakeServer == nil {
+        t.Skip("needs the mongotest server")
+    }
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    col := conn.Db("libgomongo-test").C("faults")
+    fakeServer.AddFault(mongotest.Fault{Op: "count", Err: "interrupted", Code: 11601, Times: 1})
+    _, err := col.Count(nil)
+    assert.NotEquals(t, err, nil)
+    n, err := col.Count(nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, int64(0))
+
+    fakeServer.AddFault(mongotest.Fault{Op: "count", Drop: true, Times: 1})
+    _, err = col.Count(nil)
+    assert.NotEquals(t, err, nil)
+}
+
+func TestReadPreference(t *testing.T) {
+    // three members, each holding a document naming it, as they do not
+    // replicate
+    var servers []*mongotest.Server
+    var hosts []string
+    for i := 0; i < 3; i++ {
+        s, err := mongotest.NewServer()
+        assert.Equals(t, err, nil)
+        defer s.Close()
+        servers = append(servers, s)
+        hosts = append(hosts, s.Addr())
+    }
+    for i, s := range servers {
+        dc := []string{"", "east", "west"}[i]
+        s.SetMember(mongotest.Member{SetName: "rs0", Hosts: hosts, Primary: i == 0, Tags: map[string]string{"dc": dc}})
+        conn := NewMongo()
+        assert.Equals(t, conn.Client(s.Host(), s.Port()), MONGO_OK)
+        if i == 0 {
+            conn.Db("test").C("members").Insert(M{"name": "primary"}, nil)
+        } else {
+            // secondaries refuse writes, so the document is inserted
+            // while the server is still a primary
+            s.SetMember(mongotest.Member{SetName: "rs0", Hosts: hosts, Primary: true})
+            conn.Db("test").C("members").Insert(M{"name": dc}, nil)
+            s.SetMember(mongotest.Member{SetName: "rs0", Hosts: hosts, Tags: map[string]string{"dc": dc}})
+        }
+        conn.Destroy()
+    }
+
+    conn := NewMongo()
+    conn.ReplicaSetInit("rs0")
+    conn.ReplicaSetAddSeed(servers[1].Host(), servers[1].Port())
+    assert.Equals(t, conn.ReplicaSetClient(), MONGO_OK)
+    defer conn.Destroy()
+    assert.Equals(t, len(conn.Hosts()), 3)
+
+    col := conn.Db("test").C("members")
+    name := func(q *Query) string {
+        var doc struct{ Name string }
+        if err := q.One(&doc); err != nil {
+            return err.Error()
+        }
+        return doc.Name
+    }
+    assert.Equals(t, name(col.Find(nil)), "primary")
+    west := &ReadPreference{Mode: Secondary, TagSets: []map[string]string{{"dc": "west"}}}
+    assert.Equals(t, name(col.Find(nil).ReadPreference(west)), "west")
+    n, err := col.Find(M{"name": "west"}).ReadPreference(west).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1)
+
+    col.SetReadPreference(&ReadPreference{Mode: Secondary, TagSets: []map[string]string{{"dc": "east"}}})
+    assert.Equals(t, name(col.Find(nil)), "east")
+    assert.Equals(t, name(col.Find(nil).ReadPreference(&ReadPreference{Mode: Primary})), "primary")
+
+    conn.SetReadPreference(&ReadPreference{Mode: Secondary, TagSets: []map[string]string{{"dc": "north"}}})
+    _, err = conn.Db("test").C("members").Find(nil).Cursor()
+    assert.NotEquals(t, err, nil)
+    conn.SetReadPreference(&ReadPreference{Mode: SecondaryPreferred, TagSets: []map[string]string{{"dc": "north"}}})
+    assert.Equals(t, name(conn.Db("test").C("members").Find(nil)), "primary")
+
+    // the reads from the members are seen by the monitor of the connection
+    monitor := &recordingMonitor{}
+    conn.SetMonitor(monitor)
+    assert.Equals(t, name(col.Find(nil).ReadPreference(west)), "west")
+    ops := monitor.take()
+    assert.NotEquals(t, len(ops), 0)
+    assert.Equals(t, ops[len(ops)-1].Event.Operation, "find")
+
+    // the commands reading from a secondary are sent with slaveOk
+    direct := NewMongo()
+    assert.Equals(t, direct.Client(servers[2].Host(), servers[2].Port()), MONGO_OK)
+    defer direct.Destroy()
+    direct.SetReadPreference(&ReadPreference{Mode: SecondaryPreferred})
+    n, err = direct.Db("test").C("members").Find(nil).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1)
+    var names []string
+    assert.Equals(t, direct.Db("test").C("members").Find(nil).Distinct("name", &names), nil)
+    assert.DeepEquals(t, names, []string{"west"})
+
+    // a cursor keeps reading from its member when the connections to the
+    // members are closed, as on reconnect, and closes it when destroyed
+    servers[2].SetMember(mongotest.Member{SetName: "rs0", Hosts: hosts, Primary: true})
+    for i := 0; i < 4; i++ {
+        direct.Db("test").C("members").Insert(M{"name": "west"}, nil)
+    }
+    servers[2].SetMember(mongotest.Member{SetName: "rs0", Hosts: hosts, Tags: map[string]string{"dc": "west"}})
+    cur, err := col.Find(nil).ReadPreference(west).BatchSize(2).Cursor()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, cur.Next(), MONGO_OK)
+    open := servers[2].Connections()
+    conn.closeMembers()
+    assert.Equals(t, servers[2].Connections(), open)
+    n = 1
+    for cur.Next() == MONGO_OK {
+        n++
+    }
+    assert.Equals(t, n, 5)
+    assert.Equals(t, cur.ErrNo(), MONGO_CURSOR_EXHAUSTED)
+    cur.Destroy()
+    for i := 0; i < 100 && servers[2].Connections() == open; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    assert.Equals(t, servers[2].Connections(), open-1)
+}
+
+func TestRetryPolicy(t *testing.T) {
+    if fakeServer == nil {
+        t.Skip("needs the mongotest server")
+    }
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+    defer fakeServer.ClearFaults()
+    policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5}
+    conn.SetRetryPolicy(policy)
+
+    col := conn.Db("libgomongo-test").C("retries")
+    col.RemoveAll(nil, nil)
+    fakeServer.AddFault(mongotest.Fault{Op: "count", Drop: true, Times: 2})
+    n, err := col.Count(nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, int64(0))
+
+    fakeServer.AddFault(mongotest.Fault{Op: "query", Namespace: "libgomongo-test.retries", Drop: true, Times: 3})
+    _, err = col.Find(nil).Cursor()
+    assert.NotEquals(t, err, nil)
+    fakeServer.ClearFaults()
+
+    fakeServer.AddFault(mongotest.Fault{Op: "count", Err: "not master", Code: 10107, Times: 1})
+    _, err = col.Find(nil).Count()
+    assert.Equals(t, err, nil)
+    fakeServer.AddFault(mongotest.Fault{Op: "count", Err: "exceeded time limit", Code: 50, Times: 1})
+    _, err = col.Find(nil).Count()
+    assert.NotEquals(t, err, nil)
+
+    // writes are only run again with RetryWrites
+    wc := NewMongoWriteConcern()
+    wc.Init()
+    wc.SetW(1)
+    wc.Finish()
+    defer wc.Destroy()
+    fakeServer.AddFault(mongotest.Fault{Op: "insert", Drop: true, Times: 1})
+    _, err = col.Insert(M{"name": "Ann"}, wc)
+    assert.NotEquals(t, err, nil)
+    policy.RetryWrites = true
+    fakeServer.AddFault(mongotest.Fault{Op: "insert", Drop: true, Times: 1})
+    _, err = col.Insert(M{"name": "Bob"}, wc)
+    assert.Equals(t, err, nil)
+    n, err = col.Count(nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, int64(1))
+
+    // a write failing on a stepped down primary is reported with its code
+    fakeServer.AddFault(mongotest.Fault{Op: "insert", Err: "not master", Code: 10058, Times: 1})
+    _, err = col.Insert(M{"name": "Cid"}, wc)
+    assert.Equals(t, err, nil)
+    // and so is a query
+    fakeServer.AddFault(mongotest.Fault{Op: "query", Namespace: "libgomongo-test.retries", Err: "not master and slaveOk=false", Code: 13435, Times: 1})
+    cur, err := col.Find(nil).Cursor()
+    assert.Equals(t, err, nil)
+    cur.Destroy()
+
+    assert.Equals(t, IsRetryable(conn.Error()), false)
+    assert.Equals(t, IsRetryable(&OpError{Code: MONGO_IO_ERROR, Err: errors.New(connErrors[MONGO_IO_ERROR])}), true)
+    assert.Equals(t, IsRetryable(prefixError("has error: ", &OpError{Code: MONGO_IO_ERROR, Err: errors.New("IO")})), true)
+    assert.Equals(t, IsRetryable(&OpError{Code: MONGO_WRITE_ERROR, ServerCode: 10107, Err: errors.New("MongoDB write error: not primary")}), true)
+    // the codes come before the messages, which are not looked at out of
+    // the errors of the server
+    assert.Equals(t, IsRetryable(&OpError{Code: MONGO_COMMAND_FAILED, ServerCode: 2, Err: errors.New("MongoDB command error: bad value \"not master\"")}), false)
+    assert.Equals(t, IsRetryable(&OpError{Code: MONGO_COMMAND_FAILED, Err: errors.New("MongoDB: The query failed: not master")}), true)
+    assert.Equals(t, IsRetryable(errors.New("MongoDB write error: not master")), false)
+    assert.Equals(t, IsRetryable(ErrNotFound), false)
+    assert.Equals(t, policy.backoff(1) <= time.Millisecond, true)
+    assert.Equals(t, (&RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}).backoff(4), 3*time.Second)
+}
+
+func TestTopologyMonitor(t *testing.T) {
+    var servers []*mongotest.Server
+    var hosts []string
+    for i := 0; i < 3; i++ {
+        s, err := mongotest.NewServer()
+        assert.Equals(t, err, nil)
+        defer s.Close()
+        servers = append(servers, s)
+        hosts = append(hosts, s.Addr())
+    }
+    // the third server is an arbiter, which the members only report once
+    // known is all the hosts
+    setMembers := func(primary int, known []string) {
+        for i, s := range servers {
+            s.SetMember(mongotest.Member{SetName: "rs0", Hosts: known, Primary: i == primary, Arbiter: i == 2})
+        }
+    }
+    setMembers(0, hosts[:2])
+
+    conn := NewMongo()
+    conn.ReplicaSetInit("rs0")
+    conn.ReplicaSetAddSeed(servers[0].Host(), servers[0].Port())
+    assert.Equals(t, conn.ReplicaSetClient(), MONGO_OK)
+    defer conn.Destroy()
+    assert.Equals(t, conn.Topology().Primary, "")
+
+    events, err := conn.StartTopologyMonitor(20 * time.Millisecond)
+    assert.Equals(t, err, nil)
+    _, err = conn.StartTopologyMonitor(time.Second)
+    assert.NotEquals(t, err, nil)
+    topology := conn.Topology()
+    assert.Equals(t, topology.SetName, "rs0")
+    assert.Equals(t, topology.Primary, hosts[0])
+    assert.Equals(t, len(topology.Servers), 2)
+    s, _ := topology.Server(hosts[1])
+    assert.Equals(t, s.Kind, ServerSecondary)
+    assert.Equals(t, s.Err, nil)
+    assert.Equals(t, s.RTT > 0, true)
+
+    next := func() TopologyEvent {
+        select {
+        case e := <-events:
+            return e
+        case <-time.After(2 * time.Second):
+            t.Fatal("no topology event")
+        }
+        return TopologyEvent{}
+    }
+    assert.Equals(t, next().Type, ServerChanged)
+    assert.Equals(t, next().Type, ServerChanged)
+    e := next()
+    assert.Equals(t, e.Type, PrimaryChanged)
+    assert.Equals(t, e.OldPrimary, "")
+    assert.Equals(t, e.NewPrimary, hosts[0])
+
+    setMembers(0, hosts)
+    e = next()
+    assert.Equals(t, e.Current.Addr, hosts[2])
+    assert.Equals(t, e.Previous.Kind, ServerUnknown)
+    assert.Equals(t, e.Current.Kind, ServerArbiter)
+
+    // failover, which a round of checks may see half done
+    setMembers(-1, hosts)
+    setMembers(1, hosts)
+    for e = next(); e.Type != PrimaryChanged; e = next() {
+    }
+    assert.Equals(t, e.OldPrimary, hosts[0])
+    for e.NewPrimary != hosts[1] {
+        e = next()
+    }
+    assert.Equals(t, conn.Topology().Primary, hosts[1])
+    s, _ = conn.Topology().Server(hosts[0])
+    assert.Equals(t, s.Kind, ServerSecondary)
+
+    // the arbiter is removed from the configuration of the set
+    setMembers(1, hosts[:2])
+    for e = next(); e.Type != ServerRemoved; e = next() {
+    }
+    assert.Equals(t, e.Previous.Addr, hosts[2])
+    _, ok := conn.Topology().Server(hosts[2])
+    assert.Equals(t, ok, false)
+
+    servers[1].Close()
+    for e = next(); e.Type != PrimaryChanged; e = next() {
+    }
+    assert.Equals(t, e.NewPrimary, "")
+    s, _ = conn.Topology().Server(hosts[1])
+    assert.Equals(t, s.Kind, ServerUnknown)
+    assert.NotEquals(t, s.Err, nil)
+
+    conn.StopTopologyMonitor()
+    for range events {
+    }
+    assert.Equals(t, conn.Topology().Primary, "")
+}
@@ -0,0 +1,30 @@
+package libgomongo
+
+import (
+    "github.com/QLeelulu/libgomongo/bson"
+)
+
+// Map decodes the bson document into a M. Sub documents are decoded as M
+// and arrays as []interface{}.
+func (b *Bson) Map() M {
+    m := M{}
+    b.Unmarshal(&m)
+    return m
+}
+
+// D decodes the bson document into a D, keeping the order of the elements.
+// Sub documents are decoded as D and arrays as []interface{}.
+func (b *Bson) D() D {
+    d := D{}
+    b.Unmarshal(&d)
+    return d
+}
+
+// Unmarshal decodes the bson document into result. The result argument must
+// be a pointer to a map, a D, a Raw, a struct or an interface{}.
+//
+// The data of the document is copied once and decoded in Go, see
+// bson.Unmarshal.
+func (b *Bson) Unmarshal(result interface{}) error {
+    return bson.Unmarshal(b.Raw(), result)
+}
@@ -0,0 +1,176 @@
+package libgomongo
+
+// #cgo CFLAGS: -std=gnu99 -I./mongo-c-driver/src/
+// #cgo LDFLAGS: -L./mongo-c-driver/src/ -lmongoc
+// #include "bson.h"
+import "C"
+
+import (
+    "bytes"
+    "encoding/binary"
+    "strings"
+)
+
+/**
+ * Size of a bson.
+ *
+ * @param b the bson.
+ *
+ * @return the size of the bson in bytes.
+ */
+// MONGO_EXPORT int bson_size( const bson *b );
+func (b *Bson) Size() int {
+    return int(C.bson_size(b._bson))
+}
+
+/**
+ * Make a complete copy of the a BSON object.
+ * The source bson object must be in a finished
+ * state; otherwise, the copy will fail.
+ *
+ * @return the copy, which must be destroyed, or nil on failure.
+ */
+// MONGO_EXPORT int bson_copy( bson *out, const bson *in );
+func (b *Bson) Copy() *Bson {
+    out := NewBson()
+    if C.bson_copy(out._bson, b._bson) != BSON_OK {
+        out.Destroy()
+        return nil
+    }
+    return out
+}
+
+/**
+ * Get the value at a dotted path of a finished bson, as "address.city".
+ * Array elements are reached by their index, as in "tags.0" or
+ * "items.2.price".
+ *
+ * The value is decoded as by Unmarshal, with documents as M.
+ *
+ * @return the value, and whether the path was found.
+ */
+func (b *Bson) Get(path string) (interface{}, bool) {
+    v := b.Raw().Lookup(strings.Split(path, ".")...)
+    if v.Type == BSON_EOO {
+        return nil, false
+    }
+    var result interface{}
+    if err := v.Unmarshal(&result); err != nil {
+        return nil, false
+    }
+    return result, true
+}
+
+// Keys returns the top level keys of a finished bson, in order.
+func (b *Bson) Keys() []string {
+    elems, err := b.Raw().Elements()
+    if err != nil {
+        return nil
+    }
+    keys := make([]string, len(elems))
+    for i, el := range elems {
+        keys[i] = el.Key
+    }
+    return keys
+}
+
+/**
+ * Compare two finished bsons.
+ *
+ * The documents are equal when they hold the same keys with values of the
+ * same type and content, whatever the order of the keys, at every level.
+ * The elements of arrays are compared in order. Numbers of different types,
+ * as an int and a long, are not equal.
+ */
+func (b *Bson) Equal(other *Bson) bool {
+    return rawEqual(b.Raw(), other.Raw(), false)
+}
+
+/**
+ * Merge two finished bsons into a new one.
+ *
+ * The result holds the elements of b, in order, with the values of other
+ * for the keys found in both, then the elements of other with new keys.
+ * Sub documents are not merged, they are replaced as a whole.
+ *
+ * @return the merged bson, which must be destroyed, or nil if one of the
+ *     bsons is not valid.
+ */
+func (b *Bson) Merge(other *Bson) *Bson {
+    elems, err := b.Raw().Elements()
+    if err != nil {
+        return nil
+    }
+    others, err := other.Raw().Elements()
+    if err != nil {
+        return nil
+    }
+    index := make(map[string]int, len(elems))
+    for i, el := range elems {
+        index[el.Key] = i
+    }
+    for _, el := range others {
+        if i, ok := index[el.Key]; ok {
+            elems[i] = el
+        } else {
+            index[el.Key] = len(elems)
+            elems = append(elems, el)
+        }
+    }
+    return NewBsonFromRaw(rawDocument(elems))
+}
+
+// rawDocument builds a document from elements, copying their bytes.
+func rawDocument(elems []RawElement) Raw {
+    out := make(Raw, 4, 64)
+    for _, el := range elems {
+        out = append(out, byte(el.Value.Type))
+        out = append(out, el.Key...)
+        out = append(out, 0)
+        out = append(out, el.Value.Data...)
+    }
+    out = append(out, 0)
+    binary.LittleEndian.PutUint32(out, uint32(len(out)))
+    return out
+}
+
+// rawEqual compares two documents, in order when they are arrays.
+func rawEqual(a, b Raw, array bool) bool {
+    ea, err := a.Elements()
+    if err != nil {
+        return false
+    }
+    eb, err := b.Elements()
+    if err != nil || len(ea) != len(eb) {
+        return false
+    }
+    if array {
+        for i := range ea {
+            if !rawValueEqual(ea[i].Value, eb[i].Value) {
+                return false
+            }
+        }
+        return true
+    }
+    values := make(map[string]RawValue, len(eb))
+    for _, el := range eb {
+        values[el.Key] = el.Value
+    }
+    for _, el := range ea {
+        v, ok := values[el.Key]
+        if !ok || !rawValueEqual(el.Value, v) {
+            return false
+        }
+    }
+    return true
+}
+
+func rawValueEqual(a, b RawValue) bool {
+    if a.Type != b.Type {
+        return false
+    }
+    if a.Type == BSON_OBJECT || a.Type == BSON_ARRAY {
+        return rawEqual(a.Document(), b.Document(), a.Type == BSON_ARRAY)
+    }
+    return bytes.Equal(a.Data, b.Data)
+}
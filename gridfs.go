@@ -0,0 +1,442 @@
+package libgomongo
+
+// #cgo CFLAGS: -std=gnu99 -I./mongo-c-driver/src/
+// #cgo LDFLAGS: -L./mongo-c-driver/src/ -lmongoc
+// #include <stdlib.h>
+// #include "gridfs.h"
+import "C"
+
+import (
+    "errors"
+    "io"
+    "time"
+    "unsafe"
+)
+
+// GridFS stores files in two collections of a database, <prefix>.files for
+// the file descriptors and <prefix>.chunks for their content, split in
+// chunks as described by the GridFS specification. The chunking itself is
+// done by the gridfs API of the C driver.
+//
+// More information: http://www.mongodb.org/display/DOCS/GridFS+Specification
+type GridFS struct {
+    Db     *DB
+    Prefix string
+    Files  *Collection
+    Chunks *Collection
+
+    gfs *C.gridfs
+    err error
+}
+
+// GridFile is a file stored in a GridFS. Files returned by GridFS.Create
+// are written with Write, those returned by GridFS.Open and GridFS.OpenId
+// are read with Read and Seek. Either way, they must be closed with Close.
+type GridFile struct {
+    gfs   *GridFS
+    gfile *C.gridfile
+
+    writing bool
+    started bool
+    closed  bool
+    written int64
+
+    name        string
+    contentType string
+    metadata    M
+}
+
+var (
+    _ io.WriteCloser    = (*GridFile)(nil)
+    _ io.ReadSeekCloser = (*GridFile)(nil)
+)
+
+// GridFileInfo describes a file stored in a GridFS, as listed by
+// GridFS.List.
+type GridFileInfo struct {
+    Id          ObjectId  `bson:"_id"`
+    Name        string    `bson:"filename"`
+    Length      int64     `bson:"length"`
+    ChunkSize   int       `bson:"chunkSize"`
+    UploadDate  time.Time `bson:"uploadDate"`
+    MD5         string    `bson:"md5"`
+    ContentType string    `bson:"contentType"`
+    Metadata    M         `bson:"metadata"`
+}
+
+// GridFS returns a GridFS storing its files in the collections
+// <prefix>.files and <prefix>.chunks of the database. The "fs" prefix is
+// the one used by the other drivers and tools by default.
+//
+// The GridFS must be released with Destroy when no longer used.
+func (db *DB) GridFS(prefix string) *GridFS {
+    gfs := &GridFS{
+        Db:     db,
+        Prefix: prefix,
+        Files:  db.C(prefix + ".files"),
+        Chunks: db.C(prefix + ".chunks"),
+    }
+    return gfs
+}
+
+/**
+ * Initializes a GridFS object
+ * @param client - db connection
+ * @param dbname - database name
+ * @param prefix - collection prefix, default is fs if NULL or empty
+ * @param gfs - the GridFS object to initialize
+ *
+ * @return - MONGO_OK or MONGO_ERROR.
+ */
+// MONGO_EXPORT int gridfs_init( mongo *client, const char *dbname,
+//                               const char *prefix, gridfs *gfs );
+func (gfs *GridFS) init() error {
+    if gfs.gfs != nil || gfs.err != nil {
+        return gfs.err
+    }
+    g := C.gridfs_alloc()
+    r := C.gridfs_init(gfs.Db.Conn.conn, C.CString(gfs.Db.Name), C.CString(gfs.Prefix), g)
+    if r != MONGO_OK {
+        C.gridfs_dealloc(g)
+        gfs.err = errors.New("MongoDB GridFS error: " + errString(gfs.Db.Conn.Error()))
+        return gfs.err
+    }
+    gfs.gfs = g
+    return nil
+}
+
+/**
+ * Destroys a GridFS object. Call this when finished with
+ * the object..
+ *
+ * @param gfs a grid
+ */
+// MONGO_EXPORT void gridfs_destroy( gridfs *gfs );
+func (gfs *GridFS) Destroy() {
+    if gfs.gfs != nil {
+        C.gridfs_destroy(gfs.gfs)
+        C.gridfs_dealloc(gfs.gfs)
+        gfs.gfs = nil
+    }
+}
+
+// Create returns a new file to be written in the GridFS with the given
+// name. The content type and metadata may be set before the first Write.
+// The file is stored once Close is called.
+func (gfs *GridFS) Create(name string) (*GridFile, error) {
+    if err := gfs.init(); err != nil {
+        return nil, err
+    }
+    file := &GridFile{
+        gfs:     gfs,
+        gfile:   C.gridfile_create(),
+        writing: true,
+        name:    name,
+    }
+    return file, nil
+}
+
+/**
+ *  Find the first file matching the provided query within the
+ *  GridFS files collection, and return the file as a GridFile.
+ *
+ *  @param gfs - the working GridFS
+ *  @param query - a pointer to the bson with the query data
+ *  @param gfile - the output GridFile to be initialized
+ *
+ *  @return MONGO_OK if successful, MONGO_ERROR otherwise
+ */
+// MONGO_EXPORT int gridfs_find_query( gridfs *gfs, const bson *query,
+//                                     gridfile *gfile );
+func (gfs *GridFS) find(query interface{}) (*GridFile, error) {
+    if err := gfs.init(); err != nil {
+        return nil, err
+    }
+    q, err := docBson(query)
+    if err != nil {
+        return nil, err
+    }
+    defer q.Destroy()
+    gfile := C.gridfile_create()
+    if C.gridfs_find_query(gfs.gfs, q._bson, gfile) != MONGO_OK {
+        C.gridfile_dealloc(gfile)
+        return nil, ErrNotFound
+    }
+    return &GridFile{gfs: gfs, gfile: gfile}, nil
+}
+
+// Open returns the most recently uploaded file with the given name, for
+// reading. ErrNotFound is returned if there is no such file.
+func (gfs *GridFS) Open(name string) (*GridFile, error) {
+    return gfs.find(M{"filename": name})
+}
+
+// OpenId returns the file with the given id, for reading. ErrNotFound is
+// returned if there is no such file.
+func (gfs *GridFS) OpenId(id interface{}) (*GridFile, error) {
+    return gfs.find(M{"_id": id})
+}
+
+/**
+ *  Removes the files referenced by filename from the db
+ *
+ *  @param gfs - the working GridFS
+ *  @param filename - the filename of the file/s to be removed
+ */
+// MONGO_EXPORT void gridfs_remove_filename( gridfs *gfs, const char *filename );
+func (gfs *GridFS) Remove(name string) error {
+    if err := gfs.init(); err != nil {
+        return err
+    }
+    // gridfs_remove_filename returns no status, its errors are those left
+    // on the connection
+    conn := gfs.Db.Conn
+    C.mongo_clear_errors(conn.conn)
+    C.gridfs_remove_filename(gfs.gfs, C.CString(name))
+    if err := conn.Error(); err != nil {
+        return errors.New("MongoDB GridFS error: " + err.Error())
+    }
+    return nil
+}
+
+// List returns the descriptors of the files matching query, which may be
+// nil to list all the files of the GridFS.
+func (gfs *GridFS) List(query interface{}) ([]GridFileInfo, error) {
+    cur, err := gfs.Files.Find(query).Cursor()
+    if err != nil {
+        return nil, err
+    }
+    defer cur.Destroy()
+    files := []GridFileInfo{}
+    for cur.Next() == MONGO_OK {
+        var info GridFileInfo
+        if err := cur.Current().Unmarshal(&info); err != nil {
+            return nil, err
+        }
+        files = append(files, info)
+    }
+    if cur.ErrNo() != MONGO_CURSOR_EXHAUSTED {
+        return nil, cur.Error()
+    }
+    return files, nil
+}
+
+// descriptor returns the fs.files document of a file opened for reading.
+func (file *GridFile) descriptor() M {
+    return (&Bson{_bson: file.gfile.meta}).Map()
+}
+
+// Id returns the _id of the file. For a file being written, the id is only
+// known after the first Write.
+func (file *GridFile) Id() ObjectId {
+    if file.writing {
+        if !file.started {
+            return ""
+        }
+        return ObjectId(C.GoBytes(unsafe.Pointer(&file.gfile.id), 12))
+    }
+    id, _ := file.descriptor()["_id"].(ObjectId)
+    return id
+}
+
+// Name returns the name of the file.
+func (file *GridFile) Name() string {
+    if file.writing {
+        return file.name
+    }
+    return C.GoString(C.gridfile_get_filename(file.gfile))
+}
+
+// Size returns the length of the file content, in bytes.
+func (file *GridFile) Size() int64 {
+    if file.writing {
+        return file.written
+    }
+    return int64(C.gridfile_get_contentlength(file.gfile))
+}
+
+// ContentType returns the MIME type of the file content, if known.
+func (file *GridFile) ContentType() string {
+    if file.writing {
+        return file.contentType
+    }
+    ct, _ := file.descriptor()["contentType"].(string)
+    return ct
+}
+
+// SetContentType sets the MIME type of the content of a file being
+// written. It has no effect after the first Write.
+func (file *GridFile) SetContentType(contentType string) {
+    file.contentType = contentType
+}
+
+// UploadDate returns the time the file was stored.
+func (file *GridFile) UploadDate() time.Time {
+    date, _ := file.descriptor()["uploadDate"].(time.Time)
+    return date
+}
+
+// MD5 returns the hex MD5 checksum of the file content, as computed by the
+// server.
+func (file *GridFile) MD5() string {
+    md5, _ := file.descriptor()["md5"].(string)
+    return md5
+}
+
+// Metadata returns the metadata document of the file, or nil.
+func (file *GridFile) Metadata() M {
+    if file.writing {
+        return file.metadata
+    }
+    meta, _ := file.descriptor()["metadata"].(M)
+    return meta
+}
+
+// SetMetadata sets the metadata document stored with a file being written.
+func (file *GridFile) SetMetadata(metadata M) {
+    file.metadata = metadata
+}
+
+/**
+ *  Initializes a GridFile for writing and writes a buffer of data to it.
+ *  The data is stored in chunks as soon as enough of it is pending.
+ */
+// MONGO_EXPORT void gridfile_writer_init( gridfile *gfile, gridfs *gfs, const char *remote_name,
+//                                         const char *content_type );
+// MONGO_EXPORT void gridfile_write_buffer( gridfile *gfile, const char *data,
+//                                          gridfs_offset length );
+func (file *GridFile) Write(p []byte) (int, error) {
+    if !file.writing || file.closed {
+        return 0, errors.New("MongoDB GridFS error: file is not open for writing")
+    }
+    file.start()
+    if len(p) == 0 {
+        return 0, nil
+    }
+    C.gridfile_write_buffer(file.gfile, (*C.char)(unsafe.Pointer(&p[0])), C.gridfs_offset(len(p)))
+    file.written += int64(len(p))
+    return len(p), nil
+}
+
+func (file *GridFile) start() {
+    if file.started {
+        return
+    }
+    var contentType *C.char
+    if file.contentType != "" {
+        contentType = C.CString(file.contentType)
+    }
+    C.gridfile_writer_init(file.gfile, file.gfs.gfs, C.CString(file.name), contentType)
+    file.started = true
+}
+
+/**
+ *  Reads length bytes from the GridFile to a buffer
+ *  and updates the position in the file.
+ *  (assumes the buffer is large enough)
+ *  (if size is greater than EOF gridfile_read reads until EOF)
+ *
+ *  @param gfile - the working GridFile
+ *  @param size - the amount of bytes to be read
+ *  @param buf - the buffer to read to
+ *
+ *  @return - the number of bytes read
+ */
+// MONGO_EXPORT gridfs_offset gridfile_read( gridfile *gfile, gridfs_offset size, char *buf );
+func (file *GridFile) Read(p []byte) (int, error) {
+    if file.writing || file.closed {
+        return 0, errors.New("MongoDB GridFS error: file is not open for reading")
+    }
+    if len(p) == 0 {
+        return 0, nil
+    }
+    if int64(file.gfile.pos) >= file.Size() {
+        return 0, io.EOF
+    }
+    // a failed read is told apart from a missing chunk by the errors left
+    // on the connection
+    conn := file.gfs.Db.Conn
+    C.mongo_clear_errors(conn.conn)
+    n := C.gridfile_read(file.gfile, C.gridfs_offset(len(p)), (*C.char)(unsafe.Pointer(&p[0])))
+    if n == 0 {
+        // a missing chunk, or the connection failed
+        if err := conn.Error(); err != nil {
+            return 0, errors.New("MongoDB GridFS error: " + err.Error())
+        }
+        return 0, io.ErrUnexpectedEOF
+    }
+    return int(n), nil
+}
+
+/**
+ *  Updates the position in the file
+ *  (If the offset goes beyond the contentlength,
+ *  the position is updated to the end of the file.)
+ *
+ *  @param gfile - the working GridFile
+ *  @param offset - the position to update to
+ *
+ *  @return - resulting offset location
+ */
+// MONGO_EXPORT gridfs_offset gridfile_seek( gridfile *gfile, gridfs_offset offset );
+func (file *GridFile) Seek(offset int64, whence int) (int64, error) {
+    if file.writing || file.closed {
+        return 0, errors.New("MongoDB GridFS error: file is not open for reading")
+    }
+    switch whence {
+    case io.SeekStart:
+    case io.SeekCurrent:
+        offset += int64(file.gfile.pos)
+    case io.SeekEnd:
+        offset += file.Size()
+    default:
+        return 0, errors.New("MongoDB GridFS error: invalid whence")
+    }
+    if offset < 0 {
+        return 0, errors.New("MongoDB GridFS error: negative position")
+    }
+    return int64(C.gridfile_seek(file.gfile, C.gridfs_offset(offset))), nil
+}
+
+/**
+ *  Writes the pending data of a GridFile being written and stores its
+ *  descriptor, then releases it.
+ *
+ *  The metadata, for which gridfile_writer_done has no room, is set on the
+ *  descriptor once it is stored.
+ */
+// MONGO_EXPORT int gridfile_writer_done( gridfile *gfile );
+// MONGO_EXPORT void gridfile_destroy( gridfile *gfile );
+func (file *GridFile) Close() error {
+    if file.closed {
+        return nil
+    }
+    file.closed = true
+    defer C.gridfile_dealloc(file.gfile)
+    if !file.writing {
+        C.gridfile_destroy(file.gfile)
+        return nil
+    }
+
+    file.start()
+    gfs, id := file.gfs, file.Id()
+    C.mongo_clear_errors(gfs.Db.Conn.conn)
+    if C.gridfile_writer_done(file.gfile) != MONGO_OK {
+        return errors.New("MongoDB GridFS error: " + errString(gfs.Db.Conn.Error()))
+    }
+    if file.metadata != nil {
+        _, err := gfs.Files.Update(M{"_id": id}, M{"$set": M{"metadata": file.metadata}}, nil)
+        if err != nil {
+            return errors.New("MongoDB GridFS error: " + err.Error())
+        }
+    }
+    return nil
+}
+
+// errString returns the message of err, or a generic one when err is nil.
+func errString(err error) string {
+    if err == nil {
+        return "Unknow Error."
+    }
+    return err.Error()
+}
@@ -0,0 +1,79 @@
+package libgomongo
+
+import (
+    "bytes"
+    "github.com/couchbaselabs/go.assert"
+    "io"
+    "io/ioutil"
+    "testing"
+)
+
+func TestGridFS(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    gfs := conn.Db("libgomongo-test").GridFS("fs")
+    defer gfs.Destroy()
+    gfs.Remove("upload.txt")
+
+    // larger than the default chunk size, to span several chunks
+    data := bytes.Repeat([]byte("libgomongo"), 30*1024)
+    file, err := gfs.Create("upload.txt")
+    assert.Equals(t, err, nil)
+    file.SetContentType("text/plain")
+    file.SetMetadata(M{"owner": "Joe", "size": struct{ W, H int }{640, 480}})
+    n, err := file.Write(data[:1000])
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1000)
+    _, err = file.Write(data[1000:])
+    assert.Equals(t, err, nil)
+    id := file.Id()
+    assert.Equals(t, id.Valid(), true)
+    assert.Equals(t, file.Close(), nil)
+
+    file, err = gfs.Open("upload.txt")
+    assert.Equals(t, err, nil)
+    assert.Equals(t, file.Id(), id)
+    assert.Equals(t, file.Size(), int64(len(data)))
+    assert.Equals(t, file.ContentType(), "text/plain")
+    assert.Equals(t, file.Metadata()["owner"], "Joe")
+    assert.Equals(t, file.Metadata()["size"].(M)["w"], 640)
+    content, err := ioutil.ReadAll(file)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, bytes.Equal(content, data), true)
+
+    pos, err := file.Seek(-10, io.SeekEnd)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, pos, int64(len(data)-10))
+    buf := make([]byte, 10)
+    n, err = file.Read(buf)
+    assert.Equals(t, n, 10)
+    assert.Equals(t, string(buf), "libgomongo")
+    assert.Equals(t, file.Close(), nil)
+
+    file, err = gfs.OpenId(id)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, file.Name(), "upload.txt")
+    file.Close()
+
+    files, err := gfs.List(M{"filename": "upload.txt"})
+    assert.Equals(t, err, nil)
+    assert.Equals(t, len(files), 1)
+    assert.Equals(t, files[0].Id, id)
+    assert.Equals(t, files[0].Length, int64(len(data)))
+    assert.Equals(t, files[0].ChunkSize, 256*1024)
+
+    // a file whose chunks are gone
+    file, err = gfs.Open("upload.txt")
+    assert.Equals(t, err, nil)
+    _, err = gfs.Chunks.RemoveAll(M{"files_id": id}, nil)
+    assert.Equals(t, err, nil)
+    _, err = ioutil.ReadAll(file)
+    assert.Equals(t, err, io.ErrUnexpectedEOF)
+    file.Close()
+
+    assert.Equals(t, gfs.Remove("upload.txt"), nil)
+    _, err = gfs.Open("upload.txt")
+    assert.Equals(t, err, ErrNotFound)
+}
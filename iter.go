@@ -0,0 +1,194 @@
+package libgomongo
+
+import (
+    "errors"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// How long Iter waits before re-querying when its tailable cursor died
+// without returning any data, e.g. on an empty capped collection.
+var tailRetryDelay = 100 * time.Millisecond
+
+// Iter follows a tailable cursor created with Query.Tail.
+type Iter struct {
+    m        sync.Mutex
+    query    Query
+    timeout  time.Duration
+    cursor   *Cursor
+    lastId   *Bson // {"_id": <last seen _id>}
+    err      error
+    timedout bool
+    closed   int32
+}
+
+// Tail returns a tailable iterator over the query results. Unlike a normal
+// cursor, the tailable iterator is not closed when the last result is
+// retrieved. Instead Next blocks, with the AwaitData option, until a new
+// document is inserted in the capped collection, or until timeout is
+// reached. A negative timeout blocks forever, and a zero timeout returns as
+// soon as no data is available.
+//
+// When Next returns false because of the timeout, Timeout reports true and
+// Next may be called again to keep following the collection. When the
+// server drops the cursor, the iterator transparently re-runs the query
+// from the last _id it has seen, in $natural order.
+//
+// Only the filter and the fields of the query are used: its sort, limit
+// and skip are ignored, as tailable cursors do not support sorting.
+//
+// More information: http://www.mongodb.org/display/DOCS/Tailable+Cursors
+func (q *Query) Tail(timeout time.Duration) *Iter {
+    tail := *q
+    tail.Spec.Sort = nil
+    tail.Options.Limit = 0
+    tail.Options.Skip = 0
+    tail.Options.Tailable = true
+    tail.Options.AwaitData = true
+    return &Iter{query: tail, timeout: timeout}
+}
+
+// Next unmarshals the next document into result and reports whether it
+// succeeded. It returns false when the timeout is reached, on error, and
+// after Close; see Timeout and Err to tell them apart.
+func (iter *Iter) Next(result interface{}) bool {
+    iter.m.Lock()
+    defer iter.m.Unlock()
+
+    iter.timedout = false
+    start := time.Now()
+    for atomic.LoadInt32(&iter.closed) == 0 && iter.err == nil {
+        if iter.cursor == nil {
+            iter.cursor, iter.err = iter.open()
+            if iter.err != nil {
+                return false
+            }
+        }
+        if iter.cursor.Next() == MONGO_OK {
+            current := iter.cursor.Current()
+            iter.remember(current)
+            if err := current.Unmarshal(result); err != nil {
+                iter.err = err
+                return false
+            }
+            return true
+        }
+
+        switch iter.cursor.ErrNo() {
+        case MONGO_CURSOR_PENDING:
+            // The cursor is alive but no data arrived while the server
+            // was awaiting it.
+        case MONGO_CURSOR_EXHAUSTED, MONGO_CURSOR_INVALID:
+            // The cursor is dead, query again from the last position.
+            iter.cursor.Destroy()
+            iter.cursor = nil
+            time.Sleep(tailRetryDelay)
+        default:
+            iter.err = iter.cursor.Error()
+            return false
+        }
+        if iter.timeout >= 0 && time.Since(start) >= iter.timeout {
+            iter.timedout = true
+            return false
+        }
+    }
+    return false
+}
+
+// Timeout reports whether the last call to Next returned false because no
+// document arrived before the timeout.
+func (iter *Iter) Timeout() bool {
+    iter.m.Lock()
+    defer iter.m.Unlock()
+    return iter.timedout
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (iter *Iter) Err() error {
+    iter.m.Lock()
+    defer iter.m.Unlock()
+    return iter.err
+}
+
+// Close stops the iterator and releases its cursor. It may be called from
+// another goroutine while Next is blocked, in which case it waits for Next
+// to return.
+func (iter *Iter) Close() error {
+    atomic.StoreInt32(&iter.closed, 1)
+    iter.m.Lock()
+    defer iter.m.Unlock()
+    if iter.cursor != nil {
+        iter.cursor.Destroy()
+        iter.cursor = nil
+    }
+    if iter.lastId != nil {
+        iter.lastId.Destroy()
+        iter.lastId = nil
+    }
+    return iter.err
+}
+
+// remember keeps a copy of the _id of doc, to resume from it if the cursor
+// dies.
+func (iter *Iter) remember(doc *Bson) {
+    it := NewBsonIterator()
+    if it.Find(doc, "_id") == BSON_EOO {
+        return
+    }
+    if iter.lastId != nil {
+        iter.lastId.Destroy()
+    }
+    iter.lastId = NewBson()
+    iter.lastId.Init()
+    iter.lastId.AppendElement("_id", it)
+    iter.lastId.Finish()
+}
+
+// open runs the query, restricted to the documents after the last seen _id.
+func (iter *Iter) open() (*Cursor, error) {
+    q := &iter.query
+    if iter.lastId == nil {
+        return q.Cursor()
+    }
+
+    it := NewBsonIterator()
+    it.Init(iter.lastId)
+    if it.Next() == BSON_EOO {
+        return nil, errors.New("MongoDB Tail error: lost the last seen _id")
+    }
+    filter := q.Spec.Query
+    if filter == nil {
+        filter = M{}
+    }
+    query := NewBson()
+    query.Init()
+    query.AppendStartObject("$query")
+    query.AppendStartArray("$and")
+    query.appendValue("0", filter)
+    query.AppendStartObject("1")
+    query.AppendStartObject("_id")
+    query.AppendElement("$gt", it)
+    query.AppendFinishObject()
+    query.AppendFinishObject()
+    query.AppendFinishArray()
+    query.AppendFinishObject()
+    query.AppendStartObject("$orderby")
+    query.AppendInt("$natural", 1)
+    query.AppendFinishObject()
+    query.Finish()
+    defer query.Destroy()
+
+    fields, err := q.bsonFields()
+    if err != nil {
+        return nil, err
+    }
+    if fields != nil {
+        defer fields.Destroy()
+    }
+    conn, options, err := q.readConn()
+    if err != nil {
+        return nil, err
+    }
+    return conn.Find(q.Namespace, query, fields, 0, 0, options)
+}
@@ -0,0 +1,217 @@
+package libgomongo
+
+// #cgo CFLAGS: -std=gnu99 -I./mongo-c-driver/src/
+// #cgo LDFLAGS: -L./mongo-c-driver/src/ -lmongoc
+// #include "mongo.h"
+import "C"
+
+import (
+    "context"
+    "github.com/QLeelulu/libgomongo/bson"
+    "log/slog"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// Logger of the package, see SetLogger.
+var defaultLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger of the diagnostics of the package, as the
+// documents which can not be encoded, and of the connections which have no
+// logger of their own. A nil logger restores slog.Default().
+func SetLogger(logger *slog.Logger) {
+    defaultLogger.Store(logger)
+}
+
+// Logger returns the logger set by SetLogger, or slog.Default().
+func Logger() *slog.Logger {
+    if logger := defaultLogger.Load(); logger != nil {
+        return logger
+    }
+    return slog.Default()
+}
+
+// SetLogger sets the logger of the connection, or restores the logger of
+// the package when logger is nil.
+func (c *Mongo) SetLogger(logger *slog.Logger) {
+    c.logger = logger
+}
+
+// Logger returns the logger of the connection.
+func (c *Mongo) Logger() *slog.Logger {
+    if c.logger == nil {
+        return Logger()
+    }
+    return c.logger
+}
+
+// SetSlowQueryThreshold logs the operations of the connection taking at
+// least threshold, or disables it when threshold is 0. The queries are
+// logged at the warning level, with their namespace, the shape of their
+// filter, their duration and the number of documents returned, and with
+// the summary of their explain when enabled by SetSlowQueryExplain.
+func (c *Mongo) SetSlowQueryThreshold(threshold time.Duration) {
+    c.slowQuery = threshold
+}
+
+// SetSlowQueryExplain adds the summary of their explain to the logs of the
+// slow queries, which is off by default.
+//
+// The explain runs the query again on the connection, once the slow query
+// is over and before the operation returns, so each slow query costs about
+// twice its time. It is not seen by the monitor of the connection.
+func (c *Mongo) SetSlowQueryExplain(explain bool) {
+    c.slowExplain = explain
+}
+
+// SetLogger sets the logger of the connections returned by Get, or
+// restores the logger of the package when logger is nil.
+func (p *Pool) SetLogger(logger *slog.Logger) {
+    p.logger = logger
+}
+
+// SetSlowQueryThreshold sets the slow query threshold of the connections
+// returned by Get, see Mongo.SetSlowQueryThreshold.
+func (p *Pool) SetSlowQueryThreshold(threshold time.Duration) {
+    p.slowQuery = threshold
+}
+
+// SetSlowQueryExplain sets whether the connections returned by Get explain
+// their slow queries, see Mongo.SetSlowQueryExplain.
+func (p *Pool) SetSlowQueryExplain(explain bool) {
+    p.slowExplain = explain
+}
+
+// logSlowQuery logs the operation of the trace, which took duration.
+func (c *Mongo) logSlowQuery(t *opTrace, duration time.Duration, err error) {
+    e := t.event
+    attrs := []slog.Attr{
+        slog.String("namespace", e.Namespace),
+        slog.String("operation", e.Operation),
+        slog.Duration("duration", duration),
+    }
+    if e.Filter != nil {
+        if filter, err := bson.MarshalExtJSON(e.Filter, false); err == nil {
+            attrs = append(attrs, slog.String("filter", string(filter)))
+        }
+    }
+    switch e.Operation {
+    case "find", "getMore":
+        attrs = append(attrs, slog.Int("nReturned", e.Documents))
+    }
+    if err != nil {
+        attrs = append(attrs, slog.String("error", err.Error()))
+    } else if c.slowExplain && t.query != nil && e.Collection != "" {
+        if explain := c.explain(e.Database+"."+e.Collection, t.query); explain != nil {
+            attrs = append(attrs, slog.Any("explain", explain.summary()))
+        }
+    }
+    c.Logger().LogAttrs(c.Context(), slog.LevelWarn, "MongoDB: slow query", attrs...)
+}
+
+// explainResult holds the fields of an explain output which are logged, of
+// the servers before 3.0, and of the later ones.
+type explainResult struct {
+    Cursor          string
+    N               int64
+    NScanned        int64 `bson:"nscanned"`
+    NScannedObjects int64 `bson:"nscannedObjects"`
+    Millis          int64
+
+    QueryPlanner struct {
+        WinningPlan M `bson:"winningPlan"`
+    } `bson:"queryPlanner"`
+    ExecutionStats struct {
+        NReturned           int64 `bson:"nReturned"`
+        TotalKeysExamined   int64 `bson:"totalKeysExamined"`
+        TotalDocsExamined   int64 `bson:"totalDocsExamined"`
+        ExecutionTimeMillis int64 `bson:"executionTimeMillis"`
+    } `bson:"executionStats"`
+}
+
+// summary returns the plan of the query, as "BtreeCursor name_1" or
+// "FETCH > IXSCAN", and the numbers of keys and documents it examined.
+func (r *explainResult) summary() slog.Value {
+    if len(r.QueryPlanner.WinningPlan) == 0 {
+        return slog.GroupValue(
+            slog.String("plan", r.Cursor),
+            slog.Int64("n", r.N),
+            slog.Int64("keysExamined", r.NScanned),
+            slog.Int64("docsExamined", r.NScannedObjects),
+            slog.Int64("millis", r.Millis))
+    }
+    var stages []string
+    for plan := r.QueryPlanner.WinningPlan; plan != nil; {
+        if stage, ok := plan["stage"].(string); ok {
+            stages = append(stages, stage)
+        }
+        plan = docMap(plan["inputStage"])
+    }
+    stats := r.ExecutionStats
+    return slog.GroupValue(
+        slog.String("plan", strings.Join(stages, " > ")),
+        slog.Int64("n", stats.NReturned),
+        slog.Int64("keysExamined", stats.TotalKeysExamined),
+        slog.Int64("docsExamined", stats.TotalDocsExamined),
+        slog.Int64("millis", stats.ExecutionTimeMillis))
+}
+
+// docMap returns the document v as a M, or nil.
+func docMap(v interface{}) M {
+    switch v := v.(type) {
+    case M:
+        return v
+    case D:
+        return v.Map()
+    }
+    return nil
+}
+
+// explain returns the explain output of the query on ns, or nil if it
+// fails. It calls the C driver directly, so that the explain is neither
+// monitored nor logged, and leaves the errors of the connection as they
+// were.
+func (c *Mongo) explain(ns string, query D) *explainResult {
+    if _, ok := query.Map()["$query"]; !ok {
+        query = D{{Name: "$query", Value: query}}
+    }
+    q := NewBsonFromDoc(append(query[:len(query):len(query)], DocElem{Name: "$explain", Value: true}))
+    if q == nil {
+        return nil
+    }
+    defer q.Destroy()
+    options := 0
+    if c.slaveOk {
+        options = MONGO_SLAVE_OK
+    }
+    hadError := c.ErrNo() != MONGO_CONN_SUCCESS
+    cur := C.mongo_find(c.conn, C.CString(ns), q._bson, nil, -1, 0, C.int(options))
+    if cur == nil {
+        if !hadError {
+            C.mongo_clear_errors(c.conn)
+        }
+        return nil
+    }
+    defer C.mongo_cursor_destroy(cur)
+    if C.mongo_cursor_next(cur) != MONGO_OK {
+        if !hadError {
+            C.mongo_clear_errors(c.conn)
+        }
+        return nil
+    }
+    var r explainResult
+    if err := (&Bson{_bson: &cur.current}).Raw().Unmarshal(&r); err != nil {
+        return nil
+    }
+    return &r
+}
+
+// logUnsupported logs the value of key, whose type can not be appended to
+// a document.
+func logUnsupported(key string, t reflect.Type) {
+    Logger().LogAttrs(context.Background(), slog.LevelWarn, "MongoDB: type not supported in a document",
+        slog.String("key", key),
+        slog.String("type", t.String()))
+}
@@ -0,0 +1,149 @@
+package libgomongo
+
+import (
+    "bytes"
+    "encoding/json"
+    "github.com/couchbaselabs/go.assert"
+    "log/slog"
+    "strings"
+    "testing"
+    "time"
+)
+
+// records returns the JSON records written to buf, and resets it.
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+    var recs []map[string]interface{}
+    for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+        if line == "" {
+            continue
+        }
+        var rec map[string]interface{}
+        assert.Equals(t, json.Unmarshal([]byte(line), &rec), nil)
+        recs = append(recs, rec)
+    }
+    buf.Reset()
+    return recs
+}
+
+func TestSlowQueryLog(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+    col := conn.Db("libgomongo-test").C("slow")
+    col.RemoveAll(nil, nil)
+    for i := 0; i < 3; i++ {
+        _, err := col.Insert(M{"n": i, "name": "secret"}, nil)
+        assert.Equals(t, err, nil)
+    }
+
+    var buf bytes.Buffer
+    conn.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+    conn.SetSlowQueryThreshold(time.Nanosecond)
+
+    // the queries are not explained by default
+    col.Count(nil)
+    recs := records(t, &buf)
+    assert.Equals(t, len(recs), 1)
+    assert.Equals(t, recs[0]["explain"], nil)
+
+    conn.SetSlowQueryExplain(true)
+    iter := col.Find(M{"name": "secret"}).Iter()
+    var doc M
+    for iter.Next(&doc) {
+    }
+    assert.Equals(t, iter.Close(), nil)
+    recs = records(t, &buf)
+    assert.Equals(t, len(recs), 1)
+    rec := recs[0]
+    assert.Equals(t, rec["level"], "WARN")
+    assert.Equals(t, rec["msg"], "MongoDB: slow query")
+    assert.Equals(t, rec["namespace"], "libgomongo-test.slow")
+    assert.Equals(t, rec["operation"], "find")
+    assert.Equals(t, rec["filter"], `{"name":"?"}`)
+    assert.Equals(t, rec["nReturned"], float64(3))
+    explain := rec["explain"].(map[string]interface{})
+    assert.NotEquals(t, explain["plan"], "")
+    assert.Equals(t, explain["n"], float64(3))
+    assert.Equals(t, conn.Error(), nil)
+
+    n, err := col.Find(M{"n": M{"$lt": 2}}).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 2)
+    recs = records(t, &buf)
+    assert.Equals(t, len(recs), 1)
+    assert.Equals(t, recs[0]["operation"], "count")
+    assert.Equals(t, recs[0]["filter"], `{"n":{"$lt":"?"}}`)
+    assert.Equals(t, recs[0]["explain"].(map[string]interface{})["n"], float64(2))
+
+    // the explain is not seen by the monitor
+    monitor := &recordingMonitor{}
+    conn.SetMonitor(monitor)
+    col.Count(M{"n": 1})
+    assert.Equals(t, len(monitor.take()), 1)
+    assert.Equals(t, len(records(t, &buf)), 1)
+
+    conn.SetSlowQueryThreshold(time.Hour)
+    col.Count(nil)
+    assert.Equals(t, len(records(t, &buf)), 0)
+}
+
+func TestPoolLogger(t *testing.T) {
+    var buf bytes.Buffer
+    pool := NewPool(host, port, 1)
+    pool.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+    pool.SetSlowQueryThreshold(time.Nanosecond)
+    pool.SetSlowQueryExplain(true)
+    conn, err := pool.Get()
+    assert.Equals(t, err, nil)
+    defer conn.Destroy()
+    conn.Db("libgomongo-test").C("slow").Count(nil)
+    recs := records(t, &buf)
+    assert.Equals(t, len(recs), 1)
+    assert.Equals(t, recs[0]["namespace"], "libgomongo-test.slow")
+    assert.NotEquals(t, recs[0]["explain"], nil)
+}
+
+func TestLogger(t *testing.T) {
+    var buf bytes.Buffer
+    SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+    defer SetLogger(nil)
+
+    assert.Equals(t, NewBsonFromM(M{"events": make(chan int)}), (*Bson)(nil))
+    b := NewBsonFromM(M{})
+    defer b.Destroy()
+    b.Print()
+    recs := records(t, &buf)
+    assert.Equals(t, len(recs), 2)
+    assert.Equals(t, recs[0]["msg"], "MongoDB: type not supported in a document")
+    assert.Equals(t, recs[0]["key"], "events")
+    assert.Equals(t, recs[0]["type"], "chan int")
+    assert.Equals(t, recs[1]["doc"], "{}")
+
+    conn := NewMongo()
+    assert.Equals(t, conn.Logger(), Logger())
+    SetLogger(nil)
+    assert.Equals(t, Logger(), slog.Default())
+}
+
+func TestExplainSummary(t *testing.T) {
+    var r explainResult
+    err := NewBsonFromDoc(D{
+        {Name: "queryPlanner", Value: D{{Name: "winningPlan", Value: D{
+            {Name: "stage", Value: "FETCH"},
+            {Name: "inputStage", Value: D{{Name: "stage", Value: "IXSCAN"}}},
+        }}}},
+        {Name: "executionStats", Value: D{
+            {Name: "nReturned", Value: 2},
+            {Name: "totalKeysExamined", Value: 3},
+            {Name: "totalDocsExamined", Value: int64(2)},
+            {Name: "executionTimeMillis", Value: 5},
+        }},
+    }).Raw().Unmarshal(&r)
+    assert.Equals(t, err, nil)
+    summary := r.summary().Group()
+    assert.Equals(t, summary[0].Value.String(), "FETCH > IXSCAN")
+    assert.Equals(t, summary[1].Value.Int64(), int64(2))
+    assert.Equals(t, summary[2].Value.Int64(), int64(3))
+    assert.Equals(t, summary[3].Value.Int64(), int64(2))
+    assert.Equals(t, summary[4].Value.Int64(), int64(5))
+}
@@ -0,0 +1,257 @@
+package libgomongo
+
+import (
+    "errors"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// members holds the connections to the members of a replica set, opened
+// for the reads routed by a ReadPreference.
+type members struct {
+    list    []*member
+    checked time.Time
+}
+
+// SetReadPreference sets the read preference of the queries run on the
+// connection, or resets it to Primary when pref is nil.
+func (c *Mongo) SetReadPreference(pref *ReadPreference) {
+    c.readPref = pref
+}
+
+// ReadPreference returns the read preference of the connection, or nil.
+func (c *Mongo) ReadPreference() *ReadPreference {
+    return c.readPref
+}
+
+// SetReadPreference sets the read preference of the queries run on the
+// database, overriding the one of its connection.
+func (db *DB) SetReadPreference(pref *ReadPreference) {
+    db.readPref = pref
+}
+
+// SetReadPreference sets the read preference of the queries run on the
+// collection, overriding the one of its database.
+func (c *Collection) SetReadPreference(pref *ReadPreference) {
+    c.readPref = pref
+}
+
+// readPreference returns the read preference of the collection, or of its
+// database.
+func (c *Collection) readPreference() *ReadPreference {
+    if c.readPref != nil {
+        return c.readPref
+    }
+    return c.Db.readPref
+}
+
+// ReadPreference sets the read preference of the query, overriding the one
+// of its collection.
+func (q *Query) ReadPreference(pref *ReadPreference) *Query {
+    q.Options.ReadPreference = pref
+    return q
+}
+
+// readConn returns the connection the query reads from, as chosen by its
+// read preference, and the cursor options to read with.
+func (q *Query) readConn() (*Mongo, int, error) {
+    pref := q.Options.ReadPreference
+    if pref == nil {
+        pref = q.Conn.readPref
+    }
+    options := q.Options.cursorOptions()
+    conn, slaveOk, err := q.Conn.readConn(pref)
+    if err != nil {
+        return nil, 0, err
+    }
+    if slaveOk {
+        options |= MONGO_SLAVE_OK
+    }
+    return conn, options, nil
+}
+
+// readConn returns the connection to read from with pref, and whether the
+// reads need the SlaveOk option.
+func (c *Mongo) readConn(pref *ReadPreference) (*Mongo, bool, error) {
+    if pref == nil {
+        return c, false, nil
+    }
+    if err := pref.validate(); err != nil {
+        return nil, false, err
+    }
+    if pref.Mode == Primary {
+        return c, false, nil
+    }
+    hosts := c.Hosts()
+    if hosts == nil {
+        return c, true, nil
+    }
+    if c.members == nil || time.Since(c.members.checked) >= memberCheckInterval {
+        c.checkMembers(hosts)
+    }
+    m, err := pref.choose(c.members.list)
+    if err != nil {
+        return nil, false, err
+    }
+    m.conn.inherit(c)
+    return m.conn, !m.primary, nil
+}
+
+// checkMembers connects to the hosts of the replica set that have no
+// connection yet, and asks every member for its state.
+func (c *Mongo) checkMembers(hosts []string) {
+    if c.members == nil {
+        c.members = &members{}
+    }
+    known := make(map[string]*member)
+    for _, m := range c.members.list {
+        known[m.addr] = m
+    }
+    list := make([]*member, 0, len(hosts))
+    for _, addr := range hosts {
+        m := known[addr]
+        if m == nil {
+            m = &member{addr: addr}
+        }
+        delete(known, addr)
+        m.check(c)
+        list = append(list, m)
+    }
+    for _, m := range known {
+        m.close()
+    }
+    c.members.list = list
+    c.members.checked = time.Now()
+}
+
+// check updates the state of the member with ismaster, connecting to it
+// first if needed, with the credentials given to parent.
+func (m *member) check(parent *Mongo) {
+    if m.conn == nil {
+        host, portStr, err := net.SplitHostPort(m.addr)
+        if err != nil {
+            m.err = err
+            return
+        }
+        port, _ := strconv.Atoi(portStr)
+        conn := NewMongo()
+        if conn.Client(host, port) != MONGO_OK {
+            m.err = conn.Error()
+            conn.Destroy()
+            return
+        }
+        for _, cred := range parent.credentials {
+            if conn.authenticate(cred) != MONGO_OK {
+                m.err = errors.New("MongoDB: replica set member " + m.addr + " refused the credentials of " + cred.db + ": " + errString(conn.Error()))
+                conn.Destroy()
+                return
+            }
+        }
+        conn.credentials = append([]credential(nil), parent.credentials...)
+        conn.slaveOk = true
+        m.conn = conn
+    }
+    m.conn.inherit(parent)
+
+    var res struct {
+        IsMaster  bool `bson:"ismaster"`
+        Secondary bool
+        Tags      M
+    }
+    start := time.Now()
+    if err := m.conn.Db("admin").Run("ismaster", &res); err != nil {
+        m.err = errors.New("MongoDB: replica set member " + m.addr + " is not available: " + err.Error())
+        m.close()
+        return
+    }
+    m.latency = time.Since(start)
+    m.primary = res.IsMaster
+    m.secondary = res.Secondary
+    m.tags = make(map[string]string, len(res.Tags))
+    for k, v := range res.Tags {
+        if s, ok := v.(string); ok {
+            m.tags[k] = s
+        }
+    }
+    m.err = nil
+}
+
+// inherit gives c the operation monitor, context, logger and slow query
+// settings of parent, as c reads on its behalf.
+func (c *Mongo) inherit(parent *Mongo) {
+    c.opMonitor = parent.opMonitor
+    c.ctx = parent.ctx
+    c.logger = parent.logger
+    c.slowQuery = parent.slowQuery
+    c.slowExplain = parent.slowExplain
+}
+
+// close gives up the connection to the member, which is destroyed once the
+// cursors reading from it are.
+func (m *member) close() {
+    if m.conn != nil {
+        m.conn.retire()
+        m.conn = nil
+    }
+}
+
+// cursorRefs counts the cursors open on a connection, so that a connection
+// to a replica set member is not destroyed under the cursors of the queries
+// routed to it.
+type cursorRefs struct {
+    mu      sync.Mutex
+    n       int
+    retired bool // the connection is destroyed when n drops to 0
+}
+
+// retain counts the cursor in the cursors of its connection.
+func (cur *Cursor) retain() {
+    refs := &cur.Conn.cursors
+    refs.mu.Lock()
+    refs.n++
+    refs.mu.Unlock()
+    cur.retained = true
+}
+
+// release uncounts the destroyed cursor, and destroys its connection when
+// it was retired and this was its last cursor.
+func (cur *Cursor) release() {
+    if !cur.retained {
+        return
+    }
+    cur.retained = false
+    refs := &cur.Conn.cursors
+    refs.mu.Lock()
+    refs.n--
+    destroy := refs.retired && refs.n == 0
+    refs.mu.Unlock()
+    if destroy {
+        cur.Conn.Destroy()
+    }
+}
+
+// retire destroys the connection, or leaves it to the last of its open
+// cursors when there are some.
+func (c *Mongo) retire() {
+    refs := &c.cursors
+    refs.mu.Lock()
+    refs.retired = true
+    destroy := refs.n == 0
+    refs.mu.Unlock()
+    if destroy {
+        c.Destroy()
+    }
+}
+
+// closeMembers closes the connections to the replica set members.
+func (c *Mongo) closeMembers() {
+    if c.members == nil {
+        return
+    }
+    for _, m := range c.members.list {
+        m.close()
+    }
+    c.members = nil
+}
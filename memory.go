@@ -0,0 +1,973 @@
+package libgomongo
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "github.com/QLeelulu/libgomongo/bson"
+    "reflect"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// NewMemoryDB returns a database held in memory, for the unit tests of
+// code written against DatabaseAPI. It needs no server.
+//
+// Documents are stored as M. Queries support the $eq, $ne, $gt, $gte,
+// $lt, $lte, $in, $nin, $exists, $and, $or and $nor operators on dotted
+// paths, sorting, skip, limit and the inclusion or exclusion of top level
+// fields. Update takes a replacement document, or the $set, $unset and
+// $inc operators on dotted paths. Insert enforces unique _id fields, and
+// EnsureIndex does nothing.
+// Write concerns are ignored, as every write is applied at once. Run only
+// knows the ping, count, drop and dropDatabase commands.
+func NewMemoryDB(name string) DatabaseAPI {
+    return &memoryDB{name: name, colls: make(map[string][]M)}
+}
+
+type memoryDB struct {
+    name  string
+    mu    sync.Mutex
+    colls map[string][]M // documents by collection name
+}
+
+type memoryCollection struct {
+    db   *memoryDB
+    name string
+}
+
+type memoryQuery struct {
+    coll    *memoryCollection
+    spec    QuerySpec
+    options FindOptions
+}
+
+type memoryIter struct {
+    docs []M
+    err  error
+}
+
+func (db *memoryDB) Collection(name string) CollectionAPI {
+    return &memoryCollection{db: db, name: name}
+}
+
+func (db *memoryDB) Run(cmd interface{}, result interface{}) error {
+    if s, ok := cmd.(string); ok {
+        cmd = D{{Name: s, Value: 1}}
+    }
+    c, err := memoryDoc(cmd)
+    if err != nil {
+        return err
+    }
+    if len(c) == 0 {
+        return errors.New("MongoDB command error: no command given")
+    }
+    name, _ := c[0].Value.(string)
+    res := M{"ok": 1.0}
+    switch strings.ToLower(c[0].Name) {
+    case "ping":
+    case "count":
+        q := &memoryQuery{coll: &memoryCollection{db: db, name: name}}
+        for _, e := range c[1:] {
+            switch e.Name {
+            case "query":
+                q.spec.Query = e.Value
+            case "skip":
+                n, _ := memoryNumber(e.Value)
+                q.options.Skip = int(n)
+            case "limit":
+                n, _ := memoryNumber(e.Value)
+                q.options.Limit = int(n)
+            }
+        }
+        n, err := q.Count()
+        if err != nil {
+            return err
+        }
+        res["n"] = float64(n)
+    case "drop":
+        db.mu.Lock()
+        _, ok := db.colls[name]
+        delete(db.colls, name)
+        db.mu.Unlock()
+        if !ok {
+            return errors.New("MongoDB command error: ns not found")
+        }
+    case "dropdatabase":
+        db.mu.Lock()
+        db.colls = make(map[string][]M)
+        db.mu.Unlock()
+    default:
+        return errors.New(fmt.Sprintf("MongoDB command error: %s is not supported by the memory database", c[0].Name))
+    }
+    if result == nil {
+        return nil
+    }
+    return memoryUnmarshal(res, result)
+}
+
+func (c *memoryCollection) Query(filter interface{}) QueryAPI {
+    return &memoryQuery{coll: c, spec: QuerySpec{Query: filter}}
+}
+
+func (c *memoryCollection) Count(query interface{}) (int64, error) {
+    n, err := c.Query(query).Count()
+    return int64(n), err
+}
+
+func (c *memoryCollection) Insert(data interface{}, writeConcern *MongoWriteConcern) (int, error) {
+    doc, err := memoryM(data)
+    if err != nil {
+        return MONGO_ERROR, err
+    }
+    if err := memoryValidate(doc); err != nil {
+        return MONGO_ERROR, err
+    }
+    if _, ok := doc["_id"]; !ok {
+        doc["_id"] = bson.NewObjectId()
+    }
+    c.db.mu.Lock()
+    defer c.db.mu.Unlock()
+    for _, other := range c.db.colls[c.name] {
+        if memoryEqual(other["_id"], doc["_id"]) {
+            return MONGO_ERROR, errors.New(fmt.Sprintf("E11000 duplicate key error index: %s.%s.$_id_  dup key: { : %v }", c.db.name, c.name, doc["_id"]))
+        }
+    }
+    c.db.colls[c.name] = append(c.db.colls[c.name], doc)
+    return MONGO_OK, nil
+}
+
+// memoryValidate rejects the keys the server refuses on insert, in doc and
+// in the documents of its arrays.
+func memoryValidate(doc M) error {
+    for key, v := range doc {
+        if strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+            return errors.New(fmt.Sprintf("MongoDB: BSON not valid for insert: invalid key %q.", key))
+        }
+        if err := memoryValidateValue(v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func memoryValidateValue(v interface{}) error {
+    switch v := v.(type) {
+    case M:
+        return memoryValidate(v)
+    case []interface{}:
+        for _, item := range v {
+            if err := memoryValidateValue(item); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func (c *memoryCollection) Update(selector, update interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    filter, err := memoryM(selector)
+    if err != nil {
+        return nil, err
+    }
+    change, err := memoryM(update)
+    if err != nil {
+        return nil, err
+    }
+    c.db.mu.Lock()
+    defer c.db.mu.Unlock()
+    for i, doc := range c.db.colls[c.name] {
+        ok, err := memoryMatch(doc, filter)
+        if err != nil {
+            return nil, err
+        }
+        if !ok {
+            continue
+        }
+        updated, err := memoryApply(doc, change)
+        if err != nil {
+            return nil, err
+        }
+        if !memoryEqual(updated["_id"], doc["_id"]) {
+            return nil, errors.New("MongoDB write error: the _id field cannot be changed")
+        }
+        c.db.colls[c.name][i] = updated
+        return &ChangeInfo{Updated: 1}, nil
+    }
+    return &ChangeInfo{}, ErrNotFound
+}
+
+// memoryApply returns a copy of doc changed by update, which is either a
+// replacement document or a document of update operators.
+func memoryApply(doc M, update M) (M, error) {
+    operators := 0
+    for key := range update {
+        if strings.HasPrefix(key, "$") {
+            operators++
+        }
+    }
+    if operators > 0 && operators < len(update) {
+        return nil, errors.New("MongoDB write error: update mixes operators and fields")
+    }
+    if operators == 0 {
+        if err := memoryValidate(update); err != nil {
+            return nil, err
+        }
+        if id, ok := doc["_id"]; ok {
+            if _, ok := update["_id"]; !ok {
+                update["_id"] = id
+            }
+        }
+        return update, nil
+    }
+    out, err := memoryM(doc)
+    if err != nil {
+        return nil, err
+    }
+    for op, arg := range update {
+        fields, ok := arg.(M)
+        if !ok {
+            return nil, errors.New(fmt.Sprintf("MongoDB write error: %s needs a document", op))
+        }
+        for path, v := range fields {
+            switch op {
+            case "$set":
+                err = memorySet(out, path, v)
+            case "$unset":
+                err = memoryUnset(out, path)
+            case "$inc":
+                n, isNumber := memoryNumber(v)
+                if !isNumber {
+                    return nil, errors.New("MongoDB write error: $inc needs a number")
+                }
+                var sum interface{} = v
+                if old := memoryLookup(out, path); old != memoryMissing {
+                    x, isNumber := memoryNumber(old)
+                    if !isNumber {
+                        return nil, errors.New(fmt.Sprintf("MongoDB write error: $inc of the non-number field %s", path))
+                    }
+                    sum = memoryAdd(old, v, x+n)
+                }
+                err = memorySet(out, path, sum)
+            default:
+                return nil, errors.New(fmt.Sprintf("MongoDB: unsupported update operator %s", op))
+            }
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+    return out, nil
+}
+
+// memoryAdd returns the sum of the numbers a and b, which is f as a float,
+// in the type the server gives it: a double when one of them is a double,
+// a long when one of them is a long, and an int otherwise.
+func memoryAdd(a, b interface{}, f float64) interface{} {
+    _, da := a.(float64)
+    _, db := b.(float64)
+    if da || db {
+        return f
+    }
+    x, _ := memoryInt(a)
+    y, _ := memoryInt(b)
+    _, la := a.(int64)
+    _, lb := b.(int64)
+    if la || lb {
+        return x + y
+    }
+    return int(x + y)
+}
+
+func memoryInt(v interface{}) (int64, bool) {
+    switch n := v.(type) {
+    case int:
+        return int64(n), true
+    case int32:
+        return int64(n), true
+    case int64:
+        return n, true
+    }
+    return 0, false
+}
+
+// memorySet sets the value at the dotted path of doc, making the missing
+// documents along the path.
+func memorySet(doc M, path string, v interface{}) error {
+    keys := strings.Split(path, ".")
+    for _, key := range keys[:len(keys)-1] {
+        sub, ok := doc[key]
+        if !ok {
+            sub = M{}
+            doc[key] = sub
+        }
+        if doc, ok = sub.(M); !ok {
+            return errors.New(fmt.Sprintf("MongoDB write error: cannot set %s in a non-document", path))
+        }
+    }
+    doc[keys[len(keys)-1]] = v
+    return nil
+}
+
+// memoryUnset removes the value at the dotted path of doc, if any.
+func memoryUnset(doc M, path string) error {
+    keys := strings.Split(path, ".")
+    for _, key := range keys[:len(keys)-1] {
+        sub, ok := doc[key].(M)
+        if !ok {
+            return nil
+        }
+        doc = sub
+    }
+    delete(doc, keys[len(keys)-1])
+    return nil
+}
+
+func (c *memoryCollection) EnsureIndex(key interface{}, options int) error {
+    _, err := memoryDoc(key)
+    return err
+}
+
+func (c *memoryCollection) Remove(selector interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    info, err := c.remove(selector, true)
+    if err == nil && info.Removed == 0 {
+        return info, ErrNotFound
+    }
+    return info, err
+}
+
+func (c *memoryCollection) RemoveId(id interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    return c.Remove(M{"_id": id}, writeConcern)
+}
+
+func (c *memoryCollection) RemoveAll(selector interface{}, writeConcern *MongoWriteConcern) (*ChangeInfo, error) {
+    return c.remove(selector, false)
+}
+
+func (c *memoryCollection) remove(selector interface{}, single bool) (*ChangeInfo, error) {
+    filter, err := memoryM(selector)
+    if err != nil {
+        return nil, err
+    }
+    c.db.mu.Lock()
+    defer c.db.mu.Unlock()
+    info := &ChangeInfo{}
+    docs := c.db.colls[c.name]
+    kept := make([]M, 0, len(docs))
+    for _, doc := range docs {
+        if info.Removed == 0 || !single {
+            ok, err := memoryMatch(doc, filter)
+            if err != nil {
+                return nil, err
+            }
+            if ok {
+                info.Removed++
+                continue
+            }
+        }
+        kept = append(kept, doc)
+    }
+    if len(docs) > 0 {
+        c.db.colls[c.name] = kept
+    }
+    return info, nil
+}
+
+// results returns copies of the documents matched by the query, sorted,
+// skipped, limited and projected.
+func (q *memoryQuery) results() ([]M, error) {
+    filter, err := memoryM(q.spec.Query)
+    if err != nil {
+        return nil, err
+    }
+    var order, fields D
+    if q.spec.Sort != nil {
+        if order, err = memoryDoc(q.spec.Sort); err != nil {
+            return nil, err
+        }
+    }
+    if q.options.Fields != nil {
+        if fields, err = memoryDoc(q.options.Fields); err != nil {
+            return nil, err
+        }
+    }
+
+    q.coll.db.mu.Lock()
+    var docs []M
+    for _, doc := range q.coll.db.colls[q.coll.name] {
+        ok, err := memoryMatch(doc, filter)
+        if err != nil {
+            q.coll.db.mu.Unlock()
+            return nil, err
+        }
+        if ok {
+            docs = append(docs, doc)
+        }
+    }
+    q.coll.db.mu.Unlock()
+
+    if len(order) > 0 {
+        sort.SliceStable(docs, func(i, j int) bool {
+            for _, key := range order {
+                c := memoryCompare(memoryLookup(docs[i], key.Name), memoryLookup(docs[j], key.Name))
+                if dir, _ := memoryNumber(key.Value); dir < 0 {
+                    c = -c
+                }
+                if c != 0 {
+                    return c < 0
+                }
+            }
+            return false
+        })
+    }
+    if skip := q.options.Skip; skip > 0 {
+        if skip > len(docs) {
+            skip = len(docs)
+        }
+        docs = docs[skip:]
+    }
+    limit := q.options.Limit
+    if limit < 0 {
+        limit = -limit
+    }
+    if limit > 0 && limit < len(docs) {
+        docs = docs[:limit]
+    }
+
+    out := make([]M, len(docs))
+    for i, doc := range docs {
+        if out[i], err = memoryM(memoryProject(doc, fields)); err != nil {
+            return nil, err
+        }
+    }
+    return out, nil
+}
+
+func (q *memoryQuery) WithSort(sort interface{}) QueryAPI {
+    q.spec.Sort = sort
+    return q
+}
+
+func (q *memoryQuery) WithLimit(limit int) QueryAPI {
+    q.options.Limit = limit
+    return q
+}
+
+func (q *memoryQuery) WithSkip(skip int) QueryAPI {
+    q.options.Skip = skip
+    return q
+}
+
+func (q *memoryQuery) WithFields(fields interface{}) QueryAPI {
+    q.options.Fields = fields
+    return q
+}
+
+func (q *memoryQuery) One(result interface{}) error {
+    one := *q
+    one.options.Limit = 1
+    docs, err := one.results()
+    if err != nil {
+        return err
+    }
+    if len(docs) == 0 {
+        return ErrNotFound
+    }
+    return memoryUnmarshal(docs[0], result)
+}
+
+func (q *memoryQuery) All(result interface{}) error {
+    return allResults(q.Iter(), result)
+}
+
+func (q *memoryQuery) Iter() IterAPI {
+    docs, err := q.results()
+    return &memoryIter{docs: docs, err: err}
+}
+
+func (q *memoryQuery) Count() (int, error) {
+    docs, err := q.results()
+    return len(docs), err
+}
+
+func (q *memoryQuery) Distinct(key string, result interface{}) error {
+    distinct := *q
+    distinct.options = FindOptions{}
+    docs, err := distinct.results()
+    if err != nil {
+        return err
+    }
+    values := []interface{}{}
+    for _, doc := range docs {
+        v := memoryLookup(doc, key)
+        items := []interface{}{v}
+        if arr, ok := v.([]interface{}); ok {
+            items = arr
+        } else if v == memoryMissing {
+            continue
+        }
+        for _, item := range items {
+            seen := false
+            for _, other := range values {
+                if memoryEqual(other, item) {
+                    seen = true
+                    break
+                }
+            }
+            if !seen {
+                values = append(values, item)
+            }
+        }
+    }
+    raw, err := bson.Marshal(M{"values": values})
+    if err != nil {
+        return err
+    }
+    return Raw(raw).Lookup("values").Unmarshal(result)
+}
+
+func (iter *memoryIter) Next(result interface{}) bool {
+    if iter.err != nil || len(iter.docs) == 0 {
+        return false
+    }
+    doc := iter.docs[0]
+    iter.docs = iter.docs[1:]
+    if err := memoryUnmarshal(doc, result); err != nil {
+        iter.err = err
+        return false
+    }
+    return true
+}
+
+func (iter *memoryIter) Err() error {
+    return iter.err
+}
+
+func (iter *memoryIter) Close() error {
+    iter.docs = nil
+    return iter.err
+}
+
+// memoryDoc returns doc, which may be nil, a M, a D, a map or a struct, as
+// a D.
+func memoryDoc(doc interface{}) (D, error) {
+    if doc == nil {
+        return D{}, nil
+    }
+    raw, err := bson.Marshal(doc)
+    if err != nil {
+        return nil, err
+    }
+    var d D
+    return d, bson.Unmarshal(raw, &d)
+}
+
+// memoryM returns a copy of doc as a M, with the nested documents as M and
+// the values in the types they are decoded to.
+func memoryM(doc interface{}) (M, error) {
+    if doc == nil {
+        return M{}, nil
+    }
+    raw, err := bson.Marshal(doc)
+    if err != nil {
+        return nil, err
+    }
+    m := M{}
+    return m, bson.Unmarshal(raw, &m)
+}
+
+func memoryUnmarshal(doc M, result interface{}) error {
+    raw, err := bson.Marshal(doc)
+    if err != nil {
+        return err
+    }
+    return bson.Unmarshal(raw, result)
+}
+
+// memoryProject returns the fields of doc selected by fields, which either
+// includes or excludes top level fields. The _id is included unless
+// excluded explicitly.
+func memoryProject(doc M, fields D) M {
+    if len(fields) == 0 {
+        return doc
+    }
+    include := false
+    for _, f := range fields {
+        if f.Name != "_id" && memoryTruthy(f.Value) {
+            include = true
+        }
+    }
+    out := M{}
+    if include {
+        if id, ok := doc["_id"]; ok {
+            out["_id"] = id
+        }
+    } else {
+        for key, v := range doc {
+            out[key] = v
+        }
+    }
+    for _, f := range fields {
+        if memoryTruthy(f.Value) {
+            if v, ok := doc[f.Name]; ok {
+                out[f.Name] = v
+            }
+        } else {
+            delete(out, f.Name)
+        }
+    }
+    return out
+}
+
+// memoryMissing is the value of a path absent from a document.
+var memoryMissing = &struct{}{}
+
+// memoryLookup returns the value at the dotted path of doc, or
+// memoryMissing. A path going through an array of documents returns the
+// array of their values.
+func memoryLookup(v interface{}, path string) interface{} {
+    if path == "" {
+        return v
+    }
+    key, rest := path, ""
+    if i := strings.Index(path, "."); i >= 0 {
+        key, rest = path[:i], path[i+1:]
+    }
+    switch v := v.(type) {
+    case M:
+        sub, ok := v[key]
+        if !ok {
+            return memoryMissing
+        }
+        return memoryLookup(sub, rest)
+    case []interface{}:
+        var i int
+        if _, err := fmt.Sscanf(key, "%d", &i); err == nil && fmt.Sprint(i) == key {
+            if i < 0 || i >= len(v) {
+                return memoryMissing
+            }
+            return memoryLookup(v[i], rest)
+        }
+        var values []interface{}
+        for _, item := range v {
+            if sub := memoryLookup(item, path); sub != memoryMissing {
+                values = append(values, sub)
+            }
+        }
+        if values == nil {
+            return memoryMissing
+        }
+        return values
+    }
+    return memoryMissing
+}
+
+// memoryMatch reports whether doc matches the query filter.
+func memoryMatch(doc M, filter M) (bool, error) {
+    for key, cond := range filter {
+        var ok bool
+        var err error
+        switch key {
+        case "$and", "$or", "$nor":
+            ok, err = memoryLogical(doc, key, cond)
+        default:
+            if strings.HasPrefix(key, "$") {
+                return false, errors.New(fmt.Sprintf("MongoDB: unsupported query operator %s", key))
+            }
+            ok, err = memoryMatchField(memoryLookup(doc, key), cond)
+        }
+        if err != nil || !ok {
+            return false, err
+        }
+    }
+    return true, nil
+}
+
+func memoryLogical(doc M, op string, cond interface{}) (bool, error) {
+    clauses, ok := cond.([]interface{})
+    if !ok || len(clauses) == 0 {
+        return false, errors.New(fmt.Sprintf("MongoDB: %s needs a non-empty array", op))
+    }
+    for _, clause := range clauses {
+        filter, ok := clause.(M)
+        if !ok {
+            return false, errors.New(fmt.Sprintf("MongoDB: %s needs an array of documents", op))
+        }
+        ok, err := memoryMatch(doc, filter)
+        if err != nil {
+            return false, err
+        }
+        switch {
+        case op == "$and" && !ok:
+            return false, nil
+        case op == "$or" && ok:
+            return true, nil
+        case op == "$nor" && ok:
+            return false, nil
+        }
+    }
+    return op != "$or", nil
+}
+
+// memoryMatchField reports whether the value v of a field matches cond,
+// which is either a value to compare to or a document of operators.
+func memoryMatchField(v interface{}, cond interface{}) (bool, error) {
+    ops, ok := cond.(M)
+    if !ok || len(ops) == 0 {
+        return memoryMatchValue(v, cond), nil
+    }
+    for op := range ops {
+        if !strings.HasPrefix(op, "$") {
+            return memoryMatchValue(v, cond), nil
+        }
+    }
+    for op, arg := range ops {
+        var ok bool
+        switch op {
+        case "$eq":
+            ok = memoryMatchValue(v, arg)
+        case "$ne":
+            ok = !memoryMatchValue(v, arg)
+        case "$gt", "$gte", "$lt", "$lte":
+            ok = memoryAny(v, func(item interface{}) bool {
+                if memoryClass(item) != memoryClass(arg) {
+                    return false
+                }
+                c := memoryCompare(item, arg)
+                switch op {
+                case "$gt":
+                    return c > 0
+                case "$gte":
+                    return c >= 0
+                case "$lt":
+                    return c < 0
+                }
+                return c <= 0
+            })
+        case "$in", "$nin":
+            values, isArray := arg.([]interface{})
+            if !isArray {
+                return false, errors.New(fmt.Sprintf("MongoDB: %s needs an array", op))
+            }
+            for _, value := range values {
+                if ok = memoryMatchValue(v, value); ok {
+                    break
+                }
+            }
+            if op == "$nin" {
+                ok = !ok
+            }
+        case "$exists":
+            ok = (v != memoryMissing) == memoryTruthy(arg)
+        default:
+            return false, errors.New(fmt.Sprintf("MongoDB: unsupported query operator %s", op))
+        }
+        if !ok {
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+// memoryMatchValue reports whether v equals value, or is an array holding
+// it. A null value matches missing fields.
+func memoryMatchValue(v interface{}, value interface{}) bool {
+    if v == memoryMissing {
+        return value == nil
+    }
+    if memoryEqual(v, value) {
+        return true
+    }
+    if arr, ok := v.([]interface{}); ok {
+        for _, item := range arr {
+            if memoryEqual(item, value) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// memoryAny reports whether f holds for v or, for an array, one of its
+// items.
+func memoryAny(v interface{}, f func(interface{}) bool) bool {
+    if v == memoryMissing {
+        return false
+    }
+    if arr, ok := v.([]interface{}); ok {
+        for _, item := range arr {
+            if f(item) {
+                return true
+            }
+        }
+        return false
+    }
+    return f(v)
+}
+
+func memoryEqual(a, b interface{}) bool {
+    if memoryClass(a) != memoryClass(b) {
+        return false
+    }
+    return memoryCompare(a, b) == 0
+}
+
+func memoryTruthy(v interface{}) bool {
+    if b, ok := v.(bool); ok {
+        return b
+    }
+    if n, ok := memoryNumber(v); ok {
+        return n != 0
+    }
+    return v != nil
+}
+
+func memoryNumber(v interface{}) (float64, bool) {
+    switch n := v.(type) {
+    case int:
+        return float64(n), true
+    case int32:
+        return float64(n), true
+    case int64:
+        return float64(n), true
+    case float64:
+        return n, true
+    }
+    return 0, false
+}
+
+// memoryClass returns the rank of the type of v in the sort order of the
+// server.
+func memoryClass(v interface{}) int {
+    if _, ok := memoryNumber(v); ok {
+        return 2
+    }
+    switch v.(type) {
+    case nil:
+        return 1
+    case string, Symbol:
+        return 3
+    case M:
+        return 4
+    case []interface{}:
+        return 5
+    case Binary, []byte:
+        return 6
+    case ObjectId:
+        return 7
+    case bool:
+        return 8
+    case time.Time:
+        return 9
+    }
+    if v == memoryMissing {
+        return 0
+    }
+    return 10
+}
+
+// memoryCompare returns -1, 0 or 1 as a sorts before, as or after b.
+func memoryCompare(a, b interface{}) int {
+    ca, cb := memoryClass(a), memoryClass(b)
+    if ca != cb {
+        if ca < cb {
+            return -1
+        }
+        return 1
+    }
+    switch a := a.(type) {
+    case string:
+        return strings.Compare(a, memoryString(b))
+    case Symbol:
+        return strings.Compare(string(a), memoryString(b))
+    case ObjectId:
+        return bytes.Compare([]byte(a), []byte(b.(ObjectId)))
+    case []byte, Binary:
+        // by length, then subtype, then bytes, as the server
+        x, y := memoryBinary(a), memoryBinary(b)
+        if c := memoryCompare(len(x.Data), len(y.Data)); c != 0 {
+            return c
+        }
+        if c := memoryCompare(int(x.Kind), int(y.Kind)); c != 0 {
+            return c
+        }
+        return bytes.Compare(x.Data, y.Data)
+    case bool:
+        if a == b.(bool) {
+            return 0
+        }
+        if a {
+            return 1
+        }
+        return -1
+    case time.Time:
+        switch bt := b.(time.Time); {
+        case a.Before(bt):
+            return -1
+        case a.After(bt):
+            return 1
+        }
+        return 0
+    case M:
+        // the fields of a M have no order, they are compared by key
+        bm := b.(M)
+        ka, kb := memoryKeys(a), memoryKeys(bm)
+        for i := 0; i < len(ka) && i < len(kb); i++ {
+            if c := strings.Compare(ka[i], kb[i]); c != 0 {
+                return c
+            }
+            if c := memoryCompare(a[ka[i]], bm[kb[i]]); c != 0 {
+                return c
+            }
+        }
+        return memoryCompare(len(ka), len(kb))
+    case []interface{}:
+        bs := b.([]interface{})
+        for i := 0; i < len(a) && i < len(bs); i++ {
+            if c := memoryCompare(a[i], bs[i]); c != 0 {
+                return c
+            }
+        }
+        return memoryCompare(len(a), len(bs))
+    }
+    if x, ok := memoryNumber(a); ok {
+        y, _ := memoryNumber(b)
+        switch {
+        case x < y:
+            return -1
+        case x > y:
+            return 1
+        }
+        return 0
+    }
+    if reflect.DeepEqual(a, b) {
+        return 0
+    }
+    return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func memoryString(v interface{}) string {
+    if s, ok := v.(Symbol); ok {
+        return string(s)
+    }
+    return v.(string)
+}
+
+func memoryBinary(v interface{}) Binary {
+    if data, ok := v.([]byte); ok {
+        return Binary{Kind: bson.BinaryGeneric, Data: data}
+    }
+    return v.(Binary)
+}
+
+// memoryKeys returns the keys of m, sorted.
+func memoryKeys(m M) []string {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -0,0 +1,143 @@
+package libgomongo
+
+import (
+    "github.com/couchbaselabs/go.assert"
+    "testing"
+)
+
+type testPerson struct {
+    Name string
+    Age  int
+    Tags []string `bson:"tags,omitempty"`
+}
+
+// testDataLayer exercises db through the interfaces only, so that it runs
+// the same against a server and against the memory database.
+func testDataLayer(t *testing.T, db DatabaseAPI) {
+    people := db.Collection("api_people")
+    people.RemoveAll(nil, nil)
+    for _, p := range []testPerson{
+        {Name: "Ann", Age: 31, Tags: []string{"admin", "dev"}},
+        {Name: "Bob", Age: 25},
+        {Name: "Cid", Age: 42, Tags: []string{"dev"}},
+        {Name: "Dee", Age: 25, Tags: []string{"ops"}},
+    } {
+        _, err := people.Insert(p, nil)
+        assert.Equals(t, err, nil)
+    }
+
+    n, err := people.Count(M{"age": M{"$gt": 25}})
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, int64(2))
+
+    var all []testPerson
+    q := people.Query(M{"age": 25}).WithSort(D{{Name: "name", Value: -1}})
+    assert.Equals(t, q.All(&all), nil)
+    assert.DeepEquals(t, all, []testPerson{{Name: "Dee", Age: 25, Tags: []string{"ops"}}, {Name: "Bob", Age: 25}})
+
+    var names []M
+    q = people.Query(M{"$or": []M{{"tags": "admin"}, {"age": M{"$lt": 30}}}}).
+        WithSort(D{{Name: "age", Value: 1}, {Name: "name", Value: 1}}).
+        WithFields(M{"name": 1, "_id": 0}).WithSkip(1).WithLimit(2)
+    assert.Equals(t, q.All(&names), nil)
+    assert.DeepEquals(t, names, []M{{"name": "Dee"}, {"name": "Ann"}})
+    count, err := q.Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, count, 2)
+
+    var p testPerson
+    q = people.Query(M{"tags": M{"$in": []string{"ops", "qa"}}})
+    assert.Equals(t, q.One(&p), nil)
+    assert.Equals(t, p.Name, "Dee")
+    q = people.Query(M{"tags": M{"$exists": false}, "age": M{"$gt": 30}})
+    assert.Equals(t, q.One(&p), ErrNotFound)
+
+    iter := people.Query(M{"$and": []M{{"age": M{"$gt": 20}}, {"age": M{"$lt": 40}}}}).WithSort(M{"name": 1}).Iter()
+    got := []string{}
+    for iter.Next(&p) {
+        got = append(got, p.Name)
+    }
+    assert.Equals(t, iter.Close(), nil)
+    assert.DeepEquals(t, got, []string{"Ann", "Bob", "Dee"})
+
+    var tags []string
+    assert.Equals(t, people.Query(M{"age": M{"$gte": 31}}).Distinct("tags", &tags), nil)
+    assert.Equals(t, len(tags), 2)
+
+    info, err := people.Update(M{"name": "Cid"}, M{"$set": M{"age": 43}, "$inc": M{"visits": 1}}, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info.Updated, 1)
+    var visited M
+    assert.Equals(t, people.Query(M{"visits": 1}).WithFields(M{"_id": 0, "tags": 0}).One(&visited), nil)
+    assert.DeepEquals(t, visited, M{"name": "Cid", "age": 43, "visits": 1})
+    _, err = people.Update(M{"name": "Cid"}, testPerson{Name: "Cid", Age: 44}, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, people.Query(M{"name": "Cid"}).One(&p), nil)
+    assert.Equals(t, p.Age, 44)
+    _, err = people.Update(M{"name": "Zed"}, M{"$set": M{"age": 1}}, nil)
+    assert.Equals(t, err, ErrNotFound)
+
+    info, err = people.Remove(M{"age": 25}, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info.Removed, 1)
+    info, err = people.RemoveAll(M{"age": M{"$eq": 25}}, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info.Removed, 1)
+    _, err = people.RemoveId(NewObjectId(), nil)
+    assert.Equals(t, err, ErrNotFound)
+}
+
+func TestMemoryDB(t *testing.T) {
+    db := NewMemoryDB("libgomongo-test")
+    testDataLayer(t, db)
+
+    people := db.Collection("api_people")
+    id := ObjectIdHex("5c9bd5b1e1382b3b2c5f0a11")
+    _, err := people.Insert(M{"_id": id, "name": "Eve", "address": M{"city": "Oslo"}}, nil)
+    assert.Equals(t, err, nil)
+    _, err = people.Insert(M{"_id": id}, nil)
+    assert.NotEquals(t, err, nil)
+    _, err = people.Insert(M{"a.b": 1}, nil)
+    assert.NotEquals(t, err, nil)
+    _, err = people.Insert(M{"big": uint64(1 << 63)}, nil)
+    assert.Equals(t, err.Error(), `bson: 9223372036854775808 for "big" overflows an int64`)
+
+    var doc M
+    q := people.Query(M{"address.city": "Oslo"}).WithFields(M{"address": 0})
+    assert.Equals(t, q.One(&doc), nil)
+    assert.DeepEquals(t, doc, M{"_id": id, "name": "Eve"})
+
+    q = people.Query(M{"age": M{"$near": 1}})
+    assert.NotEquals(t, q.One(&doc), nil)
+
+    // the documents of arrays are validated too
+    _, err = people.Insert(M{"items": []M{{"$bad": 1}}}, nil)
+    assert.NotEquals(t, err, nil)
+
+    // ObjectIds sort by their bytes, and documents field by field
+    ids := people.Query(M{"_id": M{"$lt": ObjectIdHex("5c9bd5b1e1382b3b2c5f0a12")}})
+    n, err := ids.Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1)
+    _, err = people.Update(M{"_id": id}, M{"$set": M{"pos": M{"x": 2, "y": 1}}}, nil)
+    assert.Equals(t, err, nil)
+    n, err = people.Query(M{"pos": M{"$gt": M{"x": 1, "y": 9}}}).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1)
+    n, err = people.Query(M{"pos": M{"$lt": M{"x": 2, "y": 0}}}).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 0)
+
+    var res struct {
+        N int
+    }
+    assert.Equals(t, db.Run(D{{Name: "count", Value: "api_people"}, {Name: "query", Value: M{"name": M{"$ne": "Eve"}}}}, &res), nil)
+    assert.Equals(t, res.N, 2)
+    assert.Equals(t, db.Run("ping", nil), nil)
+    assert.Equals(t, db.Run(M{"drop": "api_people"}, nil), nil)
+    count, err := people.Count(nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, count, int64(0))
+    assert.NotEquals(t, db.Run(M{"drop": "api_people"}, nil), nil)
+    assert.NotEquals(t, db.Run("eval", nil), nil)
+}
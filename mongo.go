@@ -2,12 +2,22 @@ package libgomongo
 
 // #cgo CFLAGS: -std=gnu99 -I./mongo-c-driver/src/
 // #cgo LDFLAGS: -L./mongo-c-driver/src/ -lmongoc
+// #include <stdlib.h>
 // #include "mongo.h"
+// #include "env.h"
 import "C"
 
 import (
+    "context"
+    "encoding/binary"
     "errors"
-    // "fmt"
+    "fmt"
+    "github.com/QLeelulu/libgomongo/bson"
+    "log/slog"
+    "strings"
+    "sync/atomic"
+    "time"
+    "unsafe"
     // "tim
 )
 
@@ -48,25 +58,104 @@ const (
     MONGO_CURSOR_BSON_ERROR                    // Something is wrong with the BSON provided. See conn->err for details.
 )
 
+// Cursor options, see Cursor.SetOptions.
+const (
+    MONGO_TAILABLE          = (1 << 1) /**< Create a tailable cursor. */
+    MONGO_SLAVE_OK          = (1 << 2) /**< Allow queries on a non-primary node. */
+    MONGO_NO_CURSOR_TIMEOUT = (1 << 4) /**< Disable cursor timeouts. */
+    MONGO_AWAIT_DATA        = (1 << 5) /**< Momentarily block for more data. */
+    MONGO_EXHAUST           = (1 << 6) /**< Stream in multiple 'more' packages. */
+    MONGO_PARTIAL           = (1 << 7) /**< Allow reads even if a shard is down. */
+)
+
+// Operation codes of the wire protocol.
+const (
+    MONGO_OP_MSG          = 1000
+    MONGO_OP_UPDATE       = 2001
+    MONGO_OP_INSERT       = 2002
+    MONGO_OP_QUERY        = 2004
+    MONGO_OP_GET_MORE     = 2005
+    MONGO_OP_DELETE       = 2006
+    MONGO_OP_KILL_CURSORS = 2007
+)
+
+// Index options, see Mongo.CreateIndex.
+const (
+    MONGO_INDEX_UNIQUE     = (1 << 0)
+    MONGO_INDEX_DROP_DUPS  = (1 << 2)
+    MONGO_INDEX_BACKGROUND = (1 << 3)
+    MONGO_INDEX_SPARSE     = (1 << 4)
+)
+
+// OP_DELETE flags, see Mongo.RemoveFlags.
+const (
+    MONGO_DELETE_SINGLE = 0x1 /**< Remove only the first matching document. */
+)
+
+// Update flags, see Mongo.Update.
+const (
+    MONGO_UPDATE_UPSERT = 0x1 /**< Insert the document when none matches. */
+    MONGO_UPDATE_MULTI  = 0x2 /**< Update every matching document. */
+)
+
+// Insert flags, see Mongo.InsertBatch.
+const (
+    MONGO_CONTINUE_ON_ERROR = 0x1 /**< Insert the next documents of a batch after an error. */
+)
+
+// Request ids of the messages sent without the C driver.
+var requestId int32
+
 // M is a shortcut for writing map[string]interface{} in BSON literal
-// expressions. The type M is encoded the same as the type
-// map[string]interface{}.
-type M map[string]interface{}
+// expressions, see bson.M.
+type M = bson.M
+
+// D is a BSON document that preserves the order of its elements, see
+// bson.D. It is accepted wherever a M is.
+type D = bson.D
+
+// DocElem is an element of a D document.
+type DocElem = bson.DocElem
 
 type Mongo struct {
     conn *C.mongo
     pool *Pool
+
+    readPref    *ReadPreference
+    members     *members // connections to the replica set members
+    slaveOk     bool     // set on the connections to secondaries
+    retryPolicy *RetryPolicy
+    credentials []credential // authenticated, to authenticate again on reconnect
+    monitor     *topologyMonitor
+    poolGen     uint64 // generation of the pool the connection was created in
+    opMonitor   Monitor
+    ctx         context.Context // given to opMonitor
+    logger      *slog.Logger
+    slowQuery   time.Duration // threshold of the slow query logs
+    slowExplain bool          // whether the slow queries are explained
+    cursors     cursorRefs    // cursors open on the connection, see retire
+}
+
+type credential struct {
+    db, user, pass string
 }
 
 type Cursor struct {
-    Conn   *Mongo
-    cursor *C.mongo_cursor
+    Conn     *Mongo
+    cursor   *C.mongo_cursor
+    retained bool // counted in the cursors of Conn
 }
 
 type MongoWriteConcern struct {
     writeConcern *C.mongo_write_concern
 }
 
+func NewMongoWriteConcern() *MongoWriteConcern {
+    wc := &MongoWriteConcern{}
+    wc.writeConcern = &C.mongo_write_concern{}
+    return wc
+}
+
 func NewMongo() *Mongo {
     m := &Mongo{}
     m.conn = &C.mongo{}
@@ -102,10 +191,15 @@ CRUD API
 // MONGO_EXPORT int mongo_insert( mongo *conn, const char *ns, const bson *data,
 //                                mongo_write_concern *custom_write_concern );
 func (m *Mongo) Insert(ns string, data *Bson, writeConcern *MongoWriteConcern) int {
+    t := m.startOp("insert", ns, nil, 1)
+    var r int
     if writeConcern == nil {
-        return int(C.mongo_insert(m.conn, C.CString(ns), data._bson, nil))
+        r = int(C.mongo_insert(m.conn, C.CString(ns), data._bson, nil))
+    } else {
+        r = int(C.mongo_insert(m.conn, C.CString(ns), data._bson, writeConcern.writeConcern))
     }
-    return int(C.mongo_insert(m.conn, C.CString(ns), data._bson, writeConcern.writeConcern))
+    t.endStatus(r)
+    return r
 }
 
 /**
@@ -129,6 +223,34 @@ func (m *Mongo) Insert(ns string, data *Bson, writeConcern *MongoWriteConcern) i
 // MONGO_EXPORT int mongo_insert_batch( mongo *conn, const char *ns,
 //                                      const bson **data, int num, mongo_write_concern *custom_write_concern,
 //                                      int flags );
+func (m *Mongo) InsertBatch(ns string, data []*Bson, writeConcern *MongoWriteConcern, flags int) int {
+    n := len(data)
+    if n == 0 {
+        return MONGO_OK
+    }
+    // the C driver gets an array of pointers, which is copied into C memory
+    // along with the bson structs
+    structs := (*C.bson)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.bson{}))))
+    defer C.free(unsafe.Pointer(structs))
+    ptrs := (**C.bson)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(structs))))
+    defer C.free(unsafe.Pointer(ptrs))
+    s, p := unsafe.Slice(structs, n), unsafe.Slice(ptrs, n)
+    for i, b := range data {
+        s[i] = *b._bson
+        p[i] = &s[i]
+    }
+
+    t := m.startOp("insert", ns, nil, n)
+    var r int
+    if writeConcern == nil {
+        r = int(C.mongo_insert_batch(m.conn, C.CString(ns), ptrs, C.int(n), nil, C.int(flags)))
+    } else {
+        r = int(C.mongo_insert_batch(m.conn, C.CString(ns), ptrs, C.int(n),
+            writeConcern.writeConcern, C.int(flags)))
+    }
+    t.endStatus(r)
+    return r
+}
 
 /**
  * Update a document in a MongoDB server.
@@ -149,11 +271,16 @@ func (m *Mongo) Insert(ns string, data *Bson, writeConcern *MongoWriteConcern) i
 // MONGO_EXPORT int mongo_update( mongo *conn, const char *ns, const bson *cond,
 //                                const bson *op, int flags, mongo_write_concern *custom_write_concern );
 func (m *Mongo) Update(ns string, cond, op *Bson, flags int, writeConcern *MongoWriteConcern) int {
+    t := m.startOp("update", ns, cond, 0)
+    var r int
     if writeConcern == nil {
-        return int(C.mongo_update(m.conn, C.CString(ns), cond._bson, op._bson, C.int(flags), nil))
+        r = int(C.mongo_update(m.conn, C.CString(ns), cond._bson, op._bson, C.int(flags), nil))
+    } else {
+        r = int(C.mongo_update(m.conn, C.CString(ns), cond._bson,
+            op._bson, C.int(flags), writeConcern.writeConcern))
     }
-    return int(C.mongo_update(m.conn, C.CString(ns), cond._bson,
-        op._bson, C.int(flags), writeConcern.writeConcern))
+    t.endStatus(r)
+    return r
 }
 
 /**
@@ -172,10 +299,54 @@ func (m *Mongo) Update(ns string, cond, op *Bson, flags int, writeConcern *Mongo
 // MONGO_EXPORT int mongo_remove( mongo *conn, const char *ns, const bson *cond,
 //                                mongo_write_concern *custom_write_concern );
 func (m *Mongo) Remove(ns string, cond *Bson, writeConcern *MongoWriteConcern) int {
+    t := m.startOp("remove", ns, cond, 0)
+    var r int
     if writeConcern == nil {
-        return int(C.mongo_remove(m.conn, C.CString(ns), cond._bson, nil))
+        r = int(C.mongo_remove(m.conn, C.CString(ns), cond._bson, nil))
+    } else {
+        r = int(C.mongo_remove(m.conn, C.CString(ns), cond._bson, writeConcern.writeConcern))
+    }
+    t.endStatus(r)
+    return r
+}
+
+/**
+ * Remove documents from a MongoDB server with the given OP_DELETE flags.
+ * With MONGO_DELETE_SINGLE only the first matching document is removed.
+ *
+ * Unlike Remove, no getlasterror is sent whatever the write concern, so
+ * the caller must ask for it to learn the outcome of the operation.
+ *
+ * @param conn a mongo object.
+ * @param ns the namespace.
+ * @param cond the bson query.
+ * @param flags a bitfield of OP_DELETE flags.
+ *
+ * @return MONGO_OK or MONGO_ERROR with error stored in conn object.
+ */
+func (m *Mongo) RemoveFlags(ns string, cond *Bson, flags int) int {
+    if cond._bson == nil || cond._bson.finished == 0 {
+        m.conn.err = C.MONGO_BSON_NOT_FINISHED
+        return MONGO_ERROR
     }
-    return int(C.mongo_remove(m.conn, C.CString(ns), cond._bson, writeConcern.writeConcern))
+    if C.mongo_validate_ns(m.conn, C.CString(ns)) != MONGO_OK {
+        return MONGO_ERROR
+    }
+    data := C.GoBytes(unsafe.Pointer(C.bson_data(cond._bson)), C.bson_size(cond._bson))
+
+    // header, ZERO, ns, flags, selector
+    msg := make([]byte, 20, 20+len(ns)+1+4+len(data))
+    msg = append(msg, ns...)
+    msg = append(msg, 0, 0, 0, 0, 0)
+    binary.LittleEndian.PutUint32(msg[len(msg)-4:], uint32(flags))
+    msg = append(msg, data...)
+    binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+    binary.LittleEndian.PutUint32(msg[4:], uint32(atomic.AddInt32(&requestId, 1)))
+    binary.LittleEndian.PutUint32(msg[12:], MONGO_OP_DELETE)
+    t := m.startOp("remove", ns, cond, 0)
+    r := int(C.mongo_env_write_socket(m.conn, unsafe.Pointer(&msg[0]), C.size_t(len(msg))))
+    t.endStatus(r)
+    return r
 }
 
 /*********************************************************************
@@ -187,6 +358,9 @@ Write Concern API
 //  *
 //  */
 // MONGO_EXPORT void mongo_write_concern_init( mongo_write_concern *write_concern );
+func (wc *MongoWriteConcern) Init() {
+    C.mongo_write_concern_init(wc.writeConcern)
+}
 
 // /**
 //  * Finish this write concern object by serializing the literal getlasterror
@@ -196,12 +370,18 @@ Write Concern API
 //  *
 //  */
 // MONGO_EXPORT int mongo_write_concern_finish( mongo_write_concern *write_concern );
+func (wc *MongoWriteConcern) Finish() int {
+    return int(C.mongo_write_concern_finish(wc.writeConcern))
+}
 
 // /**
 //  * Free the write_concern object (specifically, the BSON that it owns).
 //  *
 //  */
 // MONGO_EXPORT void mongo_write_concern_destroy( mongo_write_concern *write_concern );
+func (wc *MongoWriteConcern) Destroy() {
+    C.mongo_write_concern_destroy(wc.writeConcern)
+}
 
 /*********************************************************************
 Cursor API
@@ -231,15 +411,29 @@ func (m *Mongo) Find(ns string, query *Bson, fields *Bson, limit, skip, options
     if fields == nil {
         fields = &Bson{}
     }
+    t := m.startOp("find", ns, query, 0)
     c := C.mongo_find(m.conn, C.CString(ns), query._bson,
         fields._bson, C.int(limit), C.int(skip), C.int(options))
     if c == nil {
-        // error need check
-        return nil, errors.New("has error: " + m.Error().Error())
+        err := m.queryError()
+        if err == nil {
+            err = &OpError{Code: MONGO_COMMAND_FAILED, Err: errors.New(errString(nil))}
+        }
+        err = prefixError("has error: ", err)
+        if t != nil {
+            t.end(err)
+        }
+        return nil, err
     }
     c2 := &Cursor{
+        Conn:   m,
         cursor: c,
     }
+    c2.retain()
+    if t != nil {
+        t.event.Documents = c2.batchSize()
+        t.end(nil)
+    }
     return c2, nil
 }
 
@@ -254,6 +448,7 @@ func (m *Mongo) Find(ns string, query *Bson, fields *Bson, limit, skip, options
 func (cur *Cursor) Init(conn *Mongo, ns string) {
     cur.Conn = conn
     C.mongo_cursor_init(cur.cursor, conn.conn, C.CString(ns))
+    cur.retain()
 }
 
 /**
@@ -355,7 +550,93 @@ func (cur *Cursor) Current() *Bson {
 //  */
 // MONGO_EXPORT int mongo_cursor_next( mongo_cursor *cursor );
 func (cur *Cursor) Next() int {
-    return int(C.mongo_cursor_next(cur.cursor))
+    var t *opTrace
+    if cur.Conn != nil && cur.Conn.traced() {
+        if cur.cursor.flags&C.MONGO_CURSOR_QUERY_SENT == 0 {
+            // a cursor built with Init, which sends its query now
+            var query *Bson
+            if cur.cursor.query != nil {
+                query = &Bson{_bson: (*C.bson)(unsafe.Pointer(cur.cursor.query))}
+            }
+            t = cur.Conn.startOp("find", C.GoString(cur.cursor.ns), query, 0)
+        } else if cur.sendsGetMore() {
+            t = cur.Conn.startOp("getMore", C.GoString(cur.cursor.ns), nil, 0)
+        }
+    }
+    connErr := MONGO_CONN_SUCCESS
+    if t != nil {
+        connErr = cur.Conn.ErrNo()
+    }
+    r := int(C.mongo_cursor_next(cur.cursor))
+    if t != nil {
+        var err error
+        if r != MONGO_OK {
+            switch {
+            case cur.Conn.ErrNo() != connErr && cur.Conn.ErrNo() != MONGO_CONN_SUCCESS:
+                err = cur.Conn.Error()
+            case cur.ErrNo() == MONGO_CURSOR_QUERY_FAIL:
+                err = &OpError{Code: MONGO_COMMAND_FAILED, ServerCode: cur.Conn.LastErrCode(), Err: cur.Error()}
+            case cur.ErrNo() != MONGO_CURSOR_EXHAUSTED && cur.ErrNo() != MONGO_CURSOR_PENDING:
+                err = &OpError{Code: MONGO_COMMAND_FAILED, Err: cur.Error()}
+            }
+        }
+        t.event.Documents = cur.batchSize()
+        t.end(err)
+    }
+    return r
+}
+
+// sendsGetMore reports whether the next call of Next fetches the next
+// batch of results from the server, as mongo_cursor_next does when the
+// documents of the last reply are all seen.
+func (cur *Cursor) sendsGetMore() bool {
+    c := cur.cursor
+    if c.reply == nil || c.reply.fields.cursorID == 0 || (c.limit != 0 && c.seen >= c.limit) {
+        return false
+    }
+    if c.reply.fields.num == 0 {
+        return true
+    }
+    if c.current.data == nil {
+        return false
+    }
+    next := uintptr(unsafe.Pointer(c.current.data)) + uintptr(C.bson_size(&c.current))
+    end := uintptr(unsafe.Pointer(c.reply)) + uintptr(c.reply.head.len)
+    return next >= end
+}
+
+// batchSize returns the number of documents of the last reply of the
+// cursor.
+func (cur *Cursor) batchSize() int {
+    if cur.cursor.reply == nil {
+        return 0
+    }
+    return int(cur.cursor.reply.fields.num)
+}
+
+// The error set on the cursor by the last call of Next.
+func (cur *Cursor) ErrNo() CursorError {
+    return CursorError(cur.cursor.err)
+}
+
+func (cur *Cursor) Error() error {
+    var err error
+    status := cur.ErrNo()
+    switch status {
+    case MONGO_CURSOR_EXHAUSTED:
+        err = errors.New("MongoDB: The cursor has no more results.")
+    case MONGO_CURSOR_INVALID:
+        err = errors.New("MongoDB: The cursor has timed out or is not recognized.")
+    case MONGO_CURSOR_PENDING:
+        err = errors.New("MongoDB: Tailable cursor still alive but no data.")
+    case MONGO_CURSOR_QUERY_FAIL:
+        err = errors.New("MongoDB: The query failed: " + C.GoString(&cur.cursor.conn.lasterrstr[0]))
+    case MONGO_CURSOR_BSON_ERROR:
+        err = errors.New("MongoDB: Something is wrong with the BSON provided.")
+    default:
+        err = errors.New(fmt.Sprintf("MongoDB: Unkonw cursor error[%d]", status))
+    }
+    return err
 }
 
 // /**
@@ -369,7 +650,9 @@ func (cur *Cursor) Next() int {
 //  */
 // MONGO_EXPORT int mongo_cursor_destroy( mongo_cursor *cursor );
 func (cur *Cursor) Destroy() int {
-    return int(C.mongo_cursor_destroy(cur.cursor))
+    r := int(C.mongo_cursor_destroy(cur.cursor))
+    cur.release()
+    return r
 }
 
 func (c *Cursor) GetIterator() *BsonIterator {
@@ -392,7 +675,43 @@ func (c *Cursor) GetIterator() *BsonIterator {
 // MONGO_EXPORT int mongo_find_one( mongo *conn, const char *ns, const bson *query,
 //                                  const bson *fields, bson *out );
 func (m *Mongo) FindOne(ns string, query, fields, out *Bson) int {
-    return int(C.mongo_find_one(m.conn, C.CString(ns), query._bson, fields._bson, out._bson))
+    if m.slaveOk {
+        return m.findOneSlaveOk(ns, query, fields, out)
+    }
+    t := m.startOp("find", ns, query, 0)
+    r := int(C.mongo_find_one(m.conn, C.CString(ns), query._bson, fields._bson, out._bson))
+    if t != nil {
+        switch {
+        case r == MONGO_OK && strings.HasSuffix(ns, ".$cmd"):
+            t.end(commandError(out))
+        case r == MONGO_OK:
+            t.event.Documents = 1
+            t.end(nil)
+        case m.Error() == nil:
+            // no document matched
+            t.end(nil)
+        default:
+            t.endStatus(r)
+        }
+    }
+    return r
+}
+
+// findOneSlaveOk is mongo_find_one with the MONGO_SLAVE_OK option, for the
+// connections to secondaries.
+func (m *Mongo) findOneSlaveOk(ns string, query, fields, out *Bson) int {
+    cur, err := m.Find(ns, query, fields, -1, 0, MONGO_SLAVE_OK)
+    if err != nil {
+        return MONGO_ERROR
+    }
+    defer cur.Destroy()
+    if cur.Next() != MONGO_OK {
+        return MONGO_ERROR
+    }
+    if out != nil && out._bson != nil {
+        C.bson_copy(out._bson, cur.Current()._bson)
+    }
+    return MONGO_OK
 }
 
 // /*********************************************************************
@@ -416,7 +735,14 @@ func (m *Mongo) Count(db, coll string, query *Bson) int64 {
     if query == nil {
         query = &Bson{}
     }
-    return int64(C.mongo_count(m.conn, C.CString(db), C.CString(coll), query._bson))
+    t := m.startOp("count", db+"."+coll, query, 0)
+    r := int64(C.mongo_count(m.conn, C.CString(db), C.CString(coll), query._bson))
+    if r == MONGO_ERROR {
+        t.endStatus(MONGO_ERROR)
+    } else {
+        t.end(nil)
+    }
+    return r
 }
 
 // /**
@@ -435,6 +761,17 @@ func (m *Mongo) Count(db, coll string, query *Bson) int64 {
 //  */
 // MONGO_EXPORT int mongo_create_index( mongo *conn, const char *ns, const bson *key,
 //                                      const char *name, int options, bson *out );
+func (m *Mongo) CreateIndex(ns string, key *Bson, name string, options int, out *Bson) int {
+    var _name *C.char
+    if name != "" {
+        _name = C.CString(name)
+    }
+    var _out *C.bson
+    if out != nil {
+        _out = out._bson
+    }
+    return int(C.mongo_create_index(m.conn, C.CString(ns), key._bson, _name, C.int(options), _out))
+}
 
 // *
 //  * Create a capped collection.
@@ -477,6 +814,17 @@ func (m *Mongo) Count(db, coll string, query *Bson) int64 {
 //  */
 // MONGO_EXPORT int mongo_run_command( mongo *conn, const char *db,
 //                                     const bson *command, bson *out );
+func (m *Mongo) RunCommand(db string, command, out *Bson) int {
+    t := m.startOp("command", db+".$cmd", command, 0)
+    var r int
+    if out == nil {
+        r = int(C.mongo_run_command(m.conn, C.CString(db), command._bson, nil))
+    } else {
+        r = int(C.mongo_run_command(m.conn, C.CString(db), command._bson, out._bson))
+    }
+    t.endStatus(r)
+    return r
+}
 
 // /**
 //  * Run a command that accepts a simple string key and integer value.
@@ -556,6 +904,27 @@ func (m *Mongo) Count(db, coll string, query *Bson) int64 {
 //  */
 // MONGO_EXPORT int mongo_cmd_authenticate( mongo *conn, const char *db,
 //         const char *user, const char *pass );
+//
+// The credentials are kept to authenticate again when the connection is
+// reconnected by its RetryPolicy.
+func (m *Mongo) Authenticate(db, user, pass string) int {
+    cred := credential{db: db, user: user, pass: pass}
+    r := m.authenticate(cred)
+    if r == MONGO_OK {
+        for i, c := range m.credentials {
+            if c.db == db {
+                m.credentials = append(m.credentials[:i:i], m.credentials[i+1:]...)
+                break
+            }
+        }
+        m.credentials = append(m.credentials, cred)
+    }
+    return r
+}
+
+func (m *Mongo) authenticate(cred credential) int {
+    return int(C.mongo_cmd_authenticate(m.conn, C.CString(cred.db), C.CString(cred.user), C.CString(cred.pass)))
+}
 
 // /**
 //  * Check if the current server is a master.
@@ -1,9 +1,11 @@
 package libgomongo
 
 import (
+    "context"
     // "fmt"
     "github.com/couchbaselabs/go.assert"
     "testing"
+    "time"
 )
 
 func TestInsert(t *testing.T) {
@@ -75,6 +77,180 @@ func TestCount(t *testing.T) {
     assert.Equals(t, count, int64(1))
 }
 
+func TestQueryCount(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    col := conn.Db("libgomongo-test").C("people")
+    n, err := col.Find(nil).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 2)
+
+    n, err = col.Find(nil).Skip(1).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1)
+
+    n, err = col.Find(M{"age": M{"$gt": 10}}).Limit(1).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1)
+}
+
+func TestExplain(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    col := conn.Db("libgomongo-test").C("people")
+    explain := M{}
+    err := col.Find(M{"name": "Joe"}).Sort(M{"age": -1}).Explain(&explain)
+    assert.Equals(t, err, nil)
+    _, ok := explain["cursor"]
+    assert.Equals(t, ok, true)
+}
+
+func TestDistinct(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    col := conn.Db("libgomongo-test").C("people")
+    var names []string
+    err := col.Find(nil).Distinct("name", &names)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, len(names), 2)
+
+    var ages []int
+    err = col.Find(M{"name": "Joe"}).Distinct("age", &ages)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, len(ages), 1)
+    assert.Equals(t, ages[0], 33)
+}
+
+func TestMapReduce(t *testing.T) {
+    requireMongod(t)
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    col := conn.Db("libgomongo-test").C("people")
+    job := &MapReduce{
+        Map:     "function() { emit(this.name, this.age * factor) }",
+        Reduce:  "function(key, values) { return Array.sum(values) }",
+        Scope:   M{"factor": 2},
+        Verbose: true,
+    }
+    var result []struct {
+        Id    string `bson:"_id"`
+        Value float64
+    }
+    info, err := col.Find(nil).MapReduce(job, &result)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info.InputCount, 2)
+    assert.Equals(t, info.Collection, "")
+    assert.NotEquals(t, info.VerboseTime, nil)
+    assert.Equals(t, len(result), 2)
+    for _, r := range result {
+        if r.Id == "Joe" {
+            assert.Equals(t, r.Value, float64(66))
+        }
+    }
+
+    job.Out = MapReduceReplace
+    job.OutCollection = "people_mr"
+    info, err = col.Find(M{"name": "Joe"}).MapReduce(job, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info.Collection, "people_mr")
+    assert.Equals(t, info.OutputCount, 1)
+}
+
+func TestStream(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    col := conn.Db("libgomongo-test").C("people")
+    results, err := col.Find(nil).Sort(M{"age": 1}).Stream(context.Background(), 1)
+    assert.Equals(t, err, nil)
+    var names []string
+    for r := range results {
+        assert.Equals(t, r.Err, nil)
+        var p struct {
+            Name string
+            Age  int
+        }
+        assert.Equals(t, r.Unmarshal(&p), nil)
+        names = append(names, p.Name)
+    }
+    assert.Equals(t, len(names), 2)
+    assert.Equals(t, names[0], "GoLang")
+
+    ctx, cancel := context.WithCancel(context.Background())
+    results, err = col.Find(nil).Stream(ctx, 0)
+    assert.Equals(t, err, nil)
+    r := <-results
+    assert.Equals(t, r.Err, nil)
+    cancel()
+    for r = range results {
+        if r.Err != nil {
+            assert.Equals(t, r.Err, context.Canceled)
+        }
+    }
+}
+
+func TestTail(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    db := conn.Db("libgomongo-test")
+    db.Run(M{"drop": "log"}, nil)
+    cmd := NewBson()
+    cmd.Init()
+    cmd.AppendString("create", "log")
+    cmd.AppendBool("capped", true)
+    cmd.AppendInt("size", 4096)
+    cmd.Finish()
+    err := db.Run(cmd, nil)
+    cmd.Destroy()
+    assert.Equals(t, err, nil)
+
+    col := db.C("log")
+    for i := 0; i < 3; i++ {
+        _, err = col.Insert(M{"n": i}, nil)
+        assert.Equals(t, err, nil)
+    }
+
+    iter := col.Find(nil).Tail(500 * time.Millisecond)
+    defer iter.Close()
+    var doc struct{ N int }
+    for i := 0; i < 3; i++ {
+        assert.Equals(t, iter.Next(&doc), true)
+        assert.Equals(t, doc.N, i)
+    }
+    assert.Equals(t, iter.Next(&doc), false)
+    assert.Equals(t, iter.Timeout(), true)
+    assert.Equals(t, iter.Err(), nil)
+
+    _, err = col.Insert(M{"n": 3}, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, iter.Next(&doc), true)
+    assert.Equals(t, doc.N, 3)
+
+    // the sort, limit and skip of the query are ignored
+    limited := col.Find(nil).Sort(M{"n": -1}).Limit(1).Skip(1).Tail(0)
+    for i := 0; i < 4; i++ {
+        assert.Equals(t, limited.Next(&doc), true)
+        assert.Equals(t, doc.N, i)
+    }
+    assert.Equals(t, limited.Next(&doc), false)
+    assert.Equals(t, limited.Close(), nil)
+
+    assert.Equals(t, iter.Close(), nil)
+    assert.Equals(t, iter.Next(&doc), false)
+    assert.Equals(t, iter.Timeout(), false)
+}
+
 func TestRemove(t *testing.T) {
     conn, status := newClient()
     assert.Equals(t, status, MONGO_OK)
@@ -82,23 +258,116 @@ func TestRemove(t *testing.T) {
 
     db := conn.Db("libgomongo-test")
     col := db.C("people")
+    _, err := col.Insert(M{"name": "Joe", "age": 34}, nil)
+    assert.Equals(t, err, nil)
     q := M{
         "name": "Joe",
     }
 
-    status, err := col.Remove(q, nil)
+    info, err := col.Remove(q, nil)
     assert.Equals(t, err, nil)
-    assert.Equals(t, status, MONGO_OK)
+    assert.Equals(t, info.Removed, 1)
 
     count, err := col.Count(nil)
     assert.Equals(t, err, nil)
-    assert.Equals(t, count, int64(1))
+    assert.Equals(t, count, int64(2))
 
-    status, err = col.Remove(nil, nil)
+    info, err = col.RemoveAll(q, nil)
     assert.Equals(t, err, nil)
-    assert.Equals(t, status, MONGO_OK)
+    assert.Equals(t, info.Removed, 1)
+
+    info, err = col.Remove(q, nil)
+    assert.Equals(t, err, ErrNotFound)
+    assert.Equals(t, info.Removed, 0)
+
+    info, err = col.RemoveAll(nil, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info.Removed, 1)
 
     count, err = col.Count(nil)
     assert.Equals(t, err, nil)
     assert.Equals(t, count, int64(0))
 }
+
+func TestRemoveId(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    col := conn.Db("libgomongo-test").C("people")
+    id := NewObjectId()
+    _, err := col.Insert(M{"_id": id, "name": "Joe"}, nil)
+    assert.Equals(t, err, nil)
+
+    info, err := col.RemoveId(id, nil)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info.Removed, 1)
+
+    _, err = col.RemoveId(id, nil)
+    assert.Equals(t, err, ErrNotFound)
+
+    wc := NewMongoWriteConcern()
+    wc.Init()
+    wc.SetW(0)
+    wc.Finish()
+    defer wc.Destroy()
+    info, err = col.RemoveAll(nil, wc)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, info, (*ChangeInfo)(nil))
+}
+
+func TestSortD(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    db := conn.Db("libgomongo-test")
+    col := db.C("sorted")
+    col.RemoveAll(nil, nil)
+    for _, doc := range []D{
+        {{Name: "last", Value: "b"}, {Name: "age", Value: 1}},
+        {{Name: "last", Value: "a"}, {Name: "age", Value: 1}},
+        {{Name: "last", Value: "a"}, {Name: "age", Value: 2}},
+    } {
+        _, err := col.Insert(doc, nil)
+        assert.Equals(t, err, nil)
+    }
+    assert.Equals(t, col.EnsureIndex(D{{Name: "last", Value: 1}, {Name: "age", Value: -1}}, 0), nil)
+
+    cur, err := col.Find(nil).Sort(D{{Name: "last", Value: 1}, {Name: "age", Value: -1}}).Fields(M{"_id": 0}).Cursor()
+    assert.Equals(t, err, nil)
+    defer cur.Destroy()
+    docs := []D{}
+    for cur.Next() == MONGO_OK {
+        var doc D
+        assert.Equals(t, cur.Current().Unmarshal(&doc), nil)
+        docs = append(docs, doc)
+    }
+    assert.DeepEquals(t, docs, []D{
+        {{Name: "last", Value: "a"}, {Name: "age", Value: 2}},
+        {{Name: "last", Value: "a"}, {Name: "age", Value: 1}},
+        {{Name: "last", Value: "b"}, {Name: "age", Value: 1}},
+    })
+
+    var res struct {
+        N int
+    }
+    err = db.Run(D{{Name: "count", Value: "sorted"}, {Name: "query", Value: M{"last": "a"}}}, &res)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, res.N, 2)
+
+    // a command which can not be encoded is an error, rather than a panic
+    assert.NotEquals(t, db.Run(M{"x": uint64(1 << 63)}, &res), nil)
+
+    // the encoding error is reported as is
+    _, err = db.C("sorted").Insert(M{"x": uint64(1 << 63)}, nil)
+    assert.Equals(t, err.Error(), `bson: 9223372036854775808 for "x" overflows an int64`)
+}
+
+func TestDataLayer(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+
+    testDataLayer(t, conn.Db("libgomongo-test"))
+}
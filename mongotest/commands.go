@@ -0,0 +1,270 @@
+package mongotest
+
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "github.com/QLeelulu/libgomongo/bson"
+    "strings"
+    "time"
+)
+
+// Largest document accepted, reported as maxBsonObjectSize by ismaster.
+const maxBsonObjectSize = 16 * 1024 * 1024
+
+// commandName returns the lowercased name of the command cmd, which may be
+// wrapped in a $query document.
+func commandName(cmd bson.D) string {
+    if q, ok := get(cmd, "$query"); ok {
+        if inner, ok := q.(bson.D); ok && len(inner) > 0 {
+            cmd = inner
+        }
+    }
+    return strings.ToLower(cmd[0].Name)
+}
+
+func commandReply(fields ...bson.DocElem) *reply {
+    doc := append(bson.D(fields), bson.DocElem{Name: "ok", Value: 1.0})
+    return &reply{docs: []bson.D{doc}}
+}
+
+func commandFailure(errmsg string, code int) *reply {
+    doc := bson.D{{Name: "ok", Value: 0.0}, {Name: "errmsg", Value: errmsg}}
+    if code != 0 {
+        doc = append(doc, bson.DocElem{Name: "code", Value: code})
+    }
+    return &reply{docs: []bson.D{doc}}
+}
+
+// command runs a query on the $cmd namespace of a database.
+func (s *Server) command(c *client, req *request) *reply {
+    cmd := req.query
+    if q, ok := get(cmd, "$query"); ok {
+        cmd, _ = q.(bson.D)
+    }
+    if len(cmd) == 0 {
+        return commandFailure("no command given", 59)
+    }
+    db, _ := splitNamespace(req.ns)
+    arg := cmd[0].Value
+    name, _ := arg.(string)
+    ns := db + "." + name
+
+    switch commandName(cmd) {
+    case "ismaster":
+        return s.isMaster()
+    case "ping":
+        return commandReply()
+    case "buildinfo":
+        return commandReply(
+            bson.DocElem{Name: "version", Value: "2.4.0"},
+            bson.DocElem{Name: "versionArray", Value: []interface{}{2, 4, 0, 0}},
+            bson.DocElem{Name: "maxBsonObjectSize", Value: maxBsonObjectSize},
+        )
+    case "getlasterror":
+        return lastErrorReply(c.lastErr)
+    case "count":
+        return s.count(ns, cmd)
+    case "distinct":
+        return s.distinct(ns, cmd)
+    case "create":
+        return s.create(ns, cmd)
+    case "drop":
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if s.colls[ns] == nil {
+            return commandFailure("ns not found", 26)
+        }
+        delete(s.colls, ns)
+        return commandReply(bson.DocElem{Name: "ns", Value: ns}, bson.DocElem{Name: "nIndexesWas", Value: 1})
+    case "dropdatabase":
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        for key := range s.colls {
+            if strings.HasPrefix(key, db+".") {
+                delete(s.colls, key)
+            }
+        }
+        return commandReply(bson.DocElem{Name: "dropped", Value: db})
+    case "createindexes", "deleteindexes", "dropindexes", "reindex":
+        return commandReply()
+    case "filemd5":
+        return s.filemd5(db, cmd)
+    }
+    return commandFailure("no such cmd: "+cmd[0].Name, 59)
+}
+
+func (s *Server) isMaster() *reply {
+    s.mu.Lock()
+    member, lastWrite := s.member, s.lastWrite
+    s.mu.Unlock()
+    fields := []bson.DocElem{{Name: "ismaster", Value: member == nil || member.Primary}}
+    if member != nil {
+        hosts := make([]interface{}, len(member.Hosts))
+        for i, host := range member.Hosts {
+            hosts[i] = host
+        }
+        fields = append(fields,
+            bson.DocElem{Name: "secondary", Value: !member.Primary && !member.Arbiter},
+            bson.DocElem{Name: "setName", Value: member.SetName},
+            bson.DocElem{Name: "hosts", Value: hosts},
+        )
+        if member.Arbiter {
+            fields = append(fields, bson.DocElem{Name: "arbiterOnly", Value: true})
+        }
+        if !lastWrite.IsZero() {
+            fields = append(fields, bson.DocElem{Name: "lastWrite", Value: bson.D{{Name: "lastWriteDate", Value: lastWrite}}})
+        }
+        if len(member.Tags) > 0 {
+            tags := bson.M{}
+            for k, v := range member.Tags {
+                tags[k] = v
+            }
+            fields = append(fields, bson.DocElem{Name: "tags", Value: tags})
+        }
+    }
+    fields = append(fields,
+        bson.DocElem{Name: "maxBsonObjectSize", Value: maxBsonObjectSize},
+        bson.DocElem{Name: "maxMessageSizeBytes", Value: maxMessageSize},
+        bson.DocElem{Name: "localTime", Value: time.Now()},
+    )
+    return commandReply(fields...)
+}
+
+func lastErrorReply(le lastError) *reply {
+    fields := []bson.DocElem{{Name: "n", Value: le.n}}
+    if le.err != "" {
+        fields = append(fields, bson.DocElem{Name: "err", Value: le.err}, bson.DocElem{Name: "code", Value: le.code})
+    } else {
+        fields = append(fields, bson.DocElem{Name: "err", Value: nil})
+    }
+    if le.update {
+        fields = append(fields, bson.DocElem{Name: "updatedExisting", Value: le.updatedExisting})
+    }
+    if le.upserted != nil {
+        fields = append(fields, bson.DocElem{Name: "upserted", Value: le.upserted})
+    }
+    return commandReply(fields...)
+}
+
+// commandFilter returns the query field of a command.
+func commandFilter(cmd bson.D) bson.D {
+    q, _ := get(cmd, "query")
+    filter, _ := q.(bson.D)
+    return filter
+}
+
+func (s *Server) count(ns string, cmd bson.D) *reply {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var docs []bson.D
+    if coll := s.colls[ns]; coll != nil {
+        var err error
+        if docs, err = filterDocs(coll.docs, commandFilter(cmd)); err != nil {
+            return commandFailure(err.Error(), errorCode(err))
+        }
+    }
+    n := len(docs)
+    if v, ok := get(cmd, "skip"); ok {
+        skip, _ := toFloat(v)
+        n -= int(skip)
+        if n < 0 {
+            n = 0
+        }
+    }
+    if v, ok := get(cmd, "limit"); ok {
+        limit, _ := toFloat(v)
+        if limit < 0 {
+            limit = -limit
+        }
+        if limit > 0 && int(limit) < n {
+            n = int(limit)
+        }
+    }
+    return commandReply(bson.DocElem{Name: "n", Value: float64(n)})
+}
+
+func (s *Server) distinct(ns string, cmd bson.D) *reply {
+    key, _ := get(cmd, "key")
+    path, ok := key.(string)
+    if !ok {
+        return commandFailure("distinct needs a key", 2)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    values := []interface{}{}
+    if coll := s.colls[ns]; coll != nil {
+        docs, err := filterDocs(coll.docs, commandFilter(cmd))
+        if err != nil {
+            return commandFailure(err.Error(), errorCode(err))
+        }
+        for _, doc := range docs {
+            for _, v := range lookupPath(doc, path) {
+                items := []interface{}{v}
+                if arr, ok := v.([]interface{}); ok {
+                    items = arr
+                }
+                for _, item := range items {
+                    if !contains(values, item) {
+                        values = append(values, item)
+                    }
+                }
+            }
+        }
+    }
+    return commandReply(bson.DocElem{Name: "values", Value: values})
+}
+
+func contains(values []interface{}, v interface{}) bool {
+    for _, e := range values {
+        if equal(e, v) {
+            return true
+        }
+    }
+    return false
+}
+
+func (s *Server) create(ns string, cmd bson.D) *reply {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.colls[ns] != nil {
+        return commandFailure("collection already exists", 48)
+    }
+    coll := newCollection()
+    if v, ok := get(cmd, "capped"); ok {
+        coll.capped = truthy(v)
+    }
+    s.colls[ns] = coll
+    return commandReply()
+}
+
+// filemd5 returns the md5 of the chunks of a GridFS file, as computed by
+// the server when a file is written.
+func (s *Server) filemd5(db string, cmd bson.D) *reply {
+    root := "fs"
+    if v, ok := get(cmd, "root"); ok {
+        root, _ = v.(string)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var chunks []bson.D
+    if coll := s.colls[db+"."+root+".chunks"]; coll != nil {
+        var err error
+        chunks, err = filterDocs(coll.docs, bson.D{{Name: "files_id", Value: cmd[0].Value}})
+        if err != nil {
+            return commandFailure(err.Error(), errorCode(err))
+        }
+    }
+    sortDocs(chunks, bson.D{{Name: "n", Value: 1}})
+    h := md5.New()
+    for _, chunk := range chunks {
+        switch data, _ := get(chunk, "data"); data.(type) {
+        case []byte, bson.Binary:
+            _, bin := binaryOf(data)
+            h.Write(bin)
+        }
+    }
+    return commandReply(
+        bson.DocElem{Name: "numChunks", Value: len(chunks)},
+        bson.DocElem{Name: "md5", Value: hex.EncodeToString(h.Sum(nil))},
+    )
+}
@@ -0,0 +1,295 @@
+package mongotest
+
+import (
+    "github.com/QLeelulu/libgomongo/bson"
+    "time"
+)
+
+// Size of the first batch of a query, when the client does not set one.
+const defaultBatchSize = 101
+
+// cursor holds the remaining results of a query.
+type cursor struct {
+    id       int64
+    ns       string
+    docs     []bson.D // remaining results, for the other cursors
+    fields   bson.D
+    returned int32
+
+    // tailable cursors follow the collection from pos
+    tailable bool
+    await    bool
+    coll     *collection
+    filter   bson.D
+    pos      int
+}
+
+// query runs an OP_QUERY on a collection.
+func (s *Server) query(req *request) *reply {
+    filter, sortSpec := req.query, bson.D(nil)
+    explain := false
+    if q, ok := get(req.query, "$query"); ok {
+        filter, _ = q.(bson.D)
+        if v, ok := get(req.query, "$orderby"); ok {
+            sortSpec, _ = v.(bson.D)
+        }
+        if v, ok := get(req.query, "$explain"); ok {
+            explain = truthy(v)
+        }
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    coll := s.colls[req.ns]
+    var all []bson.D
+    if coll != nil {
+        all = coll.docs
+    }
+    docs, err := filterDocs(all, filter)
+    if err != nil {
+        return failure(err.Error(), errorCode(err))
+    }
+    if explain {
+        return &reply{docs: []bson.D{{
+            {Name: "cursor", Value: "BasicCursor"},
+            {Name: "isMultiKey", Value: false},
+            {Name: "n", Value: len(docs)},
+            {Name: "nscannedObjects", Value: len(all)},
+            {Name: "nscanned", Value: len(all)},
+            {Name: "scanAndOrder", Value: len(sortSpec) > 0},
+            {Name: "indexOnly", Value: false},
+            {Name: "millis", Value: 0},
+            {Name: "indexBounds", Value: bson.D{}},
+            {Name: "server", Value: s.Addr()},
+        }}}
+    }
+    if len(sortSpec) > 0 {
+        sortDocs(docs, sortSpec)
+    }
+    if skip := int(req.skip); skip > 0 {
+        if skip > len(docs) {
+            skip = len(docs)
+        }
+        docs = docs[skip:]
+    }
+
+    c := &cursor{ns: req.ns, docs: docs, fields: req.fields}
+    if req.flags&queryTailable != 0 && coll != nil {
+        c.tailable = true
+        c.await = req.flags&queryAwaitData != 0
+        c.coll = coll
+        c.filter = filter
+        c.pos = len(coll.docs)
+    }
+    return s.batch(c, req.limit, true)
+}
+
+// batch returns the next batch of c, of at most n documents, and keeps the
+// cursor open if results remain. A negative n, or 1, closes the cursor
+// after the batch.
+func (s *Server) batch(c *cursor, n int32, first bool) *reply {
+    single := n < 0 || n == 1
+    size := int(n)
+    if size < 0 {
+        size = -size
+    }
+    if size == 0 && first {
+        size = defaultBatchSize
+    }
+    if size == 0 || size > len(c.docs) {
+        size = len(c.docs)
+    }
+    r := &reply{startingFrom: c.returned}
+    for _, doc := range c.docs[:size] {
+        r.docs = append(r.docs, project(doc, c.fields))
+    }
+    c.docs = c.docs[size:]
+    c.returned += int32(size)
+
+    if !single && (len(c.docs) > 0 || c.tailable) {
+        if c.id == 0 {
+            s.cursorId++
+            c.id = s.cursorId
+            s.cursors[c.id] = c
+        }
+        r.cursorId = c.id
+    } else if c.id != 0 {
+        delete(s.cursors, c.id)
+    }
+    if c.await {
+        r.flags |= replyAwaitCapable
+    }
+    return r
+}
+
+// getMore returns the next batch of a cursor. A tailable cursor returns the
+// documents inserted since its last batch, waiting for them when it has the
+// AwaitData option.
+func (s *Server) getMore(req *request) *reply {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    c := s.cursors[req.cursorId]
+    if c == nil || c.ns != req.ns {
+        return &reply{flags: replyCursorNotFound}
+    }
+    if !c.tailable {
+        return s.batch(c, req.limit, false)
+    }
+
+    deadline := time.Now().Add(awaitDataTimeout)
+    for {
+        if s.colls[c.ns] != c.coll {
+            // dropped
+            delete(s.cursors, c.id)
+            return &reply{flags: replyCursorNotFound}
+        }
+        docs, err := filterDocs(c.coll.docs[c.pos:], c.filter)
+        if err != nil {
+            return failure(err.Error(), errorCode(err))
+        }
+        c.pos = len(c.coll.docs)
+        c.docs = append(c.docs, docs...)
+        wait := deadline.Sub(time.Now())
+        if len(c.docs) > 0 || !c.await || wait <= 0 {
+            return s.batch(c, req.limit, false)
+        }
+        changed := c.coll.changed
+        s.mu.Unlock()
+        select {
+        case <-changed:
+        case <-time.After(wait):
+        }
+        s.mu.Lock()
+        if s.cursors[c.id] != c {
+            return &reply{flags: replyCursorNotFound}
+        }
+    }
+}
+
+// filterDocs returns the documents of docs matching filter.
+func filterDocs(docs []bson.D, filter bson.D) ([]bson.D, error) {
+    out := []bson.D{}
+    for _, doc := range docs {
+        ok, err := match(doc, filter)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            out = append(out, doc)
+        }
+    }
+    return out, nil
+}
+
+// collection returns the collection of ns, creating it if needed. The lock
+// must be held.
+func (s *Server) collection(ns string) *collection {
+    coll := s.colls[ns]
+    if coll == nil {
+        coll = newCollection()
+        s.colls[ns] = coll
+    }
+    return coll
+}
+
+func (s *Server) insert(req *request) (lastError, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    coll := s.collection(req.ns)
+    defer coll.notify()
+    var firstErr error
+    for _, doc := range req.docs {
+        doc = withId(doc)
+        id := doc[0].Value
+        duplicate := false
+        for _, other := range coll.docs {
+            if equal(other[0].Value, id) {
+                duplicate = true
+                break
+            }
+        }
+        if duplicate {
+            if firstErr == nil {
+                firstErr = errorf(11000, "E11000 duplicate key error index: %s.$_id_  dup key: { : %v }", req.ns, id)
+            }
+            if req.flags&insertContinueOnError == 0 {
+                break
+            }
+            continue
+        }
+        coll.docs = append(coll.docs, doc)
+    }
+    return lastError{}, firstErr
+}
+
+func (s *Server) update(req *request) (lastError, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    le := lastError{update: true}
+    coll := s.colls[req.ns]
+    if coll != nil {
+        for i, doc := range coll.docs {
+            ok, err := match(doc, req.selector)
+            if err != nil {
+                return le, err
+            }
+            if !ok {
+                continue
+            }
+            updated, err := applyUpdate(doc, req.update, false)
+            if err != nil {
+                return le, err
+            }
+            coll.docs[i] = updated
+            le.n++
+            le.updatedExisting = true
+            if req.flags&updateMulti == 0 {
+                break
+            }
+        }
+    }
+    if le.n > 0 || req.flags&updateUpsert == 0 {
+        return le, nil
+    }
+
+    doc, err := upsertDoc(req.selector, req.update)
+    if err != nil {
+        return le, err
+    }
+    doc = withId(doc)
+    coll = s.collection(req.ns)
+    coll.docs = append(coll.docs, doc)
+    coll.notify()
+    le.n = 1
+    le.upserted = doc[0].Value
+    return le, nil
+}
+
+func (s *Server) remove(req *request) (lastError, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    le := lastError{}
+    coll := s.colls[req.ns]
+    if coll == nil {
+        return le, nil
+    }
+    if coll.capped {
+        return le, errorf(10101, "can't remove from a capped collection: %s", req.ns)
+    }
+    kept := make([]bson.D, 0, len(coll.docs))
+    for _, doc := range coll.docs {
+        if le.n == 0 || req.flags&deleteSingle == 0 {
+            ok, err := match(doc, req.selector)
+            if err != nil {
+                return lastError{}, err
+            }
+            if ok {
+                le.n++
+                continue
+            }
+        }
+        kept = append(kept, doc)
+    }
+    coll.docs = kept
+    return le, nil
+}
@@ -0,0 +1,408 @@
+// Package mongotest runs an in-process MongoDB server for tests, speaking
+// the legacy wire protocol used by the mongo-c-driver against an in-memory
+// store.
+//
+// The server answers OP_QUERY, OP_INSERT, OP_UPDATE, OP_DELETE,
+// OP_GET_MORE and OP_KILL_CURSORS, with the common query and update
+// operators, sorting, projections, capped collections with tailable
+// cursors, and the ismaster, getlasterror, count, distinct, create, drop
+// and filemd5 commands. It does not run JavaScript, so map/reduce and
+// $where are not supported.
+//
+//     server, err := mongotest.NewServer()
+//     if err != nil {
+//         panic(err)
+//     }
+//     defer server.Close()
+//     conn := libgomongo.NewMongo()
+//     conn.Client(server.Host(), server.Port())
+//
+// Failures are injected with AddFault, to test how the clients handle
+// slow servers, dropped connections and errors. Several servers made
+// members of a replica set with SetMember test the routing of reads.
+package mongotest
+
+import (
+    "errors"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Fault is a failure injected by the server into the requests it matches.
+type Fault struct {
+    // Op restricts the fault to an operation: "query", "getmore",
+    // "insert", "update", "delete", "killcursors", or the name of a
+    // command, as "count" or "getlasterror". An empty Op matches every
+    // request.
+    Op string
+
+    // Namespace restricts the fault to the requests on a namespace, as
+    // "test.people", or "test.$cmd" for the commands of a database.
+    Namespace string
+
+    // Delay is waited before the request is handled.
+    Delay time.Duration
+
+    // Drop closes the connection instead of handling the request.
+    Drop bool
+
+    // Err fails the request with this message and Code: queries and
+    // getmores are answered with a {$err: Err, code: Code} reply, commands
+    // with {ok: 0, errmsg: Err, code: Code}, and writes are not applied
+    // and reported by the next getlasterror.
+    Err  string
+    Code int
+
+    // Times is the number of requests the fault applies to, or 0 for all
+    // of them.
+    Times int
+}
+
+func (f *Fault) matches(req *request) bool {
+    if f.Op != "" && !strings.EqualFold(f.Op, req.op) {
+        return false
+    }
+    return f.Namespace == "" || f.Namespace == req.ns
+}
+
+// Member describes a server as a member of a replica set, see SetMember.
+type Member struct {
+    // SetName is the name of the replica set.
+    SetName string
+
+    // Hosts are the members of the set, as "127.0.0.1:51234", including
+    // this server.
+    Hosts []string
+
+    // Primary is set on the primary, and Arbiter on the arbiters. The
+    // other members are secondaries.
+    Primary bool
+    Arbiter bool
+
+    // Tags are the tags of the member, matched by read preferences.
+    Tags map[string]string
+}
+
+// How long a tailable cursor with the AwaitData option waits for new
+// documents before returning an empty batch.
+var awaitDataTimeout = 100 * time.Millisecond
+
+// Server is an in-process MongoDB server.
+type Server struct {
+    listener net.Listener
+    wg       sync.WaitGroup
+
+    mu        sync.Mutex
+    colls     map[string]*collection // by namespace
+    cursors   map[int64]*cursor
+    cursorId  int64
+    requestId int32
+    faults    []*Fault
+    conns     map[net.Conn]bool
+    closed    bool
+    member    *Member
+    lastWrite time.Time // reported by ismaster, as lastWrite.lastWriteDate
+}
+
+// client is the state of a connection.
+type client struct {
+    conn    net.Conn
+    lastErr lastError
+}
+
+// lastError is the outcome of the last write of a connection, reported by
+// getlasterror.
+type lastError struct {
+    n               int
+    err             string
+    code            int
+    updatedExisting bool
+    upserted        interface{}
+    update          bool
+}
+
+// NewServer starts a server listening on a random port of 127.0.0.1.
+func NewServer() (*Server, error) {
+    return NewServerAddr("127.0.0.1:0")
+}
+
+// NewServerAddr starts a server listening on addr, as "127.0.0.1:27017".
+func NewServerAddr(addr string) (*Server, error) {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    s := &Server{
+        listener: l,
+        colls:    make(map[string]*collection),
+        cursors:  make(map[int64]*cursor),
+        conns:    make(map[net.Conn]bool),
+    }
+    s.wg.Add(1)
+    go s.accept()
+    return s, nil
+}
+
+// Addr returns the address the server listens on, as "127.0.0.1:51234".
+func (s *Server) Addr() string {
+    return s.listener.Addr().String()
+}
+
+// Host returns the host the server listens on.
+func (s *Server) Host() string {
+    host, _, _ := net.SplitHostPort(s.Addr())
+    return host
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+    _, port, _ := net.SplitHostPort(s.Addr())
+    n, _ := strconv.Atoi(port)
+    return n
+}
+
+// Close stops the server, closing its connections, and waits for them to
+// be released.
+func (s *Server) Close() error {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return errors.New("mongotest: server already closed")
+    }
+    s.closed = true
+    err := s.listener.Close()
+    for conn := range s.conns {
+        conn.Close()
+    }
+    s.mu.Unlock()
+    s.wg.Wait()
+    return err
+}
+
+// Reset drops all the data, cursors and faults of the server.
+func (s *Server) Reset() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.colls = make(map[string]*collection)
+    s.cursors = make(map[int64]*cursor)
+    s.faults = nil
+}
+
+// AddFault injects f in the next requests it matches. Faults are checked
+// in the order they were added, and the first matching one applies.
+func (s *Server) AddFault(f Fault) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all the faults.
+func (s *Server) ClearFaults() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.faults = nil
+}
+
+// SetMember makes the server report m to ismaster, as a member of a replica
+// set. As on a mongod, a secondary refuses the writes, and the queries and
+// commands sent without the SlaveOk flag. The members do not replicate:
+// each server keeps its own data.
+func (s *Server) SetMember(m Member) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.member = &m
+}
+
+// DropConnections closes the open client connections, as a server restart
+// would. The data is kept and new connections are accepted.
+func (s *Server) DropConnections() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for conn := range s.conns {
+        conn.Close()
+    }
+}
+
+// Connections returns the number of open client connections.
+func (s *Server) Connections() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.conns)
+}
+
+func (s *Server) accept() {
+    defer s.wg.Done()
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            return
+        }
+        s.mu.Lock()
+        if s.closed {
+            s.mu.Unlock()
+            conn.Close()
+            return
+        }
+        s.conns[conn] = true
+        s.wg.Add(1)
+        s.mu.Unlock()
+        go s.serve(&client{conn: conn})
+    }
+}
+
+func (s *Server) serve(c *client) {
+    defer s.wg.Done()
+    defer func() {
+        s.mu.Lock()
+        delete(s.conns, c.conn)
+        s.mu.Unlock()
+        c.conn.Close()
+    }()
+    for {
+        req, err := readRequest(c.conn)
+        if err != nil {
+            return
+        }
+        fault := s.fault(req)
+        if fault != nil && fault.Delay > 0 {
+            time.Sleep(fault.Delay)
+        }
+        if fault != nil && fault.Drop {
+            return
+        }
+        r := s.handle(c, req, fault)
+        if r == nil {
+            continue
+        }
+        s.mu.Lock()
+        s.requestId++
+        id := s.requestId
+        s.mu.Unlock()
+        if err := r.write(c.conn, id, req.requestId); err != nil {
+            return
+        }
+    }
+}
+
+// fault returns the fault applying to req, if any.
+func (s *Server) fault(req *request) *Fault {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i, f := range s.faults {
+        if !f.matches(req) {
+            continue
+        }
+        if f.Times > 0 {
+            f.Times--
+            if f.Times == 0 {
+                s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+            }
+        }
+        return f
+    }
+    return nil
+}
+
+// handle runs req and returns its reply, or nil for the writes which have
+// none.
+func (s *Server) handle(c *client, req *request, fault *Fault) *reply {
+    failed := fault != nil && fault.Err != ""
+    if s.refused(req) {
+        if req.opCode != opQuery && req.opCode != opGetMore {
+            c.lastErr = lastError{err: "not master", code: 10058}
+            return nil
+        }
+        fault = &Fault{Err: "not master and slaveOk=false", Code: 13435}
+        failed = true
+    }
+    switch req.opCode {
+    case opQuery:
+        if isCommand(req.ns) {
+            if failed {
+                return commandFailure(fault.Err, fault.Code)
+            }
+            return s.command(c, req)
+        }
+        if failed {
+            return failure(fault.Err, fault.Code)
+        }
+        return s.query(req)
+    case opGetMore:
+        if failed {
+            return failure(fault.Err, fault.Code)
+        }
+        return s.getMore(req)
+    case opKillCursors:
+        s.mu.Lock()
+        for _, id := range req.cursorIds {
+            delete(s.cursors, id)
+        }
+        s.mu.Unlock()
+        return nil
+    }
+
+    // writes
+    if failed {
+        c.lastErr = lastError{err: fault.Err, code: fault.Code}
+        return nil
+    }
+    s.mu.Lock()
+    s.lastWrite = time.Now()
+    s.mu.Unlock()
+    var err error
+    switch req.opCode {
+    case opInsert:
+        c.lastErr, err = s.insert(req)
+    case opUpdate:
+        c.lastErr, err = s.update(req)
+    case opDelete:
+        c.lastErr, err = s.remove(req)
+    }
+    if err != nil {
+        c.lastErr.err = err.Error()
+        c.lastErr.code = errorCode(err)
+    }
+    return nil
+}
+
+// refused reports whether req is refused by a secondary.
+func (s *Server) refused(req *request) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.member == nil || s.member.Primary {
+        return false
+    }
+    switch req.opCode {
+    case opInsert, opUpdate, opDelete:
+        return true
+    case opQuery:
+        if req.flags&querySlaveOk != 0 {
+            return false
+        }
+        if isCommand(req.ns) {
+            switch req.op {
+            case "ismaster", "ping", "buildinfo", "getlasterror":
+                return false
+            }
+        }
+        return true
+    }
+    return false
+}
+
+// isCommand reports whether ns is the command namespace of a database.
+func isCommand(ns string) bool {
+    return strings.HasSuffix(ns, ".$cmd")
+}
+
+// splitNamespace returns the database and collection names of ns.
+func splitNamespace(ns string) (string, string) {
+    i := strings.Index(ns, ".")
+    if i < 0 {
+        return ns, ""
+    }
+    return ns[:i], ns[i+1:]
+}
@@ -0,0 +1,344 @@
+package mongotest
+
+import (
+    "encoding/binary"
+    "github.com/QLeelulu/libgomongo/bson"
+    "github.com/couchbaselabs/go.assert"
+    "net"
+    "testing"
+    "time"
+)
+
+// testClient speaks the wire protocol as the mongo-c-driver does.
+type testClient struct {
+    t    *testing.T
+    conn net.Conn
+    id   int32
+}
+
+func dial(t *testing.T, s *Server) *testClient {
+    conn, err := net.Dial("tcp", s.Addr())
+    assert.Equals(t, err, nil)
+    return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) send(op int32, parts ...interface{}) {
+    c.id++
+    out := make([]byte, 16)
+    binary.LittleEndian.PutUint32(out[4:], uint32(c.id))
+    binary.LittleEndian.PutUint32(out[12:], uint32(op))
+    for _, p := range parts {
+        switch p := p.(type) {
+        case int32:
+            out = binary.LittleEndian.AppendUint32(out, uint32(p))
+        case int64:
+            out = binary.LittleEndian.AppendUint64(out, uint64(p))
+        case string:
+            out = append(append(out, p...), 0)
+        case bson.D:
+            data, err := bson.Marshal(p)
+            assert.Equals(c.t, err, nil)
+            out = append(out, data...)
+        }
+    }
+    binary.LittleEndian.PutUint32(out, uint32(len(out)))
+    // write errors show up on the following read
+    c.conn.Write(out)
+}
+
+// read returns the flags, the cursor id and the documents of a reply.
+func (c *testClient) read() (int32, int64, []bson.D, error) {
+    header := make([]byte, 36)
+    if _, err := readFull(c.conn, header); err != nil {
+        return 0, 0, nil, err
+    }
+    body := make([]byte, binary.LittleEndian.Uint32(header)-36)
+    if _, err := readFull(c.conn, body); err != nil {
+        return 0, 0, nil, err
+    }
+    assert.Equals(c.t, int32(binary.LittleEndian.Uint32(header[8:])), c.id)
+    m := &reader{data: body}
+    var docs []bson.D
+    for m.more() {
+        docs = append(docs, m.document())
+    }
+    return int32(binary.LittleEndian.Uint32(header[16:])), int64(binary.LittleEndian.Uint64(header[20:])), docs, m.err
+}
+
+func readFull(conn net.Conn, b []byte) (int, error) {
+    n := 0
+    for n < len(b) {
+        m, err := conn.Read(b[n:])
+        n += m
+        if err != nil {
+            return n, err
+        }
+    }
+    return n, nil
+}
+
+func (c *testClient) query(ns string, query bson.D, skip, limit int32, flags int32) (int32, int64, []bson.D) {
+    c.send(opQuery, flags, ns, skip, limit, query)
+    f, id, docs, err := c.read()
+    assert.Equals(c.t, err, nil)
+    return f, id, docs
+}
+
+func (c *testClient) command(db string, cmd bson.D) bson.M {
+    _, _, docs := c.query(db+".$cmd", cmd, 0, -1, 0)
+    assert.Equals(c.t, len(docs), 1)
+    return docs[0].Map()
+}
+
+func (c *testClient) insert(ns string, docs ...bson.D) bson.M {
+    parts := []interface{}{int32(0), ns}
+    for _, d := range docs {
+        parts = append(parts, d)
+    }
+    c.send(opInsert, parts...)
+    return c.command("test", bson.D{{Name: "getlasterror", Value: 1}})
+}
+
+func newTestServer(t *testing.T) (*Server, *testClient) {
+    s, err := NewServer()
+    assert.Equals(t, err, nil)
+    return s, dial(t, s)
+}
+
+func TestCommands(t *testing.T) {
+    s, c := newTestServer(t)
+    defer s.Close()
+
+    res := c.command("admin", bson.D{{Name: "ismaster", Value: 1}})
+    assert.Equals(t, res["ismaster"], true)
+    assert.Equals(t, res["maxBsonObjectSize"], maxBsonObjectSize)
+    assert.Equals(t, res["ok"], 1.0)
+
+    id := bson.NewObjectId()
+    res = c.insert("test.people", bson.D{{Name: "_id", Value: id}, {Name: "name", Value: "Joe"}, {Name: "age", Value: 33}},
+        bson.D{{Name: "name", Value: "GoLang"}, {Name: "age", Value: 18}})
+    assert.Equals(t, res["err"], nil)
+    res = c.insert("test.people", bson.D{{Name: "_id", Value: id}})
+    assert.Equals(t, res["code"], 11000)
+
+    res = c.command("test", bson.D{{Name: "count", Value: "people"}, {Name: "query", Value: bson.D{{Name: "age", Value: bson.D{{Name: "$gt", Value: 20}}}}}})
+    assert.Equals(t, res["n"], 1.0)
+    res = c.command("test", bson.D{{Name: "count", Value: "people"}, {Name: "skip", Value: 1}})
+    assert.Equals(t, res["n"], 1.0)
+
+    res = c.command("test", bson.D{{Name: "distinct", Value: "people"}, {Name: "key", Value: "name"}})
+    assert.DeepEquals(t, res["values"], []interface{}{"Joe", "GoLang"})
+
+    res = c.command("test", bson.D{{Name: "mapreduce", Value: "people"}})
+    assert.Equals(t, res["ok"], 0.0)
+    res = c.command("test", bson.D{{Name: "drop", Value: "people"}})
+    assert.Equals(t, res["ok"], 1.0)
+    res = c.command("test", bson.D{{Name: "drop", Value: "people"}})
+    assert.Equals(t, res["ok"], 0.0)
+}
+
+func TestQuery(t *testing.T) {
+    s, c := newTestServer(t)
+    defer s.Close()
+
+    for i := 0; i < 5; i++ {
+        c.insert("test.items", bson.D{{Name: "n", Value: i}, {Name: "tags", Value: []interface{}{"all", i%2 == 0}}, {Name: "sub", Value: bson.D{{Name: "x", Value: i * 10}}}})
+    }
+
+    // sorted, projected, in batches of 2
+    query := bson.D{
+        {Name: "$query", Value: bson.D{{Name: "n", Value: bson.D{{Name: "$gte", Value: 1}}}}},
+        {Name: "$orderby", Value: bson.D{{Name: "n", Value: -1}}},
+    }
+    c.send(opQuery, int32(0), "test.items", int32(0), int32(2), query, bson.D{{Name: "n", Value: 1}, {Name: "_id", Value: 0}})
+    _, cursorId, docs, err := c.read()
+    assert.Equals(t, err, nil)
+    assert.NotEquals(t, cursorId, int64(0))
+    assert.DeepEquals(t, docs, []bson.D{{{Name: "n", Value: 4}}, {{Name: "n", Value: 3}}})
+    c.send(opGetMore, int32(0), "test.items", int32(0), cursorId)
+    _, id, docs, err := c.read()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, id, int64(0))
+    assert.DeepEquals(t, docs, []bson.D{{{Name: "n", Value: 2}}, {{Name: "n", Value: 1}}})
+    c.send(opGetMore, int32(0), "test.items", int32(0), cursorId)
+    flags, _, _, err := c.read()
+    assert.Equals(t, flags&replyCursorNotFound, int32(replyCursorNotFound))
+
+    count := func(filter bson.D) int {
+        _, _, docs := c.query("test.items", filter, 0, 0, 0)
+        return len(docs)
+    }
+    assert.Equals(t, count(bson.D{{Name: "tags", Value: true}}), 3)
+    assert.Equals(t, count(bson.D{{Name: "sub.x", Value: bson.D{{Name: "$in", Value: []interface{}{10, int64(20), 30.0}}}}}), 3)
+    assert.Equals(t, count(bson.D{{Name: "$or", Value: []interface{}{bson.D{{Name: "n", Value: 0}}, bson.D{{Name: "n", Value: bson.D{{Name: "$gt", Value: 3}}}}}}}), 2)
+    assert.Equals(t, count(bson.D{{Name: "missing", Value: bson.D{{Name: "$exists", Value: false}}}, {Name: "n", Value: bson.D{{Name: "$ne", Value: 2}}}}), 4)
+    assert.Equals(t, count(bson.D{{Name: "tags.0", Value: bson.RegEx{Pattern: "^A", Options: "i"}}}), 5)
+
+    _, _, docs = c.query("test.items", nil, 3, -1, 0)
+    assert.Equals(t, len(docs), 1)
+    assert.Equals(t, docs[0].Map()["n"], 3)
+
+    flags, _, docs = c.query("test.items", bson.D{{Name: "n", Value: bson.D{{Name: "$bad", Value: 1}}}}, 0, 0, 0)
+    assert.Equals(t, flags&replyQueryFailure, int32(replyQueryFailure))
+    assert.Equals(t, docs[0].Map()["$err"], "unknown operator: $bad")
+}
+
+func TestUpdate(t *testing.T) {
+    s, c := newTestServer(t)
+    defer s.Close()
+    c.insert("test.people", bson.D{{Name: "name", Value: "Joe"}, {Name: "age", Value: 33}})
+
+    update := func(flags int32, selector, update bson.D) bson.M {
+        c.send(opUpdate, int32(0), "test.people", flags, selector, update)
+        return c.command("test", bson.D{{Name: "getlasterror", Value: 1}})
+    }
+    res := update(0, bson.D{{Name: "name", Value: "Joe"}}, bson.D{
+        {Name: "$inc", Value: bson.D{{Name: "age", Value: 1}}},
+        {Name: "$set", Value: bson.D{{Name: "address.city", Value: "Guangzhou"}}},
+        {Name: "$push", Value: bson.D{{Name: "tags", Value: "go"}}},
+    })
+    assert.Equals(t, res["n"], 1)
+    assert.Equals(t, res["updatedExisting"], true)
+
+    _, _, docs := c.query("test.people", bson.D{{Name: "name", Value: "Joe"}}, 0, 0, 0)
+    assert.Equals(t, len(docs), 1)
+    doc := docs[0].Map()
+    assert.Equals(t, doc["age"], 34)
+    assert.DeepEquals(t, doc["address"], bson.D{{Name: "city", Value: "Guangzhou"}})
+    assert.DeepEquals(t, doc["tags"], []interface{}{"go"})
+
+    res = update(updateUpsert, bson.D{{Name: "name", Value: "Ann"}}, bson.D{{Name: "$set", Value: bson.D{{Name: "age", Value: 20}}}})
+    assert.Equals(t, res["n"], 1)
+    assert.Equals(t, res["updatedExisting"], false)
+    _, ok := res["upserted"].(bson.ObjectId)
+    assert.Equals(t, ok, true)
+
+    res = update(updateMulti, nil, bson.D{{Name: "$unset", Value: bson.D{{Name: "age", Value: 1}}}})
+    assert.Equals(t, res["n"], 2)
+    res = update(0, bson.D{{Name: "name", Value: "Ann"}}, bson.D{{Name: "name", Value: "Anna"}})
+    assert.Equals(t, res["n"], 1)
+    res = update(0, nil, bson.D{{Name: "$rename", Value: bson.D{{Name: "a", Value: "b"}}}})
+    assert.Equals(t, res["code"], 10147)
+
+    c.send(opDelete, int32(0), "test.people", int32(0), bson.D{})
+    res = c.command("test", bson.D{{Name: "getlasterror", Value: 1}})
+    assert.Equals(t, res["n"], 2)
+}
+
+func TestTailable(t *testing.T) {
+    s, c := newTestServer(t)
+    defer s.Close()
+    c.command("test", bson.D{{Name: "create", Value: "log"}, {Name: "capped", Value: true}, {Name: "size", Value: 4096}})
+    c.insert("test.log", bson.D{{Name: "n", Value: 0}})
+
+    _, cursorId, docs := c.query("test.log", nil, 0, 0, queryTailable|queryAwaitData)
+    assert.Equals(t, len(docs), 1)
+    assert.NotEquals(t, cursorId, int64(0))
+
+    // nothing new: an empty batch after the await timeout
+    start := time.Now()
+    c.send(opGetMore, int32(0), "test.log", int32(0), cursorId)
+    _, id, docs, err := c.read()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, id, cursorId)
+    assert.Equals(t, len(docs), 0)
+    assert.Equals(t, time.Since(start) >= awaitDataTimeout, true)
+
+    // woken up by an insert from another connection
+    go func() {
+        time.Sleep(20 * time.Millisecond)
+        other := dial(t, s)
+        other.insert("test.log", bson.D{{Name: "n", Value: 1}})
+        other.conn.Close()
+    }()
+    c.send(opGetMore, int32(0), "test.log", int32(0), cursorId)
+    _, _, docs, err = c.read()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, len(docs), 1)
+    assert.Equals(t, docs[0].Map()["n"], 1)
+
+    c.send(opDelete, int32(0), "test.log", int32(0), bson.D{})
+    res := c.command("test", bson.D{{Name: "getlasterror", Value: 1}})
+    assert.Equals(t, res["code"], 10101)
+}
+
+func TestFaults(t *testing.T) {
+    s, c := newTestServer(t)
+    defer s.Close()
+
+    s.AddFault(Fault{Op: "count", Err: "not master", Code: 10107, Times: 1})
+    res := c.command("test", bson.D{{Name: "count", Value: "people"}})
+    assert.Equals(t, res["errmsg"], "not master")
+    res = c.command("test", bson.D{{Name: "count", Value: "people"}})
+    assert.Equals(t, res["ok"], 1.0)
+
+    s.AddFault(Fault{Op: "query", Namespace: "test.people", Err: "interrupted", Code: 11601, Times: 1})
+    flags, _, docs := c.query("test.people", nil, 0, 0, 0)
+    assert.Equals(t, flags&replyQueryFailure, int32(replyQueryFailure))
+    assert.Equals(t, docs[0].Map()["code"], 11601)
+
+    s.AddFault(Fault{Op: "insert", Err: "disk full", Times: 1})
+    res = c.insert("test.people", bson.D{{Name: "n", Value: 1}})
+    assert.Equals(t, res["err"], "disk full")
+    res = c.command("test", bson.D{{Name: "count", Value: "people"}})
+    assert.Equals(t, res["n"], 0.0)
+
+    s.AddFault(Fault{Op: "ping", Delay: 50 * time.Millisecond, Times: 1})
+    start := time.Now()
+    c.command("admin", bson.D{{Name: "ping", Value: 1}})
+    assert.Equals(t, time.Since(start) >= 50*time.Millisecond, true)
+
+    s.AddFault(Fault{Op: "ping", Drop: true})
+    c.send(opQuery, int32(0), "admin.$cmd", int32(0), int32(-1), bson.D{{Name: "ping", Value: 1}})
+    _, _, _, err := c.read()
+    assert.NotEquals(t, err, nil)
+    s.ClearFaults()
+
+    c = dial(t, s)
+    assert.Equals(t, c.command("admin", bson.D{{Name: "ping", Value: 1}})["ok"], 1.0)
+    s.DropConnections()
+    c.send(opQuery, int32(0), "admin.$cmd", int32(0), int32(-1), bson.D{{Name: "ping", Value: 1}})
+    _, _, _, err = c.read()
+    assert.NotEquals(t, err, nil)
+}
+
+func TestMember(t *testing.T) {
+    s, c := newTestServer(t)
+    defer s.Close()
+    s.SetMember(Member{SetName: "rs0", Hosts: []string{"a:1", s.Addr()}, Tags: map[string]string{"dc": "east"}})
+
+    res := c.command("admin", bson.D{{Name: "ismaster", Value: 1}})
+    assert.Equals(t, res["ismaster"], false)
+    assert.Equals(t, res["secondary"], true)
+    assert.Equals(t, res["setName"], "rs0")
+    assert.DeepEquals(t, res["hosts"], []interface{}{"a:1", s.Addr()})
+    assert.DeepEquals(t, res["tags"], bson.D{{Name: "dc", Value: "east"}})
+
+    le := c.insert("test.people", bson.D{{Name: "name", Value: "Ann"}})
+    assert.Equals(t, le["code"], 10058)
+    flags, _, docs := c.query("test.people", bson.D{}, 0, 0, 0)
+    assert.Equals(t, flags, int32(replyQueryFailure))
+    assert.Equals(t, docs[0].Map()["code"], 13435)
+    _, _, docs = c.query("test.$cmd", bson.D{{Name: "count", Value: "people"}}, 0, -1, 0)
+    assert.Equals(t, docs[0].Map()["ok"], 0.0)
+
+    _, _, docs = c.query("test.people", bson.D{}, 0, 0, querySlaveOk)
+    assert.Equals(t, len(docs), 0)
+    _, _, docs = c.query("test.$cmd", bson.D{{Name: "count", Value: "people"}}, 0, -1, querySlaveOk)
+    assert.Equals(t, docs[0].Map()["n"], 0.0)
+
+    s.SetMember(Member{SetName: "rs0", Hosts: []string{s.Addr()}, Primary: true})
+    res = c.command("admin", bson.D{{Name: "ismaster", Value: 1}})
+    assert.Equals(t, res["ismaster"], true)
+    assert.Equals(t, res["tags"], nil)
+    le = c.insert("test.people", bson.D{{Name: "name", Value: "Ann"}})
+    assert.Equals(t, le["err"], nil)
+    res = c.command("admin", bson.D{{Name: "ismaster", Value: 1}})
+    lastWrite := res["lastWrite"].(bson.D).Map()["lastWriteDate"].(time.Time)
+    assert.Equals(t, time.Since(lastWrite) < time.Minute, true)
+
+    s.SetMember(Member{SetName: "rs0", Hosts: []string{s.Addr()}, Arbiter: true})
+    res = c.command("admin", bson.D{{Name: "ismaster", Value: 1}})
+    assert.Equals(t, res["arbiterOnly"], true)
+    assert.Equals(t, res["secondary"], false)
+}
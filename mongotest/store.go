@@ -0,0 +1,813 @@
+package mongotest
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "github.com/QLeelulu/libgomongo/bson"
+    "math"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// collection holds the documents of a namespace, in insertion order.
+type collection struct {
+    docs   []bson.D
+    capped bool
+
+    // changed is closed and replaced on every insert, to wake up the
+    // tailable cursors awaiting data.
+    changed chan struct{}
+}
+
+func newCollection() *collection {
+    return &collection{changed: make(chan struct{})}
+}
+
+func (c *collection) notify() {
+    close(c.changed)
+    c.changed = make(chan struct{})
+}
+
+// queryError is an error reported to the client, with its server code.
+type queryError struct {
+    msg  string
+    code int
+}
+
+func (e *queryError) Error() string {
+    return e.msg
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+    return &queryError{fmt.Sprintf(format, args...), code}
+}
+
+// errorCode returns the server code of err.
+func errorCode(err error) int {
+    if qe, ok := err.(*queryError); ok {
+        return qe.code
+    }
+    return 0
+}
+
+// get returns the value of the top level key of doc.
+func get(doc bson.D, key string) (interface{}, bool) {
+    for _, e := range doc {
+        if e.Name == key {
+            return e.Value, true
+        }
+    }
+    return nil, false
+}
+
+// lookup returns the values found at the dotted path of v. Arrays met on
+// the way are traversed by index, or else through each of their documents,
+// as the server does.
+func lookup(v interface{}, path []string) []interface{} {
+    if len(path) == 0 {
+        return []interface{}{v}
+    }
+    switch v := v.(type) {
+    case bson.D:
+        if e, ok := get(v, path[0]); ok {
+            return lookup(e, path[1:])
+        }
+    case []interface{}:
+        if i, err := strconv.Atoi(path[0]); err == nil {
+            if i >= 0 && i < len(v) {
+                return lookup(v[i], path[1:])
+            }
+            return nil
+        }
+        var out []interface{}
+        for _, e := range v {
+            if _, ok := e.(bson.D); ok {
+                out = append(out, lookup(e, path)...)
+            }
+        }
+        return out
+    }
+    return nil
+}
+
+func lookupPath(doc bson.D, path string) []interface{} {
+    return lookup(doc, strings.Split(path, "."))
+}
+
+// expand returns the values and the elements of the arrays among them.
+func expand(values []interface{}) []interface{} {
+    out := values
+    for _, v := range values {
+        if arr, ok := v.([]interface{}); ok {
+            if len(out) == len(values) {
+                out = append([]interface{}(nil), values...)
+            }
+            out = append(out, arr...)
+        }
+    }
+    return out
+}
+
+// match reports whether doc matches the query filter.
+func match(doc bson.D, filter bson.D) (bool, error) {
+    for _, e := range filter {
+        var ok bool
+        var err error
+        switch e.Name {
+        case "$and", "$or", "$nor":
+            ok, err = matchLogical(doc, e.Name, e.Value)
+        case "$where":
+            return false, errorf(16395, "$where is not supported by mongotest")
+        case "$comment", "$isolated", "$atomic":
+            ok = true
+        default:
+            if strings.HasPrefix(e.Name, "$") {
+                return false, errorf(2, "unknown top level operator: %s", e.Name)
+            }
+            ok, err = matchValues(lookupPath(doc, e.Name), e.Value)
+        }
+        if err != nil || !ok {
+            return false, err
+        }
+    }
+    return true, nil
+}
+
+func matchLogical(doc bson.D, op string, v interface{}) (bool, error) {
+    clauses, ok := v.([]interface{})
+    if !ok || len(clauses) == 0 {
+        return false, errorf(2, "%s needs a non-empty array", op)
+    }
+    for _, c := range clauses {
+        filter, ok := c.(bson.D)
+        if !ok {
+            return false, errorf(2, "%s entries need to be full objects", op)
+        }
+        ok, err := match(doc, filter)
+        if err != nil {
+            return false, err
+        }
+        switch {
+        case op == "$and" && !ok:
+            return false, nil
+        case op == "$or" && ok:
+            return true, nil
+        case op == "$nor" && ok:
+            return false, nil
+        }
+    }
+    return op != "$or", nil
+}
+
+// isOperatorDoc reports whether v is a document of query operators, as
+// {$gt: 1}.
+func isOperatorDoc(v interface{}) bool {
+    d, ok := v.(bson.D)
+    return ok && len(d) > 0 && strings.HasPrefix(d[0].Name, "$")
+}
+
+// matchValues reports whether the values found for a field match cond, an
+// operator document or a value compared for equality.
+func matchValues(values []interface{}, cond interface{}) (bool, error) {
+    if !isOperatorDoc(cond) {
+        return matchEqual(values, cond), nil
+    }
+    ops := cond.(bson.D)
+    options, _ := get(ops, "$options")
+    for _, op := range ops {
+        ok, err := matchOp(values, op.Name, op.Value, options)
+        if err != nil || !ok {
+            return false, err
+        }
+    }
+    return true, nil
+}
+
+func matchEqual(values []interface{}, want interface{}) bool {
+    if re, ok := want.(bson.RegEx); ok {
+        return matchRegex(values, re.Pattern, re.Options)
+    }
+    if want == nil && len(values) == 0 {
+        return true
+    }
+    for _, v := range expand(values) {
+        if equal(v, want) {
+            return true
+        }
+    }
+    return false
+}
+
+func matchOp(values []interface{}, op string, arg interface{}, options interface{}) (bool, error) {
+    switch op {
+    case "$eq":
+        return matchEqual(values, arg), nil
+    case "$ne":
+        return !matchEqual(values, arg), nil
+    case "$gt", "$gte", "$lt", "$lte":
+        for _, v := range expand(values) {
+            if class(v) != class(arg) {
+                continue
+            }
+            c := compare(v, arg)
+            if op == "$gt" && c > 0 || op == "$gte" && c >= 0 || op == "$lt" && c < 0 || op == "$lte" && c <= 0 {
+                return true, nil
+            }
+        }
+        return false, nil
+    case "$in", "$nin":
+        arr, ok := arg.([]interface{})
+        if !ok {
+            return false, errorf(2, "%s needs an array", op)
+        }
+        found := false
+        for _, want := range arr {
+            if matchEqual(values, want) {
+                found = true
+                break
+            }
+        }
+        return found == (op == "$in"), nil
+    case "$all":
+        arr, ok := arg.([]interface{})
+        if !ok {
+            return false, errorf(2, "$all needs an array")
+        }
+        for _, want := range arr {
+            if !matchEqual(values, want) {
+                return false, nil
+            }
+        }
+        return len(arr) > 0, nil
+    case "$exists":
+        return truthy(arg) == (len(values) > 0), nil
+    case "$size":
+        n, ok := toFloat(arg)
+        if !ok {
+            return false, errorf(2, "$size needs a number")
+        }
+        for _, v := range values {
+            if arr, ok := v.([]interface{}); ok && float64(len(arr)) == n {
+                return true, nil
+            }
+        }
+        return false, nil
+    case "$regex":
+        switch re := arg.(type) {
+        case string:
+            opts, _ := options.(string)
+            return matchRegex(values, re, opts), nil
+        case bson.RegEx:
+            return matchRegex(values, re.Pattern, re.Options), nil
+        }
+        return false, errorf(2, "$regex has to be a string")
+    case "$options":
+        return true, nil
+    case "$not":
+        if re, ok := arg.(bson.RegEx); ok {
+            return !matchRegex(values, re.Pattern, re.Options), nil
+        }
+        if !isOperatorDoc(arg) {
+            return false, errorf(2, "$not needs a regex or a document")
+        }
+        ok, err := matchValues(values, arg)
+        return !ok, err
+    case "$elemMatch":
+        filter, ok := arg.(bson.D)
+        if !ok {
+            return false, errorf(2, "$elemMatch needs an Object")
+        }
+        for _, v := range values {
+            arr, _ := v.([]interface{})
+            for _, e := range arr {
+                var ok bool
+                var err error
+                if isOperatorDoc(filter) {
+                    ok, err = matchValues([]interface{}{e}, filter)
+                } else if doc, isDoc := e.(bson.D); isDoc {
+                    ok, err = match(doc, filter)
+                }
+                if err != nil || ok {
+                    return ok, err
+                }
+            }
+        }
+        return false, nil
+    }
+    return false, errorf(2, "unknown operator: %s", op)
+}
+
+func matchRegex(values []interface{}, pattern, options string) bool {
+    flags := ""
+    for _, o := range options {
+        if o == 'i' || o == 'm' || o == 's' {
+            flags += string(o)
+        }
+    }
+    if flags != "" {
+        pattern = "(?" + flags + ")" + pattern
+    }
+    re, err := regexp.Compile(pattern)
+    if err != nil {
+        return false
+    }
+    for _, v := range expand(values) {
+        switch v := v.(type) {
+        case string:
+            if re.MatchString(v) {
+                return true
+            }
+        case bson.Symbol:
+            if re.MatchString(string(v)) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func truthy(v interface{}) bool {
+    switch v := v.(type) {
+    case nil:
+        return false
+    case bool:
+        return v
+    }
+    if f, ok := toFloat(v); ok {
+        return f != 0
+    }
+    return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+    switch v := v.(type) {
+    case int:
+        return float64(v), true
+    case int64:
+        return float64(v), true
+    case float64:
+        return v, true
+    }
+    return 0, false
+}
+
+// class returns the rank of the type of v in the server sort order.
+func class(v interface{}) int {
+    switch v := v.(type) {
+    case nil:
+        return 2
+    case int, int64, float64:
+        return 3
+    case string, bson.Symbol:
+        return 4
+    case bson.D:
+        return 5
+    case []interface{}:
+        return 6
+    case []byte, bson.Binary:
+        return 7
+    case bson.ObjectId:
+        return 8
+    case bool:
+        return 9
+    case time.Time:
+        return 10
+    case bson.MongoTimestamp:
+        return 11
+    case bson.RegEx:
+        return 12
+    default:
+        if v == bson.MinKey {
+            return 1
+        }
+        if v == bson.MaxKey {
+            return 14
+        }
+        if v == bson.Undefined {
+            return 2
+        }
+    }
+    return 13
+}
+
+// compare orders two values as the server does, first by type and then by
+// value. Numbers of any type are compared by their value.
+func compare(a, b interface{}) int {
+    ca, cb := class(a), class(b)
+    if ca != cb {
+        return sign(ca - cb)
+    }
+    switch a := a.(type) {
+    case int, int64, float64:
+        fa, _ := toFloat(a)
+        fb, _ := toFloat(b)
+        switch {
+        case fa < fb:
+            return -1
+        case fa > fb:
+            return 1
+        case math.IsNaN(fa) && !math.IsNaN(fb):
+            return -1
+        case !math.IsNaN(fa) && math.IsNaN(fb):
+            return 1
+        }
+        return 0
+    case string:
+        return strings.Compare(a, stringOf(b))
+    case bson.Symbol:
+        return strings.Compare(string(a), stringOf(b))
+    case bson.D:
+        bd := b.(bson.D)
+        for i := 0; i < len(a) && i < len(bd); i++ {
+            if c := compare(a[i].Value, bd[i].Value); c != 0 {
+                return c
+            }
+            if c := strings.Compare(a[i].Name, bd[i].Name); c != 0 {
+                return c
+            }
+        }
+        return sign(len(a) - len(bd))
+    case []interface{}:
+        bl := b.([]interface{})
+        for i := 0; i < len(a) && i < len(bl); i++ {
+            if c := compare(a[i], bl[i]); c != 0 {
+                return c
+            }
+        }
+        return sign(len(a) - len(bl))
+    case []byte, bson.Binary:
+        ka, da := binaryOf(a)
+        kb, db := binaryOf(b)
+        if len(da) != len(db) {
+            return sign(len(da) - len(db))
+        }
+        if ka != kb {
+            return sign(int(ka) - int(kb))
+        }
+        return bytes.Compare(da, db)
+    case bson.ObjectId:
+        return strings.Compare(string(a), string(b.(bson.ObjectId)))
+    case bool:
+        bb := b.(bool)
+        if a == bb {
+            return 0
+        }
+        if bb {
+            return -1
+        }
+        return 1
+    case time.Time:
+        bt := b.(time.Time)
+        if a.Before(bt) {
+            return -1
+        }
+        if a.After(bt) {
+            return 1
+        }
+        return 0
+    case bson.MongoTimestamp:
+        ta, tb := uint64(a), uint64(b.(bson.MongoTimestamp))
+        if ta < tb {
+            return -1
+        }
+        if ta > tb {
+            return 1
+        }
+        return 0
+    case bson.RegEx:
+        br := b.(bson.RegEx)
+        if c := strings.Compare(a.Pattern, br.Pattern); c != 0 {
+            return c
+        }
+        return strings.Compare(a.Options, br.Options)
+    }
+    return 0
+}
+
+func equal(a, b interface{}) bool {
+    return class(a) == class(b) && compare(a, b) == 0
+}
+
+func sign(n int) int {
+    switch {
+    case n < 0:
+        return -1
+    case n > 0:
+        return 1
+    }
+    return 0
+}
+
+func stringOf(v interface{}) string {
+    if s, ok := v.(bson.Symbol); ok {
+        return string(s)
+    }
+    s, _ := v.(string)
+    return s
+}
+
+func binaryOf(v interface{}) (byte, []byte) {
+    if b, ok := v.(bson.Binary); ok {
+        return b.Kind, b.Data
+    }
+    return bson.BinaryGeneric, v.([]byte)
+}
+
+// sortDocs sorts docs by the sort specification spec, as {age: -1}. The
+// $natural key keeps the insertion order, or reverses it with -1.
+func sortDocs(docs []bson.D, spec bson.D) {
+    if len(spec) == 1 && spec[0].Name == "$natural" {
+        if f, _ := toFloat(spec[0].Value); f < 0 {
+            for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+                docs[i], docs[j] = docs[j], docs[i]
+            }
+        }
+        return
+    }
+    sort.SliceStable(docs, func(i, j int) bool {
+        for _, key := range spec {
+            if key.Name == "$natural" {
+                continue
+            }
+            c := compare(sortValue(docs[i], key.Name), sortValue(docs[j], key.Name))
+            if f, _ := toFloat(key.Value); f < 0 {
+                c = -c
+            }
+            if c != 0 {
+                return c < 0
+            }
+        }
+        return false
+    })
+}
+
+func sortValue(doc bson.D, path string) interface{} {
+    values := lookupPath(doc, path)
+    if len(values) == 0 {
+        return nil
+    }
+    return values[0]
+}
+
+// project returns the fields of doc selected by the projection fields. Only
+// top level keys, or the first part of dotted keys, are considered.
+func project(doc bson.D, fields bson.D) bson.D {
+    if len(fields) == 0 {
+        return doc
+    }
+    keepId := true
+    include := false
+    selected := make(map[string]bool, len(fields))
+    for _, f := range fields {
+        name := strings.SplitN(f.Name, ".", 2)[0]
+        if name == "_id" {
+            keepId = truthy(f.Value)
+            continue
+        }
+        selected[name] = truthy(f.Value)
+        if truthy(f.Value) {
+            include = true
+        }
+    }
+    out := make(bson.D, 0, len(doc))
+    for _, e := range doc {
+        if e.Name == "_id" {
+            if keepId {
+                out = append(out, e)
+            }
+            continue
+        }
+        keep, listed := selected[e.Name]
+        if include && keep || !include && !listed {
+            out = append(out, e)
+        }
+    }
+    return out
+}
+
+// deepCopy copies the documents and arrays of v, so that updates do not
+// change the values returned before.
+func deepCopy(v interface{}) interface{} {
+    switch v := v.(type) {
+    case bson.D:
+        d := make(bson.D, len(v))
+        for i, e := range v {
+            d[i] = bson.DocElem{Name: e.Name, Value: deepCopy(e.Value)}
+        }
+        return d
+    case []interface{}:
+        arr := make([]interface{}, len(v))
+        for i, e := range v {
+            arr[i] = deepCopy(e)
+        }
+        return arr
+    }
+    return v
+}
+
+// setPath returns v with the dotted path set to value, creating the
+// missing documents on the way.
+func setPath(v interface{}, path []string, value interface{}) (interface{}, error) {
+    if len(path) == 0 {
+        return value, nil
+    }
+    switch d := v.(type) {
+    case nil:
+        sub, err := setPath(nil, path[1:], value)
+        return bson.D{{Name: path[0], Value: sub}}, err
+    case bson.D:
+        for i, e := range d {
+            if e.Name == path[0] {
+                sub, err := setPath(e.Value, path[1:], value)
+                d[i].Value = sub
+                return d, err
+            }
+        }
+        sub, err := setPath(nil, path[1:], value)
+        return append(d, bson.DocElem{Name: path[0], Value: sub}), err
+    case []interface{}:
+        i, err := strconv.Atoi(path[0])
+        if err != nil || i < 0 {
+            return d, errorf(16837, "cannot use the part (%s) to traverse the element", path[0])
+        }
+        for len(d) <= i {
+            d = append(d, nil)
+        }
+        sub, err := setPath(d[i], path[1:], value)
+        d[i] = sub
+        return d, err
+    }
+    return v, errorf(16837, "cannot use the part (%s) to traverse the element", path[0])
+}
+
+// unsetPath returns v without the dotted path.
+func unsetPath(v interface{}, path []string) interface{} {
+    switch d := v.(type) {
+    case bson.D:
+        for i, e := range d {
+            if e.Name != path[0] {
+                continue
+            }
+            if len(path) == 1 {
+                return append(d[:i:i], d[i+1:]...)
+            }
+            d[i].Value = unsetPath(e.Value, path[1:])
+            return d
+        }
+    case []interface{}:
+        if i, err := strconv.Atoi(path[0]); err == nil && i >= 0 && i < len(d) {
+            if len(path) == 1 {
+                d[i] = nil
+            } else {
+                d[i] = unsetPath(d[i], path[1:])
+            }
+        }
+    }
+    return v
+}
+
+// applyUpdate returns doc changed by update, which is either a replacement
+// document or a document of update operators, as {$set: {a: 1}}.
+func applyUpdate(doc bson.D, update bson.D, inserting bool) (bson.D, error) {
+    id, hasId := get(doc, "_id")
+    if len(update) == 0 || !strings.HasPrefix(update[0].Name, "$") {
+        out := deepCopy(update).(bson.D)
+        if newId, ok := get(out, "_id"); ok && hasId && !equal(newId, id) {
+            return nil, errorf(16836, "The _id field cannot be changed from {_id: %v} to {_id: %v}.", id, newId)
+        }
+        if _, ok := get(out, "_id"); !ok && hasId {
+            out = append(bson.D{{Name: "_id", Value: id}}, out...)
+        }
+        return out, nil
+    }
+
+    var out interface{} = deepCopy(doc)
+    for _, op := range update {
+        fields, ok := op.Value.(bson.D)
+        if !ok {
+            return nil, errorf(9, "Modifier %s allowed for objects only", op.Name)
+        }
+        for _, f := range fields {
+            path := strings.Split(f.Name, ".")
+            if path[0] == "_id" && op.Name != "$setOnInsert" && !(inserting && op.Name == "$set") {
+                return nil, errorf(10148, "Mod on _id not allowed")
+            }
+            current := lookup(out, path)
+            var err error
+            switch op.Name {
+            case "$set":
+                out, err = setPath(out, path, deepCopy(f.Value))
+            case "$setOnInsert":
+                if inserting {
+                    out, err = setPath(out, path, deepCopy(f.Value))
+                }
+            case "$unset":
+                out = unsetPath(out, path)
+            case "$inc":
+                sum := f.Value
+                if len(current) > 0 {
+                    if sum, err = add(current[0], f.Value); err != nil {
+                        return nil, err
+                    }
+                } else if _, ok := toFloat(f.Value); !ok {
+                    return nil, errorf(10152, "Modifier $inc allowed for numbers only")
+                }
+                out, err = setPath(out, path, sum)
+            case "$push", "$addToSet":
+                var arr []interface{}
+                if len(current) > 0 {
+                    if arr, ok = current[0].([]interface{}); !ok {
+                        return nil, errorf(10141, "Cannot apply %s modifier to non-array", op.Name)
+                    }
+                }
+                if op.Name == "$addToSet" && contains(arr, f.Value) {
+                    continue
+                }
+                out, err = setPath(out, path, append(arr[:len(arr):len(arr)], deepCopy(f.Value)))
+            case "$pull":
+                if len(current) == 0 {
+                    continue
+                }
+                arr, ok := current[0].([]interface{})
+                if !ok {
+                    return nil, errorf(10142, "Cannot apply $pull modifier to non-array")
+                }
+                kept := []interface{}{}
+                for _, e := range arr {
+                    if !matchEqual([]interface{}{e}, f.Value) {
+                        kept = append(kept, e)
+                    }
+                }
+                out, err = setPath(out, path, kept)
+            default:
+                return nil, errorf(10147, "Invalid modifier specified: %s", op.Name)
+            }
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+    return out.(bson.D), nil
+}
+
+// add returns the sum of two numbers, as an int while it fits in 32 bits,
+// then as an int64, or as a float64 if one of them is.
+func add(a, b interface{}) (interface{}, error) {
+    fa, ok := toFloat(a)
+    fb, ok2 := toFloat(b)
+    if !ok || !ok2 {
+        return nil, errors.New("Cannot apply $inc modifier to non-number")
+    }
+    _, floatA := a.(float64)
+    _, floatB := b.(float64)
+    if floatA || floatB {
+        return fa + fb, nil
+    }
+    sum := int64(fa) + int64(fb)
+    _, longA := a.(int64)
+    _, longB := b.(int64)
+    if !longA && !longB && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+        return int(sum), nil
+    }
+    return sum, nil
+}
+
+// upsertDoc returns the document inserted by an upsert: the equality fields
+// of the selector, changed by update.
+func upsertDoc(selector bson.D, update bson.D) (bson.D, error) {
+    var doc interface{} = bson.D{}
+    if len(update) > 0 && strings.HasPrefix(update[0].Name, "$") {
+        for _, e := range selector {
+            if strings.HasPrefix(e.Name, "$") || isOperatorDoc(e.Value) {
+                continue
+            }
+            var err error
+            if doc, err = setPath(doc, strings.Split(e.Name, "."), deepCopy(e.Value)); err != nil {
+                return nil, err
+            }
+        }
+    } else if id, ok := get(selector, "_id"); ok && !isOperatorDoc(id) {
+        doc = bson.D{{Name: "_id", Value: id}}
+    }
+    return applyUpdate(doc.(bson.D), update, true)
+}
+
+// withId returns doc with an _id in first position, adding a new ObjectId
+// if it has none.
+func withId(doc bson.D) bson.D {
+    for i, e := range doc {
+        if e.Name == "_id" {
+            if i == 0 {
+                return doc
+            }
+            out := bson.D{e}
+            out = append(out, doc[:i]...)
+            return append(out, doc[i+1:]...)
+        }
+    }
+    return append(bson.D{{Name: "_id", Value: bson.NewObjectId()}}, doc...)
+}
@@ -0,0 +1,236 @@
+package mongotest
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "github.com/QLeelulu/libgomongo/bson"
+    "io"
+)
+
+// Opcodes of the legacy wire protocol.
+const (
+    opReply       = 1
+    opUpdate      = 2001
+    opInsert      = 2002
+    opQuery       = 2004
+    opGetMore     = 2005
+    opDelete      = 2006
+    opKillCursors = 2007
+)
+
+// Flags of OP_REPLY.
+const (
+    replyCursorNotFound = 1 << 0
+    replyQueryFailure   = 1 << 1
+    replyAwaitCapable   = 1 << 3
+)
+
+// Flags of OP_QUERY, OP_INSERT, OP_UPDATE and OP_DELETE.
+const (
+    queryTailable         = 1 << 1
+    querySlaveOk          = 1 << 2
+    queryAwaitData        = 1 << 5
+    insertContinueOnError = 1 << 0
+    updateUpsert          = 1 << 0
+    updateMulti           = 1 << 1
+    deleteSingle          = 1 << 0
+)
+
+const maxMessageSize = 48 * 1000 * 1000
+
+// request is a decoded client message.
+type request struct {
+    requestId int32
+    opCode    int32
+    op        string // operation name, or command name, matched by faults
+    ns        string
+    flags     int32
+    skip      int32
+    limit     int32 // numberToReturn
+    query     bson.D
+    fields    bson.D
+    docs      []bson.D
+    selector  bson.D
+    update    bson.D
+    cursorId  int64
+    cursorIds []int64
+}
+
+// readRequest reads and decodes the next message of r.
+func readRequest(r io.Reader) (*request, error) {
+    var header [16]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return nil, err
+    }
+    length := int32(binary.LittleEndian.Uint32(header[0:]))
+    if length < 16 || length > maxMessageSize {
+        return nil, errors.New(fmt.Sprintf("mongotest: invalid message length %d", length))
+    }
+    body := make([]byte, length-16)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+    req := &request{
+        requestId: int32(binary.LittleEndian.Uint32(header[4:])),
+        opCode:    int32(binary.LittleEndian.Uint32(header[12:])),
+    }
+    m := &reader{data: body}
+    switch req.opCode {
+    case opQuery:
+        req.op = "query"
+        req.flags = m.int32()
+        req.ns = m.cstring()
+        req.skip = m.int32()
+        req.limit = m.int32()
+        req.query = m.document()
+        if m.more() {
+            req.fields = m.document()
+        }
+        if isCommand(req.ns) && len(req.query) > 0 {
+            req.op = commandName(req.query)
+        }
+    case opGetMore:
+        req.op = "getmore"
+        m.int32()
+        req.ns = m.cstring()
+        req.limit = m.int32()
+        req.cursorId = m.int64()
+    case opInsert:
+        req.op = "insert"
+        req.flags = m.int32()
+        req.ns = m.cstring()
+        for m.more() && m.err == nil {
+            req.docs = append(req.docs, m.document())
+        }
+    case opUpdate:
+        req.op = "update"
+        m.int32()
+        req.ns = m.cstring()
+        req.flags = m.int32()
+        req.selector = m.document()
+        req.update = m.document()
+    case opDelete:
+        req.op = "delete"
+        m.int32()
+        req.ns = m.cstring()
+        req.flags = m.int32()
+        req.selector = m.document()
+    case opKillCursors:
+        req.op = "killcursors"
+        m.int32()
+        n := m.int32()
+        for i := int32(0); i < n && m.err == nil; i++ {
+            req.cursorIds = append(req.cursorIds, m.int64())
+        }
+    default:
+        return nil, errors.New(fmt.Sprintf("mongotest: unsupported opcode %d", req.opCode))
+    }
+    if m.err != nil {
+        return nil, m.err
+    }
+    return req, nil
+}
+
+// reader decodes the fields of a message body, keeping the first error.
+type reader struct {
+    data []byte
+    err  error
+}
+
+func (m *reader) more() bool {
+    return len(m.data) > 0
+}
+
+func (m *reader) next(n int) []byte {
+    if m.err != nil {
+        return nil
+    }
+    if n < 0 || n > len(m.data) {
+        m.err = errors.New("mongotest: truncated message")
+        return nil
+    }
+    b := m.data[:n]
+    m.data = m.data[n:]
+    return b
+}
+
+func (m *reader) int32() int32 {
+    b := m.next(4)
+    if b == nil {
+        return 0
+    }
+    return int32(binary.LittleEndian.Uint32(b))
+}
+
+func (m *reader) int64() int64 {
+    b := m.next(8)
+    if b == nil {
+        return 0
+    }
+    return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (m *reader) cstring() string {
+    for i, c := range m.data {
+        if c == 0 {
+            return string(m.next(i + 1)[:i])
+        }
+    }
+    m.err = errors.New("mongotest: unterminated string")
+    return ""
+}
+
+func (m *reader) document() bson.D {
+    if len(m.data) < 4 {
+        m.err = errors.New("mongotest: truncated document")
+        return nil
+    }
+    data := m.next(int(int32(binary.LittleEndian.Uint32(m.data))))
+    if data == nil {
+        return nil
+    }
+    var d bson.D
+    if err := bson.Unmarshal(data, &d); err != nil {
+        m.err = err
+        return nil
+    }
+    return d
+}
+
+// reply is an OP_REPLY message.
+type reply struct {
+    flags        int32
+    cursorId     int64
+    startingFrom int32
+    docs         []bson.D
+}
+
+func (r *reply) write(w io.Writer, requestId, responseTo int32) error {
+    out := make([]byte, 36, 256)
+    for _, doc := range r.docs {
+        data, err := bson.Marshal(doc)
+        if err != nil {
+            return err
+        }
+        out = append(out, data...)
+    }
+    binary.LittleEndian.PutUint32(out[0:], uint32(len(out)))
+    binary.LittleEndian.PutUint32(out[4:], uint32(requestId))
+    binary.LittleEndian.PutUint32(out[8:], uint32(responseTo))
+    binary.LittleEndian.PutUint32(out[12:], opReply)
+    binary.LittleEndian.PutUint32(out[16:], uint32(r.flags))
+    binary.LittleEndian.PutUint64(out[20:], uint64(r.cursorId))
+    binary.LittleEndian.PutUint32(out[28:], uint32(r.startingFrom))
+    binary.LittleEndian.PutUint32(out[32:], uint32(len(r.docs)))
+    _, err := w.Write(out)
+    return err
+}
+
+// failure returns the reply of a failed query, as {$err: msg, code: code}.
+func failure(msg string, code int) *reply {
+    return &reply{
+        flags: replyQueryFailure,
+        docs:  []bson.D{{{Name: "$err", Value: msg}, {Name: "code", Value: code}}},
+    }
+}
@@ -0,0 +1,303 @@
+package libgomongo
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// OpEvent describes an operation sent to the server, as given to a
+// Monitor.
+type OpEvent struct {
+    // RequestId identifies the operation among the calls of a Monitor: the
+    // event given to Succeeded or Failed has the RequestId of the one
+    // given to Started.
+    RequestId int64
+
+    // Operation is "find", "getMore", "insert", "update", "remove" or
+    // "count", or the name of the command for the other commands.
+    Operation string
+
+    Namespace  string // "<database>.<collection>", or "<database>.$cmd"
+    Database   string
+    Collection string // "" for the commands on no collection
+
+    // Filter is the query of a find, update, remove, count or command,
+    // with every value replaced by "?", so that it shows the shape of the
+    // query without its data. It is nil when the operation has no query.
+    Filter D
+
+    // Documents is the number of documents sent by an insert, or returned
+    // by a find or a getMore in the event given to Succeeded.
+    Documents int
+
+    // Addr is the address of the server, as "host:port".
+    Addr string
+}
+
+// Monitor observes the operations a connection sends to the server, for
+// logging, metrics or tracing. Started is called before the operation is
+// sent, then either Succeeded, with the time it took, or Failed, with an
+// *OpError.
+//
+// The methods are called by the goroutine running the operation, with the
+// context of the connection, see Mongo.SetContext. They must not use the
+// connection.
+type Monitor interface {
+    Started(ctx context.Context, e OpEvent)
+    Succeeded(ctx context.Context, e OpEvent, duration time.Duration)
+    Failed(ctx context.Context, e OpEvent, err error)
+}
+
+// Monitors returns a Monitor calling each of monitors in turn.
+func Monitors(monitors ...Monitor) Monitor {
+    return multiMonitor(monitors)
+}
+
+type multiMonitor []Monitor
+
+func (ms multiMonitor) Started(ctx context.Context, e OpEvent) {
+    for _, m := range ms {
+        m.Started(ctx, e)
+    }
+}
+
+func (ms multiMonitor) Succeeded(ctx context.Context, e OpEvent, duration time.Duration) {
+    for _, m := range ms {
+        m.Succeeded(ctx, e, duration)
+    }
+}
+
+func (ms multiMonitor) Failed(ctx context.Context, e OpEvent, err error) {
+    for _, m := range ms {
+        m.Failed(ctx, e, err)
+    }
+}
+
+// OpError is the error of a failed operation, as returned by Mongo.Error
+// and given to Monitor.Failed.
+type OpError struct {
+    // Code is the error of the connection, or MONGO_COMMAND_FAILED for the
+    // errors reported by the server, as a failed command or query.
+    Code MongoError
+    // ServerCode is the code of the error reported by the server, as the
+    // code of a failed command, write or query, or 0 when unknown.
+    ServerCode int
+    Err        error
+}
+
+func (e *OpError) Error() string {
+    return e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+    return e.Err
+}
+
+// SetMonitor sets the monitor of the operations of the connection, or
+// removes it when monitor is nil.
+func (c *Mongo) SetMonitor(monitor Monitor) {
+    c.opMonitor = monitor
+}
+
+// Monitor returns the monitor of the connection, or nil.
+func (c *Mongo) Monitor() Monitor {
+    return c.opMonitor
+}
+
+// SetContext sets the context given to the monitor of the connection, as
+// the context of the request a connection of a Pool is used for. It is
+// reset when the connection is put back in its pool.
+func (c *Mongo) SetContext(ctx context.Context) {
+    c.ctx = ctx
+}
+
+// Context returns the context set by SetContext, or context.Background().
+func (c *Mongo) Context() context.Context {
+    if c.ctx == nil {
+        return context.Background()
+    }
+    return c.ctx
+}
+
+// SetMonitor sets the monitor of the connections returned by Get, or
+// removes it when monitor is nil.
+func (p *Pool) SetMonitor(monitor Monitor) {
+    p.opMonitor = monitor
+}
+
+// Monitor returns the monitor of the pool, or nil.
+func (p *Pool) Monitor() Monitor {
+    return p.opMonitor
+}
+
+// Last RequestId of OpEvent.
+var opRequestId int64
+
+// opTrace is an operation reported to the monitor of a connection.
+type opTrace struct {
+    conn  *Mongo
+    event OpEvent
+    start time.Time
+    query D // unredacted, to explain the slow queries
+}
+
+// traced reports whether the operations of the connection are traced, for
+// its monitor or its slow query logs.
+func (c *Mongo) traced() bool {
+    return c.opMonitor != nil || c.slowQuery > 0
+}
+
+// startOp calls the Started method of the monitor of the connection, if
+// any, with an event for the operation on ns, and returns the trace to end
+// the operation with, or nil when the connection is not traced. The filter
+// is the query of the operation, or the command for a command.
+func (c *Mongo) startOp(op, ns string, filter *Bson, documents int) *opTrace {
+    if !c.traced() {
+        return nil
+    }
+    e := OpEvent{
+        RequestId: atomic.AddInt64(&opRequestId, 1),
+        Operation: op,
+        Namespace: ns,
+        Documents: documents,
+        Addr:      c.Primary(),
+    }
+    e.Database, e.Collection = ns, ""
+    if i := strings.Index(ns, "."); i >= 0 {
+        e.Database, e.Collection = ns[:i], ns[i+1:]
+    }
+    t := &opTrace{conn: c}
+    doc := bsonDoc(filter)
+    if e.Collection == "$cmd" {
+        e.Collection = ""
+        if len(doc) > 0 {
+            e.Operation = doc[0].Name
+            if coll, ok := doc[0].Value.(string); ok {
+                e.Collection = coll
+            }
+        }
+        query, _ := doc.Map()["query"].(D)
+        if query == nil {
+            query, _ = doc.Map()["filter"].(D)
+        }
+        e.Filter = redactDoc(query)
+        if e.Operation == "count" {
+            t.query = query
+        }
+    } else if filter != nil {
+        if op == "find" || op == "count" {
+            t.query = doc
+        }
+        if query, ok := doc.Map()["$query"].(D); ok {
+            doc = query
+        }
+        e.Filter = redactDoc(doc)
+        if e.Filter == nil {
+            e.Filter = D{}
+        }
+    }
+    if c.opMonitor != nil {
+        c.opMonitor.Started(c.Context(), e)
+    }
+    t.event, t.start = e, time.Now()
+    return t
+}
+
+// end calls the Succeeded or Failed method of the monitor, depending on
+// err, which is an *OpError, and logs the operation if it is slow. It does
+// nothing on a nil trace.
+func (t *opTrace) end(err error) {
+    if t == nil {
+        return
+    }
+    c, duration := t.conn, time.Since(t.start)
+    if monitor := c.opMonitor; monitor != nil {
+        if err != nil {
+            monitor.Failed(c.Context(), t.event, err)
+        } else {
+            monitor.Succeeded(c.Context(), t.event, duration)
+        }
+    }
+    if c.slowQuery > 0 && duration >= c.slowQuery {
+        c.logSlowQuery(t, duration, err)
+    }
+}
+
+// endStatus ends the trace with the error of the connection when status
+// is not MONGO_OK.
+func (t *opTrace) endStatus(status int) {
+    if t == nil {
+        return
+    }
+    if status == MONGO_OK {
+        t.end(nil)
+        return
+    }
+    err := t.conn.Error()
+    if err == nil {
+        err = &OpError{Code: MONGO_COMMAND_FAILED, Err: errors.New("MongoDB: " + t.event.Operation + " failed")}
+    }
+    t.end(err)
+}
+
+// commandError returns the error of a command reply whose "ok" field is not
+// set, for the monitor.
+func commandError(reply *Bson) error {
+    res := bsonDoc(reply).Map()
+    if len(res) == 0 || commandOk(res) {
+        return nil
+    }
+    errmsg, _ := res["errmsg"].(string)
+    if errmsg == "" {
+        errmsg = "Unknow Error."
+    }
+    return &OpError{Code: MONGO_COMMAND_FAILED, ServerCode: serverCode(res), Err: errors.New("MongoDB command error: " + errmsg)}
+}
+
+// bsonDoc decodes b, which may be nil or empty.
+func bsonDoc(b *Bson) D {
+    if b == nil || b._bson == nil {
+        return nil
+    }
+    var d D
+    if err := b.Raw().Unmarshal(&d); err != nil {
+        return nil
+    }
+    return d
+}
+
+// redactDoc returns a copy of the document d where the values are replaced
+// by "?", except for the documents and arrays, which are redacted in turn.
+func redactDoc(d D) D {
+    if d == nil {
+        return nil
+    }
+    r := make(D, len(d))
+    for i, elem := range d {
+        r[i] = DocElem{Name: elem.Name, Value: redactValue(elem.Value)}
+    }
+    return r
+}
+
+func redactValue(v interface{}) interface{} {
+    switch v := v.(type) {
+    case D:
+        return redactDoc(v)
+    case M:
+        r := make(M, len(v))
+        for k, val := range v {
+            r[k] = redactValue(val)
+        }
+        return r
+    case []interface{}:
+        r := make([]interface{}, len(v))
+        for i, val := range v {
+            r[i] = redactValue(val)
+        }
+        return r
+    }
+    return "?"
+}
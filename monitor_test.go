@@ -0,0 +1,171 @@
+package libgomongo
+
+import (
+    "context"
+    "github.com/couchbaselabs/go.assert"
+    "sync"
+    "testing"
+    "time"
+)
+
+// recordedOp is an operation seen by a recordingMonitor.
+type recordedOp struct {
+    Event OpEvent
+    Err   error
+    Done  bool
+    Ctx   context.Context
+}
+
+// recordingMonitor is a Monitor keeping the operations it sees.
+type recordingMonitor struct {
+    mu  sync.Mutex
+    ops []recordedOp
+}
+
+func (m *recordingMonitor) Started(ctx context.Context, e OpEvent) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.ops = append(m.ops, recordedOp{Event: e, Ctx: ctx})
+}
+
+func (m *recordingMonitor) finish(e OpEvent, err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for i := range m.ops {
+        if m.ops[i].Event.RequestId == e.RequestId {
+            m.ops[i] = recordedOp{Event: e, Err: err, Done: true, Ctx: m.ops[i].Ctx}
+        }
+    }
+}
+
+func (m *recordingMonitor) Succeeded(ctx context.Context, e OpEvent, duration time.Duration) {
+    m.finish(e, nil)
+}
+
+func (m *recordingMonitor) Failed(ctx context.Context, e OpEvent, err error) {
+    m.finish(e, err)
+}
+
+// take returns the operations seen so far, and forgets them.
+func (m *recordingMonitor) take() []recordedOp {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    ops := m.ops
+    m.ops = nil
+    return ops
+}
+
+func TestMonitor(t *testing.T) {
+    conn, status := newClient()
+    assert.Equals(t, status, MONGO_OK)
+    defer conn.Destroy()
+    col := conn.Db("libgomongo-test").C("monitored")
+    col.RemoveAll(nil, nil)
+
+    monitor := &recordingMonitor{}
+    conn.SetMonitor(monitor)
+    type key struct{}
+    ctx := context.WithValue(context.Background(), key{}, "request")
+    conn.SetContext(ctx)
+
+    for i := 0; i < 120; i++ {
+        _, err := col.Insert(M{"n": i, "name": "secret"}, nil)
+        assert.Equals(t, err, nil)
+    }
+    ops := monitor.take()
+    assert.Equals(t, len(ops), 120)
+    op := ops[0]
+    assert.Equals(t, op.Done, true)
+    assert.Equals(t, op.Err, nil)
+    assert.Equals(t, op.Ctx.Value(key{}), "request")
+    assert.Equals(t, op.Event.Operation, "insert")
+    assert.Equals(t, op.Event.Namespace, "libgomongo-test.monitored")
+    assert.Equals(t, op.Event.Database, "libgomongo-test")
+    assert.Equals(t, op.Event.Collection, "monitored")
+    assert.Equals(t, op.Event.Documents, 1)
+    assert.Equals(t, op.Event.Addr, conn.Primary())
+    assert.NotEquals(t, ops[1].Event.RequestId, op.Event.RequestId)
+
+    // the first batch holds 101 documents, the rest comes with a getMore
+    iter := col.Select(QuerySpec{Query: M{"name": "secret", "n": M{"$gte": 0}}}, FindOptions{}).Iter()
+    var doc M
+    n := 0
+    for iter.Next(&doc) {
+        n++
+    }
+    assert.Equals(t, iter.Close(), nil)
+    assert.Equals(t, n, 120)
+    ops = monitor.take()
+    assert.Equals(t, len(ops), 2)
+    assert.Equals(t, ops[0].Event.Operation, "find")
+    assert.Equals(t, ops[0].Event.Documents, 101)
+    assert.Equals(t, ops[0].Event.Filter.Map()["name"], "?")
+    assert.DeepEquals(t, ops[0].Event.Filter.Map()["n"], D{{Name: "$gte", Value: "?"}})
+    assert.Equals(t, ops[1].Event.Operation, "getMore")
+    assert.Equals(t, ops[1].Event.Namespace, "libgomongo-test.monitored")
+    assert.Equals(t, ops[1].Event.Documents, 19)
+    assert.Equals(t, ops[1].Done, true)
+
+    count, err := col.Find(M{"n": M{"$lt": 10}}).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, count, 10)
+    ops = monitor.take()
+    assert.Equals(t, len(ops), 1)
+    assert.Equals(t, ops[0].Event.Operation, "count")
+    assert.Equals(t, ops[0].Event.Collection, "monitored")
+    assert.DeepEquals(t, ops[0].Event.Filter, D{{Name: "n", Value: D{{Name: "$lt", Value: "?"}}}})
+
+    _, err = col.RemoveAll(M{"n": M{"$in": []int{1, 2}}}, nil)
+    assert.Equals(t, err, nil)
+    ops = monitor.take()
+    assert.Equals(t, ops[0].Event.Operation, "remove")
+    assert.DeepEquals(t, ops[0].Event.Filter, D{{Name: "n", Value: D{{Name: "$in", Value: []interface{}{"?", "?"}}}}})
+
+    err = conn.Db("libgomongo-test").Run("nosuchcommand", nil)
+    assert.NotEquals(t, err, nil)
+    ops = monitor.take()
+    assert.Equals(t, len(ops), 1)
+    assert.Equals(t, ops[0].Event.Operation, "nosuchcommand")
+    assert.Equals(t, ops[0].Done, true)
+    assert.NotEquals(t, ops[0].Err, nil)
+    assert.Equals(t, ops[0].Err.(*OpError).Code, MONGO_COMMAND_FAILED)
+    assert.Equals(t, MONGO_COMMAND_FAILED.String(), "MONGO_COMMAND_FAILED")
+
+    conn.SetMonitor(nil)
+    col.Count(nil)
+    assert.Equals(t, len(monitor.take()), 0)
+}
+
+func TestPoolMonitor(t *testing.T) {
+    monitor := &recordingMonitor{}
+    pool := NewPool(host, port, 1)
+    pool.SetMonitor(monitor)
+    conn, err := pool.Get()
+    assert.Equals(t, err, nil)
+    conn.SetContext(context.TODO())
+    conn.Db("libgomongo-test").Run("ping", nil)
+    conn.Close()
+    ops := monitor.take()
+    assert.Equals(t, len(ops), 1)
+    assert.Equals(t, ops[0].Event.Operation, "ping")
+    assert.Equals(t, ops[0].Ctx, context.TODO())
+
+    conn, err = pool.Get()
+    assert.Equals(t, err, nil)
+    defer conn.Destroy()
+    assert.Equals(t, conn.Context(), context.Background())
+}
+
+func TestRedactDoc(t *testing.T) {
+    filter := D{
+        {Name: "name", Value: "Ann"},
+        {Name: "age", Value: D{{Name: "$gt", Value: 30}}},
+        {Name: "$or", Value: []interface{}{M{"a": 1}, D{{Name: "b", Value: nil}}}},
+    }
+    assert.DeepEquals(t, redactDoc(filter), D{
+        {Name: "name", Value: "?"},
+        {Name: "age", Value: D{{Name: "$gt", Value: "?"}}},
+        {Name: "$or", Value: []interface{}{M{"a": "?"}, D{{Name: "b", Value: "?"}}}},
+    })
+    assert.DeepEquals(t, redactDoc(nil), D(nil))
+}
@@ -0,0 +1,141 @@
+// Package otelmongo traces the operations of libgomongo connections with
+// OpenTelemetry, with a span per operation sent to the server.
+//
+// The spans follow the semantic conventions of the database clients, with
+// the db.system, db.name, db.mongodb.collection, db.operation,
+// net.peer.name and net.peer.port attributes. Their parent is the span of
+// the context of the connection, set with SetContext:
+//
+//     pool.SetMonitor(otelmongo.NewMonitor())
+//     ...
+//     conn, err := pool.Get()
+//     if err != nil {
+//         return err
+//     }
+//     defer conn.Close()
+//     conn.SetContext(r.Context())
+//
+// A monitor which is already set, as for logging, is kept by combining
+// both with libgomongo.Monitors.
+package otelmongo
+
+import (
+    "context"
+    "github.com/QLeelulu/libgomongo"
+    "github.com/QLeelulu/libgomongo/bson"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+    "go.opentelemetry.io/otel/trace"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Name of the tracer, the import path of the package.
+const tracerName = "github.com/QLeelulu/libgomongo/otelmongo"
+
+// Option configures the monitor returned by NewMonitor.
+type Option func(*monitor)
+
+// WithTracerProvider sets the provider of the tracer, which defaults to
+// the global provider of otel.GetTracerProvider.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+    return func(m *monitor) {
+        m.provider = provider
+    }
+}
+
+// WithFilter records the redacted filter of the operations, as the
+// db.statement attribute. It shows the fields and operators of the
+// queries, with their values replaced by "?".
+func WithFilter(enabled bool) Option {
+    return func(m *monitor) {
+        m.filter = enabled
+    }
+}
+
+// NewMonitor returns a libgomongo.Monitor creating a span per operation.
+func NewMonitor(options ...Option) libgomongo.Monitor {
+    m := &monitor{spans: make(map[int64]trace.Span)}
+    for _, option := range options {
+        option(m)
+    }
+    if m.provider == nil {
+        m.provider = otel.GetTracerProvider()
+    }
+    m.tracer = m.provider.Tracer(tracerName)
+    return m
+}
+
+type monitor struct {
+    provider trace.TracerProvider
+    tracer   trace.Tracer
+    filter   bool
+
+    mu    sync.Mutex
+    spans map[int64]trace.Span // by OpEvent.RequestId
+}
+
+func (m *monitor) Started(ctx context.Context, e libgomongo.OpEvent) {
+    attrs := []attribute.KeyValue{
+        semconv.DBSystemMongoDB,
+        semconv.DBName(e.Database),
+        semconv.DBOperation(e.Operation),
+    }
+    if e.Collection != "" {
+        attrs = append(attrs, semconv.DBMongoDBCollection(e.Collection))
+    }
+    if host, port, err := net.SplitHostPort(e.Addr); err == nil {
+        attrs = append(attrs, semconv.NetPeerName(host))
+        if p, err := strconv.Atoi(port); err == nil {
+            attrs = append(attrs, semconv.NetPeerPort(p))
+        }
+    }
+    if m.filter && e.Filter != nil {
+        if statement, err := bson.MarshalExtJSON(e.Filter, false); err == nil {
+            attrs = append(attrs, semconv.DBStatement(string(statement)))
+        }
+    }
+    _, span := m.tracer.Start(ctx, spanName(e),
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(attrs...))
+
+    m.mu.Lock()
+    m.spans[e.RequestId] = span
+    m.mu.Unlock()
+}
+
+func (m *monitor) Succeeded(ctx context.Context, e libgomongo.OpEvent, duration time.Duration) {
+    if span := m.span(e); span != nil {
+        span.End()
+    }
+}
+
+func (m *monitor) Failed(ctx context.Context, e libgomongo.OpEvent, err error) {
+    if span := m.span(e); span != nil {
+        span.RecordError(err)
+        span.SetStatus(codes.Error, err.Error())
+        span.End()
+    }
+}
+
+// span returns the span of the operation, and forgets it.
+func (m *monitor) span(e libgomongo.OpEvent) trace.Span {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    span := m.spans[e.RequestId]
+    delete(m.spans, e.RequestId)
+    return span
+}
+
+// spanName returns the name of the span of an operation, as
+// "<operation> <database>.<collection>".
+func spanName(e libgomongo.OpEvent) string {
+    if e.Collection == "" {
+        return e.Operation + " " + e.Database
+    }
+    return e.Operation + " " + e.Database + "." + e.Collection
+}
@@ -0,0 +1,115 @@
+package otelmongo
+
+import (
+    "context"
+    "errors"
+    "github.com/QLeelulu/libgomongo"
+    "github.com/QLeelulu/libgomongo/mongotest"
+    "github.com/couchbaselabs/go.assert"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/trace/tracetest"
+    "go.opentelemetry.io/otel/trace"
+    "testing"
+    "time"
+)
+
+// newRecorder returns a tracer provider keeping the spans in memory.
+func newRecorder() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+    exporter := tracetest.NewInMemoryExporter()
+    provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+    return provider, exporter
+}
+
+// attrs returns the attributes of a span by key.
+func attrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+    m := make(map[attribute.Key]attribute.Value)
+    for _, kv := range span.Attributes {
+        m[kv.Key] = kv.Value
+    }
+    return m
+}
+
+func TestMonitor(t *testing.T) {
+    provider, exporter := newRecorder()
+    monitor := NewMonitor(WithTracerProvider(provider), WithFilter(true))
+
+    ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+    e := libgomongo.OpEvent{
+        RequestId:  1,
+        Operation:  "find",
+        Namespace:  "app.people",
+        Database:   "app",
+        Collection: "people",
+        Filter:     libgomongo.D{{Name: "age", Value: libgomongo.D{{Name: "$gt", Value: "?"}}}},
+        Addr:       "db1.example.com:27017",
+    }
+    monitor.Started(ctx, e)
+    monitor.Started(ctx, libgomongo.OpEvent{RequestId: 2, Operation: "ping", Namespace: "admin.$cmd", Database: "admin"})
+    monitor.Failed(ctx, libgomongo.OpEvent{RequestId: 2}, errors.New("MongoDB command error: boom"))
+    monitor.Succeeded(ctx, e, time.Millisecond)
+    parent.End()
+
+    spans := exporter.GetSpans()
+    assert.Equals(t, len(spans), 3)
+    failed, find := spans[0], spans[1]
+
+    assert.Equals(t, find.Name, "find app.people")
+    assert.Equals(t, find.SpanKind, trace.SpanKindClient)
+    assert.Equals(t, find.Parent.SpanID(), parent.SpanContext().SpanID())
+    assert.Equals(t, find.SpanContext.TraceID(), parent.SpanContext().TraceID())
+    a := attrs(find)
+    assert.Equals(t, a["db.system"].AsString(), "mongodb")
+    assert.Equals(t, a["db.name"].AsString(), "app")
+    assert.Equals(t, a["db.mongodb.collection"].AsString(), "people")
+    assert.Equals(t, a["db.operation"].AsString(), "find")
+    assert.Equals(t, a["net.peer.name"].AsString(), "db1.example.com")
+    assert.Equals(t, a["net.peer.port"].AsInt64(), int64(27017))
+    assert.Equals(t, a["db.statement"].AsString(), `{"age":{"$gt":"?"}}`)
+    assert.Equals(t, find.Status.Code, codes.Unset)
+
+    assert.Equals(t, failed.Name, "ping admin")
+    assert.Equals(t, failed.Status.Code, codes.Error)
+    assert.Equals(t, failed.Status.Description, "MongoDB command error: boom")
+    assert.Equals(t, len(failed.Events), 1)
+    _, ok := attrs(failed)["db.mongodb.collection"]
+    assert.Equals(t, ok, false)
+
+    // without a Started, as when the monitor is set during an operation
+    monitor.Succeeded(ctx, libgomongo.OpEvent{RequestId: 3}, time.Millisecond)
+    assert.Equals(t, len(exporter.GetSpans()), 3)
+}
+
+func TestConnection(t *testing.T) {
+    server, err := mongotest.NewServer()
+    assert.Equals(t, err, nil)
+    defer server.Close()
+    conn := libgomongo.NewMongo()
+    assert.Equals(t, conn.Client(server.Host(), server.Port()), libgomongo.MONGO_OK)
+    defer conn.Destroy()
+
+    provider, exporter := newRecorder()
+    conn.SetMonitor(NewMonitor(WithTracerProvider(provider)))
+    ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+    conn.SetContext(ctx)
+
+    col := conn.Db("app").C("people")
+    _, err = col.Insert(libgomongo.M{"name": "Ann"}, nil)
+    assert.Equals(t, err, nil)
+    n, err := col.Find(libgomongo.M{"name": "Ann"}).Count()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, n, 1)
+    parent.End()
+
+    spans := exporter.GetSpans()
+    assert.Equals(t, len(spans), 3)
+    assert.Equals(t, spans[0].Name, "insert app.people")
+    assert.Equals(t, spans[1].Name, "count app.people")
+    for _, span := range spans[:2] {
+        assert.Equals(t, span.Parent.SpanID(), parent.SpanContext().SpanID())
+        assert.Equals(t, attrs(span)["net.peer.name"].AsString(), server.Host())
+        _, ok := attrs(span)["db.statement"]
+        assert.Equals(t, ok, false)
+    }
+}
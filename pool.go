@@ -1,5 +1,14 @@
 package libgomongo
 
+import (
+    "errors"
+    "log/slog"
+    "net"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
 // Pool maintains a pool of database connections.
 //
 // The following example shows how to use a pool in a web application. The
@@ -36,7 +45,35 @@ type Pool struct {
     Host string
     Port int
 
-    conns chan *Mongo
+    // The name and the seeds, as "host:port", of the replica set of a pool
+    // created by NewReplicaSetPool.
+    SetName string
+    Seeds   []string
+
+    conns     chan *Mongo
+    gen       uint64 // incremented when the primary changes
+    monitor   *topologyMonitor
+    opMonitor   Monitor
+    logger      *slog.Logger
+    slowQuery   time.Duration
+    slowExplain bool
+
+    // counters of PoolStats, updated atomically
+    active    int64
+    waiting   int64
+    created   uint64
+    destroyed uint64
+}
+
+// PoolStats reports the state of the connections of a Pool.
+type PoolStats struct {
+    Idle    int // connections in the pool
+    Active  int // connections returned by Get and not closed yet
+    Waiting int // calls of Get connecting to the server
+
+    // Number of connections opened and destroyed by the pool.
+    Created   uint64
+    Destroyed uint64
 }
 
 // NewPool returns a new connection pool. The pool create
@@ -46,6 +83,13 @@ func NewPool(host string, port int, maxIdle int) *Pool {
         conns: make(chan *Mongo, maxIdle)}
 }
 
+// NewReplicaSetPool returns a new pool of connections to the primary of
+// the named replica set, found from the seeds, given as "host:port".
+func NewReplicaSetPool(setName string, seeds []string, maxIdle int) *Pool {
+    return &Pool{SetName: setName, Seeds: seeds, Size: maxIdle,
+        conns: make(chan *Mongo, maxIdle)}
+}
+
 // Get returns an idle connection from the pool if available or creates a new
 // connection. The caller should Close() the connection to return the
 // connection to the pool.
@@ -55,23 +99,133 @@ func (p *Pool) Get() (*Mongo, error) {
     case conn = <-p.conns:
     default:
         var err error
-        conn = NewMongo()
-        status := conn.Client(p.Host, p.Port)
-        if status != MONGO_OK {
-            err = conn.Error()
-        }
+        atomic.AddInt64(&p.waiting, 1)
+        conn, err = p.connect()
+        atomic.AddInt64(&p.waiting, -1)
         if err != nil {
             return nil, err
         }
+        atomic.AddUint64(&p.created, 1)
     }
+    atomic.AddInt64(&p.active, 1)
     conn.pool = p
+    conn.opMonitor = p.opMonitor
+    conn.logger = p.logger
+    conn.slowQuery = p.slowQuery
+    conn.slowExplain = p.slowExplain
     return conn, nil
 }
 
+// connect opens a new connection to the server, or to the primary of the
+// replica set.
+func (p *Pool) connect() (*Mongo, error) {
+    conn := NewMongo()
+    conn.poolGen = atomic.LoadUint64(&p.gen)
+    var status int
+    if p.SetName == "" {
+        status = conn.Client(p.Host, p.Port)
+    } else {
+        conn.ReplicaSetInit(p.SetName)
+        for _, seed := range p.Seeds {
+            host, portStr, err := net.SplitHostPort(seed)
+            if err != nil {
+                return nil, err
+            }
+            port, _ := strconv.Atoi(portStr)
+            conn.ReplicaSetAddSeed(host, port)
+        }
+        status = conn.ReplicaSetClient()
+    }
+    if status != MONGO_OK {
+        err := conn.Error()
+        conn.Destroy()
+        return nil, err
+    }
+    return conn, nil
+}
+
+// Put returns a connection to the pool, or destroys it when the pool is
+// full or when it was opened before the primary changed.
 func (p *Pool) Put(conn *Mongo) {
+    conn.ctx = nil
+    atomic.AddInt64(&p.active, -1)
+    if conn.poolGen != atomic.LoadUint64(&p.gen) {
+        p.destroy(conn)
+        return
+    }
     select {
     case p.conns <- conn:
     default:
-        conn.Destroy()
+        p.destroy(conn)
+    }
+}
+
+func (p *Pool) destroy(conn *Mongo) {
+    conn.Destroy()
+    atomic.AddUint64(&p.destroyed, 1)
+}
+
+// Stats returns the state of the connections of the pool.
+func (p *Pool) Stats() PoolStats {
+    return PoolStats{
+        Idle:      len(p.conns),
+        Active:    int(atomic.LoadInt64(&p.active)),
+        Waiting:   int(atomic.LoadInt64(&p.waiting)),
+        Created:   atomic.LoadUint64(&p.created),
+        Destroyed: atomic.LoadUint64(&p.destroyed),
+    }
+}
+
+// StartTopologyMonitor starts a topology monitor on the servers of the
+// pool, see Mongo.StartTopologyMonitor. When the primary steps down or is
+// lost, the idle connections are destroyed, and so are the connections in
+// use when they are put back, so that the pool only holds connections to
+// the new primary.
+func (p *Pool) StartTopologyMonitor(interval time.Duration) (<-chan TopologyEvent, error) {
+    if p.monitor != nil {
+        return nil, errors.New("MongoDB: the topology monitor is already started")
+    }
+    seeds := p.Seeds
+    if p.SetName == "" {
+        seeds = []string{net.JoinHostPort(p.Host, strconv.Itoa(p.Port))}
+    }
+    p.monitor = newTopologyMonitor(seeds, interval)
+    p.monitor.listen(func(e TopologyEvent) {
+        if e.Type == PrimaryChanged && e.OldPrimary != "" {
+            p.drain()
+        }
+    })
+    p.monitor.start()
+    return p.monitor.events, nil
+}
+
+// StopTopologyMonitor stops the topology monitor of the pool, if any.
+func (p *Pool) StopTopologyMonitor() {
+    if p.monitor != nil {
+        p.monitor.close()
+        p.monitor = nil
+    }
+}
+
+// Topology returns the topology last seen by the topology monitor of the
+// pool, or an empty Topology when it is not started.
+func (p *Pool) Topology() Topology {
+    if p.monitor == nil {
+        return Topology{}
+    }
+    return p.monitor.get()
+}
+
+// drain destroys the idle connections and the connections in use when
+// they are put back.
+func (p *Pool) drain() {
+    atomic.AddUint64(&p.gen, 1)
+    for {
+        select {
+        case conn := <-p.conns:
+            p.destroy(conn)
+        default:
+            return
+        }
     }
 }
@@ -1,8 +1,10 @@
 package libgomongo
 
 import (
+    "github.com/QLeelulu/libgomongo/mongotest"
     "github.com/couchbaselabs/go.assert"
     "testing"
+    "time"
 )
 
 func TestConnPool(t *testing.T) {
@@ -31,3 +33,81 @@ func TestConnPool(t *testing.T) {
     conn4.Close()
     assert.Equals(t, len(pool.conns), size)
 }
+
+func TestPoolFailover(t *testing.T) {
+    var servers []*mongotest.Server
+    var hosts []string
+    for i := 0; i < 2; i++ {
+        s, err := mongotest.NewServer()
+        assert.Equals(t, err, nil)
+        defer s.Close()
+        servers = append(servers, s)
+        hosts = append(hosts, s.Addr())
+    }
+    setPrimary := func(primary int) {
+        for i, s := range servers {
+            s.SetMember(mongotest.Member{SetName: "rs0", Hosts: hosts, Primary: i == primary})
+        }
+    }
+    setPrimary(0)
+
+    pool := NewReplicaSetPool("rs0", hosts[1:], 2)
+    defer pool.StopTopologyMonitor()
+    events, err := pool.StartTopologyMonitor(20 * time.Millisecond)
+    assert.Equals(t, err, nil)
+    assert.Equals(t, pool.Topology().Primary, hosts[0])
+
+    conn1, err := pool.Get()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, conn1.Primary(), hosts[0])
+    conn2, err := pool.Get()
+    assert.Equals(t, err, nil)
+    conn1.Close()
+    assert.Equals(t, len(pool.conns), 1)
+
+    setPrimary(-1)
+    setPrimary(1)
+    for e := (TopologyEvent{}); e.NewPrimary != hosts[1]; {
+        select {
+        case e = <-events:
+        case <-time.After(2 * time.Second):
+            t.Fatal("no failover")
+        }
+    }
+    // the connections to the old primary are dropped
+    assert.Equals(t, len(pool.conns), 0)
+    conn2.Close()
+    assert.Equals(t, len(pool.conns), 0)
+
+    conn, err := pool.Get()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, conn.Primary(), hosts[1])
+    conn.Close()
+    assert.Equals(t, len(pool.conns), 1)
+}
+
+func TestPoolStats(t *testing.T) {
+    pool := NewPool(host, port, 1)
+    assert.Equals(t, pool.Stats(), PoolStats{})
+
+    conn1, err := pool.Get()
+    assert.Equals(t, err, nil)
+    conn2, err := pool.Get()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, pool.Stats(), PoolStats{Active: 2, Created: 2})
+
+    conn1.Close()
+    conn2.Close()
+    assert.Equals(t, pool.Stats(), PoolStats{Idle: 1, Created: 2, Destroyed: 1})
+
+    conn, err := pool.Get()
+    assert.Equals(t, err, nil)
+    assert.Equals(t, pool.Stats(), PoolStats{Active: 1, Created: 2, Destroyed: 1})
+    conn.Close()
+
+    // nothing listens on port 1
+    down := NewPool("127.0.0.1", 1, 1)
+    _, err = down.Get()
+    assert.NotEquals(t, err, nil)
+    assert.Equals(t, down.Stats(), PoolStats{})
+}
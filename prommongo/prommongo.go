@@ -0,0 +1,159 @@
+// Package prommongo exports metrics of libgomongo pools and operations to
+// Prometheus.
+//
+// The Collector reports the connections of a pool, and is the monitor of
+// its operations, timing them by namespace and operation and counting
+// their errors by code:
+//
+//     pool := libgomongo.NewPool(host, port, 10)
+//     if _, err := prommongo.Register(prometheus.DefaultRegisterer, pool); err != nil {
+//         return err
+//     }
+//
+// The metrics are:
+//
+//     mongo_pool_connections{state="idle|active|waiting"}          gauge
+//     mongo_pool_connections_created_total                         counter
+//     mongo_pool_connections_destroyed_total                       counter
+//     mongo_operation_duration_seconds{namespace,operation}        histogram
+//     mongo_operation_errors_total{namespace,operation,code}       counter
+//
+// The code label of the errors is the name of the libgomongo.MongoError, as
+// "MONGO_IO_ERROR".
+package prommongo
+
+import (
+    "context"
+    "errors"
+    "github.com/QLeelulu/libgomongo"
+    "github.com/prometheus/client_golang/prometheus"
+    "time"
+)
+
+// Option configures the Collector returned by NewCollector.
+type Option func(*options)
+
+type options struct {
+    labels  prometheus.Labels
+    buckets []float64
+}
+
+// WithConstLabels adds labels to every metric, as the name of the pool
+// when several pools are registered.
+func WithConstLabels(labels prometheus.Labels) Option {
+    return func(o *options) {
+        o.labels = labels
+    }
+}
+
+// WithBuckets sets the buckets of the duration histogram, in seconds. They
+// default to prometheus.DefBuckets.
+func WithBuckets(buckets []float64) Option {
+    return func(o *options) {
+        o.buckets = buckets
+    }
+}
+
+// Collector is a prometheus.Collector of the metrics of a pool, and the
+// libgomongo.Monitor of the operations timed by the metrics.
+type Collector struct {
+    pool *libgomongo.Pool
+
+    connections *prometheus.Desc
+    created     *prometheus.Desc
+    destroyed   *prometheus.Desc
+    duration    *prometheus.HistogramVec
+    errors      *prometheus.CounterVec
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+var _ libgomongo.Monitor = (*Collector)(nil)
+
+// NewCollector returns a Collector for pool, which may be nil to only time
+// the operations of connections the Collector is set as monitor of.
+func NewCollector(pool *libgomongo.Pool, opts ...Option) *Collector {
+    o := options{buckets: prometheus.DefBuckets}
+    for _, opt := range opts {
+        opt(&o)
+    }
+    return &Collector{
+        pool: pool,
+        connections: prometheus.NewDesc("mongo_pool_connections",
+            "Number of connections of the pool, by state.",
+            []string{"state"}, o.labels),
+        created: prometheus.NewDesc("mongo_pool_connections_created_total",
+            "Number of connections opened by the pool.", nil, o.labels),
+        destroyed: prometheus.NewDesc("mongo_pool_connections_destroyed_total",
+            "Number of connections destroyed by the pool.", nil, o.labels),
+        duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:        "mongo_operation_duration_seconds",
+            Help:        "Duration of the successful operations sent to the server.",
+            ConstLabels: o.labels,
+            Buckets:     o.buckets,
+        }, []string{"namespace", "operation"}),
+        errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name:        "mongo_operation_errors_total",
+            Help:        "Number of failed operations, by error code.",
+            ConstLabels: o.labels,
+        }, []string{"namespace", "operation", "code"}),
+    }
+}
+
+// Register registers a Collector for pool with registerer, and sets it as
+// monitor of the pool, along with the monitor the pool may already have.
+func Register(registerer prometheus.Registerer, pool *libgomongo.Pool, opts ...Option) (*Collector, error) {
+    c := NewCollector(pool, opts...)
+    if err := registerer.Register(c); err != nil {
+        return nil, err
+    }
+    if monitor := pool.Monitor(); monitor != nil {
+        pool.SetMonitor(libgomongo.Monitors(monitor, c))
+    } else {
+        pool.SetMonitor(c)
+    }
+    return c, nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+    if c.pool != nil {
+        ch <- c.connections
+        ch <- c.created
+        ch <- c.destroyed
+    }
+    c.duration.Describe(ch)
+    c.errors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+    if c.pool != nil {
+        stats := c.pool.Stats()
+        ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(stats.Idle), "idle")
+        ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(stats.Active), "active")
+        ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(stats.Waiting), "waiting")
+        ch <- prometheus.MustNewConstMetric(c.created, prometheus.CounterValue, float64(stats.Created))
+        ch <- prometheus.MustNewConstMetric(c.destroyed, prometheus.CounterValue, float64(stats.Destroyed))
+    }
+    c.duration.Collect(ch)
+    c.errors.Collect(ch)
+}
+
+// Started implements libgomongo.Monitor.
+func (c *Collector) Started(ctx context.Context, e libgomongo.OpEvent) {
+}
+
+// Succeeded implements libgomongo.Monitor.
+func (c *Collector) Succeeded(ctx context.Context, e libgomongo.OpEvent, duration time.Duration) {
+    c.duration.WithLabelValues(e.Namespace, e.Operation).Observe(duration.Seconds())
+}
+
+// Failed implements libgomongo.Monitor.
+func (c *Collector) Failed(ctx context.Context, e libgomongo.OpEvent, err error) {
+    code := libgomongo.MONGO_COMMAND_FAILED
+    var opErr *libgomongo.OpError
+    if errors.As(err, &opErr) {
+        code = opErr.Code
+    }
+    c.errors.WithLabelValues(e.Namespace, e.Operation, code.String()).Inc()
+}
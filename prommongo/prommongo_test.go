@@ -0,0 +1,85 @@
+package prommongo
+
+import (
+    "context"
+    "errors"
+    "github.com/QLeelulu/libgomongo"
+    "github.com/QLeelulu/libgomongo/mongotest"
+    "github.com/couchbaselabs/go.assert"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCollector(t *testing.T) {
+    server, err := mongotest.NewServer()
+    assert.Equals(t, err, nil)
+    defer server.Close()
+
+    pool := libgomongo.NewPool(server.Host(), server.Port(), 1)
+    registry := prometheus.NewRegistry()
+    c, err := Register(registry, pool)
+    assert.Equals(t, err, nil)
+    _, err = Register(registry, pool)
+    assert.NotEquals(t, err, nil)
+
+    conn, err := pool.Get()
+    assert.Equals(t, err, nil)
+    idle, err := pool.Get()
+    assert.Equals(t, err, nil)
+    idle.Close()
+    col := conn.Db("app").C("people")
+    _, err = col.Insert(libgomongo.M{"name": "Ann"}, nil)
+    assert.Equals(t, err, nil)
+    assert.NotEquals(t, conn.Db("app").Run("nosuchcommand", nil), nil)
+
+    err = testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP mongo_operation_errors_total Number of failed operations, by error code.
+# TYPE mongo_operation_errors_total counter
+mongo_operation_errors_total{code="MONGO_COMMAND_FAILED",namespace="app.$cmd",operation="nosuchcommand"} 1
+# HELP mongo_pool_connections Number of connections of the pool, by state.
+# TYPE mongo_pool_connections gauge
+mongo_pool_connections{state="active"} 1
+mongo_pool_connections{state="idle"} 1
+mongo_pool_connections{state="waiting"} 0
+# HELP mongo_pool_connections_created_total Number of connections opened by the pool.
+# TYPE mongo_pool_connections_created_total counter
+mongo_pool_connections_created_total 2
+`), "mongo_operation_errors_total", "mongo_pool_connections", "mongo_pool_connections_created_total")
+    assert.Equals(t, err, nil)
+    assert.Equals(t, testutil.CollectAndCount(c, "mongo_operation_duration_seconds"), 1)
+
+    conn.Close()
+    conn, err = pool.Get()
+    assert.Equals(t, err, nil)
+    conn.Destroy()
+}
+
+func TestCollectorMonitor(t *testing.T) {
+    c := NewCollector(nil, WithConstLabels(prometheus.Labels{"pool": "main"}))
+    e := libgomongo.OpEvent{Namespace: "app.people", Operation: "find"}
+    c.Started(context.Background(), e)
+    c.Succeeded(context.Background(), e, 20*time.Millisecond)
+    c.Failed(context.Background(), e, &libgomongo.OpError{Code: libgomongo.MONGO_IO_ERROR, Err: errors.New("MongoDB: IO")})
+    c.Failed(context.Background(), e, errors.New("other"))
+
+    err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP mongo_operation_errors_total Number of failed operations, by error code.
+# TYPE mongo_operation_errors_total counter
+mongo_operation_errors_total{code="MONGO_COMMAND_FAILED",namespace="app.people",operation="find",pool="main"} 1
+mongo_operation_errors_total{code="MONGO_IO_ERROR",namespace="app.people",operation="find",pool="main"} 1
+`), "mongo_operation_errors_total")
+    assert.Equals(t, err, nil)
+    assert.Equals(t, testutil.CollectAndCount(c), 3)
+
+    // the monitor of a pool is kept
+    pool := libgomongo.NewPool("127.0.0.1", 27017, 1)
+    other := NewCollector(nil)
+    pool.SetMonitor(other)
+    _, err = Register(prometheus.NewRegistry(), pool, WithBuckets([]float64{0.01, 0.1}))
+    assert.Equals(t, err, nil)
+    pool.Monitor().Succeeded(context.Background(), e, time.Millisecond)
+    assert.Equals(t, testutil.CollectAndCount(other, "mongo_operation_duration_seconds"), 1)
+}
@@ -1,15 +1,18 @@
 package libgomongo
 
 import (
-// "fmt"
+    "errors"
+    // "fmt"
+    "strings"
 )
 
 // FindOptions specifies options for the Conn.Find method.
 type FindOptions struct {
     // Optional document that limits the fields in the returned documents.
     // Fields contains one or more elements, each of which is the name of a
-    // field that should be returned, and the integer value 1.
-    Fields M
+    // field that should be returned, and the integer value 1. It may be a M
+    // or a D.
+    Fields interface{}
 
     // Do not close the cursor when no more data is available on the server.
     Tailable bool
@@ -44,16 +47,45 @@ type FindOptions struct {
     // Sets the batch size used for sending documents from the server to the
     // client.
     BatchSize int
+
+    // The read preference of the query, or nil for the one of the
+    // connection. See ReadPreference.
+    ReadPreference *ReadPreference
+}
+
+// cursorOptions returns the MONGO_* cursor option bitfield for the options.
+func (opts *FindOptions) cursorOptions() int {
+    bits := 0
+    if opts.Tailable {
+        bits |= MONGO_TAILABLE
+    }
+    if opts.SlaveOk {
+        bits |= MONGO_SLAVE_OK
+    }
+    if opts.NoCursorTimeout {
+        bits |= MONGO_NO_CURSOR_TIMEOUT
+    }
+    if opts.AwaitData {
+        bits |= MONGO_AWAIT_DATA
+    }
+    if opts.Exhaust {
+        bits |= MONGO_EXHAUST
+    }
+    if opts.PartialResults {
+        bits |= MONGO_PARTIAL
+    }
+    return bits
 }
 
 // QuerySpec is a helper for specifying complex queries.
 type QuerySpec struct {
-    // The filter. This field is required.
-    Query M   `bson:"$query"`
+    // The filter, as a M or a D. This field is required.
+    Query interface{} `bson:"$query"`
 
     // Sort order specified by (key, direction) pairs. The direction is 1 for
-    // ascending order and -1 for descending order.
-    Sort M   `bson:"$orderby"`
+    // ascending order and -1 for descending order. Use a D to sort on more
+    // than one key, as the order of a M is random.
+    Sort interface{} `bson:"$orderby"`
 
     // If set to true, then the query returns an explain plan record the query.
     // See http://www.mongodb.org/display/DOCS/Optimization#Optimization-Explain
@@ -61,7 +93,7 @@ type QuerySpec struct {
 
     // Index hint specified by (key, direction) pairs.
     // See http://www.mongodb.org/display/DOCS/Optimization#Optimization-Hint
-    Hint M   `bson:"$hint"`
+    Hint interface{} `bson:"$hint"`
 
     // Snapshot mode assures that objects which update during the lifetime of a
     // query are returned once and only once.
@@ -96,7 +128,11 @@ func NewQuery(conn *Mongo, namespace string) Query {
 // Sort specifies the sort order for the result. The order is specified by
 // (key, direction) pairs. Direction is 1 for ascending order and -1 for
 // descending order.
-func (q *Query) Sort(sort M) *Query {
+//
+// Pass a D to sort on more than one key, as in
+//
+//     q.Sort(D{{"lastname", 1}, {"age", -1}})
+func (q *Query) Sort(sort interface{}) *Query {
     q.Spec.Sort = sort
     return q
 }
@@ -105,7 +141,7 @@ func (q *Query) Sort(sort M) *Query {
 // pairs. Direction is 1 for ascending order and -1 for descending order.
 //
 // More information: http://www.mongodb.org/display/DOCS/Optimization#Optimization-Hint
-func (q *Query) Hint(hint M) *Query {
+func (q *Query) Hint(hint interface{}) *Query {
     q.Spec.Hint = hint
     return q
 }
@@ -139,7 +175,7 @@ func (q *Query) BatchSize(batchSize int) *Query {
 // and the integer value 1.
 //
 // More information: http://www.mongodb.org/display/DOCS/Retrieving+a+Subset+of+Fields
-func (q *Query) Fields(fields M) *Query {
+func (q *Query) Fields(fields interface{}) *Query {
     q.Options.Fields = fields
     return q
 }
@@ -177,11 +213,47 @@ func (q *Query) Tailable(tailable bool) *Query {
     return q
 }
 
+// wrapped reports whether the query must be sent as a complex spec, with the
+// filter stored under $query.
+func (spec *QuerySpec) wrapped() bool {
+    return spec.Sort != nil || spec.Explain || spec.Hint != nil ||
+        spec.Snapshot || spec.Min != nil || spec.Max != nil
+}
+
 func (q *Query) bsonQuery() (*Bson, error) {
-    if q.Spec.Query == nil {
-        return nil, nil
+    if !q.Spec.wrapped() {
+        if q.Spec.Query == nil {
+            return nil, nil
+        }
+        return docBson(q.Spec.Query)
+    }
+
+    b := NewBson()
+    b.Init()
+    query := q.Spec.Query
+    if query == nil {
+        query = M{}
+    }
+    b.appendValue("$query", query)
+    if q.Spec.Sort != nil {
+        b.appendValue("$orderby", q.Spec.Sort)
+    }
+    if q.Spec.Explain {
+        b.AppendBool("$explain", true)
     }
-    b := NewBsonFromM(q.Spec.Query)
+    if q.Spec.Hint != nil {
+        b.appendValue("$hint", q.Spec.Hint)
+    }
+    if q.Spec.Snapshot {
+        b.AppendBool("$snapshot", true)
+    }
+    if q.Spec.Min != nil {
+        b.appendValue("$min", q.Spec.Min)
+    }
+    if q.Spec.Max != nil {
+        b.appendValue("$max", q.Spec.Max)
+    }
+    b.Finish()
     return b, nil
 }
 
@@ -189,21 +261,298 @@ func (q *Query) bsonFields() (*Bson, error) {
     if q.Options.Fields == nil {
         return nil, nil
     }
-    b := NewBsonFromM(q.Options.Fields)
-    return b, nil
+    return docBson(q.Options.Fields)
 }
 
 // Cursor executes the query and returns a cursor over the results. Subsequent
 // changes to the query object are ignored by the cursor.
 func (q *Query) Cursor() (*Cursor, error) {
+    var cur *Cursor
+    err := q.Conn.retry(false, func() error {
+        var err error
+        cur, err = q.cursor()
+        return err
+    })
+    return cur, err
+}
+
+func (q *Query) cursor() (*Cursor, error) {
     query, err := q.bsonQuery()
     if err != nil {
         return nil, err
     }
+    if query != nil {
+        defer query.Destroy()
+    }
     fields, err := q.bsonFields()
     if err != nil {
         return nil, err
     }
-    return q.Conn.Find(q.Namespace, query, fields,
-        q.Options.Limit, q.Options.Skip, 0)
+    if fields != nil {
+        defer fields.Destroy()
+    }
+    conn, options, err := q.readConn()
+    if err != nil {
+        return nil, err
+    }
+    return conn.Find(q.Namespace, query, fields,
+        q.Options.Limit, q.Options.Skip, options)
+}
+
+// Count returns the total number of documents in the result set, honoring
+// the limit and skip of the query as well as its index hint.
+func (q *Query) Count() (int, error) {
+    var n int
+    err := q.Conn.retry(false, func() error {
+        var err error
+        n, err = q.count()
+        return err
+    })
+    return n, err
+}
+
+func (q *Query) count() (int, error) {
+    conn, options, err := q.readConn()
+    if err != nil {
+        return 0, err
+    }
+    db, coll := q.dbAndCollection()
+    cmd := NewBson()
+    cmd.Init()
+    cmd.AppendString("count", coll)
+    if q.Spec.Query != nil {
+        cmd.appendValue("query", q.Spec.Query)
+    }
+    if q.Options.Limit != 0 {
+        cmd.AppendInt("limit", q.Options.Limit)
+    }
+    if q.Options.Skip != 0 {
+        cmd.AppendInt("skip", q.Options.Skip)
+    }
+    if q.Spec.Hint != nil {
+        cmd.appendValue("hint", q.Spec.Hint)
+    }
+    cmd.Finish()
+    defer cmd.Destroy()
+
+    var res struct {
+        N int
+    }
+    if err := conn.Db(db).runOptions(cmd, &res, options); err != nil {
+        return 0, err
+    }
+    return res.N, nil
+}
+
+// Explain unmarshals into result the plan the server uses to run the query.
+// The result argument may be a pointer to a M, a struct or an interface{}.
+//
+// More information: http://www.mongodb.org/display/DOCS/Optimization#Optimization-Explain
+func (q *Query) Explain(result interface{}) error {
+    explain := *q
+    explain.Spec.Explain = true
+    if explain.Options.Limit > 0 {
+        explain.Options.Limit = -explain.Options.Limit
+    }
+    cur, err := explain.Cursor()
+    if err != nil {
+        return err
+    }
+    defer cur.Destroy()
+    if cur.Next() != MONGO_OK {
+        return errors.New("MongoDB Explain error: " + cur.Error().Error())
+    }
+    return cur.Current().Unmarshal(result)
+}
+
+// dbAndCollection splits the query namespace into its database and
+// collection names.
+func (q *Query) dbAndCollection() (string, string) {
+    i := strings.Index(q.Namespace, ".")
+    if i < 0 {
+        return q.Namespace, ""
+    }
+    return q.Namespace[:i], q.Namespace[i+1:]
+}
+
+// Distinct unmarshals into result the list of distinct values for the given
+// key among the documents matched by the query. The result argument must be
+// a pointer to a slice.
+//
+// More information: http://www.mongodb.org/display/DOCS/Aggregation#Aggregation-Distinct
+func (q *Query) Distinct(key string, result interface{}) error {
+    return q.Conn.retry(false, func() error {
+        return q.distinct(key, result)
+    })
+}
+
+func (q *Query) distinct(key string, result interface{}) error {
+    conn, options, err := q.readConn()
+    if err != nil {
+        return err
+    }
+    db, coll := q.dbAndCollection()
+    cmd := NewBson()
+    cmd.Init()
+    cmd.AppendString("distinct", coll)
+    cmd.AppendString("key", key)
+    if q.Spec.Query != nil {
+        cmd.appendValue("query", q.Spec.Query)
+    }
+    cmd.Finish()
+    defer cmd.Destroy()
+
+    var res Raw
+    if err := conn.Db(db).runOptions(cmd, &res, options); err != nil {
+        return err
+    }
+    return res.Lookup("values").Unmarshal(result)
+}
+
+// Output modes of a map/reduce job.
+const (
+    MapReduceInline  = "inline"  // Return the results in the command reply.
+    MapReduceReplace = "replace" // Replace the contents of the output collection.
+    MapReduceMerge   = "merge"   // Overwrite existing keys of the output collection.
+    MapReduceReduce  = "reduce"  // Reduce new results with existing keys of the output collection.
+)
+
+// MapReduce describes a map/reduce job to run with Query.MapReduce.
+//
+// More information: http://www.mongodb.org/display/DOCS/MapReduce
+type MapReduce struct {
+    Map      string // Map JavaScript function code (required)
+    Reduce   string // Reduce JavaScript function code (required)
+    Finalize string // Finalize JavaScript function code (optional)
+
+    // Global variables visible to the map, reduce and finalize functions.
+    Scope M
+
+    // Out is the output mode, one of the MapReduce* constants. The default
+    // is MapReduceInline, which returns the results in the reply.
+    Out string
+
+    // OutCollection and OutDatabase name the collection the results are
+    // written to for all modes but MapReduceInline. OutDatabase defaults to
+    // the database of the query.
+    OutCollection string
+    OutDatabase   string
+
+    // Report the time spent in each phase in MapReduceInfo.VerboseTime.
+    Verbose bool
+}
+
+// MapReduceInfo holds the statistics of a map/reduce job.
+type MapReduceInfo struct {
+    InputCount  int            // Number of documents mapped
+    EmitCount   int            // Number of times reduce called emit
+    OutputCount int            // Number of documents in resulting collection
+    Database    string         // Output database, if results are not inlined
+    Collection  string         // Output collection, if results are not inlined
+    Time        int64          // Time to run the job, in nanoseconds
+    VerboseTime *MapReduceTime // Only defined if MapReduce.Verbose was true
+}
+
+// MapReduceTime holds the time spent in each phase of a map/reduce job.
+type MapReduceTime struct {
+    Total    int64 // Total time, in nanoseconds
+    Map      int64 // Time within map function, in nanoseconds
+    EmitLoop int64 // Time within the emit/map loop, in nanoseconds
+}
+
+// MapReduce runs the map/reduce job over the documents matched by the query,
+// honoring its sort and limit. For inline jobs the results are unmarshalled
+// into result, which must then be a pointer to a slice; for the other output
+// modes the results are left in the output collection and result may be nil.
+//
+// More information: http://www.mongodb.org/display/DOCS/MapReduce
+func (q *Query) MapReduce(job *MapReduce, result interface{}) (*MapReduceInfo, error) {
+    db, coll := q.dbAndCollection()
+    cmd := NewBson()
+    cmd.Init()
+    cmd.AppendString("mapreduce", coll)
+    cmd.AppendCode("map", job.Map)
+    cmd.AppendCode("reduce", job.Reduce)
+    if job.Finalize != "" {
+        cmd.AppendCode("finalize", job.Finalize)
+    }
+    if q.Spec.Query != nil {
+        cmd.appendValue("query", q.Spec.Query)
+    }
+    if q.Spec.Sort != nil {
+        cmd.appendValue("sort", q.Spec.Sort)
+    }
+    if q.Options.Limit != 0 {
+        cmd.AppendInt("limit", q.Options.Limit)
+    }
+    if job.Scope != nil {
+        cmd.AppendMap("scope", job.Scope)
+    }
+    if job.Verbose {
+        cmd.AppendBool("verbose", true)
+    }
+    cmd.AppendStartObject("out")
+    switch job.Out {
+    case "", MapReduceInline:
+        cmd.AppendInt(MapReduceInline, 1)
+    case MapReduceReplace, MapReduceMerge, MapReduceReduce:
+        cmd.AppendString(job.Out, job.OutCollection)
+        if job.OutDatabase != "" {
+            cmd.AppendString("db", job.OutDatabase)
+        }
+    default:
+        cmd.Destroy()
+        return nil, errors.New("MongoDB MapReduce error: unknown output mode " + job.Out)
+    }
+    cmd.AppendFinishObject()
+    cmd.Finish()
+    defer cmd.Destroy()
+
+    var res struct {
+        Result interface{}
+        Counts  struct {
+            Input, Emit, Output int
+        }
+        TimeMillis int64 `bson:"timeMillis"`
+        Timing     *struct {
+            MapTime  int64 `bson:"mapTime"`
+            EmitLoop int64 `bson:"emitLoop"`
+            Total    int64
+        }
+    }
+    var raw Raw
+    if err := q.Conn.Db(db).Run(cmd, &raw); err != nil {
+        return nil, err
+    }
+    if err := raw.Unmarshal(&res); err != nil {
+        return nil, err
+    }
+
+    info := &MapReduceInfo{
+        InputCount:  res.Counts.Input,
+        EmitCount:   res.Counts.Emit,
+        OutputCount: res.Counts.Output,
+        Time:        res.TimeMillis * 1e6,
+    }
+    switch out := res.Result.(type) {
+    case string:
+        info.Database = db
+        info.Collection = out
+    case M:
+        info.Database, _ = out["db"].(string)
+        info.Collection, _ = out["collection"].(string)
+    }
+    if res.Timing != nil {
+        info.VerboseTime = &MapReduceTime{
+            Total:    res.Timing.Total * 1e6,
+            Map:      res.Timing.MapTime * 1e6,
+            EmitLoop: res.Timing.EmitLoop * 1e6,
+        }
+    }
+    if result != nil && info.Collection == "" {
+        if err := raw.Lookup("results").Unmarshal(result); err != nil {
+            return nil, err
+        }
+    }
+    return info, nil
 }
@@ -0,0 +1,96 @@
+package libgomongo
+
+// #cgo CFLAGS: -std=gnu99 -I./mongo-c-driver/src/
+// #cgo LDFLAGS: -L./mongo-c-driver/src/ -lmongoc
+// #include "bson.h"
+import "C"
+
+import (
+    "encoding/binary"
+    "github.com/QLeelulu/libgomongo/bson"
+    "unsafe"
+)
+
+// Raw is a finished BSON document held in Go memory, see bson.Raw. Unlike a
+// *Bson returned by Cursor.Current, it stays valid after the cursor moves
+// on.
+//
+// A Raw is accepted wherever a M is, and is appended as is, without being
+// decoded and encoded again.
+type Raw = bson.Raw
+
+// RawElement is an element of a Raw document.
+type RawElement = bson.RawElement
+
+// RawValue is the undecoded value of an element.
+type RawValue = bson.RawValue
+
+// Raw returns a copy of the finished bson data.
+func (b *Bson) Raw() Raw {
+    return Raw(C.GoBytes(unsafe.Pointer(C.bson_data(b._bson)), C.bson_size(b._bson)))
+}
+
+// NewBsonFromRaw returns a finished bson holding a copy of r in C memory,
+// without decoding it. It returns nil if r is too short to be a document.
+func NewBsonFromRaw(r Raw) *Bson {
+    if len(r) < 5 || int(int32(binary.LittleEndian.Uint32(r))) != len(r) {
+        return nil
+    }
+    b := NewBson()
+    C.bson_init_finished_data(b._bson, (*C.char)(C.CBytes(r)), C.bson_bool_t(1))
+    return b
+}
+
+// AppendRaw appends r as a sub object, copying its bytes as is.
+func (b *Bson) AppendRaw(key string, r Raw) int {
+    sub := NewBsonFromRaw(r)
+    if sub == nil {
+        return BSON_ERROR
+    }
+    defer sub.Destroy()
+    return b.AppendBson(key, sub)
+}
+
+// fromRaw appends the elements of r.
+func (b *Bson) fromRaw(r Raw) int {
+    sub := NewBsonFromRaw(r)
+    if sub == nil {
+        return BSON_ERROR
+    }
+    defer sub.Destroy()
+    it := NewBsonIterator()
+    it.Init(sub)
+    for it.Next() != BSON_EOO {
+        if st := b.AppendElement(it.Key(), it); st != BSON_OK {
+            return st
+        }
+    }
+    return BSON_OK
+}
+
+// MarshalJSON returns the document in relaxed Extended JSON, so that a *Bson
+// can be given to encoding/json.
+func (b *Bson) MarshalJSON() ([]byte, error) {
+    return bson.MarshalExtJSON(b.Raw(), false)
+}
+
+// MarshalExtJSON returns the document in canonical or relaxed Extended JSON
+// v2, see bson.MarshalExtJSON.
+func (b *Bson) MarshalExtJSON(canonical bool) ([]byte, error) {
+    return bson.MarshalExtJSON(b.Raw(), canonical)
+}
+
+// UnmarshalExtJSON sets b to the finished document encoded in Extended
+// JSON by data, releasing the document b held. Both the canonical and the
+// relaxed formats are accepted.
+func (b *Bson) UnmarshalExtJSON(data []byte) error {
+    var r Raw
+    if err := bson.UnmarshalExtJSON(data, &r); err != nil {
+        return err
+    }
+    if b._bson.data != nil {
+        C.bson_destroy(b._bson)
+    }
+    C.bson_init_finished_data(b._bson, (*C.char)(C.CBytes(r)), C.bson_bool_t(1))
+    return nil
+}
@@ -0,0 +1,184 @@
+package libgomongo
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "time"
+)
+
+// ReadMode is the mode of a ReadPreference.
+type ReadMode int
+
+const (
+    // Read from the primary only. This is the default.
+    Primary ReadMode = iota
+
+    // Read from the primary, or from a secondary when the primary is not
+    // available.
+    PrimaryPreferred
+
+    // Read from a secondary only, and fail when none is available.
+    Secondary
+
+    // Read from a secondary, or from the primary when no secondary is
+    // available.
+    SecondaryPreferred
+
+    // Read from the member with the lowest latency, primary or secondary.
+    Nearest
+)
+
+func (mode ReadMode) String() string {
+    switch mode {
+    case Primary:
+        return "primary"
+    case PrimaryPreferred:
+        return "primaryPreferred"
+    case Secondary:
+        return "secondary"
+    case SecondaryPreferred:
+        return "secondaryPreferred"
+    case Nearest:
+        return "nearest"
+    }
+    return fmt.Sprintf("ReadMode(%d)", int(mode))
+}
+
+// ReadPreference routes the reads of a connection, a database, a collection
+// or a query to the members of a replica set. The preference of a query
+// overrides the one of its collection, which overrides the one of its
+// database, which overrides the one of the connection.
+//
+// Secondaries are read from through connections of their own, opened on
+// the hosts reported by mongo_get_host. On a connection to a single
+// server, the reads go to that server, with the SlaveOk option unless the
+// mode is Primary.
+//
+// More information: http://docs.mongodb.org/manual/core/read-preference/
+type ReadPreference struct {
+    Mode ReadMode
+
+    // TagSets restrict the members read from, except the primary in the
+    // PrimaryPreferred and SecondaryPreferred modes, to those having all
+    // the tags of a set. The sets are tried in order and an empty set
+    // matches every member. They cannot be used with the Primary mode.
+    TagSets []map[string]string
+}
+
+// How often the state of the replica set members is checked again, and the
+// latency above the nearest member within which members are picked at
+// random.
+var (
+    memberCheckInterval = 10 * time.Second
+    latencyWindow       = 15 * time.Millisecond
+)
+
+// member is the state of a replica set member, as last reported by
+// ismaster.
+type member struct {
+    addr      string
+    conn      *Mongo
+    primary   bool
+    secondary bool
+    tags      map[string]string
+    latency   time.Duration
+    err       error // of the last check, the member is skipped when set
+}
+
+func (pref *ReadPreference) validate() error {
+    if pref.Mode < Primary || pref.Mode > Nearest {
+        return errors.New(fmt.Sprintf("MongoDB: invalid read preference mode %d", int(pref.Mode)))
+    }
+    if pref.Mode == Primary && len(pref.TagSets) > 0 {
+        return errors.New("MongoDB: tag sets cannot be used with the primary read preference")
+    }
+    return nil
+}
+
+// choose returns the member of members to read from.
+func (pref *ReadPreference) choose(members []*member) (*member, error) {
+    if err := pref.validate(); err != nil {
+        return nil, err
+    }
+    var primary *member
+    var secondaries, all []*member
+    for _, m := range members {
+        switch {
+        case m.err != nil:
+        case m.primary:
+            primary = m
+            all = append(all, m)
+        case m.secondary:
+            secondaries = append(secondaries, m)
+            all = append(all, m)
+        }
+    }
+
+    var chosen *member
+    switch pref.Mode {
+    case Primary:
+        chosen = primary
+    case PrimaryPreferred:
+        if chosen = primary; chosen == nil {
+            chosen = pref.nearest(secondaries)
+        }
+    case Secondary:
+        chosen = pref.nearest(secondaries)
+    case SecondaryPreferred:
+        if chosen = pref.nearest(secondaries); chosen == nil {
+            chosen = primary
+        }
+    case Nearest:
+        chosen = pref.nearest(all)
+    }
+    if chosen == nil {
+        return nil, errors.New(fmt.Sprintf("MongoDB: no replica set member available for the %s read preference", pref.Mode))
+    }
+    return chosen, nil
+}
+
+// nearest returns one of the members matching the first tag set matched by
+// any, picked at random among the ones within the latency window of the
+// nearest, or nil.
+func (pref *ReadPreference) nearest(members []*member) *member {
+    candidates := members
+    if len(pref.TagSets) > 0 {
+        candidates = nil
+        for _, set := range pref.TagSets {
+            for _, m := range members {
+                if m.hasTags(set) {
+                    candidates = append(candidates, m)
+                }
+            }
+            if len(candidates) > 0 {
+                break
+            }
+        }
+    }
+    if len(candidates) == 0 {
+        return nil
+    }
+    fastest := candidates[0].latency
+    for _, m := range candidates {
+        if m.latency < fastest {
+            fastest = m.latency
+        }
+    }
+    var near []*member
+    for _, m := range candidates {
+        if m.latency <= fastest+latencyWindow {
+            near = append(near, m)
+        }
+    }
+    return near[rand.Intn(len(near))]
+}
+
+func (m *member) hasTags(set map[string]string) bool {
+    for k, v := range set {
+        if m.tags[k] != v {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,47 @@
+package libgomongo
+
+import (
+    "github.com/couchbaselabs/go.assert"
+    "testing"
+    "time"
+)
+
+func TestReadPreferenceChoose(t *testing.T) {
+    primary := &member{addr: "a:1", primary: true, latency: 40 * time.Millisecond}
+    east := &member{addr: "b:1", secondary: true, tags: map[string]string{"dc": "east", "use": "reporting"}, latency: 20 * time.Millisecond}
+    west := &member{addr: "c:1", secondary: true, tags: map[string]string{"dc": "west"}, latency: 1 * time.Millisecond}
+    members := []*member{primary, east, west}
+
+    choose := func(pref ReadPreference, members ...*member) *member {
+        m, err := pref.choose(members)
+        if err != nil {
+            return nil
+        }
+        return m
+    }
+    assert.Equals(t, choose(ReadPreference{Mode: Primary}, members...), primary)
+    assert.Equals(t, choose(ReadPreference{Mode: PrimaryPreferred}, members...), primary)
+    assert.Equals(t, choose(ReadPreference{Mode: PrimaryPreferred}, east), east)
+    assert.Equals(t, choose(ReadPreference{Mode: Secondary}, members...), west)
+    assert.Equals(t, choose(ReadPreference{Mode: Secondary}, primary), (*member)(nil))
+    assert.Equals(t, choose(ReadPreference{Mode: SecondaryPreferred}, primary), primary)
+    assert.Equals(t, choose(ReadPreference{Mode: Nearest}, primary, east), east)
+
+    tagged := ReadPreference{Mode: Secondary, TagSets: []map[string]string{{"use": "reporting"}, {}}}
+    assert.Equals(t, choose(tagged, members...), east)
+    assert.Equals(t, choose(tagged, primary, west), west)
+    tagged.TagSets = tagged.TagSets[:1]
+    assert.Equals(t, choose(tagged, primary, west), (*member)(nil))
+    tagged.Mode = SecondaryPreferred
+    assert.Equals(t, choose(tagged, primary, west), primary)
+
+    west.err = ErrNotFound
+    assert.Equals(t, choose(ReadPreference{Mode: Secondary}, members...), east)
+    west.err = nil
+
+    _, err := (&ReadPreference{Mode: Primary, TagSets: []map[string]string{{"dc": "east"}}}).choose(members)
+    assert.NotEquals(t, err, nil)
+    _, err = (&ReadPreference{Mode: ReadMode(7)}).choose(members)
+    assert.NotEquals(t, err, nil)
+    assert.Equals(t, SecondaryPreferred.String(), "secondaryPreferred")
+}
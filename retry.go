@@ -0,0 +1,183 @@
+package libgomongo
+
+import (
+    "errors"
+    "math/rand"
+    "strings"
+    "time"
+)
+
+// RetryPolicy makes a connection recover from transient errors, as a
+// dropped socket or a replica set election: the failed operation is run
+// again after reconnecting, which finds the new primary of a replica set
+// and authenticates again with the credentials given to Authenticate.
+//
+// Reads, that is queries, counts, distincts and index creations, are
+// always run again. Writes and commands run with DB.Run may have been
+// applied before the error, so they are only run again with RetryWrites.
+// A cursor is only retried when it is created: an error while fetching
+// its next batch is returned.
+type RetryPolicy struct {
+    // MaxAttempts is the number of times an operation is run, including
+    // the first. Values below 2 disable retries.
+    MaxAttempts int
+
+    // The wait before the first retry, doubled at each retry up to
+    // MaxBackoff. They default to 100ms and 5s.
+    InitialBackoff time.Duration
+    MaxBackoff     time.Duration
+
+    // Jitter is the fraction of each wait, between 0 and 1, taken off at
+    // random, so that clients do not reconnect all at once.
+    Jitter float64
+
+    // RetryWrites opts in to running the writes again.
+    RetryWrites bool
+
+    // Retryable reports whether an operation failing with err may succeed
+    // when run again. It defaults to IsRetryable.
+    Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy returns a policy running reads up to three times,
+// waiting 100ms then 200ms, with 50% jitter.
+func DefaultRetryPolicy() *RetryPolicy {
+    return &RetryPolicy{
+        MaxAttempts:    3,
+        InitialBackoff: 100 * time.Millisecond,
+        MaxBackoff:     5 * time.Second,
+        Jitter:         0.5,
+    }
+}
+
+// Errors of the connection, and codes and messages of the server, which
+// are transient.
+var (
+    retryableErrors = []MongoError{
+        MONGO_CONN_NO_SOCKET,
+        MONGO_CONN_FAIL,
+        MONGO_CONN_NOT_MASTER,
+        MONGO_CONN_NO_PRIMARY,
+        MONGO_IO_ERROR,
+        MONGO_SOCKET_ERROR,
+        MONGO_READ_SIZE_ERROR,
+    }
+    retryableCodes = []int{
+        6,     // HostUnreachable
+        7,     // HostNotFound
+        89,    // NetworkTimeout
+        91,    // ShutdownInProgress
+        189,   // PrimarySteppedDown
+        9001,  // SocketException
+        10054, // not master, of the legacy updates
+        10056, // not master, of the legacy removes
+        10058, // not master, of the legacy inserts
+        10107, // NotMaster
+        11600, // InterruptedAtShutdown
+        11602, // InterruptedDueToReplStateChange
+        13435, // NotMasterNoSlaveOk
+        13436, // NotMasterOrSecondary
+    }
+    // the messages are only looked at when the server gives no code
+    retryableMessages = []string{
+        "not master",
+        "node is recovering",
+        "interrupted at shutdown",
+        "could not contact primary",
+    }
+)
+
+// IsRetryable reports whether err comes from a network error, or from a
+// replica set member which stepped down or is not ready, in which case the
+// operation may succeed after reconnecting. It looks at the codes of the
+// *OpError held by err, as returned by Mongo.Error, and at the message of
+// the errors reported by the server without a code.
+func IsRetryable(err error) bool {
+    var op *OpError
+    if !errors.As(err, &op) {
+        return false
+    }
+    for _, status := range retryableErrors {
+        if op.Code == status {
+            return true
+        }
+    }
+    if op.ServerCode != 0 {
+        for _, code := range retryableCodes {
+            if op.ServerCode == code {
+                return true
+            }
+        }
+        return false
+    }
+    if op.Code == MONGO_COMMAND_FAILED || op.Code == MONGO_WRITE_ERROR {
+        msg := op.Err.Error()
+        for _, m := range retryableMessages {
+            if strings.Contains(msg, m) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// SetRetryPolicy sets the retry policy of the connection, or disables
+// retries when policy is nil.
+func (c *Mongo) SetRetryPolicy(policy *RetryPolicy) {
+    c.retryPolicy = policy
+}
+
+// backoff returns the wait before the retry following the given attempt.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+    wait, max := p.InitialBackoff, p.MaxBackoff
+    if wait <= 0 {
+        wait = 100 * time.Millisecond
+    }
+    if max <= 0 {
+        max = 5 * time.Second
+    }
+    for i := 1; i < attempt && wait < max; i++ {
+        wait *= 2
+    }
+    if wait > max {
+        wait = max
+    }
+    if p.Jitter > 0 {
+        wait -= time.Duration(rand.Float64() * p.Jitter * float64(wait))
+    }
+    return wait
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+    if p.Retryable != nil {
+        return p.Retryable(err)
+    }
+    return IsRetryable(err)
+}
+
+// retry runs op, and runs it again after reconnecting while it fails with
+// a retryable error, as allowed by the retry policy of the connection.
+func (c *Mongo) retry(write bool, op func() error) error {
+    p := c.retryPolicy
+    for attempt := 1; ; attempt++ {
+        err := op()
+        if err == nil || p == nil || attempt >= p.MaxAttempts ||
+            (write && !p.RetryWrites) || !p.retryable(err) {
+            return err
+        }
+        time.Sleep(p.backoff(attempt))
+        c.reconnect()
+    }
+}
+
+// reconnect reconnects to the server, or to the primary of the replica
+// set, and authenticates again. Errors are left to the next operation.
+func (c *Mongo) reconnect() {
+    c.closeMembers()
+    if c.Reconnect() != MONGO_OK {
+        return
+    }
+    for _, cred := range c.credentials {
+        c.authenticate(cred)
+    }
+}
@@ -0,0 +1,89 @@
+package libgomongo
+
+import (
+    "context"
+    "github.com/QLeelulu/libgomongo/bson"
+)
+
+// Result is a document delivered by Query.Stream. Exactly one of Doc and
+// Err is set.
+type Result struct {
+    Doc M
+    Err error
+
+    raw Raw
+}
+
+// Unmarshal decodes the document of the result into out, which may be a
+// pointer to a M, a D, a Raw, a map, a struct or an interface{}.
+func (r Result) Unmarshal(out interface{}) error {
+    if r.Err != nil {
+        return r.Err
+    }
+    if r.raw == nil {
+        raw, err := bson.Marshal(r.Doc)
+        if err != nil {
+            return err
+        }
+        r.raw = raw
+    }
+    return r.raw.Unmarshal(out)
+}
+
+// Stream runs the query and delivers its results on the returned channel,
+// which is closed once the cursor is exhausted, fails or ctx is done.
+//
+// The cursor is driven by a background goroutine that decodes documents
+// ahead of the consumer, keeping up to bufferSize of them in the channel.
+// With a buffer at least as large as the batch size, the next batch is
+// fetched from the server while the consumer processes the current one.
+//
+// A cursor error is delivered as the last Result, with Err set. When ctx is
+// done, the goroutine stops and delivers ctx.Err() if the channel has room
+// for it. The connection of the query must not be used by other goroutines
+// until the channel is closed.
+func (q *Query) Stream(ctx context.Context, bufferSize int) (<-chan Result, error) {
+    if bufferSize < 0 {
+        bufferSize = 0
+    }
+    cur, err := q.Cursor()
+    if err != nil {
+        return nil, err
+    }
+    results := make(chan Result, bufferSize)
+    go func() {
+        defer close(results)
+        defer cur.Destroy()
+        for {
+            if ctx.Err() != nil {
+                break
+            }
+            if cur.Next() != MONGO_OK {
+                if cur.ErrNo() != MONGO_CURSOR_EXHAUSTED {
+                    select {
+                    case results <- Result{Err: cur.Error()}:
+                    case <-ctx.Done():
+                    }
+                }
+                return
+            }
+            select {
+            case results <- newResult(cur.Current().Raw()):
+            case <-ctx.Done():
+            }
+        }
+        select {
+        case results <- Result{Err: ctx.Err()}:
+        default:
+        }
+    }()
+    return results, nil
+}
+
+func newResult(raw Raw) Result {
+    r := Result{raw: raw}
+    if r.Err = raw.Unmarshal(&r.Doc); r.Err != nil {
+        r.Doc = nil
+    }
+    return r
+}
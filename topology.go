@@ -0,0 +1,427 @@
+package libgomongo
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// ServerKind is the role of a server in a Topology.
+type ServerKind int
+
+const (
+    ServerUnknown    ServerKind = iota // Not reachable, or not checked yet.
+    ServerStandalone                   // A server which is not in a replica set.
+    ServerPrimary
+    ServerSecondary
+    ServerArbiter
+    ServerOther // A member which is recovering, hidden or starting up.
+)
+
+func (kind ServerKind) String() string {
+    switch kind {
+    case ServerUnknown:
+        return "unknown"
+    case ServerStandalone:
+        return "standalone"
+    case ServerPrimary:
+        return "primary"
+    case ServerSecondary:
+        return "secondary"
+    case ServerArbiter:
+        return "arbiter"
+    case ServerOther:
+        return "other"
+    }
+    return fmt.Sprintf("ServerKind(%d)", int(kind))
+}
+
+// ServerDescription is the state of a server, as last reported by
+// ismaster.
+type ServerDescription struct {
+    Addr    string // as "host:port"
+    Kind    ServerKind
+    SetName string
+    Tags    map[string]string
+
+    // RTT is the round trip time of ismaster, averaged over the checks.
+    RTT time.Duration
+
+    // Lag is how far a secondary is behind the primary, from the dates of
+    // their last writes. It is zero when unknown, as before MongoDB 3.4.
+    Lag time.Duration
+
+    // The error of the last check, for an unknown server.
+    Err error
+
+    LastCheck time.Time
+}
+
+// Topology is the state of the servers of a connection, as seen by its
+// topology monitor.
+type Topology struct {
+    SetName string
+    Primary string // address of the primary, or "" when there is none
+    Servers []ServerDescription
+}
+
+// Server returns the description of the server at addr.
+func (t Topology) Server(addr string) (ServerDescription, bool) {
+    for _, s := range t.Servers {
+        if s.Addr == addr {
+            return s, true
+        }
+    }
+    return ServerDescription{}, false
+}
+
+// TopologyEventType is the type of a TopologyEvent.
+type TopologyEventType int
+
+const (
+    // The kind or the error of a server changed, or it was discovered.
+    ServerChanged TopologyEventType = iota
+
+    // A new primary was elected, or the primary was lost, as in a
+    // failover. It follows the ServerChanged events of the round of
+    // checks which saw the change.
+    PrimaryChanged
+
+    // The server is no longer reported by any reachable member, as when it
+    // is removed from the replica set configuration.
+    ServerRemoved
+)
+
+// TopologyEvent reports a change of the topology of a connection.
+type TopologyEvent struct {
+    Type TopologyEventType
+    Time time.Time
+
+    // The server, for ServerChanged, and the removed one in Previous for
+    // ServerRemoved.
+    Previous ServerDescription
+    Current  ServerDescription
+
+    // The addresses of the primaries, or "", for PrimaryChanged.
+    OldPrimary string
+    NewPrimary string
+}
+
+// Number of events kept for the receiver of the events channel, after
+// which new events are dropped.
+const topologyEventBuffer = 64
+
+// Weight of the last round trip time in the average of ServerDescription.RTT.
+const rttWeight = 0.2
+
+// topologyMonitor polls ismaster on the servers of a deployment, from a
+// goroutine with connections of its own.
+type topologyMonitor struct {
+    interval time.Duration
+    events   chan TopologyEvent
+    stop     chan struct{}
+    done     chan struct{}
+
+    mu        sync.Mutex
+    topology  Topology
+    listeners []func(TopologyEvent)
+
+    conns map[string]*Mongo // used by the goroutine only
+}
+
+func newTopologyMonitor(seeds []string, interval time.Duration) *topologyMonitor {
+    m := &topologyMonitor{
+        interval: interval,
+        events:   make(chan TopologyEvent, topologyEventBuffer),
+        stop:     make(chan struct{}),
+        done:     make(chan struct{}),
+        conns:    make(map[string]*Mongo),
+    }
+    for _, addr := range seeds {
+        m.topology.Servers = append(m.topology.Servers, ServerDescription{Addr: addr})
+    }
+    return m
+}
+
+// start runs a first round of checks, so that the topology is known on
+// return, then polls in the background.
+func (m *topologyMonitor) start() {
+    m.check()
+    go m.run()
+}
+
+func (m *topologyMonitor) run() {
+    defer close(m.done)
+    ticker := time.NewTicker(m.interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-m.stop:
+            for _, conn := range m.conns {
+                conn.Destroy()
+            }
+            close(m.events)
+            return
+        case <-ticker.C:
+            m.check()
+        }
+    }
+}
+
+// close stops the goroutine and waits for it to release its connections.
+func (m *topologyMonitor) close() {
+    close(m.stop)
+    <-m.done
+}
+
+func (m *topologyMonitor) get() Topology {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    t := m.topology
+    t.Servers = append([]ServerDescription(nil), t.Servers...)
+    return t
+}
+
+// listen calls f with the events, from the goroutine of the monitor.
+func (m *topologyMonitor) listen(f func(TopologyEvent)) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.listeners = append(m.listeners, f)
+}
+
+// check runs ismaster on every known server, in parallel, then updates
+// the topology and publishes the changes.
+func (m *topologyMonitor) check() {
+    old := m.get()
+    known := make(map[string]ServerDescription)
+    for _, s := range old.Servers {
+        known[s.Addr] = s
+    }
+
+    type result struct {
+        desc  ServerDescription
+        hosts []string
+        last  time.Time // lastWrite.lastWriteDate
+    }
+    results := make([]result, len(old.Servers))
+    conns := make([]*Mongo, len(old.Servers))
+    var wg sync.WaitGroup
+    for i, s := range old.Servers {
+        wg.Add(1)
+        go func(i int, prev ServerDescription) {
+            defer wg.Done()
+            r := &results[i]
+            conns[i], r.desc, r.hosts, r.last = checkServer(m.conns[prev.Addr], prev)
+        }(i, s)
+    }
+    wg.Wait()
+
+    // the servers which no reachable member reports any more are removed,
+    // unless none reports members, as a standalone server
+    reported := make(map[string]bool)
+    var primaryWrite time.Time
+    for _, r := range results {
+        for _, addr := range r.hosts {
+            reported[addr] = true
+        }
+        if r.desc.Kind == ServerPrimary {
+            primaryWrite = r.last
+        }
+    }
+
+    t := Topology{SetName: old.SetName}
+    var removed []ServerDescription
+    seen := make(map[string]bool)
+    for i, r := range results {
+        addr := r.desc.Addr
+        seen[addr] = true
+        if len(reported) > 0 && !reported[addr] {
+            if conns[i] != nil {
+                conns[i].Destroy()
+            }
+            delete(m.conns, addr)
+            removed = append(removed, known[addr])
+            continue
+        }
+        if conns[i] == nil {
+            delete(m.conns, addr)
+        } else {
+            m.conns[addr] = conns[i]
+        }
+        if r.desc.Kind == ServerPrimary {
+            t.Primary = addr
+        }
+        if r.desc.SetName != "" {
+            t.SetName = r.desc.SetName
+        }
+        if r.desc.Kind == ServerSecondary && !primaryWrite.IsZero() && !r.last.IsZero() {
+            if lag := primaryWrite.Sub(r.last); lag > 0 {
+                r.desc.Lag = lag
+            }
+        }
+        t.Servers = append(t.Servers, r.desc)
+    }
+    // members discovered by the ones checked are checked at the next round
+    for _, r := range results {
+        for _, addr := range r.hosts {
+            if !seen[addr] {
+                seen[addr] = true
+                t.Servers = append(t.Servers, ServerDescription{Addr: addr})
+            }
+        }
+    }
+    sort.Slice(t.Servers, func(i, j int) bool { return t.Servers[i].Addr < t.Servers[j].Addr })
+
+    var events []TopologyEvent
+    now := time.Now()
+    for _, s := range t.Servers {
+        prev, ok := known[s.Addr]
+        if !ok && s.Kind == ServerUnknown && s.Err == nil {
+            continue
+        }
+        if !ok || prev.Kind != s.Kind || (prev.Err == nil) != (s.Err == nil) {
+            events = append(events, TopologyEvent{Type: ServerChanged, Time: now, Previous: prev, Current: s})
+        }
+    }
+    for _, s := range removed {
+        events = append(events, TopologyEvent{Type: ServerRemoved, Time: now, Previous: s})
+    }
+    if old.Primary != t.Primary {
+        events = append(events, TopologyEvent{Type: PrimaryChanged, Time: now, OldPrimary: old.Primary, NewPrimary: t.Primary})
+    }
+
+    m.mu.Lock()
+    m.topology = t
+    listeners := m.listeners
+    m.mu.Unlock()
+    for _, e := range events {
+        for _, f := range listeners {
+            f(e)
+        }
+        select {
+        case m.events <- e:
+        default:
+        }
+    }
+}
+
+// checkServer runs ismaster on a server, connecting to it first when conn
+// is nil, and returns the connection to keep, the new description of the
+// server, the members it reports and the date of its last write.
+func checkServer(conn *Mongo, prev ServerDescription) (*Mongo, ServerDescription, []string, time.Time) {
+    desc := ServerDescription{Addr: prev.Addr, LastCheck: time.Now()}
+    fail := func(err error) (*Mongo, ServerDescription, []string, time.Time) {
+        if conn != nil {
+            conn.Destroy()
+        }
+        desc.Err = err
+        return nil, desc, nil, time.Time{}
+    }
+    if conn == nil {
+        host, portStr, err := net.SplitHostPort(prev.Addr)
+        if err != nil {
+            return fail(err)
+        }
+        port, _ := strconv.Atoi(portStr)
+        conn = NewMongo()
+        if conn.Client(host, port) != MONGO_OK {
+            return fail(conn.Error())
+        }
+    }
+
+    var res struct {
+        IsMaster    bool `bson:"ismaster"`
+        Secondary   bool
+        ArbiterOnly bool `bson:"arbiterOnly"`
+        SetName     string `bson:"setName"`
+        Hosts       []string
+        Passives    []string
+        Arbiters    []string
+        Tags        M
+        LastWrite   struct {
+            LastWriteDate time.Time `bson:"lastWriteDate"`
+        } `bson:"lastWrite"`
+    }
+    start := time.Now()
+    if err := conn.Db("admin").Run("ismaster", &res); err != nil {
+        return fail(errors.New("MongoDB: ismaster failed on " + prev.Addr + ": " + err.Error()))
+    }
+    rtt := time.Since(start)
+    if prev.RTT > 0 {
+        rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(prev.RTT))
+    }
+    desc.RTT = rtt
+    desc.SetName = res.SetName
+    switch {
+    case res.IsMaster && res.SetName == "":
+        desc.Kind = ServerStandalone
+    case res.IsMaster:
+        desc.Kind = ServerPrimary
+    case res.Secondary:
+        desc.Kind = ServerSecondary
+    case res.ArbiterOnly:
+        desc.Kind = ServerArbiter
+    default:
+        desc.Kind = ServerOther
+    }
+    if len(res.Tags) > 0 {
+        desc.Tags = make(map[string]string, len(res.Tags))
+        for k, v := range res.Tags {
+            if s, ok := v.(string); ok {
+                desc.Tags[k] = s
+            }
+        }
+    }
+    hosts := append(append(res.Hosts, res.Passives...), res.Arbiters...)
+    return conn, desc, hosts, res.LastWrite.LastWriteDate
+}
+
+// StartTopologyMonitor starts a goroutine checking the servers of the
+// connection with ismaster every interval, and returns the channel of the
+// changes it sees. The first check is done before returning.
+//
+// The servers are the hosts of the replica set, or the server the
+// connection is connected to, plus the members they report, less the ones
+// which no reachable member reports any more. The monitor
+// uses connections of its own, so the connection is not used by the
+// goroutine. The channel keeps a limited number of events, after which
+// new events are dropped, and is closed by StopTopologyMonitor and
+// Destroy.
+func (c *Mongo) StartTopologyMonitor(interval time.Duration) (<-chan TopologyEvent, error) {
+    if c.monitor != nil {
+        return nil, errors.New("MongoDB: the topology monitor is already started")
+    }
+    seeds := c.Hosts()
+    if seeds == nil {
+        addr := c.Primary()
+        if addr == "" {
+            return nil, errors.New("MongoDB: the connection is not connected")
+        }
+        seeds = []string{addr}
+    }
+    c.monitor = newTopologyMonitor(seeds, interval)
+    c.monitor.start()
+    return c.monitor.events, nil
+}
+
+// StopTopologyMonitor stops the topology monitor of the connection, if
+// any.
+func (c *Mongo) StopTopologyMonitor() {
+    if c.monitor != nil {
+        c.monitor.close()
+        c.monitor = nil
+    }
+}
+
+// Topology returns the topology last seen by the topology monitor of the
+// connection, or an empty Topology when it is not started.
+func (c *Mongo) Topology() Topology {
+    if c.monitor == nil {
+        return Topology{}
+    }
+    return c.monitor.get()
+}
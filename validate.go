@@ -0,0 +1,147 @@
+package libgomongo
+
+// #cgo CFLAGS: -std=gnu99 -I./mongo-c-driver/src/
+// #cgo LDFLAGS: -L./mongo-c-driver/src/ -lmongoc
+// #include "mongo.h"
+import "C"
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "unicode/utf8"
+)
+
+// Validity flags set on bson->err by the bson_append_* functions.
+const (
+    BSON_VALID             = 0
+    BSON_NOT_UTF8          = 1 << 1 /**< A key or a string is not valid UTF-8. */
+    BSON_FIELD_HAS_DOT     = 1 << 2 /**< A key contains a '.' character. */
+    BSON_FIELD_INIT_DOLLAR = 1 << 3 /**< A key starts with a '$' character. */
+    BSON_ALREADY_FINISHED  = 1 << 4 /**< Trying to modify a finished BSON object. */
+
+    // Set by the Go appends on a value which can not be encoded, and never
+    // by the C driver.
+    BSON_NOT_ENCODED = 1 << 7
+)
+
+// MONGO_DEFAULT_MAX_BSON_SIZE is the size limit of a document until the
+// server tells its own in the maxBsonObjectSize field of ismaster.
+const MONGO_DEFAULT_MAX_BSON_SIZE = 4 * 1024 * 1024
+
+// Err returns the validity flags of the bson, a bitfield of BSON_NOT_UTF8,
+// BSON_FIELD_HAS_DOT, BSON_FIELD_INIT_DOLLAR, BSON_ALREADY_FINISHED and
+// BSON_NOT_ENCODED.
+func (b *Bson) Err() int {
+    return int(b._bson.err)
+}
+
+// IsFinished returns whether bson_finish was called, or the bson was made
+// from finished data.
+func (b *Bson) IsFinished() bool {
+    return b._bson.finished != 0
+}
+
+/**
+ * Check that the bson can be inserted, before it is sent to the server.
+ *
+ * The bson must be finished, its keys and strings must be valid UTF-8, its
+ * keys must not contain '.' nor start with '$', and its size must not
+ * exceed MONGO_DEFAULT_MAX_BSON_SIZE. See Mongo.ValidateBson to check the
+ * size against the limit of the connected server.
+ *
+ * @return nil or an error naming the path of the first bad key, as
+ *     "address.city".
+ */
+func (b *Bson) Validate() error {
+    return b.validate(MONGO_DEFAULT_MAX_BSON_SIZE, true)
+}
+
+/**
+ * Check the bson as Bson.Validate does, against the maxBsonObjectSize
+ * reported by the server in ismaster.
+ *
+ * @param write whether the keys must be valid for an insert. Queries and
+ *     updates may use '$' operators.
+ */
+func (c *Mongo) ValidateBson(b *Bson, write bool) error {
+    return b.validate(c.MaxBsonSize(), write)
+}
+
+// MaxBsonSize returns the maximum document size accepted by the server, as
+// read from ismaster on connect, or MONGO_DEFAULT_MAX_BSON_SIZE.
+func (c *Mongo) MaxBsonSize() int {
+    if size := int(c.conn.max_bson_size); size > 0 {
+        return size
+    }
+    return MONGO_DEFAULT_MAX_BSON_SIZE
+}
+
+func (b *Bson) validate(maxSize int, write bool) error {
+    if b == nil || b._bson == nil {
+        return errors.New("MongoDB: BSON object is nil.")
+    }
+    if b._bson.err&BSON_ALREADY_FINISHED != 0 {
+        return errors.New("MongoDB: BSON object was modified after being finished.")
+    }
+    if b._bson.err&BSON_NOT_ENCODED != 0 {
+        return errors.New("MongoDB: BSON object holds a value which can not be encoded.")
+    }
+    if !b.IsFinished() {
+        return errors.New("MongoDB: BSON object has not been finished.")
+    }
+    raw := b.Raw()
+    if err := raw.Validate(); err != nil {
+        return errors.New("MongoDB: BSON not valid: " + err.Error())
+    }
+    if err := validateKeys(raw, "", write); err != nil {
+        return err
+    }
+    // the flags set by the C appends, for the keys that could not be found
+    switch flags := b.Err(); {
+    case flags&BSON_NOT_UTF8 != 0:
+        return errors.New("MongoDB: BSON not valid: a key or a string is not UTF-8.")
+    case write && flags&BSON_FIELD_HAS_DOT != 0:
+        return errors.New("MongoDB: BSON not valid for insert: a key contains '.'.")
+    case write && flags&BSON_FIELD_INIT_DOLLAR != 0:
+        return errors.New("MongoDB: BSON not valid for insert: a key starts with '$'.")
+    }
+    if len(raw) > maxSize {
+        return errors.New(fmt.Sprintf("MongoDB: BSON object exceeds max BSON size: %d > %d bytes.", len(raw), maxSize))
+    }
+    return nil
+}
+
+// validateKeys checks the keys and strings of r and of its sub documents.
+func validateKeys(r Raw, path string, write bool) error {
+    elems, err := r.Elements()
+    if err != nil {
+        return err
+    }
+    for _, el := range elems {
+        key := el.Key
+        if path != "" {
+            key = path + "." + el.Key
+        }
+        if !utf8.ValidString(el.Key) {
+            return errors.New(fmt.Sprintf("MongoDB: BSON not valid: key %q is not UTF-8.", key))
+        }
+        if write && strings.Contains(el.Key, ".") {
+            return errors.New(fmt.Sprintf("MongoDB: BSON not valid for insert: key %q contains '.'.", key))
+        }
+        if write && strings.HasPrefix(el.Key, "$") {
+            return errors.New(fmt.Sprintf("MongoDB: BSON not valid for insert: key %q starts with '$'.", key))
+        }
+        switch el.Value.Type {
+        case BSON_OBJECT, BSON_ARRAY:
+            if err := validateKeys(el.Value.Document(), key, write); err != nil {
+                return err
+            }
+        case BSON_STRING, BSON_SYMBOL, BSON_CODE:
+            if !utf8.Valid(el.Value.Data[4 : len(el.Value.Data)-1]) {
+                return errors.New(fmt.Sprintf("MongoDB: BSON not valid: string %q is not UTF-8.", key))
+            }
+        }
+    }
+    return nil
+}